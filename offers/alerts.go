@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// PriceAlert asks for a notification when an offer's price drops to or below
+// a target price, in the offer's currency.
+type PriceAlert struct {
+	ID          int64
+	OfferID     string
+	TargetPrice string
+	// Contact is where the notification is sent, such as an email address.
+	// Its meaning depends on the Notifier.
+	Contact   string
+	CreatedAt time.Time
+	// FiredAt is when the alert was sent, or zero if it is pending.
+	FiredAt time.Time
+}
+
+// Notifier delivers price alerts.
+type Notifier interface {
+	// Notify tells the alert's contact that the offer's price has dropped
+	// to or below the target.
+	Notify(ctx context.Context, alert *PriceAlert, offer *Offer) error
+}
+
+// AlertNotifier delivers the price alerts fired by RunUpdate. If it is nil,
+// alerts aren't fired.
+var AlertNotifier Notifier
+
+// FirePriceAlerts notifies the contacts of pending alerts whose offer's price
+// has dropped to or below the target, and returns how many were sent. Each
+// alert is marked as fired before it is sent, so it fires at most once even
+// if syncs overlap; alerts that fail to send are marked pending again and
+// retried by the next call.
+func FirePriceAlerts(ctx context.Context, db OfferDatabase, n Notifier) (int, error) {
+	alerts, err := db.TriggeredPriceAlerts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, a := range alerts {
+		claimed, err := db.SetPriceAlertFired(ctx, a.ID, true)
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			// Fired by a concurrent call.
+			continue
+		}
+		offer, err := db.GetOffer(ctx, a.OfferID)
+		if err == nil {
+			err = n.Notify(ctx, a, offer)
+		}
+		if err != nil {
+			log.Printf("could not send price alert %d: %v", a.ID, err)
+			if _, err := db.SetPriceAlertFired(ctx, a.ID, false); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// alertMessage is the text of a price alert notification.
+func alertMessage(offer *Offer) string {
+	return fmt.Sprintf("The price of %s has dropped to %s %s.\n\n%s\n", offer.Title, offer.Price, offer.Currency, offer.MerchantURL)
+}
+
+// WebhookNotifier delivers price alerts by POSTing them as JSON to URL.
+type WebhookNotifier struct {
+	URL string
+
+	// Client sends the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Notify posts the alert and the offer's current price.
+func (n WebhookNotifier) Notify(ctx context.Context, alert *PriceAlert, offer *Offer) error {
+	body, err := json.Marshal(struct {
+		AlertID     int64  `json:"alert_id"`
+		Contact     string `json:"contact"`
+		OfferID     string `json:"offer_id"`
+		Title       string `json:"title"`
+		Price       string `json:"price"`
+		Currency    string `json:"currency"`
+		TargetPrice string `json:"target_price"`
+		MerchantURL string `json:"merchant_url"`
+	}{alert.ID, alert.Contact, offer.ID, offer.Title, offer.Price, offer.Currency, alert.TargetPrice, offer.MerchantURL})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("webhook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier delivers price alerts by email through an SMTP server. The
+// alert's contact is the recipient's address.
+type EmailNotifier struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	// From is the sender's address.
+	From string
+	// Auth authenticates with the server, if it requires it.
+	Auth smtp.Auth
+}
+
+// Notify emails the alert's contact.
+func (n EmailNotifier) Notify(ctx context.Context, alert *PriceAlert, offer *Offer) error {
+	if strings.ContainsAny(alert.Contact, "\r\n") {
+		return fmt.Errorf("email: invalid recipient %q", alert.Contact)
+	}
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace("Price drop: " + offer.Title)
+	msg := "From: " + n.From + "\r\n" +
+		"To: " + alert.Contact + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		alertMessage(offer)
+	if err := smtp.SendMail(n.Addr, n.Auth, n.From, []string{alert.Contact}, []byte(msg)); err != nil {
+		return fmt.Errorf("email: %v", err)
+	}
+	return nil
+}
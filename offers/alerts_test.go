@@ -0,0 +1,216 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/content/v2"
+)
+
+// recordingNotifier records the alerts it is asked to send, failing with err
+// if it is set.
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []string // "contact offer-ID price"
+	err  error
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, alert *PriceAlert, offer *Offer) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, alert.Contact+" "+offer.ID+" "+offer.Price)
+	return nil
+}
+
+// take returns the notifications sent since the last call.
+func (n *recordingNotifier) take() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sent := n.sent
+	n.sent = nil
+	return sent
+}
+
+// setPrice changes the price of the stored offer.
+func setPrice(t *testing.T, db OfferDatabase, id, price string) {
+	t.Helper()
+	o, err := db.GetOffer(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetOffer(%s): %v", id, err)
+	}
+	o.Price = price
+	if err := db.UpdateOffer(context.Background(), o); err != nil {
+		t.Fatalf("UpdateOffer(%s): %v", id, err)
+	}
+}
+
+func TestPriceAlerts(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		first, err := db.AddPriceAlert(ctx, "a", "8.00", "first@example.com")
+		if err != nil {
+			t.Fatalf("AddPriceAlert: %v", err)
+		}
+		second, err := db.AddPriceAlert(ctx, "a", "5.00", "second@example.com")
+		if err != nil {
+			t.Fatalf("AddPriceAlert: %v", err)
+		}
+
+		alerts, err := db.ListPriceAlerts(ctx, 10)
+		if err != nil {
+			t.Fatalf("ListPriceAlerts: %v", err)
+		}
+		var got []int64
+		for _, a := range alerts {
+			got = append(got, a.ID)
+			if !a.FiredAt.IsZero() {
+				t.Errorf("new alert %d has fired", a.ID)
+			}
+		}
+		if want := []int64{second, first}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListPriceAlerts = %v, want %v, newest first", got, want)
+		}
+		if alerts, _ := db.ListPriceAlerts(ctx, 1); len(alerts) != 1 {
+			t.Errorf("ListPriceAlerts with limit 1 returned %d alerts", len(alerts))
+		}
+
+		if err := db.DeletePriceAlert(ctx, second); err != nil {
+			t.Fatalf("DeletePriceAlert: %v", err)
+		}
+		if alerts, _ := db.ListPriceAlerts(ctx, 10); len(alerts) != 1 || alerts[0].ID != first {
+			t.Errorf("alerts after deleting %d = %v, want only %d", second, alerts, first)
+		}
+		if err := db.DeletePriceAlert(ctx, second); err == nil {
+			t.Error("deleting a deleted alert succeeded")
+		}
+	})
+}
+
+func TestFirePriceAlerts(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "50.00"))
+		if _, err := db.AddPriceAlert(ctx, "a", "8.00", "a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.AddPriceAlert(ctx, "b", "40.00", "b@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		n := &recordingNotifier{}
+		fire := func(want ...string) {
+			t.Helper()
+			sent, err := FirePriceAlerts(ctx, db, n)
+			if err != nil {
+				t.Fatalf("FirePriceAlerts: %v", err)
+			}
+			got := n.take()
+			if sent != len(got) || !reflect.DeepEqual(got, want) {
+				t.Errorf("FirePriceAlerts sent %d %q, want %q", sent, got, want)
+			}
+		}
+
+		fire()
+		setPrice(t, db, "a", "9.00")
+		fire()
+		// The price crosses the target: the alert fires once.
+		setPrice(t, db, "a", "8.00")
+		fire("a@example.com a 8.00")
+		fire()
+		setPrice(t, db, "a", "7.00")
+		fire()
+
+		// Alerts that can't be sent are retried.
+		setPrice(t, db, "b", "39.99")
+		n.err = errors.New("mail server down")
+		fire()
+		n.err = nil
+		fire("b@example.com b 39.99")
+		fire()
+	})
+}
+
+func TestRunUpdateFiresPriceAlerts(t *testing.T) {
+	saved := AlertNotifier
+	defer func() { AlertNotifier = saved }()
+	n := &recordingNotifier{}
+	AlertNotifier = n
+
+	api := &fakeContentAPI{merchantID: 10}
+	db := NewMemoryDB()
+	useFakeContentAPI(t, api, db)
+	update := func(price string, want ...string) {
+		t.Helper()
+		api.products = map[uint64][][]*content.Product{10: {{testProduct("a", "Chair", price)}}}
+		stats, err := RunUpdate(10, LogConfig{}, nil)
+		if err != nil {
+			t.Fatalf("RunUpdate: %v", err)
+		}
+		got := n.take()
+		if stats.AlertsFired != len(got) || !reflect.DeepEqual(got, want) {
+			t.Errorf("sync at %s fired %d alerts %q, want %q", price, stats.AlertsFired, got, want)
+		}
+	}
+
+	update("20.00")
+	if _, err := db.AddPriceAlert(context.Background(), "a", "15.00", "shopper@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	update("16.00")
+	update("14.50", "shopper@example.com a 14.50")
+	update("14.50")
+	update("12.00")
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got map[string]interface{}
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook request %s with type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		got = nil
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	n := WebhookNotifier{URL: srv.URL}
+	alert := &PriceAlert{ID: 7, OfferID: "a", TargetPrice: "8.00", Contact: "shopper@example.com"}
+	if err := n.Notify(context.Background(), alert, testOffer("a", "Chair", "7.50")); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	want := map[string]interface{}{
+		"alert_id":     7.0,
+		"contact":      "shopper@example.com",
+		"offer_id":     "a",
+		"title":        "Chair",
+		"price":        "7.50",
+		"currency":     "USD",
+		"target_price": "8.00",
+		"merchant_url": "https://example.com/products/a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("webhook body = %v, want %v", got, want)
+	}
+
+	status = http.StatusInternalServerError
+	if err := n.Notify(context.Background(), alert, testOffer("a", "Chair", "7.50")); err == nil {
+		t.Error("Notify succeeded though the webhook failed")
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"offers"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// apiFilterLimit is the maximum number of offers returned for a filter.
+	apiFilterLimit = 100
+	// apiSearchPageSize is the number of offers in a page of search results,
+	// and apiSearchMaxPage the last page that can be requested.
+	apiSearchPageSize = 20
+	apiSearchMaxPage  = 500
+	// maxPatchSize bounds the size of a partial update's body.
+	maxPatchSize = 1 << 20
+)
+
+// apiFields are the offer fields the JSON API can return. Names must be
+// unique.
+var apiFields = []struct {
+	name  string
+	value func(*offers.Offer) string
+}{
+	{"id", func(o *offers.Offer) string { return o.ID }},
+	{"title", func(o *offers.Offer) string { return o.Title }},
+	{"price", func(o *offers.Offer) string { return o.Price }},
+	{"currency", func(o *offers.Offer) string { return o.Currency }},
+	{"converted_price", func(o *offers.Offer) string { return o.ConvertedPrice }},
+	{"converted_currency", func(o *offers.Offer) string { return o.ConvertedCurrency }},
+	{"image_url", func(o *offers.Offer) string { return o.ImageURL }},
+	{"description", func(o *offers.Offer) string { return o.Description }},
+	{"merchant_url", func(o *offers.Offer) string { return o.MerchantURL }},
+	{"item_group_id", func(o *offers.Offer) string { return o.ItemGroupID }},
+	{"gtin", func(o *offers.Offer) string { return o.GTIN }},
+	{"brand", func(o *offers.Offer) string { return o.Brand }},
+	{"category", func(o *offers.Offer) string { return o.Category }},
+	{"availability", func(o *offers.Offer) string { return o.Availability }},
+	{"condition", func(o *offers.Offer) string { return o.Condition }},
+	{"sale_price", func(o *offers.Offer) string { return o.SalePrice }},
+	{"merchant_id", func(o *offers.Offer) string { return strconv.FormatInt(o.MerchantID, 10) }},
+	{"slug", func(o *offers.Offer) string { return o.Slug }},
+	{"version", func(o *offers.Offer) string { return strconv.Itoa(o.Version) }},
+}
+
+// fieldSet selects the offer fields returned by the JSON API.
+type fieldSet []int
+
+// parseFields parses the fields parameter, a comma-separated list of field
+// names. If it is empty, all fields are selected.
+func parseFields(param string) (fieldSet, error) {
+	var fs fieldSet
+	if strings.TrimSpace(param) == "" {
+		for i := range apiFields {
+			fs = append(fs, i)
+		}
+		return fs, nil
+	}
+	seen := map[int]bool{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		i := apiFieldIndex(name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown field %q; valid fields are %s", name, apiFieldNames())
+		}
+		if !seen[i] {
+			seen[i] = true
+			fs = append(fs, i)
+		}
+	}
+	return fs, nil
+}
+
+func apiFieldIndex(name string) int {
+	for i, f := range apiFields {
+		if f.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func apiFieldNames() string {
+	names := make([]string, len(apiFields))
+	for i, f := range apiFields {
+		names[i] = f.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// project returns the selected fields of o.
+func (fs fieldSet) project(o *offers.Offer) map[string]string {
+	m := make(map[string]string, len(fs))
+	for _, i := range fs {
+		m[apiFields[i].name] = apiFields[i].value(o)
+	}
+	return m
+}
+
+// fieldsFromRequest parses the fields parameter of r.
+func fieldsFromRequest(r *http.Request) (fieldSet, *appError) {
+	fs, err := parseFields(r.FormValue("fields"))
+	if err != nil {
+		return nil, &appError{Error: err, Message: err.Error(), Code: http.StatusBadRequest}
+	}
+	return fs, nil
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) *appError {
+	return writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes v as the JSON response with the given status code.
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) *appError {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return appErrorf(err, "could not encode response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+	return nil
+}
+
+// apiListHandler returns the offers shown on the storefront list as JSON,
+// or the offers matching the filter parameter if it is set (see
+// offers.ParseFilter).
+func apiListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fs, e := fieldsFromRequest(r)
+	if e != nil {
+		return e
+	}
+	var list []*offers.Offer
+	var err error
+	if expr := r.FormValue("filter"); expr != "" {
+		f, perr := offers.ParseFilter(expr)
+		if perr != nil {
+			return &appError{Error: perr, Message: perr.Error(), Code: http.StatusBadRequest}
+		}
+		list, err = offers.DB.FilterOffers(r.Context(), f, apiFilterLimit)
+	} else {
+		list, _, err = offers.DB.ListPurchasableOffers(r.Context(), offers.ListOptions{})
+	}
+	if err != nil {
+		return appErrorf(err, "could not list offers: %v", err)
+	}
+	convertPrices(requestCurrency(r), list)
+	resp := struct {
+		Offers []map[string]string `json:"offers"`
+	}{Offers: []map[string]string{}}
+	for _, o := range list {
+		resp.Offers = append(resp.Offers, fs.project(o))
+	}
+	return writeJSON(w, resp)
+}
+
+// apiDetailHandler returns an offer as JSON.
+func apiDetailHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fs, e := fieldsFromRequest(r)
+	if e != nil {
+		return e
+	}
+	id := mux.Vars(r)["offer_id"]
+	exists, err := offers.DB.OfferExists(r.Context(), id)
+	if err != nil {
+		return appErrorf(err, "could not look up offer: %v", err)
+	}
+	if !exists {
+		return &appError{
+			Error:   fmt.Errorf("unknown offer %s", id),
+			Message: "could not find offer",
+			Code:    http.StatusNotFound,
+		}
+	}
+	offer, err := offers.DB.GetOffer(r.Context(), id)
+	if err != nil {
+		return appErrorf(err, "could not get offer: %v", err)
+	}
+	convertPrices(requestCurrency(r), []*offers.Offer{offer})
+	return writeJSON(w, fs.project(offer))
+}
+
+// apiPatchHandler sets the fields of an offer given in the request body, a
+// JSON object keyed by the field names of the API, and returns the updated
+// offer, with the fields chosen by the fields parameter. Fields that aren't
+// given in the body are left alone. If the body has the offer's version, as
+// returned by the API, the update is refused with 409 Conflict once the
+// offer has been written since.
+func apiPatchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fs, e := fieldsFromRequest(r)
+	if e != nil {
+		return e
+	}
+	id := mux.Vars(r)["offer_id"]
+	var fields map[string]interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPatchSize)).Decode(&fields); err != nil {
+		return appErrorfCode(err, http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	offer, err := offers.DB.GetOffer(r.Context(), id)
+	if err == offers.ErrOfferNotFound {
+		return appErrorfCode(err, http.StatusNotFound, "could not find offer")
+	}
+	if err != nil {
+		return appErrorf(err, "could not get offer: %v", err)
+	}
+	// Check the update before writing it, so invalid ones are told apart
+	// from database errors.
+	err = offer.SetFields(fields)
+	if err == offers.ErrConcurrentModification {
+		return appErrorfCode(err, http.StatusConflict, "offer was modified since version %v", fields["version"])
+	}
+	if err != nil {
+		return appErrorfCode(err, http.StatusBadRequest, "%v", err)
+	}
+	if err := offer.Validate(); err != nil {
+		return appErrorfCode(err, http.StatusBadRequest, "%v", err)
+	}
+	err = offers.DB.UpdateOfferFields(r.Context(), id, fields)
+	switch err {
+	case offers.ErrOfferNotFound:
+		return appErrorfCode(err, http.StatusNotFound, "could not find offer")
+	case offers.ErrConcurrentModification:
+		return appErrorfCode(err, http.StatusConflict, "offer was modified since version %v", fields["version"])
+	}
+	if err != nil {
+		return appErrorf(err, "could not update offer: %v", err)
+	}
+	if offer, err = offers.DB.GetOffer(r.Context(), id); err != nil {
+		return appErrorf(err, "could not get offer: %v", err)
+	}
+	return writeJSON(w, fs.project(offer))
+}
+
+// brandFacet is a brand and its number of offers in the facets response.
+type brandFacet struct {
+	Brand string `json:"brand"`
+	Count int    `json:"count"`
+}
+
+// apiFacetsHandler returns the values offers can be narrowed down by, with
+// their offer counts, as JSON.
+func apiFacetsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	brands, err := offers.DB.ListBrandsWithCounts(r.Context())
+	if err != nil {
+		return appErrorf(err, "could not list brands: %v", err)
+	}
+	resp := struct {
+		Brands []brandFacet `json:"brands"`
+	}{Brands: []brandFacet{}}
+	for _, b := range brands {
+		resp.Brands = append(resp.Brands, brandFacet{Brand: b.Brand, Count: b.Count})
+	}
+	return writeJSON(w, resp)
+}
+
+// facetValue is a facet value in the search response.
+type facetValue struct {
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+	Selected bool   `json:"selected"`
+}
+
+func facetValues(counts []offers.FacetCount) []facetValue {
+	values := []facetValue{}
+	for _, c := range counts {
+		values = append(values, facetValue{Value: c.Value, Count: c.Count, Selected: c.Selected})
+	}
+	return values
+}
+
+// apiSearchHandler returns a page of the offers whose description or title
+// contains the q parameter as JSON, together with the facets they can be
+// narrowed down by. The brand, currency and price parameters, which may be
+// repeated, apply facet values; the page parameter selects the page, from 1.
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fs, e := fieldsFromRequest(r)
+	if e != nil {
+		return e
+	}
+	r.ParseForm()
+	applied := offers.FilterOptions{
+		Brands:     r.Form["brand"],
+		Currencies: r.Form["currency"],
+		Prices:     r.Form["price"],
+	}
+	if err := applied.Validate(); err != nil {
+		return &appError{Error: err, Message: err.Error(), Code: http.StatusBadRequest}
+	}
+	page := 1
+	if p := r.FormValue("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > apiSearchMaxPage {
+			return &appError{
+				Error:   fmt.Errorf("bad page %q", p),
+				Message: fmt.Sprintf("page must be a number from 1 to %d", apiSearchMaxPage),
+				Code:    http.StatusBadRequest,
+			}
+		}
+		page = n
+	}
+
+	q := r.FormValue("q")
+	list, err := offers.DB.FilteredSearch(r.Context(), q, applied, (page-1)*apiSearchPageSize, apiSearchPageSize)
+	if err != nil {
+		return appErrorf(err, "could not search offers: %v", err)
+	}
+	facets, err := offers.DB.SearchFacets(r.Context(), q, applied)
+	if err != nil {
+		return appErrorf(err, "could not count facets: %v", err)
+	}
+	convertPrices(requestCurrency(r), list)
+
+	resp := struct {
+		Offers []map[string]string `json:"offers"`
+		Page   int                 `json:"page"`
+		Facets struct {
+			Brands     []facetValue `json:"brands"`
+			Currencies []facetValue `json:"currencies"`
+			Prices     []facetValue `json:"prices"`
+		} `json:"facets"`
+	}{Offers: []map[string]string{}, Page: page}
+	for _, o := range list {
+		resp.Offers = append(resp.Offers, fs.project(o))
+	}
+	resp.Facets.Brands = facetValues(facets.Brands)
+	resp.Facets.Currencies = facetValues(facets.Currencies)
+	resp.Facets.Prices = facetValues(facets.Prices)
+	return writeJSON(w, resp)
+}
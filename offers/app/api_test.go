@@ -0,0 +1,305 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"offers"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	all, err := parseFields("")
+	if err != nil {
+		t.Fatalf("parseFields(\"\"): %v", err)
+	}
+	if len(all) != len(apiFields) {
+		t.Errorf("parseFields(\"\") selected %d fields, want all %d", len(all), len(apiFields))
+	}
+
+	fs, err := parseFields(" title, id,title ")
+	if err != nil {
+		t.Fatalf("parseFields: %v", err)
+	}
+	got := fs.project(testOffer("a", "Chair", "10.00"))
+	if want := map[string]string{"id": "a", "title": "Chair"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("projection = %v, want %v", got, want)
+	}
+
+	for _, param := range []string{"name", "id,", "id,Title", "id;title"} {
+		if _, err := parseFields(param); err == nil {
+			t.Errorf("parseFields(%q) succeeded, want an error", param)
+		}
+	}
+}
+
+func TestAPIFields(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "99.00"))
+
+	w := get(t, db, "/api/v1/offers?fields=id,price")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var list struct {
+		Offers []map[string]string `json:"offers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decoding list: %v", err)
+	}
+	want := []map[string]string{{"id": "a", "price": "10.00"}, {"id": "b", "price": "99.00"}}
+	if !reflect.DeepEqual(list.Offers, want) {
+		t.Errorf("list offers = %v, want %v", list.Offers, want)
+	}
+
+	w = get(t, db, "/api/v1/offers/b?fields=title")
+	if w.Code != http.StatusOK {
+		t.Fatalf("detail: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"title":"Table"}`; got != want {
+		t.Errorf("detail = %s, want %s", got, want)
+	}
+
+	// Without the parameter, every field is returned.
+	w = get(t, db, "/api/v1/offers/b")
+	var detail map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+		t.Fatalf("decoding detail: %v", err)
+	}
+	if len(detail) != len(apiFields) {
+		t.Errorf("detail has %d fields, want all %d: %v", len(detail), len(apiFields), detail)
+	}
+
+	for _, target := range []string{
+		"/api/v1/offers?fields=id,secret",
+		"/api/v1/offers/b?fields=secret",
+	} {
+		w := get(t, db, target)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+		if !strings.Contains(w.Body.String(), `unknown field "secret"`) {
+			t.Errorf("GET %s: body %q doesn't name the unknown field", target, w.Body)
+		}
+	}
+}
+
+func TestAPIOffers(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"), testOffer("b", "Table", "99.00"))
+	for _, tt := range []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/api/v1/offers?fields=id,title", http.StatusOK, `{"offers":[{"id":"a","title":"Garden chair"},{"id":"b","title":"Table"}]}`},
+		{"/api/v1/offers/a?fields=id,price,currency", http.StatusOK, `{"currency":"USD","id":"a","price":"10.00"}`},
+		{"/api/v1/search?q=garden&fields=id", http.StatusOK, `"offers":[{"id":"a"}]`},
+		{"/api/v1/search?q=sofa&fields=id", http.StatusOK, `"offers":[]`},
+		{"/api/v1/offers/missing", http.StatusNotFound, ""},
+		{"/api/v1/search?q=garden&page=x", http.StatusBadRequest, ""},
+	} {
+		w := get(t, db, tt.target)
+		if w.Code != tt.code {
+			t.Errorf("GET %s: status %d, want %d: %s", tt.target, w.Code, tt.code, w.Body)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("GET %s: Content-Type %q, want JSON", tt.target, ct)
+		}
+		if !json.Valid(w.Body.Bytes()) || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("GET %s = %s, want JSON containing %s", tt.target, w.Body, tt.body)
+		}
+	}
+
+	// Offers marshal with the API's field names.
+	b, err := json.Marshal(testOffer("a", "Garden chair", "10.00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]interface{}{"id": "a", "title": "Garden chair", "price": "10.00", "currency": "USD", "merchant_url": "https://example.com/products/a"} {
+		if got[name] != want {
+			t.Errorf("JSON offer %s = %v, want %v", name, got[name], want)
+		}
+	}
+}
+
+func TestAPIFilter(t *testing.T) {
+	cheap := testOffer("a", "Chair", "10.00")
+	dear := testOffer("b", "Table", "2500.00")
+	euro := testOffer("c", "Lamp", "15.00")
+	euro.Currency = "EUR"
+	db := newTestDB(t, cheap, dear, euro)
+
+	w := get(t, db, "/api/v1/offers?fields=id&filter="+url.QueryEscape("price<2000 AND currency=USD"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("filter: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"offers":[{"id":"a"}]}`; got != want {
+		t.Errorf("filtered offers = %s, want %s", got, want)
+	}
+
+	for _, filter := range []string{"secret=1", "price<10; DROP TABLE offers", "title>a"} {
+		w := get(t, db, "/api/v1/offers?filter="+url.QueryEscape(filter))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("filter %q: status %d, want %d", filter, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIFacets(t *testing.T) {
+	branded := func(id, brand string) *offers.Offer {
+		o := testOffer(id, "Chair "+id, "10.00")
+		o.Brand = brand
+		return o
+	}
+	db := newTestDB(t, branded("a", "Bolt"), branded("b", "Acme"), branded("c", "Bolt"), branded("d", ""))
+
+	w := get(t, db, "/api/v1/facets")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/facets: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got, want := strings.TrimSpace(w.Body.String()), `{"brands":[{"brand":"Bolt","count":2},{"brand":"Acme","count":1}]}`; got != want {
+		t.Errorf("facets = %s, want %s", got, want)
+	}
+
+	w = get(t, db, "/offers")
+	if body := w.Body.String(); !strings.Contains(body, "<li>Bolt (2)</li>") || !strings.Contains(body, "<li>Acme (1)</li>") {
+		t.Errorf("list page doesn't show the brand counts:\n%s", body)
+	}
+}
+
+func TestAPISearchFacets(t *testing.T) {
+	offer := func(id, title, brand string) *offers.Offer {
+		o := testOffer(id, title, "10.00")
+		o.Brand = brand
+		return o
+	}
+	db := newTestDB(t, offer("a", "Garden chair", "Acme"), offer("b", "Garden bench", "Bolt"), offer("c", "Garden shed", "Bolt"))
+
+	var resp struct {
+		Offers []map[string]string `json:"offers"`
+		Page   int                 `json:"page"`
+		Facets struct {
+			Brands []facetValue `json:"brands"`
+		} `json:"facets"`
+	}
+	w := get(t, db, "/api/v1/search?q=garden&brand=Bolt&fields=id")
+	if w.Code != http.StatusOK {
+		t.Fatalf("search: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding search: %v", err)
+	}
+	if want := []map[string]string{{"id": "b"}, {"id": "c"}}; !reflect.DeepEqual(resp.Offers, want) || resp.Page != 1 {
+		t.Errorf("search page %d offers = %v, want page 1 with %v", resp.Page, resp.Offers, want)
+	}
+	want := []facetValue{{"Bolt", 2, true}, {"Acme", 1, false}}
+	if !reflect.DeepEqual(resp.Facets.Brands, want) {
+		t.Errorf("brand facets = %+v, want %+v", resp.Facets.Brands, want)
+	}
+
+	for _, target := range []string{"/api/v1/search?q=garden&price=cheap", "/api/v1/search?q=garden&page=0"} {
+		if w := get(t, db, target); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIPatch(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"), testOffer("b", "Table", "99.00"))
+	patch := func(target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("PATCH", target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return serveRequest(t, db, r)
+	}
+
+	w := patch("/api/v1/offers/a?fields=id,title,price,brand", `{"price": "12.50"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH price: status %d: %s", w.Code, w.Body)
+	}
+	if want := `{"brand":"","id":"a","price":"12.50","title":"Garden chair"}`; strings.TrimSpace(w.Body.String()) != want {
+		t.Errorf("PATCH price = %s, want %s", w.Body, want)
+	}
+	o, err := db.GetOffer(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Price != "12.50" || o.Title != "Garden chair" || o.Currency != "USD" || o.MerchantURL != "https://example.com/products/a" {
+		t.Errorf("patched offer = %+v, want only the price changed", o)
+	}
+
+	for _, tt := range []struct {
+		target, body string
+		code         int
+	}{
+		{"/api/v1/offers/a", `{"title": "Armchair", "brand": "Acme"}`, http.StatusOK},
+		{"/api/v1/offers/a", `{"name": "Armchair"}`, http.StatusBadRequest},
+		{"/api/v1/offers/a", `{"price": 12.5}`, http.StatusBadRequest},
+		{"/api/v1/offers/a", `{"currency": "dollars"}`, http.StatusBadRequest},
+		{"/api/v1/offers/a", `{}`, http.StatusBadRequest},
+		{"/api/v1/offers/a", `["title"]`, http.StatusBadRequest},
+		{"/api/v1/offers/a?fields=name", `{"title": "Stool"}`, http.StatusBadRequest},
+		{"/api/v1/offers/missing", `{"title": "Stool"}`, http.StatusNotFound},
+	} {
+		if w := patch(tt.target, tt.body); w.Code != tt.code {
+			t.Errorf("PATCH %s with %s: status %d, want %d: %s", tt.target, tt.body, w.Code, tt.code, w.Body)
+		}
+	}
+	if o, err := db.GetOffer(context.Background(), "a"); err != nil || o.Title != "Armchair" || o.Brand != "Acme" || o.Price != "12.50" || o.Currency != "USD" {
+		t.Errorf("offer after the patches = %+v, %v; want the title and brand of the valid one", o, err)
+	}
+	if o, err := db.GetOffer(context.Background(), "b"); err != nil || o.Title != "Table" || o.Price != "99.00" {
+		t.Errorf("other offer after the patches = %+v, %v; want it unchanged", o, err)
+	}
+}
+
+func TestAPIPatchVersion(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	patch := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		return serveRequest(t, db, httptest.NewRequest("PATCH", "/api/v1/offers/a?fields=title,version", strings.NewReader(body)))
+	}
+	var got map[string]string
+	w := get(t, db, "/api/v1/offers/a?fields=version")
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding offer: %v", err)
+	}
+	version := got["version"]
+
+	w = patch(`{"title": "Armchair", "version": ` + version + `}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH with the current version: status %d: %s", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding patched offer: %v", err)
+	}
+	if got["title"] != "Armchair" || got["version"] == version {
+		t.Errorf("patched offer = %v, want the new title and a new version", got)
+	}
+
+	// The write moved the version on, so the old one is stale.
+	if w := patch(`{"title": "Stool", "version": ` + version + `}`); w.Code != http.StatusConflict {
+		t.Errorf("PATCH with a stale version: status %d, want 409", w.Code)
+	}
+	if w := patch(`{"title": "Stool", "version": "latest"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH with a malformed version: status %d, want 400", w.Code)
+	}
+	if o, err := db.GetOffer(context.Background(), "a"); err != nil || o.Title != "Armchair" {
+		t.Errorf("offer after rejected patches = %+v, %v; want the Armchair", o, err)
+	}
+}
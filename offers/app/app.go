@@ -9,44 +9,558 @@
 package main
 
 import (
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
 	"offers"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-
-	"google.golang.org/appengine"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	// See template.go
-	listTmpl          = parseTemplate("list.html")
-	detailTmpl        = parseTemplate("detail.html")
-	updateSuccessTmpl = parseTemplate("update.html")
-	privacyTmpl       = parseTemplate("privacy.html")
-	aboutTmpl         = parseTemplate("about.html")
+	// See template.go. The templates are parsed by parseTemplates.
+	listTmpl       *appTemplate
+	detailTmpl     *appTemplate
+	privacyTmpl    *appTemplate
+	aboutTmpl      *appTemplate
+	featuredTmpl   *appTemplate
+	reportTmpl     *appTemplate
+	reportsTmpl    *appTemplate
+	comparisonTmpl *appTemplate
+	alertTmpl      *appTemplate
+	alertsTmpl     *appTemplate
+
+	// reportLimiter limits how many reports each client can submit.
+	reportLimiter = newWindowLimiter(maxReportsPerHour, time.Hour)
+	// reviewLimiter limits how many reviews each client can submit.
+	reviewLimiter = newWindowLimiter(maxReviewsPerHour, time.Hour)
+	// alertLimiter limits how many price alerts each client can create.
+	alertLimiter = newWindowLimiter(maxAlertsPerHour, time.Hour)
+	// updateLimiter limits how often syncs can be requested, by anyone. It
+	// is set by configureUpdateLimit.
+	updateLimiter *tokenBucket
+
+	// converter converts prices to displayCurrency. It is nil unless
+	// currency rates are configured.
+	converter       offers.CurrencyConverter
+	displayCurrency string
+
+	// apiLog configures logging of Content API requests made by updates.
+	apiLog offers.LogConfig
 )
 
 const (
 	merchantIDEnv = "MERCHANT_ID"
+	// apiTimeoutEnv optionally overrides the Content API client timeout,
+	// e.g. "90s".
+	apiTimeoutEnv = "CONTENT_API_TIMEOUT"
+	// apiProxyEnv optionally sets the proxy URL for Content API requests.
+	apiProxyEnv = "CONTENT_API_PROXY"
+	// apiAuthEnv optionally selects how the Content API client authenticates:
+	// "dir", "credentials" or "default". By default, the first credentials
+	// configured are used; see offers.AuthAuto.
+	apiAuthEnv = "CONTENT_API_AUTH"
+	// apiCredentialsEnv and apiCredentialsJSONEnv optionally name and hold
+	// the credentials JSON, such as a service account key, of the
+	// "credentials" method.
+	apiCredentialsEnv     = "CONTENT_API_CREDENTIALS"
+	apiCredentialsJSONEnv = "CONTENT_API_CREDENTIALS_JSON"
+	// apiLogEnv optionally sets the file Content API requests made by
+	// updates are logged to. Relative paths are in the home directory.
+	apiLogEnv = "CONTENT_API_LOG"
+	// apiLogSizeEnv optionally sets the size in bytes at which the API log
+	// is rotated.
+	apiLogSizeEnv = "CONTENT_API_LOG_MAX_SIZE"
+	// productPageSizeEnv optionally sets the number of products fetched
+	// per Content API request, up to 250.
+	productPageSizeEnv = "SYNC_PAGE_SIZE"
+	// maxAccountsEnv optionally caps the number of MCA sub-accounts synced.
+	maxAccountsEnv = "MCA_MAX_ACCOUNTS"
+	// allowAccountsEnv optionally lists the only MCA sub-account IDs to sync,
+	// separated by commas.
+	allowAccountsEnv = "MCA_ACCOUNT_ALLOWLIST"
+	// denyAccountsEnv optionally lists MCA sub-account IDs not to sync,
+	// separated by commas.
+	denyAccountsEnv = "MCA_ACCOUNT_DENYLIST"
+	// includeUnapprovedEnv, if "true", syncs products that aren't approved.
+	includeUnapprovedEnv = "SYNC_INCLUDE_UNAPPROVED"
+	// approvalDestinationEnv optionally requires synced products to be
+	// approved for a destination, e.g. "Shopping".
+	approvalDestinationEnv = "SYNC_APPROVAL_DESTINATION"
+	// rootEnv configures the root path. It is either "list", to render the
+	// offers list directly, or the path to redirect to. It defaults to
+	// "/offers".
+	rootEnv = "ROOT_PAGE"
+	// rootStatusEnv is the status code used when redirecting the root path.
+	// It defaults to 302.
+	rootStatusEnv = "ROOT_REDIRECT_STATUS"
+	// cacheTTLEnv enables caching of offer reads for the given duration,
+	// e.g. "30s".
+	cacheTTLEnv = "OFFER_CACHE_TTL"
+	// cachePollEnv optionally sets how often the database is polled for
+	// changes made outside the app, which clear the cache, e.g. "10s".
+	cachePollEnv = "OFFER_CACHE_POLL"
+	// cacheMaxOffersEnv limits the number of offers cached for detail pages.
+	cacheMaxOffersEnv = "OFFER_CACHE_MAX_OFFERS"
+	// cacheRedisEnv optionally keeps the cache in Redis, shared by all
+	// instances, e.g. "redis://10.0.0.3:6379/0".
+	cacheRedisEnv = "OFFER_CACHE_REDIS_URL"
+	// keepaliveEnv optionally pings idle database connections at the given
+	// interval, so they aren't closed by Cloud SQL, e.g. "1m".
+	keepaliveEnv = "DB_KEEPALIVE_INTERVAL"
+	// keepaliveConnsEnv optionally sets the number of connections the
+	// keepalive keeps open. It defaults to 1.
+	keepaliveConnsEnv = "DB_KEEPALIVE_CONNS"
+	// updateRateEnv optionally sets how many sync requests are accepted per
+	// minute. It defaults to defaultUpdateRate.
+	updateRateEnv = "UPDATE_RATE_LIMIT"
+	// slowQueryEnv optionally logs database calls slower than the given
+	// duration, e.g. "200ms".
+	slowQueryEnv = "SLOW_QUERY_THRESHOLD"
+	// currencyRatesEnv lists static exchange rates against a common base,
+	// e.g. "USD=1,EUR=0.9". See offers.StaticRates.
+	currencyRatesEnv = "CURRENCY_RATES"
+	// displayCurrencyEnv is the currency prices are converted to.
+	displayCurrencyEnv = "DISPLAY_CURRENCY"
+	// alertWebhookEnv optionally sets a URL price alerts are POSTed to as
+	// JSON.
+	alertWebhookEnv = "PRICE_ALERT_WEBHOOK"
+	// alertSMTPEnv optionally sets the host:port of an SMTP server price
+	// alerts are emailed through, from alertFromEnv. alertSMTPUserEnv and
+	// alertSMTPPasswordEnv optionally authenticate with it.
+	alertSMTPEnv         = "PRICE_ALERT_SMTP_ADDR"
+	alertFromEnv         = "PRICE_ALERT_FROM"
+	alertSMTPUserEnv     = "PRICE_ALERT_SMTP_USER"
+	alertSMTPPasswordEnv = "PRICE_ALERT_SMTP_PASSWORD"
+
+	// trendingWindow is how far back views count towards trending offers.
+	trendingWindow = 7 * 24 * time.Hour
+	// trendingLimit is the number of trending offers shown on the list page.
+	trendingLimit = 4
+	// maxReportsPerHour is how many offer reports a client may submit per hour.
+	maxReportsPerHour = 10
+	// maxReportLength is the maximum length of a report's reason.
+	maxReportLength = 1000
+	// reportsLimit is the number of reports shown on the admin page.
+	reportsLimit = 200
+	// maxReviewsPerHour is how many reviews a client may submit per hour.
+	maxReviewsPerHour = 10
+	// maxReviewLength is the maximum length of a review's text.
+	maxReviewLength = 2000
+	// maxAlertsPerHour is how many price alerts a client may create per hour.
+	maxAlertsPerHour = 10
+	// defaultUpdateRate is how many sync requests are accepted per minute,
+	// unless updateRateEnv is set.
+	defaultUpdateRate = 1
+	// maxContactLength is the maximum length of a price alert's contact.
+	maxContactLength = 255
+	// alertsLimit is the number of price alerts shown on the admin page.
+	alertsLimit = 200
+	// maxPerPage is the largest number of offers a list page can show.
+	maxPerPage = 100
+	// relatedLimit is the number of offers shown on an offer's related
+	// offers page.
+	relatedLimit = 20
+	// comparisonLimit is the number of duplicate offers shown on the price
+	// comparison page.
+	comparisonLimit = 500
+	// readyTimeout bounds how long the readiness check waits for the
+	// database.
+	readyTimeout = 2 * time.Second
+	// viewRetention is how long views are kept before being pruned. It must be
+	// at least as long as trendingWindow.
+	viewRetention = 30 * 24 * time.Hour
+	// deletedRetention is how long soft-deleted offers are kept, so offers
+	// that briefly leave the feed come back with their history, before
+	// being purged.
+	deletedRetention = 90 * 24 * time.Hour
+	// shutdownTimeout bounds how long in-flight requests may take to finish
+	// once the server is asked to stop.
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
+	if err := offers.OpenDatabases(); err != nil {
+		log.Fatal(err)
+	}
+	configureSlowQueryLog()
+	configureAPIClient()
+	configureKeepalive()
+	configureMetrics()
+	configureTracing()
+	configureCache()
+	configureCurrency()
+	configureAlerts()
+	configureUpdateLimit()
+	configureAuth()
+	configureClientIP()
+	configureImageProxy()
+	parseTemplates()
 	registerHandlers()
-	appengine.Main()
+	serve()
+}
+
+// serve serves the registered handlers on $PORT, like appengine.Main, until
+// the process receives SIGINT or SIGTERM.
+func serve() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := serveUntilSignal(ln, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveUntilSignal serves handler, or the registered handlers if it is nil,
+// on ln until the process receives SIGINT or SIGTERM. It then stops
+// accepting requests, waits up to shutdownTimeout for in-flight ones, closes
+// the databases and exports the remaining spans. It returns an error only if
+// the server stops serving before a signal arrives.
+func serveUntilSignal(ln net.Listener, handler http.Handler) error {
+	srv := &http.Server{Handler: handler}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("could not finish in-flight requests: %v", err)
+	}
+	closeDatabases()
+	shutdownTracing(ctx)
+	return nil
+}
+
+// closeDatabases closes the serving database, and the sync database if it
+// is separate, logging any errors.
+func closeDatabases() {
+	if err := offers.DB.Close(); err != nil {
+		log.Printf("could not close database: %v", err)
+	}
+	if offers.SyncDB != offers.DB {
+		if err := offers.SyncDB.Close(); err != nil {
+			log.Printf("could not close sync database: %v", err)
+		}
+	}
+}
+
+// parseTemplates parses all page templates. Functions used by templates must
+// be registered with RegisterTemplateFunc before it is called.
+func parseTemplates() {
+	listTmpl = parseTemplate("list.html")
+	detailTmpl = parseTemplate("detail.html")
+	privacyTmpl = parseTemplate("privacy.html")
+	aboutTmpl = parseTemplate("about.html")
+	featuredTmpl = parseTemplate("featured.html")
+	reportTmpl = parseTemplate("report.html")
+	reportsTmpl = parseTemplate("reports.html")
+	comparisonTmpl = parseTemplate("comparison.html")
+	alertTmpl = parseTemplate("alert.html")
+	alertsTmpl = parseTemplate("alerts.html")
+}
+
+// configureSlowQueryLog enables logging of slow database calls if a
+// threshold is configured.
+func configureSlowQueryLog() {
+	if v := os.Getenv(slowQueryEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", slowQueryEnv, err)
+		}
+		offers.SlowQueryThreshold = d
+	}
+}
+
+// validAuthMethod reports whether m is one of offers.AuthMethods.
+func validAuthMethod(m offers.AuthMethod) bool {
+	for _, v := range offers.AuthMethods {
+		if m == v {
+			return true
+		}
+	}
+	return false
+}
+
+// configureAPIClient applies the Content API client settings from the
+// environment.
+func configureAPIClient() {
+	if v := os.Getenv(apiTimeoutEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", apiTimeoutEnv, err)
+		}
+		offers.APIClient.Timeout = d
+	}
+	if v := os.Getenv(apiProxyEnv); v != "" {
+		u, err := url.Parse(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", apiProxyEnv, err)
+		}
+		offers.APIClient.Proxy = http.ProxyURL(u)
+	}
+	offers.APIClient.Auth = offers.AuthMethod(os.Getenv(apiAuthEnv))
+	if !validAuthMethod(offers.APIClient.Auth) {
+		log.Fatalf("invalid %s %q: must be dir, credentials or default", apiAuthEnv, offers.APIClient.Auth)
+	}
+	offers.APIClient.CredentialsFile = os.Getenv(apiCredentialsEnv)
+	if v := os.Getenv(apiCredentialsJSONEnv); v != "" {
+		offers.APIClient.CredentialsJSON = []byte(v)
+	}
+	if offers.APIClient.Auth == offers.AuthCredentials && offers.APIClient.CredentialsFile == "" && offers.APIClient.CredentialsJSON == nil {
+		log.Fatalf("%s is credentials, but neither %s nor %s is set", apiAuthEnv, apiCredentialsEnv, apiCredentialsJSONEnv)
+	}
+	if v := os.Getenv(apiLogEnv); v != "" {
+		apiLog = offers.LogConfig{Enabled: true, Path: v}
+		if v := os.Getenv(apiLogSizeEnv); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				log.Fatalf("invalid %s: %q", apiLogSizeEnv, v)
+			}
+			apiLog.MaxSize = n
+		}
+	}
+
+	if v := os.Getenv(productPageSizeEnv); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > offers.MaxProductPageSize {
+			log.Fatalf("invalid %s %q: must be between 1 and %d", productPageSizeEnv, v, offers.MaxProductPageSize)
+		}
+		offers.ProductList.PageSize = n
+	}
+
+	if v := os.Getenv(maxAccountsEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", maxAccountsEnv, err)
+		}
+		offers.SubAccounts.MaxAccounts = n
+	}
+	offers.SubAccounts.Allow = accountIDsFromEnv(allowAccountsEnv)
+	offers.SubAccounts.Deny = accountIDsFromEnv(denyAccountsEnv)
+
+	if v := os.Getenv(includeUnapprovedEnv); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", includeUnapprovedEnv, err)
+		}
+		offers.ProductStatuses.IncludeUnapproved = b
+	}
+	offers.ProductStatuses.Destination = os.Getenv(approvalDestinationEnv)
+}
+
+// accountIDsFromEnv parses a comma-separated list of account IDs from the
+// environment variable k.
+func accountIDsFromEnv(k string) []uint64 {
+	var ids []uint64
+	for _, f := range strings.Split(os.Getenv(k), ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", k, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// configureKeepalive starts pinging idle database connections if an interval
+// is configured. It must run before configureCache wraps the database.
+func configureKeepalive() {
+	v := os.Getenv(keepaliveEnv)
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		log.Fatalf("invalid %s: %q", keepaliveEnv, v)
+	}
+	opts := offers.KeepaliveOptions{Interval: interval}
+	if v := os.Getenv(keepaliveConnsEnv); v != "" {
+		if opts.MinConns, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("invalid %s: %v", keepaliveConnsEnv, err)
+		}
+	}
+	dbs := []offers.OfferDatabase{offers.DB}
+	if offers.SyncDB != offers.DB {
+		dbs = append(dbs, offers.SyncDB)
+	}
+	for _, db := range dbs {
+		if k, ok := db.(offers.Keepaliver); ok {
+			k.StartKeepalive(opts)
+		}
+	}
+}
+
+// configureUpdateLimit sets how often syncs can be requested. Requests
+// beyond the rate are refused, without a burst allowance.
+func configureUpdateLimit() {
+	rate := defaultUpdateRate
+	if v := os.Getenv(updateRateEnv); v != "" {
+		var err error
+		if rate, err = strconv.Atoi(v); err != nil || rate <= 0 {
+			log.Fatalf("invalid %s: %q", updateRateEnv, v)
+		}
+	}
+	updateLimiter = newTokenBucket(rate, 1)
+}
+
+// configureCache wraps the offers database in a cache if one is configured.
+func configureCache() {
+	v := os.Getenv(cacheTTLEnv)
+	if v == "" {
+		return
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", cacheTTLEnv, err)
+	}
+	opts := offers.CacheOptions{TTL: ttl}
+	if v := os.Getenv(cachePollEnv); v != "" {
+		if opts.PollInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid %s: %v", cachePollEnv, err)
+		}
+	}
+	if v := os.Getenv(cacheMaxOffersEnv); v != "" {
+		if opts.MaxOffers, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("invalid %s: %v", cacheMaxOffersEnv, err)
+		}
+	}
+	if v := os.Getenv(cacheRedisEnv); v != "" {
+		configureRedisCache(v, opts)
+		return
+	}
+	cached := offers.NewCachedDB(offers.DB, opts)
+	// Syncs only clear the cache if they write through it. A separate sync
+	// database is only seen through the TTL or polling.
+	if offers.SyncDB == offers.DB {
+		offers.SyncDB = cached
+	}
+	offers.DB = cached
+}
+
+// configureRedisCache wraps the offers database in a cache shared by all
+// instances through the Redis server at redisURL.
+func configureRedisCache(redisURL string, opts offers.CacheOptions) {
+	redisOpts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", cacheRedisEnv, err)
+	}
+	client := redis.NewClient(redisOpts)
+	cached, err := offers.NewRedisCachedDB(offers.DB, client, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Unlike the in-process cache, a separate sync database can be cached
+	// in the same Redis server, so its writes clear the cache of every
+	// instance.
+	if offers.SyncDB == offers.DB {
+		offers.SyncDB = cached
+	} else if offers.SyncDB, err = offers.NewRedisCachedDB(offers.SyncDB, client, opts); err != nil {
+		log.Fatal(err)
+	}
+	offers.DB = cached
+}
+
+// configureCurrency sets up price conversion if currency rates are
+// configured.
+func configureCurrency() {
+	v := os.Getenv(currencyRatesEnv)
+	if v == "" {
+		return
+	}
+	rates := offers.StaticRates{}
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalf("invalid %s: %q is not CODE=RATE", currencyRatesEnv, f)
+		}
+		rate, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || rate <= 0 {
+			log.Fatalf("invalid %s: bad rate for %s", currencyRatesEnv, kv[0])
+		}
+		rates[strings.ToUpper(strings.TrimSpace(kv[0]))] = rate
+	}
+	converter = rates
+	displayCurrency = strings.ToUpper(mustGetenv(displayCurrencyEnv))
+}
+
+// configureAlerts sets how price alerts are delivered after syncs. Without a
+// webhook or SMTP server, alerts are stored but never fired.
+func configureAlerts() {
+	if v := os.Getenv(alertWebhookEnv); v != "" {
+		if _, err := url.Parse(v); err != nil {
+			log.Fatalf("invalid %s: %v", alertWebhookEnv, err)
+		}
+		offers.AlertNotifier = offers.WebhookNotifier{URL: v}
+		return
+	}
+	if v := os.Getenv(alertSMTPEnv); v != "" {
+		host, _, err := net.SplitHostPort(v)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", alertSMTPEnv, err)
+		}
+		n := offers.EmailNotifier{Addr: v, From: mustGetenv(alertFromEnv)}
+		if user := os.Getenv(alertSMTPUserEnv); user != "" {
+			n.Auth = smtp.PlainAuth("", user, os.Getenv(alertSMTPPasswordEnv), host)
+		}
+		offers.AlertNotifier = n
+	}
 }
 
 func registerHandlers() {
+	// [START request_logging]
+	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
+	// Log all requests using the standard Apache format.
+	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, newRouter()))
+	// [END request_logging]
+}
+
+// newRouter returns the router of all the app's pages, API endpoints and
+// tasks.
+func newRouter() *mux.Router {
 	// Use gorilla/mux for rich routing.
 	// See http://www.gorillatoolkit.org/pkg/mux
 	r := mux.NewRouter()
 
-	r.Handle("/", http.RedirectHandler("/offers", http.StatusFound))
+	r.Handle("/", rootHandler())
 
 	r.Methods("GET").Path("/offers").
 		Handler(appHandler(listHandler))
@@ -54,6 +568,15 @@ func registerHandlers() {
 	r.Methods("GET").Path("/search").
 		Handler(appHandler(searchHandler))
 
+	r.Methods("GET").Path("/offers.csv").
+		Handler(appHandler(offersCSVHandler))
+
+	r.Methods("GET").Path("/search.csv").
+		Handler(appHandler(searchCSVHandler))
+
+	r.Methods("GET").Path("/recently-viewed").
+		Handler(appHandler(recentlyViewedHandler))
+
 	// TODO(asheem): Add a handler for static pages instead.
 	r.Methods("GET").Path("/privacy").
 		Handler(appHandler(privacyHandler))
@@ -61,32 +584,445 @@ func registerHandlers() {
 	r.Methods("GET").Path("/about").
 		Handler(appHandler(aboutHandler))
 
+	r.Methods("GET").Path("/offers/category/{category}").
+		Handler(appHandler(categoryHandler))
+
 	r.Methods("GET").Path("/offers/{offer_id}").
 		Handler(appHandler(detailHandler))
 
+	r.Methods("GET").Path("/p/{slug}").
+		Handler(appHandler(slugDetailHandler))
+
+	// Resized merchant images, from the hosts in IMAGE_PROXY_HOSTS.
+	r.Methods("GET").Path("/img").
+		Handler(appHandler(imageHandler))
+
+	r.Methods("GET").Path("/offers/{offer_id}/related").
+		Handler(appHandler(relatedHandler))
+
+	// JSON API. The fields parameter limits the offer fields returned, and
+	// the filter parameter selects the offers listed.
+	r.Methods("GET").Path("/api/v1/offers").
+		Handler(appHandler(apiListHandler))
+
+	r.Methods("GET").Path("/api/v1/offers/{offer_id}").
+		Handler(appHandler(apiDetailHandler))
+
+	// Partial updates need the admin token; see authMiddleware.
+	r.Methods("PATCH").Path("/api/v1/offers/{offer_id}").
+		Handler(appHandler(apiPatchHandler))
+
+	r.Methods("GET").Path("/api/v1/facets").
+		Handler(appHandler(apiFacetsHandler))
+
+	r.Methods("GET").Path("/api/v1/search").
+		Handler(appHandler(apiSearchHandler))
+
+	r.Methods("POST").Path("/offers/{offer_id}/report").
+		Handler(appHandler(reportHandler))
+
+	r.Methods("POST").Path("/offers/{offer_id}/reviews").
+		Handler(appHandler(reviewHandler))
+
+	r.Methods("POST").Path("/offers/{offer_id}/alerts").
+		Handler(appHandler(addAlertHandler))
+
+	// Only one sync runs at a time, and requests to start one are also rate
+	// limited, so syncs can't run back to back and use up the Content API
+	// quota.
 	r.Methods("GET").Path("/tasks/update_db").
-		Handler(appHandler(updateHandler))
-	// Respond to App Engine and Compute Engine health checks.
-	// Indicate the server is healthy.
-	r.Methods("GET").Path("/_ah/health").HandlerFunc(
+		Handler(rateLimited(updateLimiter, appHandler(updateHandler)))
+
+	r.Methods("GET").Path("/tasks/update_db/status/{job_id}").
+		Handler(appHandler(updateStatusHandler))
+
+	// Admin pages. These need ADMIN_TOKEN, and are refused without it. See
+	// authMiddleware.
+	r.Methods("GET").Path("/admin/offers").
+		Handler(appHandler(allOffersHandler))
+
+	r.Methods("POST").Path("/admin/offers/import").
+		Handler(appHandler(importHandler))
+
+	r.Methods("DELETE").Path("/admin/offers/{offer_id}").
+		Handler(appHandler(deleteOfferHandler))
+
+	r.Methods("POST").Path("/admin/offers/{offer_id}/meta").
+		Handler(appHandler(setMetaHandler))
+
+	r.Methods("GET").Path("/admin/featured").
+		Handler(appHandler(featuredHandler))
+
+	r.Methods("POST").Path("/admin/featured").
+		Handler(appHandler(setFeaturedHandler))
+
+	r.Methods("GET").Path("/admin/reports").
+		Handler(appHandler(reportsHandler))
+
+	r.Methods("GET").Path("/admin/alerts").
+		Handler(appHandler(alertsHandler))
+
+	r.Methods("POST").Path("/admin/alerts/{alert_id}/delete").
+		Handler(appHandler(deleteAlertHandler))
+
+	r.Methods("POST").Path("/admin/recompute_prices").
+		Handler(appHandler(recomputePricesHandler))
+
+	r.Methods("GET").Path("/admin/duplicates").
+		Handler(appHandler(comparisonHandler))
+
+	r.Methods("POST").Path("/admin/duplicates").
+		Handler(appHandler(duplicatesHandler))
+
+	r.Methods("POST").Path("/admin/cache/invalidate").
+		Handler(appHandler(invalidateCacheHandler))
+
+	r.Methods("GET").Path("/tasks/prune_views").
+		Handler(appHandler(pruneViewsHandler))
+
+	r.Methods("GET").Path("/tasks/prune_reservations").
+		Handler(appHandler(pruneReservationsHandler))
+
+	r.Methods("GET").Path("/tasks/purge_deleted").
+		Handler(appHandler(purgeDeletedHandler))
+	// Respond to App Engine and Compute Engine health checks. The instance
+	// is only healthy if it can serve requests, which requires working
+	// database queries.
+	r.Methods("GET").Path("/_ah/health").HandlerFunc(readyHandler)
+	r.Methods("GET").Path("/readyz").HandlerFunc(readyHandler)
+
+	// Report that the process is running, without checking the database, so
+	// a database outage doesn't get instances restarted.
+	r.Methods("GET").Path("/_ah/live").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("ok"))
 		})
 
-	// [START request_logging]
-	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
-	// Log all requests using the standard Apache format.
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, r))
-	// [END request_logging]
+	// Expose Prometheus metrics of requests and database calls. Access
+	// should be restricted in front of the app.
+	r.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
+	r.Use(tracingMiddleware, metricsMiddleware, authMiddleware)
+	return r
+}
+
+// rootHandler returns the handler for the root path, as configured by rootEnv
+// and rootStatusEnv.
+func rootHandler() http.Handler {
+	target := os.Getenv(rootEnv)
+	if target == "list" {
+		return appHandler(listHandler)
+	}
+	if target == "" {
+		target = "/offers"
+	}
+	code := http.StatusFound
+	if v := os.Getenv(rootStatusEnv); v != "" {
+		var err error
+		if code, err = strconv.Atoi(v); err != nil || code < 300 || code > 399 {
+			log.Fatalf("invalid %s: %q is not a redirect status code", rootStatusEnv, v)
+		}
+	}
+	return http.RedirectHandler(target, code)
+}
+
+// listView is the data rendered by the list template.
+type listView struct {
+	Heading  string
+	Offers   []*offers.Offer
+	Featured []*offers.Offer
+	Trending []*offers.Offer
+	Brands   []offers.BrandCount
+
+	// Query is the search query, if the list holds search results.
+	Query string
+
+	// Total is the number of offers matching Query, which may be more than
+	// are listed, if it was counted.
+	Total int
+
+	// Page is set if the list is paginated.
+	Page *pageView
+}
+
+// pageView is the position of a list page among all pages.
+type pageView struct {
+	Number  int
+	Count   int
+	PerPage int
+	Sort    offers.SortOrder
+
+	// InStock is set if out-of-stock offers are hidden.
+	InStock bool
+
+	// MerchantID is set if only the offers synced from that account are
+	// listed.
+	MerchantID int64
+}
+
+// sortLabels name the sort orders on list pages.
+var sortLabels = map[offers.SortOrder]string{
+	offers.SortByTitle:     "Title",
+	offers.SortByPrice:     "Price",
+	offers.SortByInsertion: "Date added",
+}
+
+// query returns the query string of the list page p describes, carrying
+// every parameter set on it. All links between the pages of a list are
+// built with it, so none drop a filter.
+func (p *pageView) query() string {
+	v := url.Values{}
+	v.Set("page", strconv.Itoa(p.Number))
+	v.Set("per_page", strconv.Itoa(p.PerPage))
+	if p.Sort != "" {
+		v.Set("sort", string(p.Sort))
+	}
+	if p.InStock {
+		v.Set("in_stock", "true")
+	}
+	if p.MerchantID != 0 {
+		v.Set("merchant_id", strconv.FormatInt(p.MerchantID, 10))
+	}
+	return "?" + v.Encode()
+}
+
+// link returns the query string of the list with a copy of p changed by
+// change, keeping the other parameters.
+func (p *pageView) link(change func(q *pageView)) string {
+	q := *p
+	change(&q)
+	return q.query()
+}
+
+// URL returns the query string of page n of the list.
+func (p *pageView) URL(n int) string {
+	return p.link(func(q *pageView) { q.Number = n })
+}
+
+// StockURL returns the query string of the first page of the list with
+// out-of-stock offers hidden or not, as inStock says.
+func (p *pageView) StockURL(inStock bool) string {
+	return p.link(func(q *pageView) { q.Number, q.InStock = 1, inStock })
+}
+
+// sortLink is a link to the list in another order.
+type sortLink struct {
+	Label    string
+	URL      string
+	Selected bool
+}
+
+// Sorts returns links to the first page of the list in each order.
+func (p *pageView) Sorts() []sortLink {
+	var links []sortLink
+	for _, s := range offers.SortOrders {
+		u := p.link(func(q *pageView) { q.Number, q.Sort = 1, s })
+		links = append(links, sortLink{Label: sortLabels[s], URL: u, Selected: s == p.Sort})
+	}
+	return links
+}
+
+// Prev and Next are the numbers of the adjacent pages, or 0 if there are
+// none.
+func (p *pageView) Prev() int {
+	if p.Number <= 1 {
+		return 0
+	}
+	return p.Number - 1
+}
+
+func (p *pageView) Next() int {
+	if p.Number >= p.Count {
+		return 0
+	}
+	return p.Number + 1
+}
+
+// pageFromRequest reads the page, per_page, sort and in_stock parameters of
+// r. Pages are numbered from 1, and in_stock=true hides out-of-stock offers.
+func pageFromRequest(r *http.Request) (offers.ListOptions, *pageView, *appError) {
+	p := &pageView{Number: 1, PerPage: offers.DefaultPageSize, Sort: offers.SortByTitle}
+	if s := r.FormValue("sort"); s != "" {
+		p.Sort = offers.SortOrder(s)
+		if _, ok := sortLabels[p.Sort]; !ok {
+			return offers.ListOptions{}, nil, &appError{
+				Error:   fmt.Errorf("bad sort %q", s),
+				Message: "sort must be one of title, price or added",
+				Code:    http.StatusBadRequest,
+			}
+		}
+	}
+	for _, param := range []struct {
+		name string
+		v    *int
+		max  int
+	}{{"page", &p.Number, math.MaxInt32}, {"per_page", &p.PerPage, maxPerPage}} {
+		s := r.FormValue(param.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > param.max {
+			return offers.ListOptions{}, nil, &appError{
+				Error:   fmt.Errorf("bad %s %q", param.name, s),
+				Message: fmt.Sprintf("%s must be a number from 1 to %d", param.name, param.max),
+				Code:    http.StatusBadRequest,
+			}
+		}
+		*param.v = n
+	}
+	p.InStock = r.FormValue("in_stock") == "true"
+	return offers.ListOptions{Limit: p.PerPage, Offset: (p.Number - 1) * p.PerPage, Sort: p.Sort, InStock: p.InStock}, p, nil
+}
+
+// setTotal sets the number of pages needed for total offers.
+func (p *pageView) setTotal(total int) {
+	p.Count = (total + p.PerPage - 1) / p.PerPage
+	if p.Count < 1 {
+		p.Count = 1
+	}
 }
 
 // listHandler displays a list with summaries of offers in the database.
+// It supports conditional requests, so caches can cheaply revalidate it.
 func listHandler(w http.ResponseWriter, r *http.Request) *appError {
-	offers, err := offers.DB.ListOffers()
+	opts, page, e := pageFromRequest(r)
+	if e != nil {
+		return e
+	}
+	if v := r.FormValue("merchant_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return appErrorfCode(fmt.Errorf("invalid merchant_id %q", v), http.StatusBadRequest, "invalid merchant_id %q: must be a Merchant Center account ID", v)
+		}
+		return merchantListHandler(w, r, id, opts, page)
+	}
+	currency := requestCurrency(r)
+	featured, err := offers.DB.GetFeaturedOffers(r.Context())
+	if err != nil {
+		log.Printf("there was an error querying featured offers: %v", err)
+	}
+	trending, err := offers.DB.TrendingOffers(r.Context(), trendingWindow, trendingLimit)
+	if err != nil {
+		log.Printf("there was an error querying trending offers: %v", err)
+	}
+	if version, err := offers.DB.CatalogVersion(r.Context()); err != nil {
+		log.Printf("there was an error querying the catalog version: %v", err)
+	} else {
+		etag := listETag(fmt.Sprintf("%s|%s|%s|%d|%d|%s|%t", version, converterVersion(), currency, page.Number, page.PerPage, page.Sort, page.InStock), featured, trending)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", countryHeader)
+		w.Header().Set("Cache-Control", "public, no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+	list, total, err := offers.DB.ListPurchasableOffers(r.Context(), opts)
+	if err != nil {
+		log.Printf("there was an error querying offers: %v", err)
+	}
+	page.setTotal(total)
+	brands, err := offers.DB.ListBrandsWithCounts(r.Context())
+	if err != nil {
+		log.Printf("there was an error querying brands: %v", err)
+	}
+	convertPrices(currency, list, featured, trending)
+	attachRatings(r.Context(), list, featured, trending)
+	return listTmpl.Execute(w, r, listView{Offers: list, Featured: featured, Trending: trending, Brands: brands, Page: page})
+}
+
+// merchantListHandler lists the offers synced from a Merchant Center account,
+// such as a sub-account of an MCA, by title, a page at a time.
+func merchantListHandler(w http.ResponseWriter, r *http.Request, merchantID int64, opts offers.ListOptions, page *pageView) *appError {
+	// Like categoryHandler, it reads one more offer than fits instead of
+	// counting them, and the order is fixed.
+	list, err := offers.DB.ListOffersByMerchant(r.Context(), merchantID, opts.Limit+1, opts.Offset)
+	if err != nil {
+		return appErrorf(err, "could not list offers by merchant: %v", err)
+	}
+	page.Sort = ""
+	page.MerchantID = merchantID
+	page.Count = page.Number
+	if len(list) > opts.Limit {
+		list = list[:opts.Limit]
+		page.Count++
+	}
+	convertPrices(requestCurrency(r), list)
+	attachRatings(r.Context(), list)
+	return listTmpl.Execute(w, r, listView{Heading: fmt.Sprintf("Offers from merchant %d", merchantID), Offers: list, Page: page})
+}
+
+// allOffersHandler lists all offers, including those hidden from the
+// storefront because they have no link.
+func allOffersHandler(w http.ResponseWriter, r *http.Request) *appError {
+	opts, page, e := pageFromRequest(r)
+	if e != nil {
+		return e
+	}
+	list, total, err := offers.DB.ListOffers(r.Context(), opts)
 	if err != nil {
-		fmt.Printf("there was an error querying offers: %v", err)
+		return appErrorf(err, "could not list offers: %v", err)
 	}
-	return listTmpl.Execute(w, r, offers)
+	page.setTotal(total)
+	convertPrices(requestCurrency(r), list)
+	attachRatings(r.Context(), list)
+	return listTmpl.Execute(w, r, listView{Heading: "All offers", Offers: list, Page: page})
+}
+
+// attachRatings sets the ratings of the offers in lists. Errors are logged,
+// leaving the offers unrated.
+func attachRatings(ctx context.Context, lists ...[]*offers.Offer) {
+	var ids []string
+	for _, list := range lists {
+		for _, o := range list {
+			ids = append(ids, o.ID)
+		}
+	}
+	ratings, err := offers.DB.AverageRatings(ctx, ids)
+	if err != nil {
+		log.Printf("could not get ratings: %v", err)
+		return
+	}
+	for _, list := range lists {
+		for _, o := range list {
+			o.Rating = ratings[o.ID]
+		}
+	}
+}
+
+// listETag returns the entity tag of the list page, derived from the catalog
+// version and the offers shown in the featured and trending sections.
+func listETag(version string, sections ...[]*offers.Offer) string {
+	h := sha1.New()
+	io.WriteString(h, version)
+	for _, section := range sections {
+		io.WriteString(h, "|")
+		for _, o := range section {
+			io.WriteString(h, o.ID+",")
+		}
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
+// converterVersion identifies the exchange rates prices are converted with,
+// so pages showing converted prices are revalidated when they change.
+func converterVersion() string {
+	if converter == nil {
+		return ""
+	}
+	// fmt prints maps, such as StaticRates, sorted by key.
+	return fmt.Sprint(converter)
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 // privacyHandler displays privacy pages.
@@ -99,48 +1035,639 @@ func aboutHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return aboutTmpl.Execute(w, r, nil)
 }
 
-// searchHandler displays a list based on the search query.
+// searchHandler displays a list based on the search query. The optional
+// min_price and max_price parameters restrict it to a price range, and
+// currency to offers priced in that currency. per_page sets the number of
+// results shown, except within a price range.
 func searchHandler(w http.ResponseWriter, r *http.Request) *appError {
 	queries, ok := r.URL.Query()["q"]
 	if !ok {
-		return appErrorf(errors.New("bad offer query"), "could not find offers")
+		return appErrorfCode(errors.New("bad offer query"), http.StatusBadRequest, "missing search query q")
+	}
+	min, max, e := priceRangeFromRequest(r)
+	if e != nil {
+		return e
+	}
+	order, e := searchOrderFromRequest(r)
+	if e != nil {
+		return e
+	}
+	limit, e := searchLimitFromRequest(r)
+	if e != nil {
+		return e
+	}
+	var list []*offers.Offer
+	var err error
+	priced := min > 0 || !math.IsInf(max, 1)
+	if priced {
+		// Searches within a price range are always cheapest first.
+		list, err = offers.DB.SearchOffersByPriceRange(r.Context(), queries[0], min, max, r.FormValue("currency"))
+	} else {
+		list, err = offers.DB.SearchOffers(r.Context(), queries[0], order, limit)
 	}
-	offers, err := offers.DB.SearchOffers(queries[0])
 	if err != nil {
-		fmt.Printf("there was an error querying offers: %v", err)
+		return appErrorf(err, "could not search offers: %v", err)
+	}
+	// Only plain searches are counted, since CountSearchOffers doesn't
+	// know about price ranges.
+	var total int
+	if !priced {
+		if total, err = offers.DB.CountSearchOffers(r.Context(), queries[0]); err != nil {
+			log.Printf("there was an error counting search results: %v", err)
+		}
+	}
+	convertPrices(requestCurrency(r), list)
+	attachRatings(r.Context(), list)
+	return listTmpl.Execute(w, r, listView{Offers: list, Query: queries[0], Total: total})
+}
+
+// searchSortAliases are other names accepted for search orders.
+var searchSortAliases = map[string]offers.SortOrder{
+	"price_asc": offers.SortByPrice,
+}
+
+// searchOrderFromRequest reads the optional sort parameter of a search,
+// which defaults to relevance.
+func searchOrderFromRequest(r *http.Request) (offers.SortOrder, *appError) {
+	s := r.FormValue("sort")
+	if s == "" {
+		return offers.SortByRelevance, nil
+	}
+	if order, ok := searchSortAliases[s]; ok {
+		return order, nil
+	}
+	for _, order := range offers.SearchOrders {
+		if offers.SortOrder(s) == order {
+			return order, nil
+		}
+	}
+	return "", &appError{
+		Error:   fmt.Errorf("bad search sort %q", s),
+		Message: "sort must be one of relevance, title, price or price_asc",
+		Code:    http.StatusBadRequest,
+	}
+}
+
+// searchLimitFromRequest reads the optional per_page parameter of a search,
+// the number of results shown, which defaults to offers.DefaultSearchLimit.
+// Larger values than maxPerPage are lowered to it.
+func searchLimitFromRequest(r *http.Request) (int, *appError) {
+	s := r.FormValue("per_page")
+	if s == "" {
+		return offers.DefaultSearchLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, appErrorfCode(fmt.Errorf("bad per_page %q", s), http.StatusBadRequest, "per_page must be a positive number")
+	}
+	if n > maxPerPage {
+		n = maxPerPage
+	}
+	return n, nil
+}
+
+// priceRangeFromRequest parses the optional min_price and max_price
+// parameters of a search. Missing bounds are 0 and +Inf.
+func priceRangeFromRequest(r *http.Request) (min, max float64, e *appError) {
+	min, max = 0, math.Inf(1)
+	parse := func(name string, v *float64) *appError {
+		s := r.FormValue(name)
+		if s == "" {
+			return nil
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+			return &appError{
+				Error:   fmt.Errorf("bad %s %q", name, s),
+				Message: name + " must be a non-negative number",
+				Code:    http.StatusBadRequest,
+			}
+		}
+		*v = n
+		return nil
+	}
+	if e := parse("min_price", &min); e != nil {
+		return 0, 0, e
+	}
+	if e := parse("max_price", &max); e != nil {
+		return 0, 0, e
+	}
+	if min > max {
+		return 0, 0, &appError{
+			Error:   fmt.Errorf("min_price %v above max_price %v", min, max),
+			Message: "min_price must not be above max_price",
+			Code:    http.StatusBadRequest,
+		}
 	}
-	return listTmpl.Execute(w, r, offers)
+	return min, max, nil
 }
 
 // offerFromRequest retrieves an offer from the database given a offer ID in the
-// URL's path.
-func offerFromRequest(r *http.Request) (*offers.Offer, error) {
+// URL's path. A missing offer is a 404 Not Found error.
+func offerFromRequest(r *http.Request) (*offers.Offer, *appError) {
 	id := mux.Vars(r)["offer_id"]
-	offer, err := offers.DB.GetOffer(id)
+	offer, err := offers.DB.GetOffer(r.Context(), id)
+	if err == offers.ErrOfferNotFound {
+		return nil, appErrorfCode(fmt.Errorf("unknown offer %s", id), http.StatusNotFound, "could not find offer")
+	}
 	if err != nil {
-		return nil, fmt.Errorf("could not find offer: %v", err)
+		return nil, appErrorf(err, "could not get offer: %v", err)
 	}
 	return offer, nil
 }
 
-// detailHandler displays the details of a given offer.
+// detailView is the data rendered by the detail template.
+type detailView struct {
+	*offers.Offer
+
+	// Variants holds all offers in the offer's item group, including the
+	// offer itself. It is empty if the offer has no variants.
+	Variants []*offers.Offer
+
+	// Reviews holds the offer's most recent reviews.
+	Reviews []*offers.Review
+}
+
+// detailHandler displays the details of a given offer, or redirects to its
+// slug URL if it has one.
 func detailHandler(w http.ResponseWriter, r *http.Request) *appError {
-	offer, err := offerFromRequest(r)
+	offer, e := offerFromRequest(r)
+	if e != nil {
+		return e
+	}
+	// Offers are served at their slug URL once they have one.
+	if offer.Slug != "" {
+		u := offer.URL()
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusMovedPermanently)
+		return nil
+	}
+	return renderDetail(w, r, offer)
+}
+
+// slugDetailHandler displays the details of the offer with a given slug.
+func slugDetailHandler(w http.ResponseWriter, r *http.Request) *appError {
+	slug := mux.Vars(r)["slug"]
+	offer, err := offers.DB.GetOfferBySlug(r.Context(), slug)
+	if err == offers.ErrOfferNotFound {
+		return appErrorfCode(fmt.Errorf("unknown offer slug %s", slug), http.StatusNotFound, "could not find offer")
+	}
+	if err != nil {
+		return appErrorf(err, "could not get offer: %v", err)
+	}
+	return renderDetail(w, r, offer)
+}
+
+// renderDetail records a view of the offer and renders its details.
+func renderDetail(w http.ResponseWriter, r *http.Request, offer *offers.Offer) *appError {
+	if err := offers.DB.RecordView(r.Context(), offer.ID); err != nil {
+		log.Printf("could not record view of offer %s: %v", offer.ID, err)
+	}
+	recordRecentlyViewed(w, r, offer.ID)
+	variants, err := offers.DB.GetVariants(r.Context(), offer.ItemGroupID)
+	if err != nil {
+		log.Printf("could not get variants of offer %s: %v", offer.ID, err)
+	}
+	convertPrices(requestCurrency(r), []*offers.Offer{offer}, variants)
+	if offer.Rating, err = offers.DB.AverageRating(r.Context(), offer.ID); err != nil {
+		log.Printf("could not get rating of offer %s: %v", offer.ID, err)
+	}
+	reviews, err := offers.DB.GetReviews(r.Context(), offer.ID)
+	if err != nil {
+		log.Printf("could not get reviews of offer %s: %v", offer.ID, err)
+	}
+	return detailTmpl.Execute(w, r, detailView{Offer: offer, Variants: variants, Reviews: reviews})
+}
+
+// relatedHandler lists the offers similar to a given offer.
+func relatedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	offer, e := offerFromRequest(r)
+	if e != nil {
+		return e
+	}
+	related, err := offers.DB.RelatedOffers(r.Context(), offer.ID, relatedLimit)
+	if err != nil {
+		return appErrorf(err, "could not get related offers: %v", err)
+	}
+	convertPrices(requestCurrency(r), related)
+	return listTmpl.Execute(w, r, listView{Heading: "Related to " + offer.Title, Offers: related})
+}
+
+// categoryHandler lists the offers in a category by title, a page at a time.
+// Offers without a category are listed under offers.Uncategorized.
+func categoryHandler(w http.ResponseWriter, r *http.Request) *appError {
+	category := mux.Vars(r)["category"]
+	opts, page, e := pageFromRequest(r)
+	if e != nil {
+		return e
+	}
+	// One more offer than fits is read to tell whether there is a next
+	// page, since the list isn't counted. The order is fixed, so the sort
+	// links aren't shown.
+	list, err := offers.DB.ListByCategory(r.Context(), category, opts.Limit+1, opts.Offset)
+	if err != nil {
+		return appErrorf(err, "could not list offers in category: %v", err)
+	}
+	page.Sort = ""
+	page.Count = page.Number
+	if len(list) > opts.Limit {
+		list = list[:opts.Limit]
+		page.Count++
+	}
+	convertPrices(requestCurrency(r), list)
+	attachRatings(r.Context(), list)
+	return listTmpl.Execute(w, r, listView{Heading: "Category: " + category, Offers: list, Page: page})
+}
+
+// reportHandler stores a shopper's report of a problem with an offer.
+func reportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !reportLimiter.allow(clientIP(r)) {
+		return &appError{
+			Error:   errors.New("report rate limit exceeded"),
+			Message: "too many reports, please try again later",
+			Code:    http.StatusTooManyRequests,
+		}
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" || len(reason) > maxReportLength {
+		return &appError{
+			Error:   fmt.Errorf("invalid report reason of length %d", len(reason)),
+			Message: fmt.Sprintf("please describe the problem in at most %d characters", maxReportLength),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	id := mux.Vars(r)["offer_id"]
+	exists, err := offers.DB.OfferExists(r.Context(), id)
+	if err != nil {
+		return appErrorf(err, "could not find offer: %v", err)
+	}
+	if !exists {
+		return &appError{
+			Error:   fmt.Errorf("report for unknown offer %s", id),
+			Message: "could not find offer",
+			Code:    http.StatusNotFound,
+		}
+	}
+	if err := offers.DB.AddReport(r.Context(), id, reason); err != nil {
+		return appErrorf(err, "could not save report: %v", err)
+	}
+	return reportTmpl.Execute(w, r, id)
+}
+
+// reviewHandler stores a shopper's review of an offer and returns to the
+// offer's page.
+func reviewHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !reviewLimiter.allow(clientIP(r)) {
+		return &appError{
+			Error:   errors.New("review rate limit exceeded"),
+			Message: "too many reviews, please try again later",
+			Code:    http.StatusTooManyRequests,
+		}
+	}
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if err != nil || rating < offers.MinRating || rating > offers.MaxRating {
+		return &appError{
+			Error:   fmt.Errorf("invalid rating %q", r.FormValue("rating")),
+			Message: fmt.Sprintf("please rate the offer from %d to %d stars", offers.MinRating, offers.MaxRating),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	text := strings.TrimSpace(r.FormValue("text"))
+	if len(text) > maxReviewLength {
+		return &appError{
+			Error:   fmt.Errorf("invalid review text of length %d", len(text)),
+			Message: fmt.Sprintf("please keep your review to at most %d characters", maxReviewLength),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	id := mux.Vars(r)["offer_id"]
+	exists, err := offers.DB.OfferExists(r.Context(), id)
 	if err != nil {
-		return appErrorf(err, "%v", err)
+		return appErrorf(err, "could not find offer: %v", err)
 	}
-	return detailTmpl.Execute(w, r, offer)
+	if !exists {
+		return &appError{
+			Error:   fmt.Errorf("review of unknown offer %s", id),
+			Message: "could not find offer",
+			Code:    http.StatusNotFound,
+		}
+	}
+	if err := offers.DB.AddReview(r.Context(), id, rating, text); err != nil {
+		return appErrorf(err, "could not save review: %v", err)
+	}
+	http.Redirect(w, r, "/offers/"+url.PathEscape(id), http.StatusSeeOther)
+	return nil
+}
+
+// addAlertHandler stores a shopper's request to be told when an offer's price
+// drops to a target.
+func addAlertHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !alertLimiter.allow(clientIP(r)) {
+		return &appError{
+			Error:   errors.New("price alert rate limit exceeded"),
+			Message: "too many price alerts, please try again later",
+			Code:    http.StatusTooManyRequests,
+		}
+	}
+	target, err := strconv.ParseFloat(r.FormValue("target"), 64)
+	if err != nil || target <= 0 {
+		return &appError{
+			Error:   fmt.Errorf("invalid target price %q", r.FormValue("target")),
+			Message: "please enter the price you want to be told about",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	contact, err := mail.ParseAddress(r.FormValue("contact"))
+	if err != nil || len(contact.Address) > maxContactLength {
+		return &appError{
+			Error:   fmt.Errorf("invalid price alert contact: %v", err),
+			Message: "please enter a valid email address",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	id := mux.Vars(r)["offer_id"]
+	exists, err := offers.DB.OfferExists(r.Context(), id)
+	if err != nil {
+		return appErrorf(err, "could not find offer: %v", err)
+	}
+	if !exists {
+		return &appError{
+			Error:   fmt.Errorf("price alert for unknown offer %s", id),
+			Message: "could not find offer",
+			Code:    http.StatusNotFound,
+		}
+	}
+	if _, err := offers.DB.AddPriceAlert(r.Context(), id, strconv.FormatFloat(target, 'f', 2, 64), contact.Address); err != nil {
+		return appErrorf(err, "could not save price alert: %v", err)
+	}
+	return alertTmpl.Execute(w, r, id)
+}
+
+// alertsHandler lists the most recent price alerts.
+func alertsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	alerts, err := offers.DB.ListPriceAlerts(r.Context(), alertsLimit)
+	if err != nil {
+		return appErrorf(err, "could not list price alerts: %v", err)
+	}
+	return alertsTmpl.Execute(w, r, alerts)
+}
+
+// deleteAlertHandler deletes a price alert and returns to the alerts page.
+func deleteAlertHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(mux.Vars(r)["alert_id"], 10, 64)
+	if err != nil {
+		return &appError{Error: err, Message: "invalid price alert ID", Code: http.StatusBadRequest}
+	}
+	if err := offers.DB.DeletePriceAlert(r.Context(), id); err != nil {
+		return appErrorf(err, "could not delete price alert: %v", err)
+	}
+	http.Redirect(w, r, "/admin/alerts", http.StatusSeeOther)
+	return nil
+}
+
+// reportsHandler lists the most recent offer reports.
+func reportsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	reports, err := offers.DB.ListReports(r.Context(), reportsLimit)
+	if err != nil {
+		return appErrorf(err, "could not list reports: %v", err)
+	}
+	return reportsTmpl.Execute(w, r, reports)
+}
+
+// setMetaHandler stores the submitted meta title and description of an
+// offer, which override the generated ones. Empty values remove the
+// overrides.
+func setMetaHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id := mux.Vars(r)["offer_id"]
+	exists, err := offers.DB.OfferExists(r.Context(), id)
+	if err != nil {
+		return appErrorf(err, "could not look up offer: %v", err)
+	}
+	if !exists {
+		return &appError{
+			Error:   fmt.Errorf("meta for unknown offer %s", id),
+			Message: "could not find offer",
+			Code:    http.StatusNotFound,
+		}
+	}
+	title := strings.TrimSpace(r.FormValue("meta_title"))
+	description := strings.TrimSpace(r.FormValue("meta_description"))
+	if err := offers.DB.SetMetaOverrides(r.Context(), id, title, description); err != nil {
+		return appErrorf(err, "could not set meta overrides: %v", err)
+	}
+	http.Redirect(w, r, "/offers/"+url.PathEscape(id), http.StatusSeeOther)
+	return nil
+}
+
+// deleteOfferHandler deletes an offer, such as one a merchant has removed.
+// Offers still in Merchant Center are added back by the next sync.
+func deleteOfferHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id := mux.Vars(r)["offer_id"]
+	err := offers.DB.DeleteOffer(r.Context(), id)
+	if err == offers.ErrOfferNotFound {
+		return &appError{
+			Error:   fmt.Errorf("delete of unknown offer %s", id),
+			Message: "could not find offer",
+			Code:    http.StatusNotFound,
+		}
+	}
+	if err != nil {
+		return appErrorf(err, "could not delete offer: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// featuredHandler displays a form for editing the featured offers.
+func featuredHandler(w http.ResponseWriter, r *http.Request) *appError {
+	featured, err := offers.DB.GetFeaturedOffers(r.Context())
+	if err != nil {
+		return appErrorf(err, "could not list featured offers: %v", err)
+	}
+	return featuredTmpl.Execute(w, r, featured)
+}
+
+// setFeaturedHandler replaces the featured offers with the submitted IDs. An
+// ID submitted more than once is featured at its first position. Nothing is
+// changed if any ID isn't an offer's.
+func setFeaturedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ids := strings.Fields(r.FormValue("ids"))
+	found, err := offers.DB.GetOffersByIDs(r.Context(), ids)
+	if err != nil {
+		return appErrorf(err, "could not look up featured offers: %v", err)
+	}
+	exists := map[string]bool{}
+	for _, o := range found {
+		exists[o.ID] = true
+	}
+	var missing []string
+	for _, id := range ids {
+		if !exists[id] {
+			missing = append(missing, id)
+			// Report a repeated ID once.
+			exists[id] = true
+		}
+	}
+	if len(missing) > 0 {
+		err := fmt.Errorf("no offers with IDs %s", strings.Join(missing, ", "))
+		return appErrorfCode(err, http.StatusBadRequest, "could not feature offers: %v", err)
+	}
+	if err := offers.DB.SetFeatured(r.Context(), ids); err != nil {
+		return appErrorf(err, "could not set featured offers: %v", err)
+	}
+	http.Redirect(w, r, "/admin/featured", http.StatusSeeOther)
+	return nil
+}
+
+// recomputePricesHandler recomputes the converted price of every offer, e.g.
+// after the exchange rates change. The currency form value overrides the
+// configured display currency.
+func recomputePricesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if converter == nil {
+		return &appError{
+			Error:   errors.New("currency rates not configured"),
+			Message: "currency conversion is not configured",
+			Code:    http.StatusServiceUnavailable,
+		}
+	}
+	currency := displayCurrency
+	if v := r.FormValue("currency"); v != "" {
+		currency = strings.ToUpper(v)
+	}
+	n, err := offers.DB.RecomputeConvertedPrices(r.Context(), converter, currency)
+	if err != nil {
+		return appErrorf(err, "could not recompute prices: %v", err)
+	}
+	fmt.Fprintf(w, "updated %d converted prices to %s", n, currency)
+	return nil
+}
+
+// duplicatesHandler detects and links duplicate offers, listing the groups
+// found.
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	groups, err := offers.DetectDuplicates(r.Context())
+	if err != nil {
+		return appErrorf(err, "could not detect duplicates: %v", err)
+	}
+	fmt.Fprintf(w, "found %d groups of duplicate offers\n", len(groups))
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s: %s\n", g.CanonicalID, strings.Join(g.OfferIDs, ", "))
+	}
+	return nil
+}
+
+// comparisonGroup is a group of duplicate offers on the comparison page.
+type comparisonGroup struct {
+	CanonicalID string
+	Offers      []offers.PriceComparison
+}
+
+// comparisonView is the data rendered by the comparison template.
+type comparisonView struct {
+	Currency string
+	Groups   []comparisonGroup
+}
+
+// comparisonHandler lists groups of duplicate offers with their prices
+// converted to a common currency, so admins can compare them. The currency
+// form value overrides the configured display currency.
+func comparisonHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if converter == nil {
+		return &appError{
+			Error:   errors.New("currency rates not configured"),
+			Message: "currency conversion is not configured",
+			Code:    http.StatusServiceUnavailable,
+		}
+	}
+	currency := displayCurrency
+	if v := r.FormValue("currency"); v != "" {
+		currency = strings.ToUpper(v)
+	}
+	dups, err := offers.DB.ListDuplicateOffers(r.Context(), comparisonLimit)
+	if err != nil {
+		return appErrorf(err, "could not list duplicate offers: %v", err)
+	}
+	view := comparisonView{Currency: currency}
+	for start := 0; start < len(dups); {
+		end := start + 1
+		for end < len(dups) && dups[end].CanonicalProductID == dups[start].CanonicalProductID {
+			end++
+		}
+		view.Groups = append(view.Groups, comparisonGroup{
+			CanonicalID: dups[start].CanonicalProductID,
+			Offers:      offers.ComparePrices(dups[start:end], converter, currency),
+		})
+		start = end
+	}
+	return comparisonTmpl.Execute(w, r, view)
+}
+
+// invalidateCacheHandler flushes the offer cache after out-of-band changes.
+// If the offer_id form value is set, only results containing that offer are
+// dropped.
+func invalidateCacheHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c, ok := offers.DB.(offers.CacheInvalidator)
+	if !ok {
+		fmt.Fprint(w, "cache not enabled")
+		return nil
+	}
+	if id := r.FormValue("offer_id"); id != "" {
+		c.InvalidateCache(id)
+		fmt.Fprintf(w, "invalidated cached results for offer %s", id)
+		return nil
+	}
+	c.InvalidateAll()
+	fmt.Fprint(w, "invalidated cache")
+	return nil
 }
 
-// updateHandler updates the sqlDB with the latest offers using the contentAPI.
-func updateHandler(w http.ResponseWriter, r *http.Request) *appError {
-	id, err := strconv.ParseInt(mustGetenv(merchantIDEnv), 10, 64)
+// pruneViewsHandler deletes recorded views that are too old to affect
+// trending offers.
+func pruneViewsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := offers.DB.PruneViews(r.Context(), time.Now().Add(-viewRetention))
 	if err != nil {
-		return appErrorf(err, "error while parsing merchant id")
+		return appErrorf(err, "could not prune views: %v", err)
+	}
+	fmt.Fprintf(w, "pruned %d views", n)
+	return nil
+}
+
+// readyHandler responds with 503 Service Unavailable unless the offers
+// database can serve queries.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := offers.DB.Check(ctx); err != nil {
+		log.Printf("not ready: %v", err)
+		// The error itself is only logged, since it may describe the
+		// database's address or credentials.
+		http.Error(w, "database unavailable: queries are failing", http.StatusServiceUnavailable)
+		return
 	}
-	// TODO(asheem): Set log file path.
-	offers.RunUpdate(id, "")
-	return updateSuccessTmpl.Execute(w, r, nil)
+	w.Write([]byte("ok"))
+}
+
+// pruneReservationsHandler deletes expired reservations.
+func pruneReservationsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := offers.DB.PruneReservations(r.Context())
+	if err != nil {
+		return appErrorf(err, "could not prune reservations: %v", err)
+	}
+	fmt.Fprintf(w, "pruned %d reservations", n)
+	return nil
+}
+
+// purgeDeletedHandler removes the offers soft-deleted more than
+// deletedRetention ago.
+func purgeDeletedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := offers.DB.PurgeDeleted(r.Context(), time.Now().Add(-deletedRetention))
+	if err != nil {
+		return appErrorf(err, "could not purge deleted offers: %v", err)
+	}
+	fmt.Fprintf(w, "purged %d deleted offers", n)
+	return nil
 }
 
 // http://blog.golang.org/error-handling-and-go
@@ -161,11 +1688,18 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// appErrorf returns a 500 Internal Server Error with the formatted message.
 func appErrorf(err error, format string, v ...interface{}) *appError {
+	return appErrorfCode(err, http.StatusInternalServerError, format, v...)
+}
+
+// appErrorfCode is like appErrorf, but with the given status code, for
+// errors caused by the request rather than the server.
+func appErrorfCode(err error, code int, format string, v ...interface{}) *appError {
 	return &appError{
 		Error:   err,
 		Message: fmt.Sprintf(format, v...),
-		Code:    500,
+		Code:    code,
 	}
 }
 
@@ -176,4 +1710,3 @@ func mustGetenv(k string) string {
 	}
 	return v
 }
-
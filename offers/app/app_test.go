@@ -0,0 +1,1715 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"offers"
+	"offers/offerstest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	parseTemplates()
+	configureUpdateLimit()
+	os.Exit(m.Run())
+}
+
+// testOffer returns a valid offer with the given ID, title and price.
+func testOffer(id, title, price string) *offers.Offer {
+	return &offers.Offer{
+		ID:          id,
+		Title:       title,
+		Price:       price,
+		Currency:    "USD",
+		ImageURL:    "https://example.com/images/" + id + ".png",
+		MerchantURL: "https://example.com/products/" + id,
+	}
+}
+
+// newTestDB returns an in-memory database holding the offers.
+func newTestDB(t *testing.T, list ...*offers.Offer) offers.OfferDatabase {
+	t.Helper()
+	db := offers.NewMemoryDB()
+	for _, o := range list {
+		if _, err := db.AddOffer(context.Background(), o); err != nil {
+			t.Fatalf("AddOffer(%s): %v", o.ID, err)
+		}
+	}
+	return db
+}
+
+// serveRequest serves the request with the app's router, using db as the
+// serving and sync databases.
+func serveRequest(t *testing.T, db offers.OfferDatabase, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	offers.DB, offers.SyncDB = db, db
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// get serves a GET request for the target.
+func get(t *testing.T, db offers.OfferDatabase, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveRequest(t, db, httptest.NewRequest("GET", target, nil))
+}
+
+// postForm serves a POST request for the target with the form values.
+func postForm(t *testing.T, db offers.OfferDatabase, target string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveRequest(t, db, r)
+}
+
+// offerIDs returns the IDs of the offers, in order.
+func offerIDs(list []*offers.Offer) []string {
+	ids := []string{}
+	for _, o := range list {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+func TestSetFeaturedHandler(t *testing.T) {
+	db := newTestDB(t,
+		testOffer("a", "A", "1.00"),
+		testOffer("b", "B", "1.00"),
+		testOffer("c", "C", "1.00"))
+	featured := func() []string {
+		list, err := db.GetFeaturedOffers(context.Background())
+		if err != nil {
+			t.Fatalf("GetFeaturedOffers: %v", err)
+		}
+		return offerIDs(list)
+	}
+
+	w := postForm(t, db, "/admin/featured", url.Values{"ids": {"c a c\nb a"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST with repeated IDs: status %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	if got, want := featured(), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("featured offers = %q, want %q", got, want)
+	}
+
+	w = postForm(t, db, "/admin/featured", url.Values{"ids": {"b missing a missing"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST with an unknown ID: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "no offers with IDs missing\n") {
+		t.Errorf("POST with an unknown ID: body %q doesn't name it once", body)
+	}
+	if got, want := featured(), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("featured offers after a rejected update = %q, want %q", got, want)
+	}
+
+	if w := get(t, db, "/admin/featured"); w.Code != http.StatusOK {
+		t.Errorf("GET /admin/featured: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestSlugPages(t *testing.T) {
+	db := newTestDB(t, testOffer("online:en:US:123", "Garden Chair", "10.00"))
+	w := get(t, db, "/p/garden-chair")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Garden Chair") {
+		t.Fatalf("GET /p/garden-chair: status %d, want the offer", w.Code)
+	}
+	w = get(t, db, "/offers/online:en:US:123")
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/p/garden-chair" {
+		t.Errorf("GET /offers/online:en:US:123: status %d to %q, want a 301 to /p/garden-chair", w.Code, w.Header().Get("Location"))
+	}
+	if w := get(t, db, "/p/sofa"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /p/sofa: status %d, want 404", w.Code)
+	}
+}
+
+func TestDetailVariants(t *testing.T) {
+	variant := func(id, title, group string) *offers.Offer {
+		o := testOffer(id, title, "10.00")
+		o.ItemGroupID = group
+		return o
+	}
+	db := newTestDB(t,
+		variant("shirt-s", "Small shirt", "shirt"),
+		variant("shirt-l", "Large shirt", "shirt"),
+		variant("mug", "Mug", "mug"),
+		variant("hat", "Hat", ""))
+
+	// page serves the detail page of the offer, at its slug URL.
+	page := func(id string) string {
+		t.Helper()
+		o, err := db.GetOffer(context.Background(), id)
+		if err != nil {
+			t.Fatalf("GetOffer(%s): %v", id, err)
+		}
+		w := get(t, db, o.URL())
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, want %d", o.URL(), w.Code, http.StatusOK)
+		}
+		return w.Body.String()
+	}
+	large, err := db.GetOffer(context.Background(), "shirt-l")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := page("shirt-s")
+	if !strings.Contains(body, "Available variants") {
+		t.Fatalf("detail page of a variant doesn't list variants:\n%s", body)
+	}
+	// The other variants are linked; the offer itself isn't.
+	if !strings.Contains(body, `<a href="`+large.URL()+`">Large shirt</a>`) {
+		t.Errorf("detail page doesn't link the other variant:\n%s", body)
+	}
+	if !strings.Contains(body, "<li>Small shirt &ndash;") {
+		t.Errorf("detail page links the offer as its own variant:\n%s", body)
+	}
+
+	// An offer alone in its group, or without one, has no other variants
+	// to list.
+	for _, id := range []string{"mug", "hat"} {
+		if strings.Contains(page(id), "Available variants") {
+			t.Errorf("detail page of %s lists variants", id)
+		}
+	}
+}
+
+func TestRootRedirect(t *testing.T) {
+	for _, tt := range []struct {
+		target, status string
+		wantCode       int
+		wantLocation   string
+	}{
+		{"", "", http.StatusFound, "/offers"},
+		{"/fr/offres", "", http.StatusFound, "/fr/offres"},
+		{"/offers?sort=price", "301", http.StatusMovedPermanently, "/offers?sort=price"},
+		{"", "308", http.StatusPermanentRedirect, "/offers"},
+	} {
+		t.Setenv(rootEnv, tt.target)
+		t.Setenv(rootStatusEnv, tt.status)
+		w := get(t, newTestDB(t), "/")
+		if w.Code != tt.wantCode {
+			t.Errorf("%s=%q %s=%q: status %d, want %d", rootEnv, tt.target, rootStatusEnv, tt.status, w.Code, tt.wantCode)
+		}
+		if got := w.Header().Get("Location"); got != tt.wantLocation {
+			t.Errorf("%s=%q %s=%q: Location %q, want %q", rootEnv, tt.target, rootStatusEnv, tt.status, got, tt.wantLocation)
+		}
+	}
+}
+
+func TestRootServesList(t *testing.T) {
+	t.Setenv(rootEnv, "list")
+	w := get(t, newTestDB(t, testOffer("a", "Garden chair", "10.00")), "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if loc := w.Header().Get("Location"); loc != "" {
+		t.Errorf("GET / redirected to %q", loc)
+	}
+	if !strings.Contains(w.Body.String(), "Garden chair") {
+		t.Errorf("GET / doesn't list the offers:\n%s", w.Body)
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	saved := reportLimiter
+	defer func() { reportLimiter = saved }()
+	reportLimiter = newWindowLimiter(2, time.Hour)
+
+	db := newTestDB(t, testOffer("a", "A", "1.00"))
+	report := func(id, reason, ip string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/offers/"+id+"/report", strings.NewReader(url.Values{"reason": {reason}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = ip + ":1234"
+		return serveRequest(t, db, r)
+	}
+	reports := func() []*offers.OfferReport {
+		t.Helper()
+		list, err := db.ListReports(context.Background(), 10)
+		if err != nil {
+			t.Fatalf("ListReports: %v", err)
+		}
+		return list
+	}
+
+	if w := report("a", "  wrong price ", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatalf("report: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if list := reports(); len(list) != 1 || list[0].OfferID != "a" || list[0].Reason != "wrong price" {
+		t.Fatalf("reports after submitting one = %+v", list)
+	}
+
+	if w := report("missing", "wrong price", "192.0.2.1"); w.Code != http.StatusNotFound {
+		t.Errorf("report for a missing offer: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	for i, reason := range []string{"", "   ", strings.Repeat("x", maxReportLength+1)} {
+		if w := report("a", reason, "198.51.100."+strconv.Itoa(i)); w.Code != http.StatusBadRequest {
+			t.Errorf("report with a reason of length %d: status %d, want %d", len(reason), w.Code, http.StatusBadRequest)
+		}
+	}
+	if n := len(reports()); n != 1 {
+		t.Errorf("%d reports stored after rejected ones, want 1", n)
+	}
+
+	// The first client has used up its limit; others haven't.
+	if w := report("a", "still wrong", "192.0.2.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("report over the limit: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := report("a", "blurry image", "192.0.2.3"); w.Code != http.StatusOK {
+		t.Errorf("report from another client: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w := get(t, db, "/admin/reports")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /admin/reports: status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "wrong price") || !strings.Contains(body, "blurry image") {
+		t.Errorf("admin listing doesn't show the reports:\n%s", body)
+	}
+	if i, j := strings.Index(body, "blurry image"), strings.Index(body, "wrong price"); i > j {
+		t.Errorf("admin listing isn't newest first:\n%s", body)
+	}
+}
+
+func TestReportsHandlerEmpty(t *testing.T) {
+	w := get(t, newTestDB(t), "/admin/reports")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /admin/reports: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), "No issues have been reported.") {
+		t.Errorf("empty admin listing:\n%s", w.Body)
+	}
+}
+
+// syncOffers replaces the offers in db as a sync would, deleting those not
+// listed.
+func syncOffers(t *testing.T, db offers.OfferDatabase, list ...*offers.Offer) {
+	t.Helper()
+	err := db.WithTx(context.Background(), func(tx offers.SyncWriter) error {
+		if err := tx.UpdateUpdated(context.Background()); err != nil {
+			return err
+		}
+		if _, err := tx.BulkUpsertOffers(context.Background(), list); err != nil {
+			return err
+		}
+		_, err := tx.DeleteOffers(context.Background())
+		return err
+	})
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+}
+
+func TestListETag(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "20.00"))
+	// list gets the list page, revalidating etag if it is set.
+	list := func(target, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", target, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		return serveRequest(t, db, r)
+	}
+
+	w := list("/offers", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET /offers: status %d with ETag %q, want %d with an ETag", w.Code, etag, http.StatusOK)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, no-cache" {
+		t.Errorf("Cache-Control = %q, want revalidation", cc)
+	}
+	if !strings.Contains(w.Body.String(), "Chair") {
+		t.Errorf("list page doesn't list the offers:\n%s", w.Body)
+	}
+
+	w = list("/offers", etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("GET /offers matching the ETag: status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("304 response has a body: %q", w.Body)
+	}
+	if w := list("/offers", `W/`+etag+`, "other"`); w.Code != http.StatusNotModified {
+		t.Errorf("GET /offers with a weak match among others: status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if w := list("/offers", `"other"`); w.Code != http.StatusOK {
+		t.Errorf("GET /offers with another ETag: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := list("/offers?page=2&per_page=1", etag); w.Code != http.StatusOK {
+		t.Errorf("GET another page with the first page's ETag: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// changed fails the test unless the list page's ETag changed as want
+	// says, and makes the new ETag current.
+	changed := func(name string, want bool) {
+		t.Helper()
+		w := list("/offers", etag)
+		if got := w.Code == http.StatusOK; got != want {
+			t.Errorf("%s: status %d, want the ETag changed %t", name, w.Code, want)
+		}
+		if got := w.Header().Get("ETag"); got != "" {
+			etag = got
+		}
+	}
+
+	syncOffers(t, db, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "20.00"))
+	changed("identical sync", false)
+	syncOffers(t, db, testOffer("a", "Chair", "12.00"), testOffer("b", "Table", "20.00"))
+	changed("sync changing a price", true)
+	syncOffers(t, db, testOffer("a", "Chair", "12.00"))
+	changed("sync deleting an offer", true)
+
+	if err := db.SetMetaOverrides(context.Background(), "a", "Best chair", ""); err != nil {
+		t.Fatal(err)
+	}
+	changed("meta overrides", true)
+	if err := db.SetFeatured(context.Background(), []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	changed("featured offers", true)
+
+	saved, savedCurrency := converter, displayCurrency
+	defer func() { converter, displayCurrency = saved, savedCurrency }()
+	converter, displayCurrency = offers.StaticRates{"USD": 1, "EUR": 0.9}, "USD"
+	changed("conversion configured", true)
+	changed("same rates", false)
+	converter = offers.StaticRates{"USD": 1, "EUR": 0.8}
+	changed("rates changed", true)
+	if w := list("/offers?currency=EUR", etag); w.Code != http.StatusOK {
+		t.Errorf("GET /offers in another currency: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRecomputePricesHandler(t *testing.T) {
+	eur := testOffer("eur", "Lamp", "9.00")
+	eur.Currency = "EUR"
+	db := newTestDB(t, testOffer("usd", "Chair", "10.00"), eur)
+
+	saved, savedCurrency := converter, displayCurrency
+	defer func() { converter, displayCurrency = saved, savedCurrency }()
+	converter, displayCurrency = nil, ""
+	if w := postForm(t, db, "/admin/recompute_prices", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST without rates: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	converter, displayCurrency = offers.StaticRates{"USD": 1, "EUR": 0.9}, "USD"
+	w := postForm(t, db, "/admin/recompute_prices", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "updated 2 converted prices to USD" {
+		t.Fatalf("POST: status %d, body %q", w.Code, w.Body)
+	}
+	o, err := db.GetOffer(context.Background(), "eur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ConvertedPrice != "10.00" || o.ConvertedCurrency != "USD" {
+		t.Errorf("converted price = %q %s, want 10.00 USD", o.ConvertedPrice, o.ConvertedCurrency)
+	}
+
+	// After a rate change, only the offers in the changed currency are
+	// written.
+	converter = offers.StaticRates{"USD": 1, "EUR": 0.8}
+	if w := postForm(t, db, "/admin/recompute_prices", nil); w.Body.String() != "updated 1 converted prices to USD" {
+		t.Errorf("POST after a rate change: body %q", w.Body)
+	}
+	if w := postForm(t, db, "/admin/recompute_prices", url.Values{"currency": {"eur"}}); w.Body.String() != "updated 2 converted prices to EUR" {
+		t.Errorf("POST for another currency: body %q", w.Body)
+	}
+}
+
+func TestInvalidateCacheHandler(t *testing.T) {
+	if w := postForm(t, newTestDB(t), "/admin/cache/invalidate", nil); w.Body.String() != "cache not enabled" {
+		t.Errorf("POST without a cache: body %q", w.Body)
+	}
+
+	inner := newTestDB(t, testOffer("a", "Chair", "10.00"))
+	db := offers.NewCachedDB(inner, offers.CacheOptions{})
+	defer db.Close()
+	title := func() string {
+		t.Helper()
+		o, err := db.GetOffer(context.Background(), "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o.Title
+	}
+	title()
+	// A change made directly to the database isn't seen through the cache
+	// until it is invalidated.
+	if err := inner.UpdateOfferFields(context.Background(), "a", map[string]interface{}{"title": "Armchair"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := title(); got != "Chair" {
+		t.Fatalf("cached title = %q before invalidating, want the cached one", got)
+	}
+
+	w := postForm(t, db, "/admin/cache/invalidate", url.Values{"offer_id": {"a"}})
+	if w.Code != http.StatusOK || w.Body.String() != "invalidated cached results for offer a" {
+		t.Errorf("POST for an offer: status %d, body %q", w.Code, w.Body)
+	}
+	if got := title(); got != "Armchair" {
+		t.Errorf("title = %q after invalidating the offer, want %q", got, "Armchair")
+	}
+
+	if err := inner.UpdateOfferFields(context.Background(), "a", map[string]interface{}{"title": "Stool"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := postForm(t, db, "/admin/cache/invalidate", nil); w.Body.String() != "invalidated cache" {
+		t.Errorf("POST for all: body %q", w.Body)
+	}
+	if got := title(); got != "Stool" {
+		t.Errorf("title = %q after invalidating all, want %q", got, "Stool")
+	}
+}
+
+func TestListExcludesUnpurchasable(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"), testOffer("b", "Kitchen table", "20.00"))
+	noLink := testOffer("c", "Linkless lamp", "5.00")
+	noLink.MerchantURL = ""
+	syncOffers(t, db, testOffer("a", "Garden chair", "10.00"), testOffer("b", "Kitchen table", "20.00"), noLink)
+
+	body := get(t, db, "/offers").Body.String()
+	if !strings.Contains(body, "Garden chair") || !strings.Contains(body, "Kitchen table") {
+		t.Errorf("storefront list doesn't list purchasable offers:\n%s", body)
+	}
+	if strings.Contains(body, "Linkless lamp") {
+		t.Errorf("storefront list includes an offer without a link:\n%s", body)
+	}
+
+	w := get(t, db, "/admin/offers")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /admin/offers: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Linkless lamp") || !strings.Contains(body, "Garden chair") {
+		t.Errorf("admin list doesn't include all offers:\n%s", body)
+	}
+}
+
+func TestHandlersUseServingDB(t *testing.T) {
+	serving := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	syncDB := &offerstest.MockDB{}
+	savedDB, savedSyncDB := offers.DB, offers.SyncDB
+	defer func() { offers.DB, offers.SyncDB = savedDB, savedSyncDB }()
+	offers.DB, offers.SyncDB = serving, syncDB
+
+	for _, target := range []string{"/offers", "/search?q=chair", "/p/garden-chair", "/api/v1/offers/a"} {
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Garden chair") {
+			t.Errorf("GET %s: status %d, want the offer from the serving database", target, w.Code)
+		}
+	}
+	if calls := syncDB.Calls(); len(calls) != 0 {
+		t.Errorf("handlers called the sync database: %v", calls)
+	}
+}
+
+func TestDetailMeta(t *testing.T) {
+	o := testOffer("a", "Garden chair", "10.00")
+	o.Description = "<p>A sturdy chair.</p>"
+	db := newTestDB(t, o)
+
+	body := get(t, db, "/p/garden-chair").Body.String()
+	for _, want := range []string{
+		"<title>Garden chair - 10.00 USD</title>",
+		`<meta name="description" content="A sturdy chair.">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("detail page doesn't include %q:\n%s", want, body)
+		}
+	}
+
+	w := postForm(t, db, "/admin/offers/a/meta", url.Values{"meta_title": {" Best chair "}, "meta_description": {"Buy it now."}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST meta: status %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	body = get(t, db, "/p/garden-chair").Body.String()
+	for _, want := range []string{
+		"<title>Best chair</title>",
+		`<meta name="description" content="Buy it now.">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("detail page doesn't include the override %q:\n%s", want, body)
+		}
+	}
+
+	if w := postForm(t, db, "/admin/offers/missing/meta", url.Values{"meta_title": {"x"}}); w.Code != http.StatusNotFound {
+		t.Errorf("POST meta for a missing offer: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	db := &offerstest.MockDB{}
+	var hasDeadline bool
+	var checkErr error
+	db.CheckFunc = func(ctx context.Context) error {
+		_, hasDeadline = ctx.Deadline()
+		return checkErr
+	}
+
+	w := get(t, db, "/readyz")
+	if w.Code != http.StatusOK {
+		t.Errorf("healthy: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if !hasDeadline {
+		t.Error("check ran without a timeout")
+	}
+
+	// The database answers pings, but its prepared statements fail.
+	checkErr = errors.New("mysql: check query failed: Error 1243: Unknown prepared statement handler")
+	for _, target := range []string{"/readyz", "/_ah/health"} {
+		w := get(t, db, target)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("GET %s with failing queries: status %d, want %d", target, w.Code, http.StatusServiceUnavailable)
+		}
+		if strings.Contains(w.Body.String(), "1243") {
+			t.Errorf("GET %s: body %q includes the database error", target, w.Body)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var checkErr error
+	db := &offerstest.MockDB{CheckFunc: func(ctx context.Context) error { return checkErr }}
+
+	w := get(t, db, "/_ah/health")
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("healthy: status %d with %q, want %d with ok", w.Code, w.Body, http.StatusOK)
+	}
+
+	// The database doesn't answer pings.
+	checkErr = errors.New("mysql: could not ping: dial tcp 10.0.0.3:3306: connect: connection refused")
+	db.Reset()
+	w = get(t, db, "/_ah/health")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("database down: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "database unavailable") || strings.Contains(body, "10.0.0.3") {
+		t.Errorf("database down: body %q, want the failure described without the address", body)
+	}
+
+	// The liveness check doesn't depend on the database.
+	db.Reset()
+	w = get(t, db, "/_ah/live")
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("GET /_ah/live with the database down: status %d with %q, want %d with ok", w.Code, w.Body, http.StatusOK)
+	}
+	if calls := db.CallsTo("Check"); len(calls) != 0 {
+		t.Errorf("GET /_ah/live checked the database %d times", len(calls))
+	}
+}
+
+func TestComparisonHandler(t *testing.T) {
+	// The yen offer is the most expensive by its number, and the pound one
+	// the cheapest, but after conversion it is the other way round.
+	usd := testOffer("usd", "Garden chair", "10.00")
+	gbp := testOffer("gbp", "Garden chair (UK)", "8.00")
+	gbp.Currency = "GBP"
+	jpy := testOffer("jpy", "Garden chair (JP)", "1000")
+	jpy.Currency = "JPY"
+	chf := testOffer("chf", "Garden chair (CH)", "9.00")
+	chf.Currency = "CHF"
+	db := newTestDB(t, usd, gbp, jpy, chf, testOffer("lamp", "Lamp", "5.00"))
+	links := map[string]string{"usd": "gtin:1", "gbp": "gtin:1", "jpy": "gtin:1", "chf": "gtin:1"}
+	if err := db.SetCanonicalProducts(context.Background(), links); err != nil {
+		t.Fatal(err)
+	}
+	useRates(t, offers.StaticRates{"USD": 1, "GBP": 0.75, "JPY": 110}, "USD")
+
+	// rows returns the titles of the offers in the comparison table, with
+	// "*" after the cheapest.
+	rows := func(body string) []string {
+		var titles []string
+		for _, row := range strings.Split(body, "<tr")[2:] {
+			end := strings.Index(row, "</a>")
+			if end < 0 {
+				continue
+			}
+			title := row[strings.LastIndex(row[:end], ">")+1 : end]
+			if strings.Contains(row, `class="success"`) {
+				title += " *"
+			}
+			titles = append(titles, title)
+		}
+		return titles
+	}
+
+	w := get(t, db, "/admin/duplicates")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /admin/duplicates: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	body := w.Body.String()
+	// Offers are listed by ID. The franc price can't be converted.
+	want := []string{"Garden chair (CH)", "Garden chair (UK)", "Garden chair (JP) *", "Garden chair"}
+	if got := rows(body); !reflect.DeepEqual(got, want) {
+		t.Errorf("comparison rows = %q, want %q", got, want)
+	}
+	for _, s := range []string{"10.67 USD", "9.09 USD", "not available"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("comparison page doesn't show %q", s)
+		}
+	}
+	if strings.Contains(body, "Lamp") {
+		t.Error("comparison page lists an offer without duplicates")
+	}
+
+	// Comparing in pounds picks the same offer.
+	w = get(t, db, "/admin/duplicates?currency=gbp")
+	if got := rows(w.Body.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("comparison rows in GBP = %q, want %q", got, want)
+	}
+
+	useRates(t, nil, "")
+	if w := get(t, db, "/admin/duplicates"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /admin/duplicates without rates: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReviewHandler(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	saved := reviewLimiter
+	defer func() { reviewLimiter = saved }()
+	reviewLimiter = newWindowLimiter(maxReviewsPerHour, time.Hour)
+
+	for _, tt := range []struct {
+		target string
+		form   url.Values
+		want   int
+	}{
+		{"/offers/a/reviews", url.Values{"rating": {"5"}, "text": {"Sturdy"}}, http.StatusSeeOther},
+		{"/offers/a/reviews", url.Values{"rating": {"4"}}, http.StatusSeeOther},
+		{"/offers/a/reviews", url.Values{"rating": {"0"}}, http.StatusBadRequest},
+		{"/offers/a/reviews", url.Values{"rating": {"6"}}, http.StatusBadRequest},
+		{"/offers/a/reviews", url.Values{"rating": {"five"}}, http.StatusBadRequest},
+		{"/offers/a/reviews", url.Values{"rating": {"3"}, "text": {strings.Repeat("x", maxReviewLength+1)}}, http.StatusBadRequest},
+		{"/offers/missing/reviews", url.Values{"rating": {"3"}}, http.StatusNotFound},
+	} {
+		if w := postForm(t, db, tt.target, tt.form); w.Code != tt.want {
+			t.Errorf("POST %s %v: status %d, want %d: %s", tt.target, tt.form, w.Code, tt.want, w.Body)
+		}
+	}
+
+	reviews, err := db.GetReviews(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews) != 2 {
+		t.Errorf("stored %d reviews, want only the 2 valid ones", len(reviews))
+	}
+	const rating = "4.5 / 5 stars (2 reviews)"
+	if body := get(t, db, "/p/garden-chair").Body.String(); !strings.Contains(body, rating) || !strings.Contains(body, "Sturdy") {
+		t.Errorf("detail page doesn't show the rating %q and review", rating)
+	}
+	if body := get(t, db, "/offers").Body.String(); !strings.Contains(body, rating) {
+		t.Errorf("list page doesn't show the rating %q", rating)
+	}
+}
+
+func TestSearchNoResults(t *testing.T) {
+	w := get(t, newTestDB(t, testOffer("a", "Garden chair", "10.00")), "/search?q=zebra")
+	if w.Code != http.StatusOK {
+		t.Fatalf("search without matches: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "No offers found for &ldquo;zebra&rdquo;") {
+		t.Errorf("search without matches doesn't show the empty state:\n%s", body)
+	}
+}
+
+func TestCloseDatabasesLogsErrors(t *testing.T) {
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	savedDB, savedSyncDB := offers.DB, offers.SyncDB
+	defer func() { offers.DB, offers.SyncDB = savedDB, savedSyncDB }()
+
+	serving := &offerstest.MockDB{CloseFunc: func() error { return errors.New("connection reset") }}
+	syncDB := &offerstest.MockDB{CloseFunc: func() error { return errors.New("broken pipe") }}
+	offers.DB, offers.SyncDB = serving, syncDB
+	closeDatabases()
+	if n := len(serving.CallsTo("Close")); n != 1 {
+		t.Errorf("closed the serving database %d times, want once", n)
+	}
+	if n := len(syncDB.CallsTo("Close")); n != 1 {
+		t.Errorf("closed the sync database %d times, want once", n)
+	}
+	for _, want := range []string{"could not close database: connection reset", "could not close sync database: broken pipe"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log %q doesn't contain %q", buf.String(), want)
+		}
+	}
+
+	// A shared database is closed once.
+	buf.Reset()
+	shared := &offerstest.MockDB{}
+	offers.DB, offers.SyncDB = shared, shared
+	closeDatabases()
+	if n := len(shared.CallsTo("Close")); n != 1 {
+		t.Errorf("closed the shared database %d times, want once", n)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("closing without errors logged %q", buf.String())
+	}
+}
+
+func TestServeDrainsOnSIGTERM(t *testing.T) {
+	savedDB, savedSyncDB := offers.DB, offers.SyncDB
+	defer func() { offers.DB, offers.SyncDB = savedDB, savedSyncDB }()
+	db := &offerstest.MockDB{}
+	offers.DB, offers.SyncDB = db, db
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- serveUntilSignal(ln, handler) }()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+	<-started
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	// Once shutting down, the server stops accepting connections.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepts connections after SIGTERM")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("server returned %v with a request in flight", err)
+	default:
+	}
+	if n := len(db.CallsTo("Close")); n != 0 {
+		t.Errorf("database closed %d times with a request in flight", n)
+	}
+
+	// The in-flight request completes before the server returns.
+	close(release)
+	select {
+	case resp := <-responses:
+		if resp.err != nil || resp.body != "done" {
+			t.Errorf("in-flight request = %q, %v; want it to complete", resp.body, resp.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request didn't complete")
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serveUntilSignal = %v, want nil after SIGTERM", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't stop after draining")
+	}
+	if n := len(db.CallsTo("Close")); n != 1 {
+		t.Errorf("database closed %d times, want once", n)
+	}
+}
+
+func TestSearchPriceRange(t *testing.T) {
+	euro := testOffer("euro", "Garden lamp", "15.00")
+	euro.Currency = "EUR"
+	db := newTestDB(t,
+		testOffer("cheap", "Garden chair", "10.00"),
+		testOffer("mid", "Garden table", "20.00"),
+		testOffer("dear", "Garden shed", "300.00"),
+		euro)
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"min_price=10&max_price=20", []string{"Garden chair", "Garden table", "Garden lamp"}},
+		{"min_price=20", []string{"Garden table", "Garden shed"}},
+		{"max_price=15", []string{"Garden chair", "Garden lamp"}},
+		{"max_price=15&currency=USD", []string{"Garden chair"}},
+		{"min_price=10&currency=GBP", nil},
+	} {
+		w := get(t, db, "/search?q=garden&"+tt.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("search with %s: status %d, want %d", tt.query, w.Code, http.StatusOK)
+			continue
+		}
+		body := w.Body.String()
+		for _, title := range []string{"Garden chair", "Garden table", "Garden shed", "Garden lamp"} {
+			want := false
+			for _, t := range tt.want {
+				want = want || t == title
+			}
+			if got := strings.Contains(body, title); got != want {
+				t.Errorf("search with %s lists %q: %v, want %v", tt.query, title, got, want)
+			}
+		}
+	}
+
+	for _, query := range []string{"min_price=cheap", "max_price=-1", "min_price=20&max_price=10", "max_price=NaN"} {
+		if w := get(t, db, "/search?q=garden&"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("search with %s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSearchSort(t *testing.T) {
+	db := newTestDB(t,
+		testOffer("a", "Garden table", "50.00"),
+		testOffer("b", "Garden chair", "5.00"),
+		testOffer("c", "Chair for the garden", "20.00"))
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Garden chair", "Garden table", "Chair for the garden"}},
+		{"&sort=relevance", []string{"Garden chair", "Garden table", "Chair for the garden"}},
+		{"&sort=title", []string{"Chair for the garden", "Garden chair", "Garden table"}},
+		{"&sort=price", []string{"Garden chair", "Chair for the garden", "Garden table"}},
+	} {
+		w := get(t, db, "/search?q=garden"+tt.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("search with %q: status %d", tt.query, w.Code)
+			continue
+		}
+		body, last := w.Body.String(), -1
+		for _, title := range tt.want {
+			i := strings.Index(body, title)
+			if i <= last {
+				t.Errorf("search with %q lists %q out of order, want %q", tt.query, title, tt.want)
+				break
+			}
+			last = i
+		}
+	}
+
+	for _, sort := range []string{"added", "price_desc", "Title"} {
+		w := get(t, db, "/search?q=garden&sort="+sort)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "price_asc") {
+			t.Errorf("search with sort=%s: status %d, want %d listing the valid orders:\n%s", sort, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+}
+
+func TestSearchSortPriceAscending(t *testing.T) {
+	db := newTestDB(t,
+		testOffer("a", "Garden table", "50.00"),
+		testOffer("b", "Garden chair", "5.00"),
+		testOffer("c", "Chair for the garden", "20.00"),
+		testOffer("d", "Garden bench", "120.00"))
+	var searched []offers.SortOrder
+	mock := &offerstest.MockDB{
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			searched = append(searched, order)
+			return db.SearchOffers(ctx, q, order, limit)
+		},
+		CountSearchOffersFunc: db.CountSearchOffers,
+	}
+
+	w := get(t, mock, "/search?q=garden&sort=price_asc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("search with sort=price_asc: status %d", w.Code)
+	}
+	if len(searched) != 1 || searched[0] != offers.SortByPrice {
+		t.Errorf("search with sort=price_asc searched in orders %q, want %q", searched, offers.SortByPrice)
+	}
+	// By price, from 5.00 to 120.00.
+	want := []string{"Garden chair", "Chair for the garden", "Garden table", "Garden bench"}
+	body, last := w.Body.String(), -1
+	for _, title := range want {
+		i := strings.Index(body, title)
+		if i <= last {
+			t.Fatalf("search with sort=price_asc lists %q out of order, want %q", title, want)
+		}
+		last = i
+	}
+}
+
+func TestCategoryHandler(t *testing.T) {
+	chair := testOffer("chair", "Garden chair", "10.00")
+	chair.Category = "Furniture"
+	table := testOffer("table", "Garden table", "50.00")
+	table.Category = "Furniture"
+	db := newTestDB(t, chair, table, testOffer("gnome", "Garden gnome", "5.00"))
+
+	w := get(t, db, "/offers/category/Furniture")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /offers/category/Furniture: status %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "Category: Furniture") || !strings.Contains(body, "Garden chair") || !strings.Contains(body, "Garden table") || strings.Contains(body, "Garden gnome") {
+		t.Errorf("category page doesn't list just the chair and table:\n%s", body)
+	}
+
+	// The first page of one offer links to the next, which doesn't.
+	body = html.UnescapeString(get(t, db, "/offers/category/Furniture?per_page=1").Body.String())
+	if !strings.Contains(body, "Garden chair") || strings.Contains(body, "Garden table") || !strings.Contains(body, `<a href="?page=2&per_page=1">Next</a>`) {
+		t.Errorf("first page of one offer doesn't list the chair and link to page 2")
+	}
+	body = get(t, db, "/offers/category/Furniture?per_page=1&page=2").Body.String()
+	if !strings.Contains(body, "Garden table") || strings.Contains(body, ">Next<") {
+		t.Errorf("second page of one offer doesn't list just the table")
+	}
+
+	body = get(t, db, "/offers/category/"+offers.Uncategorized).Body.String()
+	if !strings.Contains(body, "Garden gnome") || strings.Contains(body, "Garden chair") {
+		t.Errorf("uncategorized page doesn't list just the gnome")
+	}
+	if w := get(t, db, "/offers/category/Furniture?page=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /offers/category/Furniture?page=0: status %d, want 400", w.Code)
+	}
+}
+
+func TestListShowsAvailability(t *testing.T) {
+	sold := testOffer("sold", "Garden chair", "20.00")
+	sold.Availability = "out of stock"
+	sold.SalePrice = "15.00"
+	db := newTestDB(t, sold, testOffer("table", "Garden table", "50.00"))
+	body := get(t, db, "/offers").Body.String()
+	if n := strings.Count(body, "Out of stock"); n != 1 {
+		t.Errorf("list labels %d offers out of stock, want 1", n)
+	}
+	if !strings.Contains(body, "Sale: ") || !strings.Contains(body, "15.00") {
+		t.Errorf("list doesn't show the sale price:\n%s", body)
+	}
+}
+
+func TestUnpricedOffer(t *testing.T) {
+	unpriced := testOffer("service", "Lawn mowing", "")
+	unpriced.Currency = ""
+	// Only syncs store offers without a price.
+	db := offers.NewMemoryDB()
+	syncOffers(t, db, unpriced, testOffer("chair", "Garden chair", "10.00"))
+	for _, target := range []string{"/offers", "/api/v1/offers/service", "/search?q=lawn"} {
+		if w := get(t, db, target); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Lawn mowing") {
+			t.Errorf("GET %s: status %d, want the offer without a price", target, w.Code)
+		}
+	}
+	r := httptest.NewRequest("GET", "/offers", nil)
+	r.Header.Set(countryHeader, "de")
+	if w := serveRequest(t, db, r); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Lawn mowing") {
+		t.Errorf("GET /offers in euros: status %d, want the offer without a price", w.Code)
+	}
+}
+
+func TestSearchTotal(t *testing.T) {
+	var list []*offers.Offer
+	for i := 0; i < 5; i++ {
+		list = append(list, testOffer(strconv.Itoa(i), "Garden chair "+strconv.Itoa(i), "10.00"))
+	}
+	db := newTestDB(t, list...)
+	if body := get(t, db, "/search?q=chair&per_page=2").Body.String(); !strings.Contains(body, "Showing 2 of 5 offers") {
+		t.Errorf("search with 2 per page doesn't show 2 of 5 offers:\n%s", body)
+	}
+
+	// A failing count is logged, and the results shown without a total.
+	mock := &offerstest.MockDB{
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			return list[:2], nil
+		},
+		CountSearchOffersFunc: func(ctx context.Context, q string) (int, error) {
+			return 0, errors.New("connection refused")
+		},
+	}
+	w := get(t, mock, "/search?q=chair")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Garden chair 1") || strings.Contains(w.Body.String(), "Showing") {
+		t.Errorf("search with a failing count: status %d, want the results without a total", w.Code)
+	}
+}
+
+func TestListInStock(t *testing.T) {
+	sold := testOffer("sold", "Garden chair", "20.00")
+	sold.Availability = "out of stock"
+	db := newTestDB(t, sold, testOffer("table", "Garden table", "50.00"))
+
+	body := html.UnescapeString(get(t, db, "/offers").Body.String())
+	if !strings.Contains(body, "Garden chair") || !strings.Contains(body, `href="?in_stock=true&page=1&per_page=50&sort=title">Hide out-of-stock offers`) {
+		t.Errorf("unfiltered list doesn't show the sold-out chair and a link hiding it:\n%s", body)
+	}
+	body = html.UnescapeString(get(t, db, "/offers?in_stock=true&sort=price").Body.String())
+	if strings.Contains(body, "Garden chair") || !strings.Contains(body, "Garden table") {
+		t.Errorf("list in stock doesn't show just the table:\n%s", body)
+	}
+	for _, link := range []string{
+		`href="?in_stock=true&page=1&per_page=50&sort=title">Title`,
+		`href="?page=1&per_page=50&sort=price">Show out-of-stock offers`,
+	} {
+		if !strings.Contains(body, link) {
+			t.Errorf("list in stock doesn't link to %s", link)
+		}
+	}
+
+	// The offer page still opens.
+	w := get(t, db, "/offers/sold")
+	if w.Code == http.StatusMovedPermanently {
+		w = get(t, db, w.Header().Get("Location"))
+	}
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Garden chair") {
+		t.Errorf("GET /offers/sold: status %d, want the offer", w.Code)
+	}
+}
+
+// requestKey is a context key marking the requests of
+// TestHandlersPassRequestContext.
+type requestKey struct{}
+
+func TestHandlersPassRequestContext(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	record := func(ctx context.Context, method string) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[method] = ctx.Value(requestKey{}) == "request"
+	}
+	db := &offerstest.MockDB{
+		ListPurchasableOffersFunc: func(ctx context.Context, opts offers.ListOptions) ([]*offers.Offer, int, error) {
+			record(ctx, "ListPurchasableOffers")
+			return nil, 0, nil
+		},
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			record(ctx, "SearchOffers")
+			return []*offers.Offer{}, nil
+		},
+		OfferExistsFunc: func(ctx context.Context, id string) (bool, error) {
+			record(ctx, "OfferExists")
+			return true, nil
+		},
+		GetOfferFunc: func(ctx context.Context, id string) (*offers.Offer, error) {
+			record(ctx, "GetOffer")
+			return testOffer(id, "Garden chair", "10.00"), nil
+		},
+	}
+	for _, target := range []string{"/offers", "/search?q=chair", "/api/v1/offers/a"} {
+		r := httptest.NewRequest("GET", target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, "request"))
+		if w := serveRequest(t, db, r); w.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d, want %d", target, w.Code, http.StatusOK)
+		}
+	}
+	for _, method := range []string{"ListPurchasableOffers", "SearchOffers", "OfferExists", "GetOffer"} {
+		if passed, called := seen[method]; !called || !passed {
+			t.Errorf("%s called: %v, with the request's context: %v", method, called, passed)
+		}
+	}
+}
+
+func TestDeleteOfferHandler(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	del := func(id string) int {
+		t.Helper()
+		return serveRequest(t, db, httptest.NewRequest("DELETE", "/admin/offers/"+id, nil)).Code
+	}
+	if code := del("a"); code != http.StatusNoContent {
+		t.Errorf("DELETE /admin/offers/a: status %d, want %d", code, http.StatusNoContent)
+	}
+	if _, err := db.GetOffer(context.Background(), "a"); err != offers.ErrOfferNotFound {
+		t.Errorf("GetOffer after DELETE = %v, want ErrOfferNotFound", err)
+	}
+	for _, id := range []string{"a", "missing"} {
+		if code := del(id); code != http.StatusNotFound {
+			t.Errorf("DELETE /admin/offers/%s: status %d, want %d", id, code, http.StatusNotFound)
+		}
+	}
+}
+
+// useRunUpdate replaces the sync with run, forgets earlier sync jobs and
+// lifts the limit on requesting syncs, until the test ends.
+func useRunUpdate(t *testing.T, run func(int64, offers.LogConfig, func(offers.SyncStats)) (offers.SyncStats, error)) {
+	t.Helper()
+	t.Setenv(merchantIDEnv, "10")
+	savedRun, savedSyncs, savedLimiter := runUpdate, syncs, updateLimiter
+	t.Cleanup(func() { runUpdate, syncs, updateLimiter = savedRun, savedSyncs, savedLimiter })
+	runUpdate = run
+	syncs = &syncJobs{jobs: map[string]*syncJob{}}
+	updateLimiter = newTokenBucket(6000, 100)
+}
+
+// waitForSync polls the status of the sync job until it isn't running.
+func waitForSync(t *testing.T, db offers.OfferDatabase, id string) syncJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := get(t, db, "/tasks/update_db/status/"+id)
+		var job syncJob
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatalf("decoding sync status: %v: %s", err, w.Body)
+		}
+		if job.State != syncRunning {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sync %s still running", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUpdateHandlerSyncFails(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	useRunUpdate(t, func(int64, offers.LogConfig, func(offers.SyncStats)) (offers.SyncStats, error) {
+		return offers.SyncStats{}, errors.New("googleapi: Error 403: forbidden")
+	})
+
+	w := get(t, db, "/tasks/update_db")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("GET /tasks/update_db: status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var job syncJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job = waitForSync(t, db, job.ID); job.State != syncFailed || !strings.Contains(job.Error, "403") {
+		t.Errorf("failed sync = %+v, want failed with the API error", job)
+	}
+
+	// The server survives the failed sync.
+	if w := get(t, db, "/offers"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Garden chair") {
+		t.Errorf("GET /offers after a failed sync: status %d", w.Code)
+	}
+
+	t.Setenv(merchantIDEnv, "not-a-number")
+	if w := get(t, db, "/tasks/update_db"); w.Code != http.StatusInternalServerError {
+		t.Errorf("GET /tasks/update_db with a bad merchant ID: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestUpdateHandlerRunsInBackground(t *testing.T) {
+	db := newTestDB(t)
+	progressed, release := make(chan struct{}), make(chan struct{})
+	useRunUpdate(t, func(id int64, _ offers.LogConfig, progress func(offers.SyncStats)) (offers.SyncStats, error) {
+		if id != 10 {
+			t.Errorf("synced merchant %d, want 10", id)
+		}
+		progress(offers.SyncStats{Products: 250})
+		close(progressed)
+		<-release
+		return offers.SyncStats{Products: 400, Pages: 2}, nil
+	})
+
+	w := get(t, db, "/tasks/update_db")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("GET /tasks/update_db: status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var job syncJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" || job.State != syncRunning {
+		t.Errorf("started job = %+v, want a running job with an ID", job)
+	}
+	if loc, want := w.Header().Get("Location"), "/tasks/update_db/status/"+job.ID; loc != want {
+		t.Errorf("Location = %q, want %q", loc, want)
+	}
+
+	<-progressed
+	status := func() syncJob {
+		t.Helper()
+		w := get(t, db, "/tasks/update_db/status/"+job.ID)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status: %d, want %d", w.Code, http.StatusOK)
+		}
+		var job syncJob
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	if s := status(); s.State != syncRunning || s.Products != 250 || s.Finished != nil {
+		t.Errorf("running job = %+v, want running with 250 products processed", s)
+	}
+
+	// A second trigger doesn't start another sync.
+	w = get(t, db, "/tasks/update_db")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "sync "+job.ID+" is already running") {
+		t.Errorf("second trigger: status %d with %q, want %d naming job %s", w.Code, w.Body, http.StatusConflict, job.ID)
+	}
+
+	close(release)
+	if s := waitForSync(t, db, job.ID); s.State != syncSucceeded || s.Products != 400 || s.Finished == nil || s.Summary == "" {
+		t.Errorf("finished job = %+v, want succeeded with 400 products processed", s)
+	}
+
+	if w := get(t, db, "/tasks/update_db/status/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("status of an unknown job: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPurgeDeletedHandler(t *testing.T) {
+	var cutoff time.Time
+	db := &offerstest.MockDB{
+		PurgeDeletedFunc: func(ctx context.Context, olderThan time.Time) (int64, error) {
+			cutoff = olderThan
+			return 3, nil
+		},
+	}
+	w := get(t, db, "/tasks/purge_deleted")
+	if w.Code != http.StatusOK || w.Body.String() != "purged 3 deleted offers" {
+		t.Errorf("GET /tasks/purge_deleted: status %d, body %q", w.Code, w.Body)
+	}
+	if want := time.Now().Add(-deletedRetention); cutoff.Before(want.Add(-time.Minute)) || cutoff.After(want) {
+		t.Errorf("purged offers deleted before %v, want %v", cutoff, want)
+	}
+
+	db.PurgeDeletedFunc = func(ctx context.Context, olderThan time.Time) (int64, error) {
+		return 0, errors.New("connection refused")
+	}
+	if w := get(t, db, "/tasks/purge_deleted"); w.Code != http.StatusInternalServerError {
+		t.Errorf("GET /tasks/purge_deleted with a failing database: status %d, want 500", w.Code)
+	}
+}
+
+func TestListHandlerWithMockDB(t *testing.T) {
+	db := &offerstest.MockDB{
+		ListPurchasableOffersFunc: func(ctx context.Context, opts offers.ListOptions) ([]*offers.Offer, int, error) {
+			return []*offers.Offer{testOffer("a", "Garden chair", "10.00"), testOffer("b", "Garden table", "50.00")}, 60, nil
+		},
+	}
+	w := get(t, db, "/offers?page=2&sort=price")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /offers: status %d", w.Code)
+	}
+	for _, title := range []string{"Garden chair", "Garden table"} {
+		if !strings.Contains(w.Body.String(), title) {
+			t.Errorf("list page doesn't show %q", title)
+		}
+	}
+	want := [][]interface{}{{offers.ListOptions{Limit: 50, Offset: 50, Sort: offers.SortByPrice}}}
+	if calls := db.CallsTo("ListPurchasableOffers"); !reflect.DeepEqual(calls, want) {
+		t.Errorf("ListPurchasableOffers calls = %v, want %v", calls, want)
+	}
+
+	db.ListPurchasableOffersFunc = func(ctx context.Context, opts offers.ListOptions) ([]*offers.Offer, int, error) {
+		return nil, 0, errors.New("connection refused")
+	}
+	// The error is logged, and the page rendered without offers.
+	if w := get(t, db, "/offers"); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Garden chair") {
+		t.Errorf("GET /offers with a failing database: status %d, want an empty page", w.Code)
+	}
+}
+
+func TestPageFromRequest(t *testing.T) {
+	for _, tt := range []struct {
+		query    string
+		wantOpts offers.ListOptions
+		wantPage pageView
+	}{
+		{"", offers.ListOptions{Limit: 50, Sort: offers.SortByTitle}, pageView{Number: 1, PerPage: 50, Sort: offers.SortByTitle}},
+		{"page=3", offers.ListOptions{Limit: 50, Offset: 100, Sort: offers.SortByTitle}, pageView{Number: 3, PerPage: 50, Sort: offers.SortByTitle}},
+		{"page=2&per_page=10&sort=added&in_stock=true", offers.ListOptions{Limit: 10, Offset: 10, Sort: offers.SortByInsertion, InStock: true}, pageView{Number: 2, PerPage: 10, Sort: offers.SortByInsertion, InStock: true}},
+	} {
+		opts, page, e := pageFromRequest(httptest.NewRequest("GET", "/offers?"+tt.query, nil))
+		if e != nil {
+			t.Errorf("pageFromRequest(%q): %v", tt.query, e.Error)
+			continue
+		}
+		if opts != tt.wantOpts || *page != tt.wantPage {
+			t.Errorf("pageFromRequest(%q) = %+v, %+v; want %+v, %+v", tt.query, opts, *page, tt.wantOpts, tt.wantPage)
+		}
+	}
+	for _, query := range []string{"page=0", "page=-1", "page=two", "per_page=101", "sort=rating"} {
+		if _, _, e := pageFromRequest(httptest.NewRequest("GET", "/offers?"+query, nil)); e == nil || e.Code != http.StatusBadRequest {
+			t.Errorf("pageFromRequest(%q) = %v, want a 400", query, e)
+		}
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	p := &pageView{Number: 2, Count: 3, PerPage: 10, Sort: offers.SortByPrice, InStock: true, MerchantID: 42}
+	// params returns the parameters every link keeps, with the given
+	// page, order and stock filter.
+	params := func(page string, sort offers.SortOrder, inStock bool) url.Values {
+		v := url.Values{"page": {page}, "per_page": {"10"}, "sort": {string(sort)}, "merchant_id": {"42"}}
+		if inStock {
+			v.Set("in_stock", "true")
+		}
+		return v
+	}
+	links := []struct {
+		name, link string
+		want       url.Values
+	}{
+		{"previous", p.URL(p.Prev()), params("1", offers.SortByPrice, true)},
+		{"next", p.URL(p.Next()), params("3", offers.SortByPrice, true)},
+		{"show out-of-stock", p.StockURL(false), params("1", offers.SortByPrice, false)},
+		{"hide out-of-stock", p.StockURL(true), params("1", offers.SortByPrice, true)},
+	}
+	sorts := p.Sorts()
+	if len(sorts) != len(offers.SortOrders) {
+		t.Fatalf("Sorts returned %d links, want one per order", len(sorts))
+	}
+	for i, s := range sorts {
+		order := offers.SortOrders[i]
+		if s.Selected != (order == p.Sort) {
+			t.Errorf("sort link %s selected: %v", s.Label, s.Selected)
+		}
+		links = append(links, struct {
+			name, link string
+			want       url.Values
+		}{"sort by " + s.Label, s.URL, params("1", order, true)})
+	}
+	for _, l := range links {
+		got, err := url.ParseQuery(strings.TrimPrefix(l.link, "?"))
+		if err != nil || !reflect.DeepEqual(got, l.want) {
+			t.Errorf("%s link = %q, want %q", l.name, l.link, "?"+l.want.Encode())
+		}
+	}
+	// Building links doesn't change the page they're built from.
+	if p.Number != 2 || p.Sort != offers.SortByPrice || !p.InStock {
+		t.Errorf("building links changed the page to %+v", *p)
+	}
+}
+
+func TestListByMerchant(t *testing.T) {
+	db := offers.NewMemoryDB()
+	var list []*offers.Offer
+	for i, id := range []string{"a", "b", "c"} {
+		o := testOffer(id, "Garden chair "+id, "10.00")
+		o.MerchantID = int64(11 + i/2)
+		list = append(list, o)
+	}
+	syncOffers(t, db, list...)
+
+	body := html.UnescapeString(get(t, db, "/offers?merchant_id=11&per_page=1").Body.String())
+	if !strings.Contains(body, "Offers from merchant 11") || !strings.Contains(body, "Garden chair a") || strings.Contains(body, "Garden chair c") {
+		t.Errorf("first page of merchant 11 doesn't show just offer a:\n%s", body)
+	}
+	// The pager keeps the merchant.
+	if !strings.Contains(body, `<a href="?merchant_id=11&page=2&per_page=1">Next</a>`) {
+		t.Errorf("first page of merchant 11 doesn't link to its second page")
+	}
+	body = get(t, db, "/offers?merchant_id=11&per_page=1&page=2").Body.String()
+	if !strings.Contains(body, "Garden chair b") || strings.Contains(body, "Garden chair a") || strings.Contains(body, ">Next<") {
+		t.Errorf("second page of merchant 11 doesn't show just offer b")
+	}
+	body = get(t, db, "/offers?merchant_id=12").Body.String()
+	if !strings.Contains(body, "Garden chair c") || strings.Contains(body, "Garden chair a") {
+		t.Errorf("merchant 12 doesn't show just offer c")
+	}
+	for _, id := range []string{"0", "-1", "shop"} {
+		if w := get(t, db, "/offers?merchant_id="+id); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /offers?merchant_id=%s: status %d, want 400", id, w.Code)
+		}
+	}
+}
+
+func TestListHandlerPages(t *testing.T) {
+	db := &offerstest.MockDB{
+		ListPurchasableOffersFunc: func(ctx context.Context, opts offers.ListOptions) ([]*offers.Offer, int, error) {
+			return []*offers.Offer{testOffer("a", "Garden chair", "10.00")}, 25, nil
+		},
+	}
+	w := get(t, db, "/offers?page=2&per_page=10")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /offers?page=2: status %d", w.Code)
+	}
+	body := html.UnescapeString(w.Body.String())
+	for _, want := range []string{
+		"Page 2 of 3",
+		`<a href="?page=1&per_page=10&sort=title">Previous</a>`,
+		`<a href="?page=3&per_page=10&sort=title">Next</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page 2 doesn't contain %q", want)
+		}
+	}
+
+	// The first and last pages have no link before or after them.
+	for _, tt := range []struct {
+		page    string
+		current string
+		missing string
+	}{{"1", "Page 1 of 3", "Previous"}, {"3", "Page 3 of 3", "Next"}} {
+		body := get(t, db, "/offers?per_page=10&page="+tt.page).Body.String()
+		if !strings.Contains(body, tt.current) || strings.Contains(body, ">"+tt.missing+"<") {
+			t.Errorf("page %s doesn't show %q without a %s link", tt.page, tt.current, tt.missing)
+		}
+	}
+
+	if w := get(t, db, "/offers?page=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /offers?page=0: status %d, want 400", w.Code)
+	}
+}
+
+func TestDetailHandlerWithMockDB(t *testing.T) {
+	db := &offerstest.MockDB{
+		GetOfferFunc: func(ctx context.Context, id string) (*offers.Offer, error) {
+			if id != "a" {
+				return nil, offers.ErrOfferNotFound
+			}
+			return testOffer("a", "Garden chair", "10.00"), nil
+		},
+	}
+	w := get(t, db, "/offers/a")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Garden chair") {
+		t.Errorf("GET /offers/a: status %d, want the offer", w.Code)
+	}
+	if calls := db.CallsTo("GetOffer"); !reflect.DeepEqual(calls, [][]interface{}{{"a"}}) {
+		t.Errorf("GetOffer calls = %v, want one for a", calls)
+	}
+	if calls := db.CallsTo("RecordView"); len(calls) != 1 {
+		t.Errorf("RecordView calls = %v, want one for the view", calls)
+	}
+
+	db.Reset()
+	if w := get(t, db, "/offers/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /offers/missing: status %d, want 404", w.Code)
+	}
+	if calls := db.CallsTo("RecordView"); len(calls) != 0 {
+		t.Errorf("RecordView calls for a missing offer = %v, want none", calls)
+	}
+}
+
+func TestOfferNotFound(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	for _, target := range []string{"/offers/missing", "/offers/missing/related"} {
+		w := get(t, db, target)
+		if w.Code != http.StatusNotFound || strings.TrimSpace(w.Body.String()) != "could not find offer" {
+			t.Errorf("GET %s: status %d and %q, want 404 and a short message", target, w.Code, w.Body.String())
+		}
+	}
+
+	// Other errors remain server errors.
+	failing := &offerstest.MockDB{
+		GetOfferFunc: func(ctx context.Context, id string) (*offers.Offer, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	for _, target := range []string{"/offers/a", "/offers/a/related"} {
+		if w := get(t, failing, target); w.Code != http.StatusInternalServerError {
+			t.Errorf("GET %s with a failing database: status %d, want 500", target, w.Code)
+		}
+	}
+}
+
+func TestAppErrorCodes(t *testing.T) {
+	e := appErrorfCode(errors.New("bad offer query"), http.StatusBadRequest, "missing %s", "q")
+	if e.Code != http.StatusBadRequest || e.Message != "missing q" {
+		t.Errorf("appErrorfCode = %d %q, want 400 \"missing q\"", e.Code, e.Message)
+	}
+	if e := appErrorf(errors.New("connection refused"), "could not list offers"); e.Code != http.StatusInternalServerError {
+		t.Errorf("appErrorf has code %d, want 500", e.Code)
+	}
+
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/search", http.StatusBadRequest},
+		{"/search.csv", http.StatusBadRequest},
+		{"/search?q=chair&per_page=none", http.StatusBadRequest},
+		{"/offers/missing", http.StatusNotFound},
+		{"/search?q=chair", http.StatusOK},
+	} {
+		if w := get(t, db, tt.target); w.Code != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+	failing := &offerstest.MockDB{
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	if w := get(t, failing, "/search?q=chair"); w.Code != http.StatusInternalServerError {
+		t.Errorf("GET /search with a failing database: status %d, want 500", w.Code)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	db := &offerstest.MockDB{}
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", offers.DefaultSearchLimit},
+		{"&per_page=7", 7},
+		{"&per_page=100000", maxPerPage},
+	} {
+		db.Reset()
+		if w := get(t, db, "/search?q=chair"+tt.query); w.Code != http.StatusOK {
+			t.Errorf("search with %q: status %d", tt.query, w.Code)
+			continue
+		}
+		calls := db.CallsTo("SearchOffers")
+		if len(calls) != 1 || calls[0][2] != tt.want {
+			t.Errorf("search with %q: SearchOffers calls = %v, want one with limit %d", tt.query, calls, tt.want)
+		}
+	}
+	for _, perPage := range []string{"0", "-5", "many"} {
+		if w := get(t, db, "/search?q=chair&per_page="+perPage); w.Code != http.StatusBadRequest {
+			t.Errorf("search with per_page=%s: status %d, want 400", perPage, w.Code)
+		}
+	}
+}
+
+func TestListAndSearchPageSize(t *testing.T) {
+	db := &offerstest.MockDB{}
+	get(t, db, "/offers")
+	get(t, db, "/search?q=chair")
+	lists, searches := db.CallsTo("ListPurchasableOffers"), db.CallsTo("SearchOffers")
+	if len(lists) != 1 || len(searches) != 1 {
+		t.Fatalf("got %d lists and %d searches, want one of each", len(lists), len(searches))
+	}
+	listLimit, searchLimit := lists[0][0].(offers.ListOptions).Limit, searches[0][2]
+	if listLimit != offers.DefaultPageSize || searchLimit != offers.DefaultPageSize {
+		t.Errorf("list page reads %d offers and search %v, want %d each", listLimit, searchLimit, offers.DefaultPageSize)
+	}
+}
+
+func TestSearchHandlerWithMockDB(t *testing.T) {
+	db := &offerstest.MockDB{
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			return []*offers.Offer{testOffer("a", "Garden chair", "10.00")}, nil
+		},
+	}
+	if w := get(t, db, "/search?q=chair"); !strings.Contains(w.Body.String(), "Garden chair") {
+		t.Errorf("search page doesn't show the result:\n%s", w.Body)
+	}
+	if calls := db.CallsTo("SearchOffers"); len(calls) != 1 || calls[0][0] != "chair" {
+		t.Errorf("SearchOffers calls = %v, want one for chair", calls)
+	}
+}
+
+func TestRelatedHandler(t *testing.T) {
+	db := newTestDB(t,
+		testOffer("a", "Garden chair", "10.00"),
+		testOffer("b", "Garden table", "50.00"),
+		testOffer("c", "Lamp", "5.00"))
+
+	w := get(t, db, "/offers/a/related")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /offers/a/related: status %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "Related to Garden chair") || !strings.Contains(body, "Garden table") || strings.Contains(body, "Lamp") {
+		t.Errorf("related page for a doesn't list only the table:\n%s", body)
+	}
+	if w := get(t, db, "/offers/missing/related"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /offers/missing/related: status %d, want 404", w.Code)
+	}
+}
+
+func TestUpdateHandlerRateLimited(t *testing.T) {
+	db := newTestDB(t)
+	useRunUpdate(t, func(int64, offers.LogConfig, func(offers.SyncStats)) (offers.SyncStats, error) {
+		return offers.SyncStats{}, nil
+	})
+	t.Setenv(updateRateEnv, "1")
+	configureUpdateLimit()
+
+	w := get(t, db, "/tasks/update_db")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("first GET /tasks/update_db: status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	var job syncJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	waitForSync(t, db, job.ID)
+
+	// The sync has finished, but the next may only start a minute later.
+	w = get(t, db, "/tasks/update_db")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second GET /tasks/update_db: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 59 || retry > 60 {
+		t.Errorf("Retry-After = %q, want about 60 seconds", w.Header().Get("Retry-After"))
+	}
+	syncs.mu.Lock()
+	defer syncs.mu.Unlock()
+	if n := len(syncs.jobs); n != 1 {
+		t.Errorf("%d syncs started, want 1", n)
+	}
+}
+
+func TestConfigureAPIClientAuth(t *testing.T) {
+	savedClient, savedList, savedAccounts, savedStatuses := offers.APIClient, offers.ProductList, offers.SubAccounts, offers.ProductStatuses
+	defer func() {
+		offers.APIClient, offers.ProductList, offers.SubAccounts, offers.ProductStatuses = savedClient, savedList, savedAccounts, savedStatuses
+	}()
+
+	for _, tt := range []struct {
+		auth, file, json string
+		want             offers.ClientConfig
+	}{
+		{"", "", "", offers.ClientConfig{}},
+		{"credentials", "/secrets/key.json", "", offers.ClientConfig{Auth: offers.AuthCredentials, CredentialsFile: "/secrets/key.json"}},
+		{"credentials", "", `{"type":"service_account"}`, offers.ClientConfig{Auth: offers.AuthCredentials, CredentialsJSON: []byte(`{"type":"service_account"}`)}},
+		{"default", "", "", offers.ClientConfig{Auth: offers.AuthDefault}},
+		{"dir", "", "", offers.ClientConfig{Auth: offers.AuthConfigDir}},
+	} {
+		t.Setenv(apiAuthEnv, tt.auth)
+		t.Setenv(apiCredentialsEnv, tt.file)
+		t.Setenv(apiCredentialsJSONEnv, tt.json)
+		offers.APIClient = offers.ClientConfig{}
+		configureAPIClient()
+		got := offers.APIClient
+		if got.Auth != tt.want.Auth || got.CredentialsFile != tt.want.CredentialsFile || string(got.CredentialsJSON) != string(tt.want.CredentialsJSON) {
+			t.Errorf("%s=%q, %s=%q, %s=%q: client config %+v, want %+v", apiAuthEnv, tt.auth, apiCredentialsEnv, tt.file, apiCredentialsJSONEnv, tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureProductPageSize(t *testing.T) {
+	savedClient, savedList, savedAccounts, savedStatuses := offers.APIClient, offers.ProductList, offers.SubAccounts, offers.ProductStatuses
+	defer func() {
+		offers.APIClient, offers.ProductList, offers.SubAccounts, offers.ProductStatuses = savedClient, savedList, savedAccounts, savedStatuses
+	}()
+
+	for v, want := range map[string]int64{"": 0, "1": 1, "100": 100, "250": offers.MaxProductPageSize} {
+		t.Setenv(productPageSizeEnv, v)
+		offers.ProductList = offers.ListConfig{}
+		configureAPIClient()
+		if offers.ProductList.PageSize != want {
+			t.Errorf("%s=%q: page size %d, want %d", productPageSizeEnv, v, offers.ProductList.PageSize, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// adminTokenEnv optionally sets a secret that authorizes requests to the
+	// task and admin routes, and writes through the API, when sent as
+	// "Authorization: Bearer <token>".
+	adminTokenEnv = "ADMIN_TOKEN"
+	// appEngineInstanceEnv is set on App Engine instances, where requests
+	// from cron can be recognized by their header.
+	appEngineInstanceEnv = "GAE_INSTANCE"
+)
+
+var (
+	// errUnauthenticated is returned by authenticators for requests without
+	// credentials they recognize.
+	errUnauthenticated = errors.New("no credentials")
+	// errForbidden is returned by authenticators for requests with wrong
+	// credentials.
+	errForbidden = errors.New("invalid credentials")
+)
+
+// authenticator decides whether a request may use a protected route. Other
+// schemes, like IAP or OIDC tokens, can be added by implementing it.
+type authenticator interface {
+	// authenticate returns nil if r is authorized, errUnauthenticated if it
+	// has no credentials for this scheme, and errForbidden if they are
+	// wrong.
+	authenticate(r *http.Request) error
+}
+
+var (
+	// taskAuth authorizes requests to /tasks/ routes. It is set by
+	// configureAuth.
+	taskAuth authenticator
+	// adminAuth authorizes requests to /admin/ routes. It is set by
+	// configureAuth; without an admin token, they are refused.
+	adminAuth authenticator
+	// apiWriteAuth authorizes requests to /api/ routes other than reads. It
+	// is set by configureAuth; without an admin token, they are refused.
+	apiWriteAuth authenticator
+)
+
+// bearerAuth accepts requests carrying token as a bearer token.
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) authenticate(r *http.Request) error {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return errUnauthenticated
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(h, "Bearer ")), []byte(a.token)) != 1 {
+		return errForbidden
+	}
+	return nil
+}
+
+// cronAuth accepts requests made by App Engine cron. App Engine removes the
+// X-Appengine-Cron header from requests from outside, so it can only be
+// trusted on App Engine.
+type cronAuth struct{}
+
+func (cronAuth) authenticate(r *http.Request) error {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		return errUnauthenticated
+	}
+	return nil
+}
+
+// anyAuth accepts requests accepted by any of its authenticators. A request
+// rejected by all of them is forbidden if any found wrong credentials.
+type anyAuth []authenticator
+
+func (a anyAuth) authenticate(r *http.Request) error {
+	err := errUnauthenticated
+	for _, auth := range a {
+		switch e := auth.authenticate(r); e {
+		case nil:
+			return nil
+		case errForbidden:
+			err = e
+		}
+	}
+	return err
+}
+
+// configureAuth sets the authenticators of the protected routes. Tasks are
+// accepted from App Engine cron or with the admin token; without either, they
+// are refused. Admin pages and API writes need the token.
+func configureAuth() {
+	var tasks anyAuth
+	adminAuth, apiWriteAuth = anyAuth{}, anyAuth{}
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		adminAuth = bearerAuth{token: token}
+		apiWriteAuth = adminAuth
+		tasks = append(tasks, adminAuth)
+	} else {
+		log.Printf("%s is not set, so /admin/ requests and API writes will be refused", adminTokenEnv)
+	}
+	if os.Getenv(appEngineInstanceEnv) != "" {
+		tasks = append(tasks, cronAuth{})
+	}
+	if len(tasks) == 0 {
+		log.Printf("%s is not set, so /tasks/ requests will be refused", adminTokenEnv)
+	}
+	taskAuth = tasks
+}
+
+// authMiddleware requires taskAuth for /tasks/ routes, adminAuth for /admin/
+// routes, and apiWriteAuth for /api/ requests other than GET and HEAD. Other
+// routes, like offer browsing, are public.
+// Refused requests get 401 Unauthorized without credentials, and 403
+// Forbidden with wrong ones.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var auth authenticator
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/tasks/"):
+			auth = taskAuth
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+			auth = adminAuth
+		case strings.HasPrefix(r.URL.Path, "/api/") && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			auth = apiWriteAuth
+		}
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch err := auth.authenticate(r); err {
+		case nil:
+			next.ServeHTTP(w, r)
+		case errUnauthenticated:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="offers"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+		default:
+			http.Error(w, "not authorized", http.StatusForbidden)
+		}
+	})
+}
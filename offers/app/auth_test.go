@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// useAuth configures authentication with the admin token, if it isn't
+// empty, and as if on App Engine or not, until the test ends.
+func useAuth(t *testing.T, token string, onAppEngine bool) {
+	saved := []authenticator{taskAuth, adminAuth, apiWriteAuth}
+	t.Cleanup(func() { taskAuth, adminAuth, apiWriteAuth = saved[0], saved[1], saved[2] })
+	t.Setenv(adminTokenEnv, token)
+	instance := ""
+	if onAppEngine {
+		instance = "aef-default-1"
+	}
+	t.Setenv(appEngineInstanceEnv, instance)
+	taskAuth, adminAuth, apiWriteAuth = nil, nil, nil
+	configureAuth()
+}
+
+// authCase is a request and the status it should get.
+type authCase struct {
+	method, target string
+	header         string // "Name: value", if any
+	want           int
+}
+
+func checkAuth(t *testing.T, name string, cases []authCase) {
+	t.Helper()
+	for _, tt := range cases {
+		db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(`{"title": "Teak chair"}`))
+		if i := strings.Index(tt.header, ": "); i > 0 {
+			r.Header.Set(tt.header[:i], tt.header[i+2:])
+		}
+		w := serveRequest(t, db, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s with %q: status %d, want %d", name, tt.method, tt.target, tt.header, w.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: %s %s: 401 without WWW-Authenticate", name, tt.method, tt.target)
+		}
+	}
+}
+
+func TestAuthWithToken(t *testing.T) {
+	useAuth(t, "s3cret", true)
+	checkAuth(t, "with a token on App Engine", []authCase{
+		{"GET", "/tasks/purge_deleted", "", http.StatusUnauthorized},
+		{"GET", "/tasks/purge_deleted", "Authorization: Bearer wrong", http.StatusForbidden},
+		{"GET", "/tasks/purge_deleted", "Authorization: Basic czNjcmV0", http.StatusUnauthorized},
+		{"GET", "/tasks/purge_deleted", "Authorization: Bearer s3cret", http.StatusOK},
+		{"GET", "/tasks/purge_deleted", "X-Appengine-Cron: true", http.StatusOK},
+		{"DELETE", "/admin/offers/a", "", http.StatusUnauthorized},
+		{"DELETE", "/admin/offers/a", "X-Appengine-Cron: true", http.StatusUnauthorized},
+		{"DELETE", "/admin/offers/a", "Authorization: Bearer wrong", http.StatusForbidden},
+		{"DELETE", "/admin/offers/a", "Authorization: Bearer s3cret", http.StatusNoContent},
+		{"PATCH", "/api/v1/offers/a", "", http.StatusUnauthorized},
+		{"PATCH", "/api/v1/offers/a", "Authorization: Bearer s3cret", http.StatusOK},
+		// Browsing stays public.
+		{"GET", "/offers", "", http.StatusOK},
+		{"GET", "/api/v1/offers/a", "", http.StatusOK},
+	})
+}
+
+func TestAuthOutsideAppEngine(t *testing.T) {
+	useAuth(t, "s3cret", false)
+	checkAuth(t, "with a token outside App Engine", []authCase{
+		// The cron header can be forged outside App Engine.
+		{"GET", "/tasks/purge_deleted", "X-Appengine-Cron: true", http.StatusUnauthorized},
+		{"GET", "/tasks/purge_deleted", "Authorization: Bearer s3cret", http.StatusOK},
+	})
+
+	useAuth(t, "", false)
+	checkAuth(t, "without a token", []authCase{
+		{"GET", "/tasks/purge_deleted", "", http.StatusUnauthorized},
+		{"GET", "/tasks/purge_deleted", "X-Appengine-Cron: true", http.StatusUnauthorized},
+		{"PATCH", "/api/v1/offers/a", "Authorization: Bearer s3cret", http.StatusUnauthorized},
+		{"DELETE", "/admin/offers/a", "", http.StatusUnauthorized},
+		{"DELETE", "/admin/offers/a", "Authorization: Bearer s3cret", http.StatusUnauthorized},
+		{"POST", "/admin/featured", "", http.StatusUnauthorized},
+		{"POST", "/admin/recompute_prices", "", http.StatusUnauthorized},
+		{"POST", "/admin/offers/import", "", http.StatusUnauthorized},
+		{"GET", "/admin/offers", "", http.StatusUnauthorized},
+		{"GET", "/offers", "", http.StatusOK},
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"offers"
+	"strings"
+)
+
+const (
+	// currencyParam is the query parameter selecting the display currency.
+	currencyParam = "currency"
+	// countryHeader is set by App Engine to the client's ISO 3166 country.
+	countryHeader = "X-AppEngine-Country"
+)
+
+// countryCurrencies maps countries to the currency prices are shown in for
+// shoppers there, if none is requested.
+var countryCurrencies = map[string]string{
+	"AT": "EUR", "AU": "AUD", "BE": "EUR", "BR": "BRL", "CA": "CAD",
+	"CH": "CHF", "DE": "EUR", "ES": "EUR", "FI": "EUR", "FR": "EUR",
+	"GB": "GBP", "IE": "EUR", "IN": "INR", "IT": "EUR", "JP": "JPY",
+	"MX": "MXN", "NL": "EUR", "PT": "EUR", "SE": "SEK", "US": "USD",
+}
+
+// requestCurrency returns the currency to show prices in for r: the
+// currency parameter, else the currency of the client's country, else the
+// configured display currency. It returns "" if prices can't be converted.
+func requestCurrency(r *http.Request) string {
+	if converter == nil {
+		return ""
+	}
+	if c := strings.ToUpper(r.FormValue(currencyParam)); len(c) == 3 {
+		return c
+	}
+	if c, ok := countryCurrencies[r.Header.Get(countryHeader)]; ok {
+		return c
+	}
+	return displayCurrency
+}
+
+// convertPrices sets the converted price of each offer to its price in
+// currency. Offers whose price can't be converted are left with an empty
+// ConvertedPrice, so templates can fall back to the original price.
+func convertPrices(currency string, lists ...[]*offers.Offer) {
+	if currency == "" {
+		return
+	}
+	for _, list := range lists {
+		for _, o := range list {
+			o.ConvertedCurrency = currency
+			o.ConvertedPrice, _ = converter.Convert(o.Price, o.Currency, currency)
+		}
+	}
+}
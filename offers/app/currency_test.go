@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"offers"
+	"strings"
+	"testing"
+)
+
+// useRates converts prices with rates, displaying them in display by
+// default, until the test ends.
+func useRates(t *testing.T, rates offers.StaticRates, display string) {
+	saved, savedCurrency := converter, displayCurrency
+	t.Cleanup(func() { converter, displayCurrency = saved, savedCurrency })
+	if rates == nil {
+		converter, displayCurrency = nil, ""
+		return
+	}
+	converter, displayCurrency = rates, display
+}
+
+func TestRequestCurrency(t *testing.T) {
+	useRates(t, offers.StaticRates{"USD": 1, "EUR": 0.9}, "USD")
+	for _, tt := range []struct {
+		target, country, want string
+	}{
+		{"/offers", "", "USD"},
+		{"/offers?currency=eur", "", "EUR"},
+		{"/offers", "FR", "EUR"},
+		{"/offers", "JP", "JPY"},
+		{"/offers", "ZZ", "USD"},
+		{"/offers?currency=GBP", "FR", "GBP"},
+		{"/offers?currency=euro", "DE", "EUR"},
+	} {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.country != "" {
+			r.Header.Set(countryHeader, tt.country)
+		}
+		if got := requestCurrency(r); got != tt.want {
+			t.Errorf("requestCurrency(%s from %q) = %q, want %q", tt.target, tt.country, got, tt.want)
+		}
+	}
+
+	useRates(t, nil, "")
+	if got := requestCurrency(httptest.NewRequest("GET", "/offers?currency=EUR", nil)); got != "" {
+		t.Errorf("requestCurrency without rates = %q, want none", got)
+	}
+}
+
+func TestDisplayCurrencies(t *testing.T) {
+	useRates(t, offers.StaticRates{"USD": 1, "EUR": 0.9, "GBP": 0.8}, "USD")
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+
+	for _, tt := range []struct {
+		target, want string
+	}{
+		{"/offers?currency=EUR", "10.00 USD <small>(about 9.00 EUR)</small>"},
+		{"/offers?currency=GBP", "10.00 USD <small>(about 8.00 GBP)</small>"},
+		// Rates are missing for JPY, so the original price is shown.
+		{"/offers?currency=JPY", "10.00 USD <small>(not available in JPY)</small>"},
+	} {
+		if body := get(t, db, tt.target).Body.String(); !strings.Contains(body, tt.want) {
+			t.Errorf("GET %s doesn't show %q:\n%s", tt.target, tt.want, body)
+		}
+	}
+
+	// Prices already in the display currency aren't converted.
+	if body := get(t, db, "/offers").Body.String(); !strings.Contains(body, "10.00 USD") || strings.Contains(body, "<small>(") {
+		t.Errorf("GET /offers in the offer's currency:\n%s", body)
+	}
+}
+
+func TestDisplayCurrencyDetail(t *testing.T) {
+	useRates(t, offers.StaticRates{"USD": 1, "EUR": 0.5}, "USD")
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+
+	r := httptest.NewRequest("GET", "/p/garden-chair", nil)
+	r.Header.Set(countryHeader, "DE")
+	body := serveRequest(t, db, r).Body.String()
+	if !strings.Contains(body, "10.00 USD <small>(about 5.00 EUR)</small>") {
+		t.Errorf("detail page for a shopper in Germany doesn't show the price in EUR:\n%s", body)
+	}
+}
+
+func TestConvertPrices(t *testing.T) {
+	useRates(t, offers.StaticRates{"USD": 1, "EUR": 0.9, "GBP": 0.125}, "USD")
+	usd := testOffer("usd", "Chair", "1.00")
+	eur := testOffer("eur", "Table", "10.00")
+	eur.Currency = "EUR"
+	chf := testOffer("chf", "Lamp", "5.00")
+	chf.Currency = "CHF"
+	bad := testOffer("bad", "Sofa", "ten")
+
+	convertPrices("GBP", []*offers.Offer{usd, eur}, []*offers.Offer{chf, bad})
+	for _, tt := range []struct {
+		o    *offers.Offer
+		want string
+	}{
+		{usd, "0.13"},
+		{eur, "1.39"},
+		// Offers in currencies without a rate, or with malformed prices,
+		// are left unconverted.
+		{chf, ""},
+		{bad, ""},
+	} {
+		if tt.o.ConvertedPrice != tt.want || tt.o.ConvertedCurrency != "GBP" {
+			t.Errorf("offer %s converted to %q %s, want %q GBP", tt.o.ID, tt.o.ConvertedPrice, tt.o.ConvertedCurrency, tt.want)
+		}
+	}
+
+	// Without a display currency, offers aren't converted.
+	o := testOffer("a", "Chair", "1.00")
+	convertPrices("", []*offers.Offer{o})
+	if o.ConvertedPrice != "" || o.ConvertedCurrency != "" {
+		t.Errorf("offer converted to %q %s without a currency", o.ConvertedPrice, o.ConvertedCurrency)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"offers"
+)
+
+// csvHeader names the columns written by offerRecord.
+var csvHeader = []string{
+	"id", "title", "price", "currency", "image_url", "description", "merchant_url",
+}
+
+// offerRecord returns the CSV record for an offer.
+func offerRecord(o *offers.Offer) []string {
+	return []string{
+		o.ID, o.Title, o.Price, o.Currency, o.ImageURL, o.Description, o.MerchantURL,
+	}
+}
+
+// writeOffersCSV streams the offers produced by forEach to w as a CSV
+// attachment with the given file name.
+func writeOffersCSV(w http.ResponseWriter, filename string, forEach func(func(*offers.Offer) error) error) *appError {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return appErrorf(err, "could not write CSV: %v", err)
+	}
+	err := forEach(func(o *offers.Offer) error {
+		return cw.Write(offerRecord(o))
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// Part of the response may already have been sent, so it is too late
+		// to report an error status.
+		log.Printf("could not export %s: %v", filename, err)
+	}
+	return nil
+}
+
+// offersCSVHandler exports all offers as CSV.
+func offersCSVHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return writeOffersCSV(w, "offers.csv", func(fn func(*offers.Offer) error) error {
+		return offers.DB.ForEachOffer(r.Context(), fn)
+	})
+}
+
+// searchCSVHandler exports the offers matching the search query as CSV.
+func searchCSVHandler(w http.ResponseWriter, r *http.Request) *appError {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		return appErrorfCode(errors.New("bad offer query"), http.StatusBadRequest, "missing search query q")
+	}
+	return writeOffersCSV(w, "search.csv", func(fn func(*offers.Offer) error) error {
+		return offers.DB.ForEachSearchResult(r.Context(), q, fn)
+	})
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"offers"
+	"reflect"
+	"testing"
+)
+
+func TestOffersCSV(t *testing.T) {
+	chair := testOffer("a", "Garden chair", "10.00")
+	chair.Description = "Teak, oiled.\nSeats \"two\"."
+	table := testOffer("b", "Table, round", "99.99")
+	table.Currency = "EUR"
+	lamp := testOffer("c", "Lamp", "5.00")
+	seeded := []*offers.Offer{chair, table, lamp}
+	db := newTestDB(t, seeded...)
+
+	w := get(t, db, "/offers.csv")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /offers.csv: status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/csv", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="offers.csv"` {
+		t.Errorf("Content-Disposition = %q, want an attachment named offers.csv", cd)
+	}
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("decoding the CSV: %v", err)
+	}
+	want := [][]string{csvHeader}
+	for _, o := range seeded {
+		want = append(want, []string{o.ID, o.Title, o.Price, o.Currency, o.ImageURL, o.Description, o.MerchantURL})
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("CSV records = %q, want %q", records, want)
+	}
+}
+
+func TestSearchCSV(t *testing.T) {
+	db := newTestDB(t, testOffer("a", "Garden chair", "10.00"), testOffer("b", "Table", "20.00"))
+
+	w := get(t, db, "/search.csv?q=chair")
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("decoding the CSV: %v", err)
+	}
+	if len(records) != 2 || records[1][0] != "a" {
+		t.Errorf("CSV records for chair = %q, want the header and offer a", records)
+	}
+
+	if w := get(t, db, "/search.csv"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /search.csv without a query: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers GIF decoding for merchant images.
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// imageHostsEnv optionally lists the image hosts /img fetches from,
+	// separated by commas. A host starting with a dot also allows its
+	// subdomains. Without it, the proxy is off and templates link to merchant
+	// images directly.
+	imageHostsEnv = "IMAGE_PROXY_HOSTS"
+
+	// maxImageSize bounds the size of a fetched image, and maxImagePixels
+	// its decoded size, so small files can't expand to huge images.
+	maxImageSize   = 10 << 20
+	maxImagePixels = 40 << 20
+	// maxImageDimension bounds the requested width and height.
+	maxImageDimension = 2000
+	// imageCacheSize bounds the total size of the cached images.
+	imageCacheSize = 64 << 20
+	// imageFetchTimeout bounds fetching an image, including redirects.
+	imageFetchTimeout = 10 * time.Second
+)
+
+var (
+	// imageHosts are the hosts the proxy fetches from, set by
+	// configureImageProxy. The proxy is off if it is empty.
+	imageHosts []string
+	// resizedImages caches the images served by the proxy.
+	resizedImages = newImageCache(imageCacheSize)
+	// imageClient fetches images. It only connects to public addresses and
+	// only follows redirects to allowed hosts.
+	imageClient = &http.Client{
+		Timeout: imageFetchTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: imageFetchTimeout, Control: publicAddressOnly}).DialContext,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return checkImageURL(r.URL)
+		},
+	}
+)
+
+// configureImageProxy sets the hosts the image proxy fetches from.
+func configureImageProxy() {
+	for _, h := range strings.Split(os.Getenv(imageHostsEnv), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			imageHosts = append(imageHosts, h)
+		}
+	}
+}
+
+// imageHostAllowed reports whether the proxy may fetch from host.
+func imageHostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range imageHosts {
+		if host == h || strings.HasPrefix(h, ".") && (host == h[1:] || strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImageURL returns an error unless u is an http or https URL on an
+// allowed host.
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported image URL scheme %q", u.Scheme)
+	}
+	if !imageHostAllowed(u.Hostname()) {
+		return fmt.Errorf("image host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// privateNetworks are the address ranges that aren't reachable from the
+// internet, including the metadata server at 169.254.169.254.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "::/128", "::1/128",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// publicAddressOnly refuses connections to private addresses, so an allowed
+// host resolving to one can't reach internal services.
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("refusing to fetch images from %s", host)
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return fmt.Errorf("refusing to fetch images from private address %s", host)
+		}
+	}
+	return nil
+}
+
+// imageURL returns the URL of a merchant image resized to fit w by h pixels,
+// either of which may be 0 to scale by the other. It is the proxy's URL if
+// the image's host is allowed, and the image's own URL otherwise.
+func imageURL(src string, w, h int) string {
+	u, err := url.Parse(src)
+	if err != nil || checkImageURL(u) != nil {
+		return src
+	}
+	v := url.Values{}
+	v.Set("url", src)
+	if w > 0 {
+		v.Set("w", strconv.Itoa(w))
+	}
+	if h > 0 {
+		v.Set("h", strconv.Itoa(h))
+	}
+	return "/img?" + v.Encode()
+}
+
+// imageHandler serves a merchant image, given by the url parameter, resized
+// to fit within the w and h parameters, keeping its aspect ratio. Images are
+// only scaled down. They are re-encoded as JPEG, or PNG if they have
+// transparency; WebP would be smaller, but Go has no WebP encoder.
+func imageHandler(w http.ResponseWriter, r *http.Request) *appError {
+	src := r.FormValue("url")
+	u, err := url.Parse(src)
+	if err != nil || src == "" {
+		return appErrorfCode(fmt.Errorf("invalid image URL %q", src), http.StatusBadRequest, "invalid image URL")
+	}
+	if err := checkImageURL(u); err != nil {
+		return appErrorfCode(err, http.StatusForbidden, "%v", err)
+	}
+	width, e := imageDimension(r, "w")
+	if e != nil {
+		return e
+	}
+	height, e := imageDimension(r, "h")
+	if e != nil {
+		return e
+	}
+
+	key := fmt.Sprintf("%s|%d|%d", src, width, height)
+	img, ok := resizedImages.get(key)
+	if !ok {
+		if img, err = fetchResized(r.Context(), u.String(), width, height); err != nil {
+			return appErrorfCode(err, http.StatusBadGateway, "could not fetch image: %v", err)
+		}
+		resizedImages.add(key, img)
+	}
+	w.Header().Set("Content-Type", img.contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(img.data)
+	return nil
+}
+
+// imageDimension parses the named dimension parameter, which defaults to 0.
+func imageDimension(r *http.Request, name string) (int, *appError) {
+	v := r.FormValue(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > maxImageDimension {
+		return 0, appErrorfCode(fmt.Errorf("invalid %s %q", name, v), http.StatusBadRequest, "invalid %s %q: must be from 0 to %d", name, v, maxImageDimension)
+	}
+	return n, nil
+}
+
+// encodedImage is an image as served by the proxy.
+type encodedImage struct {
+	contentType string
+	data        []byte
+}
+
+// fetchResized fetches the image at src and resizes and encodes it.
+func fetchResized(ctx context.Context, src string, width, height int) (encodedImage, error) {
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return encodedImage{}, err
+	}
+	res, err := imageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return encodedImage{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return encodedImage{}, fmt.Errorf("got status %s", res.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxImageSize+1))
+	if err != nil {
+		return encodedImage{}, err
+	}
+	if len(b) > maxImageSize {
+		return encodedImage{}, fmt.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return encodedImage{}, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return encodedImage{}, fmt.Errorf("image of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return encodedImage{}, err
+	}
+	return encodeImage(resize(img, width, height))
+}
+
+// fitSize returns the size of an image of w by h pixels scaled down to fit
+// within maxW by maxH, keeping its aspect ratio. A zero bound is ignored.
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	fw, fh := int(float64(w)*scale+0.5), int(float64(h)*scale+0.5)
+	if fw < 1 {
+		fw = 1
+	}
+	if fh < 1 {
+		fh = 1
+	}
+	return fw, fh
+}
+
+// resize scales img down to fit within maxW by maxH, averaging the source
+// pixels covered by each pixel of the result.
+func resize(img image.Image, maxW, maxH int) image.Image {
+	b := img.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), maxW, maxH)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r, g, bl, a = r+uint64(c.R), g+uint64(c.G), bl+uint64(c.B), a+uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8((r / n) >> 8), G: uint8((g / n) >> 8), B: uint8((bl / n) >> 8), A: uint8((a / n) >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// encodeImage encodes img as PNG if it has transparent pixels, and
+// otherwise as JPEG.
+func encodeImage(img image.Image) (encodedImage, error) {
+	var buf bytes.Buffer
+	if opaque(img) {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return encodedImage{}, err
+		}
+		return encodedImage{contentType: "image/jpeg", data: buf.Bytes()}, nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return encodedImage{}, err
+	}
+	return encodedImage{contentType: "image/png", data: buf.Bytes()}, nil
+}
+
+// opaque reports whether img has no transparent pixels.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// imageCache keeps the most recently used images up to a total size.
+type imageCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *imageEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type imageEntry struct {
+	key string
+	img encodedImage
+}
+
+func newImageCache(maxSize int) *imageCache {
+	return &imageCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached image with the given key, if there is one.
+func (c *imageCache) get(key string) (encodedImage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return encodedImage{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*imageEntry).img, true
+}
+
+// add caches img under key, evicting the least recently used images to make
+// room. Images larger than the whole cache aren't kept.
+func (c *imageCache) add(key string, img encodedImage) {
+	if len(img.data) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= len(e.Value.(*imageEntry).img.data)
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&imageEntry{key: key, img: img})
+	c.size += len(img.data)
+	for c.size > c.maxSize {
+		e := c.order.Back()
+		old := e.Value.(*imageEntry)
+		c.order.Remove(e)
+		delete(c.entries, old.key)
+		c.size -= len(old.img.data)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// imageServer serves merchant images by path to the image client, without a
+// network, and counts the requests.
+type imageServer struct {
+	images   map[string]image.Image
+	requests int
+}
+
+func (s *imageServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.requests++
+	w := httptest.NewRecorder()
+	switch img, ok := s.images[req.URL.Path]; {
+	case req.URL.Path == "/moved":
+		http.Redirect(w, req, "http://metadata.internal/computeMetadata/v1/", http.StatusFound)
+	case !ok:
+		http.NotFound(w, req)
+	default:
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+	}
+	res := w.Result()
+	res.Request = req
+	return res, nil
+}
+
+// useImageProxy allows the proxy to fetch from the hosts, through server,
+// with an empty cache, until the test ends.
+func useImageProxy(t *testing.T, server *imageServer, hosts ...string) {
+	savedHosts, savedClient, savedCache := imageHosts, imageClient, resizedImages
+	t.Cleanup(func() { imageHosts, imageClient, resizedImages = savedHosts, savedClient, savedCache })
+	client := *imageClient
+	client.Transport = server
+	imageHosts, imageClient, resizedImages = hosts, &client, newImageCache(imageCacheSize)
+}
+
+// filledImage returns a w by h image of the color.
+func filledImage(w, h int, c color.Color) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// proxyURL returns the /img URL of src with the other parameters.
+func proxyURL(src string, params ...string) string {
+	v := url.Values{"url": {src}}
+	for i := 0; i+1 < len(params); i += 2 {
+		v.Set(params[i], params[i+1])
+	}
+	return "/img?" + v.Encode()
+}
+
+func TestFitSize(t *testing.T) {
+	for _, tt := range []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+	}{
+		{400, 200, 100, 0, 100, 50},
+		{400, 200, 0, 100, 200, 100},
+		{400, 200, 100, 100, 100, 50},
+		{200, 400, 100, 100, 50, 100},
+		{400, 200, 1000, 1000, 400, 200},
+		{400, 200, 0, 0, 400, 200},
+		{1000, 1, 10, 0, 10, 1},
+	} {
+		if w, h := fitSize(tt.w, tt.h, tt.maxW, tt.maxH); w != tt.wantW || h != tt.wantH {
+			t.Errorf("fitSize(%d, %d, %d, %d) = %d, %d; want %d, %d", tt.w, tt.h, tt.maxW, tt.maxH, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	// Black on the left and white on the right, which halving keeps apart.
+	src := filledImage(4, 2, color.White)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			src.(*image.NRGBA).Set(x, y, color.Black)
+		}
+	}
+	dst := resize(src, 2, 0)
+	if b := dst.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("resized image is %dx%d, want 2x1", b.Dx(), b.Dy())
+	}
+	if r, _, _, _ := dst.At(0, 0).RGBA(); r>>8 != 0 {
+		t.Errorf("left pixel has red %d, want 0", r>>8)
+	}
+	if r, _, _, _ := dst.At(1, 0).RGBA(); r>>8 != 0xff {
+		t.Errorf("right pixel has red %d, want 255", r>>8)
+	}
+	if resize(src, 10, 10) != src {
+		t.Error("resizing to a larger size changed the image")
+	}
+}
+
+func TestImageHostAllowed(t *testing.T) {
+	useImageProxy(t, &imageServer{}, "images.example.com", ".cdn.example.net")
+	for host, want := range map[string]bool{
+		"images.example.com":     true,
+		"IMAGES.example.com":     true,
+		"cdn.example.net":        true,
+		"eu.cdn.example.net":     true,
+		"example.com":            false,
+		"www.images.example.com": false,
+		"evilcdn.example.net":    false,
+		"":                       false,
+	} {
+		if got := imageHostAllowed(host); got != want {
+			t.Errorf("imageHostAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	for _, tt := range []struct{ src, want string }{
+		{"https://images.example.com/a.png", "/img?url=https%3A%2F%2Fimages.example.com%2Fa.png&w=300"},
+		{"https://other.example.com/a.png", "https://other.example.com/a.png"},
+		{"ftp://images.example.com/a.png", "ftp://images.example.com/a.png"},
+	} {
+		if got := imageURL(tt.src, 300, 0); got != tt.want {
+			t.Errorf("imageURL(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	server := &imageServer{images: map[string]image.Image{
+		"/chair.png": filledImage(400, 200, color.NRGBA{R: 200, A: 255}),
+		"/clear.png": filledImage(400, 200, color.NRGBA{}),
+	}}
+	useImageProxy(t, server, "images.example.com")
+
+	w := get(t, nil, proxyURL("https://images.example.com/chair.png", "w", "100"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("resizing an image: status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("opaque image served as %q, want image/jpeg", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=86400" {
+		t.Errorf("image served with Cache-Control %q", cc)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("decoding the resized image: %v", err)
+	}
+	if format != "jpeg" || cfg.Width != 100 || cfg.Height != 50 {
+		t.Errorf("resized image is a %dx%d %s, want a 100x50 jpeg", cfg.Width, cfg.Height, format)
+	}
+
+	// The same size is served from the cache, another size is fetched.
+	if w := get(t, nil, proxyURL("https://images.example.com/chair.png", "w", "100")); w.Code != http.StatusOK || server.requests != 1 {
+		t.Errorf("resizing an image again: status %d after %d fetches, want 200 after 1", w.Code, server.requests)
+	}
+	if w := get(t, nil, proxyURL("https://images.example.com/chair.png", "h", "100")); w.Code != http.StatusOK || server.requests != 2 {
+		t.Errorf("resizing to another size: status %d after %d fetches, want 200 after 2", w.Code, server.requests)
+	}
+
+	w = get(t, nil, proxyURL("https://images.example.com/clear.png", "w", "100"))
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "image/png" {
+		t.Errorf("transparent image: status %d, served as %q; want 200 and image/png", w.Code, ct)
+	}
+}
+
+func TestImageHandlerErrors(t *testing.T) {
+	server := &imageServer{images: map[string]image.Image{
+		"/chair.png": filledImage(40, 20, color.Black),
+	}}
+	useImageProxy(t, server, "images.example.com")
+
+	for _, tt := range []struct {
+		name, target string
+		want         int
+	}{
+		{"no URL", "/img", http.StatusBadRequest},
+		{"a bad URL", proxyURL("https://images.example.com/%zz"), http.StatusBadRequest},
+		{"a disallowed host", proxyURL("https://other.example.com/chair.png"), http.StatusForbidden},
+		{"the metadata server", proxyURL("http://169.254.169.254/computeMetadata/v1/"), http.StatusForbidden},
+		{"another scheme", proxyURL("ftp://images.example.com/chair.png"), http.StatusForbidden},
+		{"a bad width", proxyURL("https://images.example.com/chair.png", "w", "abc"), http.StatusBadRequest},
+		{"a negative height", proxyURL("https://images.example.com/chair.png", "h", "-1"), http.StatusBadRequest},
+		{"a huge width", proxyURL("https://images.example.com/chair.png", "w", "5000"), http.StatusBadRequest},
+		{"a missing image", proxyURL("https://images.example.com/missing.png"), http.StatusBadGateway},
+		{"a redirect to another host", proxyURL("https://images.example.com/moved"), http.StatusBadGateway},
+	} {
+		if w := get(t, nil, tt.target); w.Code != tt.want {
+			t.Errorf("image with %s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+	// Only the missing image and the redirect were fetched.
+	if server.requests != 2 {
+		t.Errorf("proxy made %d requests, want 2", server.requests)
+	}
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34:443":           true,
+		"[2606:2800:220:1::]:443":     true,
+		"127.0.0.1:80":                false,
+		"10.1.2.3:80":                 false,
+		"192.168.0.1:80":              false,
+		"169.254.169.254:80":          false,
+		"[::1]:80":                    false,
+		"[fd00::1]:80":                false,
+		"metadata.google.internal:80": false,
+	} {
+		if err := publicAddressOnly("tcp", address, nil); (err == nil) != public {
+			t.Errorf("publicAddressOnly(%q) = %v, want public %v", address, err, public)
+		}
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	c := newImageCache(10)
+	img := func(size int) encodedImage { return encodedImage{contentType: "image/png", data: make([]byte, size)} }
+	c.add("a", img(4))
+	c.add("b", img(4))
+	c.get("a")
+	// Adding c evicts b, the least recently used.
+	c.add("c", img(4))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("after evicting, cached %q = %v, want %v", key, ok, want)
+		}
+	}
+	c.add("huge", img(11))
+	if _, ok := c.get("huge"); ok {
+		t.Error("cached an image larger than the cache")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("an image larger than the cache evicted the others")
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"offers"
+)
+
+// maxImportSize bounds the size of an uploaded import file.
+const maxImportSize = 32 << 20
+
+// importRowError is why a row of an import was rejected. Rows are numbered
+// from 1, not counting the CSV header.
+type importRowError struct {
+	Row   int    `json:"row"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// importSummary is the response of importHandler.
+type importSummary struct {
+	Inserted int              `json:"inserted"`
+	Updated  int              `json:"updated"`
+	Failed   int              `json:"failed"`
+	Errors   []importRowError `json:"errors,omitempty"`
+}
+
+// importRow is an offer read from an import, or the error reading it.
+type importRow struct {
+	offer *offers.Offer
+	err   error
+}
+
+// importHandler adds or updates the offers of a CSV file, with the columns
+// of csvHeader in any order, or of a JSON array of offers, as selected by
+// the Content-Type. Every offer is checked with Offer.Validate. Invalid rows
+// are skipped and reported, unless strict=true, in which case nothing is
+// imported if any row is invalid. The valid offers are written in one
+// transaction.
+//
+// Imported offers that aren't in Merchant Center are deleted by the next
+// complete sync, like any offer the sync doesn't see.
+func importHandler(w http.ResponseWriter, r *http.Request) *appError {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	var rows []importRow
+	switch mediaType {
+	case "text/csv":
+		rows, err = readCSVOffers(body)
+	case "application/json":
+		rows, err = readJSONOffers(body)
+	default:
+		return &appError{
+			Error:   fmt.Errorf("unsupported import content type %q", mediaType),
+			Message: "import must be text/csv or application/json",
+			Code:    http.StatusUnsupportedMediaType,
+		}
+	}
+	if err != nil {
+		return &appError{Error: err, Message: err.Error(), Code: http.StatusBadRequest}
+	}
+
+	var summary importSummary
+	var valid []*offers.Offer
+	var ids []string
+	for i, row := range rows {
+		if row.err == nil {
+			row.err = row.offer.Validate()
+		}
+		if row.err != nil {
+			e := importRowError{Row: i + 1, Error: row.err.Error()}
+			if row.offer != nil {
+				e.ID = row.offer.ID
+			}
+			summary.Errors = append(summary.Errors, e)
+			summary.Failed++
+			continue
+		}
+		valid = append(valid, row.offer)
+		ids = append(ids, row.offer.ID)
+	}
+	if summary.Failed > 0 && r.URL.Query().Get("strict") == "true" {
+		return writeJSONStatus(w, http.StatusBadRequest, summary)
+	}
+
+	existing, err := offers.DB.GetOffersByIDs(r.Context(), ids)
+	if err != nil {
+		return appErrorf(err, "could not look up offers: %v", err)
+	}
+	found := make(map[string]bool, len(existing))
+	for _, o := range existing {
+		found[o.ID] = true
+	}
+	if _, err := offers.DB.BulkUpsertOffers(r.Context(), valid); err != nil {
+		return appErrorf(err, "could not import offers: %v", err)
+	}
+	for _, o := range valid {
+		if found[o.ID] {
+			summary.Updated++
+		} else {
+			summary.Inserted++
+			// Count an offer listed twice as inserted once.
+			found[o.ID] = true
+		}
+	}
+	return writeJSON(w, summary)
+}
+
+// readCSVOffers reads the offers of a CSV file whose header row names its
+// columns, from those of csvHeader. Rows that can't be parsed are returned
+// with their error.
+func readCSVOffers(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("import has no header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read header row: %v", err)
+	}
+	columns := make([]int, len(header))
+	for i, name := range header {
+		columns[i] = -1
+		for j, known := range csvHeader {
+			if name == known {
+				columns[i] = j
+			}
+		}
+		if columns[i] < 0 {
+			return nil, fmt.Errorf("unknown column %q; supported columns are %v", name, csvHeader)
+		}
+	}
+	// Rows may have a different number of fields than the header; those
+	// are rejected one by one.
+	cr.FieldsPerRecord = -1
+
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			rows = append(rows, importRow{err: err})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read import: %v", err)
+		}
+		if len(record) != len(header) {
+			rows = append(rows, importRow{err: fmt.Errorf("row has %d fields, want %d", len(record), len(header))})
+			continue
+		}
+		// fields is in the order of csvHeader, like offerRecord.
+		fields := make([]string, len(csvHeader))
+		for i, v := range record {
+			fields[columns[i]] = v
+		}
+		rows = append(rows, importRow{offer: &offers.Offer{
+			ID:          fields[0],
+			Title:       fields[1],
+			Price:       fields[2],
+			Currency:    fields[3],
+			ImageURL:    fields[4],
+			Description: fields[5],
+			MerchantURL: fields[6],
+		}})
+	}
+}
+
+// readJSONOffers reads a JSON array of offers, with the field names of the
+// JSON API. Elements that aren't valid offers are returned with their error.
+func readJSONOffers(r io.Reader) ([]importRow, error) {
+	var elems []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&elems); err != nil {
+		return nil, fmt.Errorf("import must be a JSON array of offers: %v", err)
+	}
+	rows := make([]importRow, len(elems))
+	for i, elem := range elems {
+		o := new(offers.Offer)
+		if err := json.Unmarshal(elem, o); err != nil {
+			rows[i].err = fmt.Errorf("invalid offer: %v", err)
+			continue
+		}
+		rows[i].offer = o
+	}
+	return rows, nil
+}
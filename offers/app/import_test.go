@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"offers"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// partlyInvalidImports are import files, by content type, updating offer a,
+// adding offer b and holding two invalid rows: one with a malformed price
+// and one that can't be read as an offer.
+var partlyInvalidImports = map[string]string{
+	"text/csv": "id,title,price,currency,image_url,merchant_url\n" +
+		"a,Teak chair,12.00,USD,https://example.com/a.png,https://example.com/a\n" +
+		"b,Table,20.00,USD,https://example.com/b.png,https://example.com/b\n" +
+		"c,Lamp,cheap,USD,https://example.com/c.png,https://example.com/c\n" +
+		"d,Sofa\n",
+	"application/json": `[
+		{"id": "a", "title": "Teak chair", "price": "12.00", "currency": "USD", "image_url": "https://example.com/a.png", "merchant_url": "https://example.com/a"},
+		{"id": "b", "title": "Table", "price": "20.00", "currency": "USD", "image_url": "https://example.com/b.png", "merchant_url": "https://example.com/b"},
+		{"id": "c", "title": "Lamp", "price": "cheap", "currency": "USD", "image_url": "https://example.com/c.png", "merchant_url": "https://example.com/c"},
+		{"id": "d", "title": 7}
+	]`,
+}
+
+// postImport serves an import of body, returning the status and summary.
+func postImport(t *testing.T, db offers.OfferDatabase, target, contentType, body string) (int, importSummary) {
+	t.Helper()
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := serveRequest(t, db, r)
+	var summary importSummary
+	if w.Code == http.StatusOK || w.Code == http.StatusBadRequest {
+		if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+			t.Fatalf("decoding the import summary: %v", err)
+		}
+	}
+	return w.Code, summary
+}
+
+func TestImportLenient(t *testing.T) {
+	for contentType, body := range partlyInvalidImports {
+		db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+		code, summary := postImport(t, db, "/admin/offers/import", contentType, body)
+		if code != http.StatusOK {
+			t.Fatalf("%s import: status %d, want 200", contentType, code)
+		}
+		if summary.Inserted != 1 || summary.Updated != 1 || summary.Failed != 2 {
+			t.Errorf("%s import summary = %+v, want 1 inserted, 1 updated and 2 failed", contentType, summary)
+		}
+		var rows []int
+		for _, e := range summary.Errors {
+			rows = append(rows, e.Row)
+		}
+		if !reflect.DeepEqual(rows, []int{3, 4}) || summary.Errors[0].ID != "c" || !strings.Contains(summary.Errors[0].Error, "invalid price") {
+			t.Errorf("%s import errors = %+v, want rows 3 and 4", contentType, summary.Errors)
+		}
+
+		list, err := db.GetOffersByIDs(context.Background(), []string{"a", "b", "c", "d"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := offerIDs(list); !reflect.DeepEqual(got, []string{"a", "b"}) || list[0].Title != "Teak chair" {
+			t.Errorf("offers after %s import = %q, want a updated and b added", contentType, got)
+		}
+	}
+}
+
+func TestImportStrict(t *testing.T) {
+	for contentType, body := range partlyInvalidImports {
+		db := newTestDB(t, testOffer("a", "Garden chair", "10.00"))
+		code, summary := postImport(t, db, "/admin/offers/import?strict=true", contentType, body)
+		if code != http.StatusBadRequest {
+			t.Fatalf("strict %s import: status %d, want 400", contentType, code)
+		}
+		if summary.Inserted != 0 || summary.Updated != 0 || summary.Failed != 2 || len(summary.Errors) != 2 {
+			t.Errorf("strict %s import summary = %+v, want only the 2 failures", contentType, summary)
+		}
+		list, err := db.GetOffersByIDs(context.Background(), []string{"a", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Title != "Garden chair" {
+			t.Errorf("strict %s import with invalid rows changed the offers: %q", contentType, offerIDs(list))
+		}
+	}
+}
+
+func TestImportRejectsFile(t *testing.T) {
+	db := newTestDB(t)
+	for _, tt := range []struct {
+		contentType, body string
+		want              int
+	}{
+		{"application/xml", "<offers/>", http.StatusUnsupportedMediaType},
+		{"text/csv", "", http.StatusBadRequest},
+		{"text/csv", "id,title,colour\n", http.StatusBadRequest},
+		{"application/json", `{"id": "a"}`, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("POST", "/admin/offers/import", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		if code := serveRequest(t, db, r).Code; code != tt.want {
+			t.Errorf("%s import of %q: status %d, want %d", tt.contentType, tt.body, code, tt.want)
+		}
+	}
+}
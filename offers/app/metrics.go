@@ -0,0 +1,66 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"offers"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "offers_http_request_duration_seconds",
+	Help: "Duration of HTTP requests, by route, method and status code.",
+}, []string{"route", "method", "code"})
+
+func init() {
+	prometheus.MustRegister(httpDuration)
+}
+
+// configureMetrics records metrics of the calls to the offers databases. It
+// must be called after configureKeepalive, which needs the MySQL databases
+// themselves, and before configureCache, so cache hits aren't counted as
+// database calls.
+func configureMetrics() {
+	instrumented := offers.NewInstrumentedDB(offers.DB)
+	if offers.SyncDB == offers.DB {
+		offers.SyncDB = instrumented
+	} else {
+		offers.SyncDB = offers.NewInstrumentedDB(offers.SyncDB)
+	}
+	offers.DB = instrumented
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// metricsMiddleware records the duration and status of every request routed
+// by the router. Requests are labeled with the route's path template rather
+// than the path, so offer IDs don't each get their own series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := ""
+		if cur := mux.CurrentRoute(r); cur != nil {
+			route, _ = cur.GetPathTemplate()
+		}
+		httpDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.code)).
+			Observe(time.Since(start).Seconds())
+	})
+}
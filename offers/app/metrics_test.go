@@ -0,0 +1,61 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"offers"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	savedDB, savedSyncDB := offers.DB, offers.SyncDB
+	defer func() { offers.DB, offers.SyncDB = savedDB, savedSyncDB }()
+	offers.DB = newTestDB(t, testOffer("a", "Chair", "10.00"))
+	offers.SyncDB = offers.DB
+	configureMetrics()
+
+	router := newRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/offers/a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/offers/a: status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", w.Code)
+	}
+	body := w.Body.String()
+	if !hasSample(body, "offers_db_operation_duration_seconds_count", `method="GetOffer"`) {
+		t.Errorf("/metrics doesn't report the GetOffer call:\n%s", body)
+	}
+	if !hasSample(body, "offers_http_request_duration_seconds_count", `route="/api/v1/offers/{offer_id}"`, `method="GET"`, `code="200"`) {
+		t.Errorf("/metrics doesn't report the request:\n%s", body)
+	}
+}
+
+// hasSample reports whether the exposition text has a sample of the named
+// metric with all the labels, in any order.
+func hasSample(text, name string, labels ...string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, name+"{") {
+			continue
+		}
+		found := true
+		for _, l := range labels {
+			if !strings.Contains(line, l) {
+				found = false
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// forwardedHopsEnv optionally sets how many X-Forwarded-For entries,
+	// counting from the end, are added by the proxies in front of the app.
+	// The client's address is the first of them. 0 ignores the header.
+	forwardedHopsEnv = "FORWARDED_HOPS"
+	// appEngineForwardedHops is the default on App Engine, whose load
+	// balancer appends the client's address and its own.
+	appEngineForwardedHops = 2
+)
+
+// forwardedHops is the number of trusted X-Forwarded-For entries, set by
+// configureClientIP.
+var forwardedHops int
+
+// windowLimiter allows up to limit events per key in each fixed time window.
+type windowLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newWindowLimiter(limit int, window time.Duration) *windowLimiter {
+	return &windowLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]int),
+	}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+func (l *windowLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Starting a new window forgets all keys, which keeps memory bounded by
+	// the number of distinct keys seen in one window.
+	if now := time.Now(); now.Sub(l.start) >= l.window {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[key] >= l.limit {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+// tokenBucket allows events at a steady rate, with bursts of up to burst
+// events after a quiet period. Unlike windowLimiter, it limits all clients
+// together.
+type tokenBucket struct {
+	// interval is the time it takes to earn a token.
+	interval time.Duration
+	burst    float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket earning perMinute tokens a minute.
+func newTokenBucket(perMinute, burst int) *tokenBucket {
+	return &tokenBucket{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// take uses a token if one is available. Otherwise it returns how long it
+// will be until one is.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+float64(now.Sub(b.last))/float64(b.interval))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(b.interval))
+}
+
+// rateLimited serves requests with next as long as b has tokens, and
+// responds with 429 Too Many Requests otherwise, saying when to retry.
+func rateLimited(b *tokenBucket, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := b.take()
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// configureClientIP sets how many X-Forwarded-For entries clientIP trusts.
+func configureClientIP() {
+	forwardedHops = 0
+	if os.Getenv(appEngineInstanceEnv) != "" {
+		forwardedHops = appEngineForwardedHops
+	}
+	if v := os.Getenv(forwardedHopsEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid %s: %q", forwardedHopsEnv, v)
+		}
+		forwardedHops = n
+	}
+}
+
+// clientIP returns the IP address of the client making the request. Behind
+// proxies this is the earliest X-Forwarded-For entry they added; entries
+// before it are sent by the client, which can forge them.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Values("X-Forwarded-For"); forwardedHops > 0 && len(fwd) > 0 {
+		hops := strings.Split(strings.Join(fwd, ","), ",")
+		i := len(hops) - forwardedHops
+		if i < 0 {
+			i = 0
+		}
+		return strings.TrimSpace(hops[i])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(60, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("take %d of the burst failed", i+1)
+		}
+	}
+	ok, wait := b.take()
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("take after the burst = %t, %v; want a wait of up to a second", ok, wait)
+	}
+
+	// Tokens are earned back at the rate, up to the burst.
+	b.last = b.last.Add(-1500 * time.Millisecond)
+	if ok, _ := b.take(); !ok {
+		t.Error("take after a second and a half failed")
+	}
+	if ok, wait := b.take(); ok || wait > 500*time.Millisecond {
+		t.Errorf("second take after a second and a half = %t, %v; want a wait of up to half a second", ok, wait)
+	}
+	b.last = b.last.Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("take %d after an hour failed", i+1)
+		}
+	}
+	if ok, _ := b.take(); ok {
+		t.Error("take beyond the burst after an hour succeeded")
+	}
+}
+
+// useForwardedHops configures clientIP as on App Engine or not, with the
+// FORWARDED_HOPS setting if it isn't empty, until the test ends.
+func useForwardedHops(t *testing.T, hops string, onAppEngine bool) {
+	saved := forwardedHops
+	t.Cleanup(func() { forwardedHops = saved })
+	instance := ""
+	if onAppEngine {
+		instance = "aef-default-1"
+	}
+	t.Setenv(appEngineInstanceEnv, instance)
+	t.Setenv(forwardedHopsEnv, hops)
+	configureClientIP()
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		hops        string
+		onAppEngine bool
+		forwarded   []string
+		want        string
+	}{
+		{"without proxies", "", false, nil, "192.0.2.9"},
+		{"ignoring the header without proxies", "", false, []string{"203.0.113.7"}, "192.0.2.9"},
+		{"on App Engine", "", true, []string{"203.0.113.7, 198.51.100.1"}, "203.0.113.7"},
+		{"with a forged entry", "", true, []string{"10.0.0.1, 203.0.113.7, 198.51.100.1"}, "203.0.113.7"},
+		{"with forged headers", "", true, []string{"10.0.0.1", "203.0.113.7,198.51.100.1"}, "203.0.113.7"},
+		{"with too few entries", "", true, []string{"203.0.113.7"}, "203.0.113.7"},
+		{"without the header", "", true, nil, "192.0.2.9"},
+		{"with one proxy", "1", false, []string{"10.0.0.1, 203.0.113.7"}, "203.0.113.7"},
+		{"ignoring the header on App Engine", "0", true, []string{"203.0.113.7, 198.51.100.1"}, "192.0.2.9"},
+	} {
+		useForwardedHops(t, tt.hops, tt.onAppEngine)
+		r := httptest.NewRequest("POST", "/offers/a/report", nil)
+		r.RemoteAddr = "192.0.2.9:1234"
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReportLimitForgedForwardedFor(t *testing.T) {
+	saved := reportLimiter
+	defer func() { reportLimiter = saved }()
+	reportLimiter = newWindowLimiter(2, time.Hour)
+	useForwardedHops(t, "", true)
+
+	db := newTestDB(t, testOffer("a", "A", "1.00"))
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/offers/a/report", strings.NewReader(url.Values{"reason": {"wrong price"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		// A new forged first entry each time, before what the load
+		// balancer appends.
+		r.Header.Set("X-Forwarded-For", "10.0.0."+strconv.Itoa(i)+", 203.0.113.7, 198.51.100.1")
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if w := serveRequest(t, db, r); w.Code != want {
+			t.Errorf("report %d with a forged X-Forwarded-For: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
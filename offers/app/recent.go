@@ -0,0 +1,77 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"offers"
+	"time"
+)
+
+const (
+	// recentCookie stores the IDs of the offers a shopper viewed most
+	// recently, newest first. Offer IDs are public, so the cookie is not
+	// signed: changing it only changes which offers are listed.
+	recentCookie = "recently_viewed"
+	// maxRecent is the number of recently viewed offers remembered.
+	maxRecent = 10
+	// recentMaxAge is how long the recently viewed cookie is kept.
+	recentMaxAge = 30 * 24 * time.Hour
+)
+
+// recentlyViewed returns the IDs of the offers recently viewed by the client
+// making the request, newest first.
+func recentlyViewed(r *http.Request) []string {
+	c, err := r.Cookie(recentCookie)
+	if err != nil {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil
+	}
+	if len(ids) > maxRecent {
+		ids = ids[:maxRecent]
+	}
+	return ids
+}
+
+// recordRecentlyViewed adds id to the front of the client's recently viewed
+// offers.
+func recordRecentlyViewed(w http.ResponseWriter, r *http.Request, id string) {
+	ids := []string{id}
+	for _, prev := range recentlyViewed(r) {
+		if prev != id && len(ids) < maxRecent {
+			ids = append(ids, prev)
+		}
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     recentCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     "/",
+		MaxAge:   int(recentMaxAge / time.Second),
+		HttpOnly: true,
+	})
+}
+
+// recentlyViewedHandler lists the offers the client viewed most recently.
+func recentlyViewedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	recent, err := offers.DB.GetOffersByIDs(r.Context(), recentlyViewed(r))
+	if err != nil {
+		return appErrorf(err, "could not get recently viewed offers: %v", err)
+	}
+	convertPrices(requestCurrency(r), recent)
+	return listTmpl.Execute(w, r, listView{Heading: "Recently viewed", Offers: recent})
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"offers"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// browser sends requests with the cookies set by earlier responses.
+type browser struct {
+	t       *testing.T
+	db      offers.OfferDatabase
+	cookies map[string]*http.Cookie
+}
+
+func (b *browser) get(target string) *httptest.ResponseRecorder {
+	b.t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := serveRequest(b.t, b.db, r)
+	for _, c := range w.Result().Cookies() {
+		b.cookies[c.Name] = c
+	}
+	return w
+}
+
+// view gets the detail page of the offer with the given ID.
+func (b *browser) view(id string) {
+	b.t.Helper()
+	o, err := b.db.GetOffer(context.Background(), id)
+	if err != nil {
+		b.t.Fatalf("GetOffer(%s): %v", id, err)
+	}
+	if w := b.get(o.URL()); w.Code != http.StatusOK {
+		b.t.Fatalf("GET %s: status %d, want %d", o.URL(), w.Code, http.StatusOK)
+	}
+}
+
+// recent returns the recently viewed offer IDs stored in the cookie.
+func (b *browser) recent() []string {
+	r := httptest.NewRequest("GET", "/", nil)
+	if c, ok := b.cookies[recentCookie]; ok {
+		r.AddCookie(c)
+	}
+	return recentlyViewed(r)
+}
+
+func TestRecentlyViewed(t *testing.T) {
+	var list []*offers.Offer
+	for i := 0; i < maxRecent+2; i++ {
+		list = append(list, testOffer(fmt.Sprintf("o%02d", i), fmt.Sprintf("Offer %02d", i), "1.00"))
+	}
+	b := &browser{t: t, db: newTestDB(t, list...), cookies: map[string]*http.Cookie{}}
+
+	if w := b.get("/recently-viewed"); w.Code != http.StatusOK {
+		t.Fatalf("GET /recently-viewed before any view: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	b.view("o00")
+	b.view("o01")
+	b.view("o02")
+	if got, want := b.recent(), []string{"o02", "o01", "o00"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recently viewed = %q, want newest first %q", got, want)
+	}
+	// Viewing an offer again moves it to the front, without repeating it.
+	b.view("o00")
+	if got, want := b.recent(), []string{"o00", "o02", "o01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recently viewed after a repeated view = %q, want %q", got, want)
+	}
+
+	// Only the newest maxRecent views are kept.
+	for _, o := range list[3:] {
+		b.view(o.ID)
+	}
+	got := b.recent()
+	if len(got) != maxRecent {
+		t.Fatalf("%d offers recently viewed, want the cap of %d", len(got), maxRecent)
+	}
+	if got[0] != "o11" || got[maxRecent-2] != "o03" || got[maxRecent-1] != "o00" {
+		t.Errorf("recently viewed = %q, want o11 to o03, then o00", got)
+	}
+
+	w := b.get("/recently-viewed")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /recently-viewed: status %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	last := -1
+	for _, id := range got {
+		title := "Offer " + strings.TrimPrefix(id, "o")
+		i := strings.Index(body, title)
+		if i < 0 {
+			t.Errorf("%s isn't listed", title)
+		} else if i < last {
+			t.Errorf("%s isn't listed after the offers viewed since", title)
+		}
+		last = i
+	}
+	if strings.Contains(body, "Offer 01") || strings.Contains(body, "Offer 02") {
+		t.Errorf("offers viewed before the newest %d are listed", maxRecent)
+	}
+}
+
+func TestRecentlyViewedInvalidCookie(t *testing.T) {
+	for _, value := range []string{"not base64!", "bm90IGpzb24"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: recentCookie, Value: value})
+		if ids := recentlyViewed(r); ids != nil {
+			t.Errorf("recentlyViewed with cookie %q = %q, want none", value, ids)
+		}
+	}
+}
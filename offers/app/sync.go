@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"offers"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSyncJobs is the number of finished sync jobs whose status is kept.
+const maxSyncJobs = 20
+
+// The states of a sync job.
+const (
+	syncRunning   = "running"
+	syncSucceeded = "succeeded"
+	syncFailed    = "failed"
+)
+
+// syncJob is the status of a sync started by updateHandler.
+type syncJob struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Products int        `json:"products_processed"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Summary describes the statistics of a succeeded sync.
+	Summary string `json:"summary,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// syncJobs runs syncs in the background, one at a time, and keeps the status
+// of the recent ones. Jobs are only known to the instance running them.
+type syncJobs struct {
+	mu      sync.Mutex
+	jobs    map[string]*syncJob
+	order   []string // job IDs, oldest first
+	running *syncJob
+	lastID  int64
+}
+
+var syncs = &syncJobs{jobs: map[string]*syncJob{}}
+
+// runUpdate syncs the offers of a merchant. Tests replace it.
+var runUpdate = offers.RunUpdate
+
+// start runs run in a new goroutine, unless a sync is already running, and
+// returns the new job. If a sync is running, it returns that job and false.
+// run must call progress with the statistics so far as it goes.
+func (s *syncJobs) start(run func(progress func(offers.SyncStats)) (offers.SyncStats, error)) (syncJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != nil {
+		return *s.running, false
+	}
+	s.lastID++
+	job := &syncJob{
+		ID:      strconv.FormatInt(s.lastID, 10),
+		State:   syncRunning,
+		Started: time.Now(),
+	}
+	s.running = job
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	if len(s.order) > maxSyncJobs {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	go func() {
+		stats, err := run(func(stats offers.SyncStats) {
+			s.mu.Lock()
+			job.Products = stats.Products
+			s.mu.Unlock()
+		})
+		s.finish(job, stats, err)
+	}()
+	return *job, true
+}
+
+// finish records the outcome of job and lets another sync start.
+func (s *syncJobs) finish(job *syncJob, stats offers.SyncStats, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	job.Finished = &now
+	job.Products = stats.Products
+	if err != nil {
+		log.Printf("sync %s failed: %v", job.ID, err)
+		job.State = syncFailed
+		job.Error = err.Error()
+	} else {
+		job.State = syncSucceeded
+		job.Summary = stats.String()
+	}
+	s.running = nil
+}
+
+// status returns the status of the job with the given ID.
+func (s *syncJobs) status(id string) (syncJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return syncJob{}, false
+	}
+	return *job, true
+}
+
+// updateHandler starts updating the sqlDB with the latest offers using the
+// contentAPI, and responds with the sync job without waiting for it.
+func updateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(os.Getenv(merchantIDEnv), 10, 64)
+	if err != nil {
+		return appErrorf(err, "error while parsing merchant id")
+	}
+	job, ok := syncs.start(func(progress func(offers.SyncStats)) (offers.SyncStats, error) {
+		return runUpdate(id, apiLog, progress)
+	})
+	if !ok {
+		return &appError{
+			Error:   fmt.Errorf("sync %s is already running", job.ID),
+			Message: fmt.Sprintf("sync %s is already running", job.ID),
+			Code:    http.StatusConflict,
+		}
+	}
+	w.Header().Set("Location", "/tasks/update_db/status/"+job.ID)
+	return writeJSONStatus(w, http.StatusAccepted, job)
+}
+
+// updateStatusHandler reports the status of a sync job.
+func updateStatusHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id := mux.Vars(r)["job_id"]
+	job, ok := syncs.status(id)
+	if !ok {
+		return &appError{
+			Error:   errors.New("unknown sync job " + id),
+			Message: "no such sync job",
+			Code:    http.StatusNotFound,
+		}
+	}
+	return writeJSON(w, job)
+}
@@ -9,12 +9,34 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// templateFuncs are the functions available to all templates.
+var templateFuncs = template.FuncMap{
+	"formatPrice":  formatPrice,
+	"truncate":     truncate,
+	"highlight":    highlight,
+	"relativeTime": relativeTime,
+	"urlHost":      urlHost,
+	"imageURL":     imageURL,
+}
+
+// RegisterTemplateFunc makes fn available to templates under the given name,
+// replacing any existing function with that name. fn must be a function that
+// html/template accepts in a FuncMap. It must be called before the templates
+// are parsed at startup.
+func RegisterTemplateFunc(name string, fn interface{}) {
+	templateFuncs[name] = fn
+}
+
 // parseTemplate applies a given file to the body of the base template.
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	tmpl := template.Must(template.New("base.html").Funcs(templateFuncs).ParseFiles("templates/base.html"))
 
 	// Put the named file into a template called "body"
 	path := filepath.Join("templates", filename)
@@ -42,7 +64,83 @@ func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data in
 	}
 
 	if err := tmpl.t.Execute(w, d); err != nil {
-		return appErrorf(err, "could not write template: %v")
+		return appErrorf(err, "could not write template: %v", err)
 	}
 	return nil
 }
+
+// formatPrice formats a price with two decimal places followed by its
+// currency. Prices that aren't numbers are shown as they are.
+func formatPrice(price, currency string) string {
+	if v, err := strconv.ParseFloat(price, 64); err == nil {
+		price = strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	return strings.TrimSpace(price + " " + currency)
+}
+
+// truncate shortens s to at most n characters, ending it with an ellipsis if
+// anything was removed.
+func truncate(n int, s string) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+	return strings.TrimSpace(string(r[:n-1])) + "…"
+}
+
+// highlight escapes s and marks case-insensitive occurrences of q in it.
+func highlight(s, q string) template.HTML {
+	lower, lq := strings.ToLower(s), strings.ToLower(q)
+	// Lowercasing can change the byte length of some characters, in which
+	// case offsets into lower don't apply to s.
+	if lq == "" || len(lower) != len(s) {
+		return template.HTML(template.HTMLEscapeString(s))
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(lower, lq)
+		if i < 0 {
+			b.WriteString(template.HTMLEscapeString(s))
+			break
+		}
+		j := i + len(lq)
+		b.WriteString(template.HTMLEscapeString(s[:i]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(s[i:j]) + "</mark>")
+		s, lower = s[j:], lower[j:]
+	}
+	return template.HTML(b.String())
+}
+
+// relativeTime describes how long ago t was, such as "3 hours ago".
+func relativeTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute") + " ago"
+	case d < 24*time.Hour:
+		return plural(int(d/time.Hour), "hour") + " ago"
+	default:
+		return plural(int(d/(24*time.Hour)), "day") + " ago"
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// urlHost returns the host name of a URL, or "" if it has none.
+func urlHost(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTemplateDir runs the rest of the test in a directory whose templates
+// are the app's base template and body, the body template given.
+func useTemplateDir(t *testing.T, body string) {
+	t.Helper()
+	base, err := ioutil.ReadFile(filepath.Join("templates", "base.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{"base.html": base, "test.html": []byte(body)} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "templates", name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// render parses the test template and renders it with data.
+func render(t *testing.T, data interface{}) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if e := parseTemplate("test.html").Execute(w, httptest.NewRequest("GET", "/", nil), data); e != nil {
+		t.Fatalf("Execute: %v", e.Error)
+	}
+	return w.Body.String()
+}
+
+func TestRegisterTemplateFunc(t *testing.T) {
+	defer delete(templateFuncs, "shout")
+	RegisterTemplateFunc("shout", func(s string) string { return strings.ToUpper(s) + "!" })
+
+	useTemplateDir(t, `<p id="custom">{{shout .}}</p>`)
+	if got := render(t, "sale"); !strings.Contains(got, `<p id="custom">SALE!</p>`) {
+		t.Errorf("rendered template doesn't call the registered function:\n%s", got)
+	}
+}
+
+func TestRegisterTemplateFuncReplacesBuiltIn(t *testing.T) {
+	saved := templateFuncs["formatPrice"]
+	defer RegisterTemplateFunc("formatPrice", saved)
+	RegisterTemplateFunc("formatPrice", func(price, currency string) string { return currency + " " + price })
+
+	useTemplateDir(t, `<p id="custom">{{formatPrice "10" "EUR"}}</p>`)
+	if got := render(t, nil); !strings.Contains(got, `<p id="custom">EUR 10</p>`) {
+		t.Errorf("rendered template doesn't call the replacement:\n%s", got)
+	}
+}
+
+func TestBuiltInTemplateFuncs(t *testing.T) {
+	useTemplateDir(t, `<ul id="custom">
+<li>{{formatPrice "9.5" "USD"}}</li>
+<li>{{truncate 8 "Comfortable chair"}}</li>
+<li>{{highlight "Garden <Chair>" "chair"}}</li>
+<li>{{relativeTime .}}</li>
+<li>{{urlHost "https://shop.example.com/chair"}}</li>
+</ul>`)
+	got := render(t, time.Now().Add(-3*time.Hour))
+	for _, want := range []string{
+		"<li>9.50 USD</li>",
+		"<li>Comfort…</li>",
+		"<li>Garden &lt;<mark>Chair</mark>&gt;</li>",
+		"<li>3 hours ago</li>",
+		"<li>shop.example.com</li>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("rendered template doesn't include %q:\n%s", want, got)
+		}
+	}
+}
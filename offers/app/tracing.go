@@ -0,0 +1,70 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// otlpEndpointEnv is the standard OpenTelemetry variable setting where
+// spans are exported to. Without it, nothing is traced. The exporter also
+// reads the other OTEL_EXPORTER_OTLP_* variables.
+const otlpEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+// tracerProvider exports spans, or is nil if tracing isn't configured.
+var tracerProvider *sdktrace.TracerProvider
+
+// configureTracing exports the spans of requests and database calls over
+// OTLP if an endpoint is configured. Incoming requests continue the trace
+// of their W3C traceparent header.
+func configureTracing() {
+	if os.Getenv(otlpEndpointEnv) == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Fatalf("could not create span exporter: %v", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// shutdownTracing exports the spans not yet exported, if tracing is
+// configured.
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("could not export remaining spans: %v", err)
+	}
+}
+
+// tracingMiddleware traces every request routed by the router in a span
+// named after the route's path template. The database calls made with the
+// request's context are traced as its children.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			if cur := mux.CurrentRoute(r); cur != nil {
+				if tpl, err := cur.GetPathTemplate(); err == nil {
+					return r.Method + " " + tpl
+				}
+			}
+			return operation
+		}))
+}
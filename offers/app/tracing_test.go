@@ -0,0 +1,72 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"offers"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	// spans records the spans of the tests. The global tracer provider
+	// is only set once, since tracers obtained before then keep using the
+	// first provider set.
+	spans           = tracetest.NewSpanRecorder()
+	installProvider sync.Once
+)
+
+// recordSpans starts recording the spans ended from now on.
+func recordSpans() *tracetest.SpanRecorder {
+	installProvider.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	})
+	spans.Reset()
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	savedDB, savedSyncDB := offers.DB, offers.SyncDB
+	defer func() { offers.DB, offers.SyncDB = savedDB, savedSyncDB }()
+	offers.DB = offers.NewInstrumentedDB(newTestDB(t, testOffer("a", "Chair", "10.00")))
+	offers.SyncDB = offers.DB
+	recorder := recordSpans()
+
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/offers/a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/offers/a: status %d", w.Code)
+	}
+
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		byName[s.Name()] = s
+	}
+	request, ok := byName["GET /api/v1/offers/{offer_id}"]
+	if !ok {
+		t.Fatalf("no span for the request, got %v", byName)
+	}
+	call, ok := byName["OfferDatabase.GetOffer"]
+	if !ok {
+		t.Fatalf("no span for the GetOffer call, got %v", byName)
+	}
+	if call.Parent().SpanID() != request.SpanContext().SpanID() || call.SpanContext().TraceID() != request.SpanContext().TraceID() {
+		t.Errorf("GetOffer span has parent %v, want the request span %v", call.Parent().SpanID(), request.SpanContext().SpanID())
+	}
+	attrs := map[attribute.Key]string{}
+	for _, kv := range call.Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs["offer.id"] != "a" || attrs["db.operation"] != "GetOffer" {
+		t.Errorf("GetOffer span has attributes %v, want offer.id a and db.operation GetOffer", attrs)
+	}
+}
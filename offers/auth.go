@@ -5,11 +5,13 @@ package offers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"time"
@@ -25,13 +27,167 @@ const (
 	serviceAccountFile = "service-account.json"
 	oauth2ClientFile   = "client-secrets.json"
 	storedTokenFile    = "stored-token.json"
+
+	// DefaultClientTimeout is used when ClientConfig.Timeout is unset.
+	DefaultClientTimeout = time.Minute
+
+	// credentialsEnv names the credentials file of Application Default
+	// Credentials.
+	credentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS"
+)
+
+// AuthMethod selects how the Content API client authenticates.
+type AuthMethod string
+
+// The AuthMethods of ClientConfig.Auth.
+const (
+	// AuthAuto uses the first credentials configured: CredentialsJSON or
+	// CredentialsFile, else Application Default Credentials if
+	// GOOGLE_APPLICATION_CREDENTIALS is set, else the configuration
+	// directory. It is the default.
+	AuthAuto AuthMethod = ""
+	// AuthConfigDir reads a service account or OAuth2 client from the
+	// configuration directory, as the sample always did.
+	AuthConfigDir AuthMethod = "dir"
+	// AuthCredentials uses the credentials JSON in CredentialsJSON, or
+	// else in CredentialsFile.
+	AuthCredentials AuthMethod = "credentials"
+	// AuthDefault uses Application Default Credentials: the file named by
+	// GOOGLE_APPLICATION_CREDENTIALS, or on Google Cloud, the instance's
+	// service account or Workload Identity.
+	AuthDefault AuthMethod = "default"
 )
 
-func authWithGoogle(ctx context.Context, configPath string) *http.Client {
+// AuthMethods lists the valid authentication methods.
+var AuthMethods = []AuthMethod{AuthAuto, AuthConfigDir, AuthCredentials, AuthDefault}
+
+// ClientConfig configures the HTTP client used for Content API calls and for
+// fetching and refreshing OAuth2 tokens.
+type ClientConfig struct {
+	// Timeout bounds each request, including token refreshes.
+	// If zero, DefaultClientTimeout is used.
+	Timeout time.Duration
+
+	// Transport is the base transport requests are sent with. If nil, a
+	// transport with the same settings as http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Proxy selects the proxy for the default transport. It is ignored when
+	// Transport is set. If nil, http.ProxyFromEnvironment is used.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Auth selects how the client authenticates. It defaults to AuthAuto.
+	Auth AuthMethod
+
+	// CredentialsJSON and CredentialsFile hold and name credentials for
+	// AuthCredentials, such as a service account key. Any type of
+	// credentials JSON the google package accepts can be used, including
+	// Workload Identity Federation configurations. CredentialsJSON is used
+	// if both are set.
+	CredentialsJSON []byte
+	CredentialsFile string
+}
+
+// APIClient is the configuration used to build the Content API client.
+var APIClient ClientConfig
+
+func (c ClientConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultClientTimeout
+	}
+	return c.Timeout
+}
+
+func (c ClientConfig) transport() http.RoundTripper {
+	if c.Transport != nil {
+		return c.Transport
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != nil {
+		t.Proxy = c.Proxy
+	}
+	return t
+}
+
+// authWithGoogle returns an authenticated client configured by cfg. The
+// client's Transport may be wrapped afterwards, e.g. by logClient.
+func authWithGoogle(ctx context.Context, configPath string, cfg ClientConfig) (*http.Client, error) {
+	// The oauth2 package makes token requests with the client stored in the
+	// context, and uses its transport as the base for authenticated requests.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: cfg.transport(),
+		Timeout:   cfg.timeout(),
+	})
+	client, err := cfg.authClient(ctx, configPath)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = cfg.timeout()
+	return client, nil
+}
+
+// authClient returns a client authenticated as c.Auth selects.
+func (c ClientConfig) authClient(ctx context.Context, configPath string) (*http.Client, error) {
+	switch c.Auth {
+	case AuthAuto:
+		if len(c.CredentialsJSON) > 0 || c.CredentialsFile != "" {
+			return c.credentialsJSONClient(ctx)
+		}
+		if os.Getenv(credentialsEnv) != "" {
+			return defaultCredentialsClient(ctx)
+		}
+		return credentialsClient(ctx, configPath)
+	case AuthConfigDir:
+		return credentialsClient(ctx, configPath)
+	case AuthCredentials:
+		return c.credentialsJSONClient(ctx)
+	case AuthDefault:
+		return defaultCredentialsClient(ctx)
+	}
+	return nil, fmt.Errorf("unknown authentication method %q", c.Auth)
+}
+
+// credentialsJSONClient returns a client authenticated with the credentials
+// in c.CredentialsJSON or c.CredentialsFile.
+func (c ClientConfig) credentialsJSONClient(ctx context.Context) (*http.Client, error) {
+	json, source := c.CredentialsJSON, "the given credentials"
+	if len(json) == 0 {
+		if c.CredentialsFile == "" {
+			return nil, errors.New("authentication failed: no credentials JSON or file given")
+		}
+		fmt.Printf("Loading credentials from %s.\n", c.CredentialsFile)
+		var err error
+		if json, err = ioutil.ReadFile(c.CredentialsFile); err != nil {
+			return nil, err
+		}
+		source = c.CredentialsFile
+	}
+	creds, err := google.CredentialsFromJSON(ctx, json, content.ContentScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials in %s: %v", source, err)
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
+// defaultCredentialsClient returns a client authenticated with Application
+// Default Credentials.
+func defaultCredentialsClient(ctx context.Context) (*http.Client, error) {
+	fmt.Println("Using Application Default Credentials.")
+	creds, err := google.FindDefaultCredentials(ctx, content.ContentScope)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed: %v", err)
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
+func credentialsClient(ctx context.Context, configPath string) (*http.Client, error) {
 	// Other authentication options require there to be a configuration directory
 	// that contains the credentials.
 	if configPath == "" {
-		log.Fatal("Must use Application Default Credentials with no configuration directory.")
+		return nil, errors.New("must use Application Default Credentials with no configuration directory")
+	}
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("configuration directory %s does not exist", configPath)
 	}
 	// Second, check for service account info, since it's the easier auth flow.
 	serviceAccountPath := path.Join(configPath, serviceAccountFile)
@@ -39,14 +195,14 @@ func authWithGoogle(ctx context.Context, configPath string) *http.Client {
 		fmt.Printf("Loading service account from %s.\n", serviceAccountPath)
 		json, err := ioutil.ReadFile(serviceAccountPath)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		config, err := google.JWTConfigFromJSON(json, content.ContentScope)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("invalid service account %s: %v", serviceAccountPath, err)
 		}
 		fmt.Printf("Service account credentials for user %s found.\n", config.Email)
-		return config.Client(ctx)
+		return config.Client(ctx), nil
 	}
 	// Last chance for authentication, check for OAuth2 client secrets.
 	oauth2ClientPath := path.Join(configPath, oauth2ClientFile)
@@ -54,11 +210,11 @@ func authWithGoogle(ctx context.Context, configPath string) *http.Client {
 		fmt.Printf("Loading OAuth2 client from %s.\n", oauth2ClientPath)
 		json, err := ioutil.ReadFile(oauth2ClientPath)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		config, err := google.ConfigFromJSON(json, content.ContentScope)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("invalid OAuth2 client %s: %v", oauth2ClientPath, err)
 		}
 		fmt.Printf("OAuth2 client credentials for application %s found.\n", config.ClientID)
 		return newOAuthClient(ctx, config, configPath)
@@ -68,8 +224,7 @@ func authWithGoogle(ctx context.Context, configPath string) *http.Client {
 	fmt.Fprintln(os.Stderr, "- ", serviceAccountPath)
 	fmt.Fprintln(os.Stderr, "- ", oauth2ClientPath)
 	fmt.Fprintln(os.Stderr, "Please read the accompanying documentation.")
-	log.Fatalln("Authentication failed")
-	return nil
+	return nil, errors.New("authentication failed: no OAuth2 authentication files found")
 }
 
 func loadToken(tokenPath string) (*oauth2.Token, error) {
@@ -92,22 +247,25 @@ func storeToken(tokenPath string, token *oauth2.Token) error {
 	return ioutil.WriteFile(tokenPath, jsonBlob, 0660)
 }
 
-func newOAuthClient(ctx context.Context, config *oauth2.Config, configPath string) *http.Client {
+func newOAuthClient(ctx context.Context, config *oauth2.Config, configPath string) (*http.Client, error) {
 	tokenPath := path.Join(configPath, storedTokenFile)
 	token, err := loadToken(tokenPath)
 	if err != nil {
 		fmt.Printf("No stored token found in %s, re-authenticating.\n", tokenPath)
-		token = tokenFromWeb(ctx, config)
+		token, err = tokenFromWeb(ctx, config)
+		if err != nil {
+			return nil, err
+		}
 		if err := storeToken(tokenPath, token); err != nil {
 			fmt.Println("Error storing OAuth2 token, continuing.")
 		}
 	} else {
 		fmt.Printf("Using token stored in %v for authentication.\n", tokenPath)
 	}
-	return config.Client(ctx, token)
+	return config.Client(ctx, token), nil
 }
 
-func tokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+func tokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
 	ch := make(chan string)
 	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
 	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -138,13 +296,13 @@ func tokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
 	log.Printf("Authorize this app at: %s", authURL)
 	code := <-ch
 	if code == "" {
-		log.Fatalln("Authentication failed.")
+		return nil, errors.New("authentication failed: no authorization code received")
 	}
 	log.Printf("Got code: %s", code)
 
 	token, err := config.Exchange(ctx, code)
 	if err != nil {
-		log.Fatalf("Token exchange error: %v", err)
+		return nil, fmt.Errorf("token exchange error: %v", err)
 	}
-	return token
+	return token, nil
 }
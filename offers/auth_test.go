@@ -0,0 +1,306 @@
+package offers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testServiceAccount returns service account credentials whose tokens are
+// requested from tokenURL.
+func testServiceAccount(t *testing.T, tokenURL string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "sync@example.iam.gserviceaccount.com",
+		"private_key_id": "test",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})),
+		"token_uri": tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// tokenHandler issues the access token "test-token".
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`))
+}
+
+// apiHandler answers requests authorized with the token tokenHandler issues.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Write([]byte("{}"))
+}
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	n int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.n, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestAuthWithGoogleTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeout, want time.Duration
+	}{
+		{0, DefaultClientTimeout},
+		{5 * time.Second, 5 * time.Second},
+	} {
+		tokens := httptest.NewServer(http.HandlerFunc(tokenHandler))
+		cfg := ClientConfig{
+			Timeout:         tt.timeout,
+			Auth:            AuthCredentials,
+			CredentialsJSON: testServiceAccount(t, tokens.URL),
+		}
+		client, err := authWithGoogle(context.Background(), "", cfg)
+		tokens.Close()
+		if err != nil {
+			t.Fatalf("authWithGoogle: %v", err)
+		}
+		if client.Timeout != tt.want {
+			t.Errorf("Timeout %v: client timeout = %v, want %v", tt.timeout, client.Timeout, tt.want)
+		}
+	}
+}
+
+func TestAuthWithGoogleTokenRefreshTimesOut(t *testing.T) {
+	// The token endpoint hangs until the request is given up.
+	release := make(chan struct{})
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer tokens.Close()
+	defer close(release)
+	api := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer api.Close()
+
+	cfg := ClientConfig{
+		Timeout:         100 * time.Millisecond,
+		Auth:            AuthCredentials,
+		CredentialsJSON: testServiceAccount(t, tokens.URL),
+	}
+	client, err := authWithGoogle(context.Background(), "", cfg)
+	if err != nil {
+		t.Fatalf("authWithGoogle: %v", err)
+	}
+	start := time.Now()
+	_, err = client.Get(api.URL)
+	if err == nil {
+		t.Fatal("request succeeded without a token")
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("request error = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("request took %v to time out", d)
+	}
+}
+
+func TestAuthWithGoogleTransport(t *testing.T) {
+	tokens := httptest.NewServer(http.HandlerFunc(tokenHandler))
+	defer tokens.Close()
+	api := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer api.Close()
+
+	transport := &countingTransport{}
+	cfg := ClientConfig{
+		Transport:       transport,
+		Auth:            AuthCredentials,
+		CredentialsJSON: testServiceAccount(t, tokens.URL),
+	}
+	client, err := authWithGoogle(context.Background(), "", cfg)
+	if err != nil {
+		t.Fatalf("authWithGoogle: %v", err)
+	}
+	var log bytes.Buffer
+	logClient(client, &log)
+
+	res, err := client.Get(api.URL + "/content/v2/accounts/authinfo")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	// The token request and the API request go through the transport.
+	if n := atomic.LoadInt32(&transport.n); n != 2 {
+		t.Errorf("transport sent %d requests, want 2", n)
+	}
+	// The API request and its response are logged, but not the token
+	// request the logging transport wraps.
+	s := log.String()
+	if !strings.Contains(s, "GET /content/v2/accounts/authinfo") || !strings.Contains(s, "200 OK") {
+		t.Errorf("log doesn't include the API request and response:\n%s", s)
+	}
+	if strings.Contains(s, "access_token") {
+		t.Errorf("log includes the token request:\n%s", s)
+	}
+}
+
+func TestAuthWithGoogleProxy(t *testing.T) {
+	tokens := httptest.NewServer(http.HandlerFunc(tokenHandler))
+	defer tokens.Close()
+	api := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer api.Close()
+
+	var proxied []string
+	cfg := ClientConfig{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			proxied = append(proxied, r.URL.Host)
+			return nil, nil
+		},
+		Auth:            AuthCredentials,
+		CredentialsJSON: testServiceAccount(t, tokens.URL),
+	}
+	client, err := authWithGoogle(context.Background(), "", cfg)
+	if err != nil {
+		t.Fatalf("authWithGoogle: %v", err)
+	}
+	res, err := client.Get(api.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	res.Body.Close()
+	if len(proxied) != 2 {
+		t.Errorf("proxy consulted for %q, want the token and API hosts", proxied)
+	}
+}
+
+// credentialsTokens issues tokens like tokenHandler and records the paths
+// they were requested at, which tell the credentials used apart.
+type credentialsTokens struct {
+	*httptest.Server
+	paths []string
+}
+
+func newCredentialsTokens(t *testing.T) *credentialsTokens {
+	s := &credentialsTokens{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.paths = append(s.paths, r.URL.Path)
+		tokenHandler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// writeServiceAccount writes credentials requesting tokens at the path of
+// the server to a file in dir, returning its path.
+func (s *credentialsTokens) writeServiceAccount(t *testing.T, dir, name, path string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, testServiceAccount(t, s.URL+path), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestAuthMethods(t *testing.T) {
+	tokens := newCredentialsTokens(t)
+	api := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer api.Close()
+
+	dir := t.TempDir()
+	configDir := filepath.Join(dir, "merchant-center")
+	if err := os.Mkdir(configDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tokens.writeServiceAccount(t, configDir, serviceAccountFile, "/dir")
+	file := tokens.writeServiceAccount(t, dir, "key.json", "/file")
+	env := tokens.writeServiceAccount(t, dir, "adc.json", "/env")
+	blob := testServiceAccount(t, tokens.URL+"/json")
+
+	for _, tt := range []struct {
+		name string
+		cfg  ClientConfig
+		env  string
+		want string // the path tokens were requested at
+	}{
+		{"a credentials file", ClientConfig{Auth: AuthCredentials, CredentialsFile: file}, env, "/file"},
+		{"a credentials blob and file", ClientConfig{Auth: AuthCredentials, CredentialsJSON: blob, CredentialsFile: file}, "", "/json"},
+		{"default credentials", ClientConfig{Auth: AuthDefault, CredentialsFile: file}, env, "/env"},
+		{"the configuration directory", ClientConfig{Auth: AuthConfigDir, CredentialsFile: file}, env, "/dir"},
+		{"auto with a file", ClientConfig{CredentialsFile: file}, env, "/file"},
+		{"auto with the environment", ClientConfig{}, env, "/env"},
+		{"auto with nothing else", ClientConfig{}, "", "/dir"},
+	} {
+		t.Setenv(credentialsEnv, tt.env)
+		tokens.paths = nil
+		client, err := authWithGoogle(context.Background(), configDir, tt.cfg)
+		if err != nil {
+			t.Errorf("%s: authWithGoogle: %v", tt.name, err)
+			continue
+		}
+		res, err := client.Get(api.URL)
+		if err != nil {
+			t.Errorf("%s: GET: %v", tt.name, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || len(tokens.paths) != 1 || tokens.paths[0] != tt.want {
+			t.Errorf("%s: status %d with tokens from %q, want 200 with tokens from %s", tt.name, res.StatusCode, tokens.paths, tt.want)
+		}
+	}
+}
+
+func TestAuthMethodErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte(`{"type": "service_account"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(credentialsEnv, "")
+
+	for _, tt := range []struct {
+		name      string
+		cfg       ClientConfig
+		configDir string
+	}{
+		{"no credentials", ClientConfig{Auth: AuthCredentials}, dir},
+		{"a missing file", ClientConfig{Auth: AuthCredentials, CredentialsFile: filepath.Join(dir, "missing.json")}, dir},
+		{"an invalid file", ClientConfig{Auth: AuthCredentials, CredentialsFile: invalid}, dir},
+		{"an invalid blob", ClientConfig{Auth: AuthCredentials, CredentialsJSON: []byte("{}")}, dir},
+		{"a missing directory", ClientConfig{Auth: AuthConfigDir}, filepath.Join(dir, "missing")},
+		{"an empty directory", ClientConfig{}, dir},
+		{"an unknown method", ClientConfig{Auth: "magic", CredentialsFile: invalid}, dir},
+	} {
+		if _, err := authWithGoogle(context.Background(), tt.configDir, tt.cfg); err == nil {
+			t.Errorf("authWithGoogle with %s succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures the cache returned by NewCachedDB. Zero values
+// select the defaults.
+type CacheOptions struct {
+	// MaxEntries is the maximum number of cached search results.
+	MaxEntries int
+
+	// MaxOffers is the maximum number of offers cached by GetOffer.
+	MaxOffers int
+
+	// TTL is how long a cached result is served before it is fetched again.
+	TTL time.Duration
+
+	// MaxResultSize is the largest number of offers in a search result that
+	// will be cached. Larger results are always fetched from the database.
+	MaxResultSize int
+
+	// PollInterval, if set, is how often the database's ChangeToken is
+	// polled. The cache is cleared when it changes, so writes made outside
+	// the app are seen without waiting for entries to expire.
+	PollInterval time.Duration
+}
+
+// CacheInvalidator is implemented by databases returned by NewCachedDB, so
+// the cache can be flushed after out-of-band changes.
+type CacheInvalidator interface {
+	// InvalidateCache drops the cached offer and results containing it.
+	InvalidateCache(offerID string)
+
+	// InvalidateAll drops all cached results.
+	InvalidateAll()
+}
+
+const (
+	defaultCacheEntries    = 100
+	defaultCacheOffers     = 1000
+	defaultCacheTTL        = time.Minute
+	defaultCacheResultSize = 200
+)
+
+// cachedDB caches reads from an OfferDatabase in process.
+type cachedDB struct {
+	invalidatingDB
+
+	maxResultSize int
+
+	mu       sync.Mutex
+	searches *lruCache
+	offers   *lruCache // by offer ID
+	// gen is incremented on every invalidation, so results fetched before
+	// one aren't cached after it.
+	gen uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Ensure cachedDB conforms to the OfferDatabase and CacheInvalidator
+// interfaces.
+var (
+	_ OfferDatabase    = &cachedDB{}
+	_ CacheInvalidator = &cachedDB{}
+)
+
+// NewCachedDB returns an OfferDatabase that caches offers and search results
+// from inner. The cache is cleared whenever offers are written through it,
+// but writes made directly to inner or by other processes are only seen once
+// cached entries expire, opts.PollInterval notices a change, or the cache is
+// flushed through CacheInvalidator.
+func NewCachedDB(inner OfferDatabase, opts CacheOptions) OfferDatabase {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultCacheEntries
+	}
+	if opts.MaxOffers <= 0 {
+		opts.MaxOffers = defaultCacheOffers
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCacheTTL
+	}
+	if opts.MaxResultSize <= 0 {
+		opts.MaxResultSize = defaultCacheResultSize
+	}
+	db := &cachedDB{
+		maxResultSize: opts.MaxResultSize,
+		searches:      newLRUCache(opts.MaxEntries, opts.TTL),
+		offers:        newLRUCache(opts.MaxOffers, opts.TTL),
+	}
+	db.invalidatingDB = invalidatingDB{OfferDatabase: inner, cache: db}
+	if opts.PollInterval > 0 {
+		db.stop = make(chan struct{})
+		db.done = make(chan struct{})
+		go db.poll(opts.PollInterval)
+	}
+	return db
+}
+
+// poll clears the cache whenever the database's change token changes, until
+// the database is closed.
+func (db *cachedDB) poll(interval time.Duration) {
+	defer close(db.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	ctx := context.Background()
+	last, err := db.OfferDatabase.ChangeToken(ctx)
+	if err != nil {
+		log.Printf("cache: %v", err)
+	}
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-t.C:
+		}
+		token, err := db.OfferDatabase.ChangeToken(ctx)
+		if err != nil {
+			// Keep serving cached results; they still expire after the TTL.
+			log.Printf("cache: %v", err)
+			continue
+		}
+		if token != last {
+			db.InvalidateAll()
+			last = token
+		}
+	}
+}
+
+// Close stops polling and closes the underlying database.
+func (db *cachedDB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+	}
+	return db.OfferDatabase.Close()
+}
+
+// searchKey normalizes a query, its order and its limit into a cache key.
+// Search is case-insensitive, so queries differing only in case share an
+// entry, as do the empty order and limit and the defaults they stand for.
+func searchKey(q string, order SortOrder, limit int) string {
+	order, _ = searchOrder(order)
+	return string(order) + ":" + strconv.Itoa(searchLimit(limit)) + ":" + strings.ToLower(q)
+}
+
+// SearchOffers returns cached results for q in the given order if present.
+func (db *cachedDB) SearchOffers(ctx context.Context, q string, order SortOrder, limit int) ([]*Offer, error) {
+	key := searchKey(q, order, limit)
+	db.mu.Lock()
+	v, ok := db.searches.get(key)
+	gen := db.gen
+	db.mu.Unlock()
+	if ok {
+		return copyOffers(v.([]*Offer)), nil
+	}
+
+	offers, err := db.OfferDatabase.SearchOffers(ctx, q, order, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(offers) <= db.maxResultSize {
+		db.mu.Lock()
+		if db.gen == gen {
+			db.searches.add(key, copyOffers(offers))
+		}
+		db.mu.Unlock()
+	}
+	return offers, nil
+}
+
+// GetOffer returns the cached offer with the given ID if present. Errors,
+// including missing offers, aren't cached.
+func (db *cachedDB) GetOffer(ctx context.Context, id string) (*Offer, error) {
+	db.mu.Lock()
+	v, ok := db.offers.get(id)
+	gen := db.gen
+	db.mu.Unlock()
+	if ok {
+		o := *v.(*Offer)
+		return &o, nil
+	}
+
+	o, err := db.OfferDatabase.GetOffer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c := *o
+	db.mu.Lock()
+	if db.gen == gen {
+		db.offers.add(id, &c)
+	}
+	db.mu.Unlock()
+	return o, nil
+}
+
+// InvalidateAll drops all cached results.
+func (db *cachedDB) InvalidateAll() {
+	db.mu.Lock()
+	db.searches.clear()
+	db.offers.clear()
+	db.gen++
+	db.mu.Unlock()
+}
+
+// InvalidateCache drops the cached offer and the cached search results
+// containing it. Results it has been added to since they were cached aren't
+// dropped; use InvalidateAll after adding offers.
+func (db *cachedDB) InvalidateCache(offerID string) {
+	db.mu.Lock()
+	db.offers.remove(offerID)
+	db.searches.removeIf(func(v interface{}) bool {
+		for _, o := range v.([]*Offer) {
+			if o.ID == offerID {
+				return true
+			}
+		}
+		return false
+	})
+	db.gen++
+	db.mu.Unlock()
+}
+
+// invalidatingDB clears a cache whenever offers are written through it.
+// Caches embed it, with OfferDatabase set to the database they cache, so
+// they share which writes clear them. Other methods are passed straight
+// through.
+type invalidatingDB struct {
+	OfferDatabase
+	cache CacheInvalidator
+}
+
+// AddOffer adds the offer and clears the cache.
+func (db invalidatingDB) AddOffer(ctx context.Context, o *Offer) (int64, error) {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.AddOffer(ctx, o)
+}
+
+// UpdateOffer updates the offer and clears the cache.
+func (db invalidatingDB) UpdateOffer(ctx context.Context, o *Offer) error {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.UpdateOffer(ctx, o)
+}
+
+// UpdateOfferFields updates the offer's fields and clears the cache.
+func (db invalidatingDB) UpdateOfferFields(ctx context.Context, id string, fields map[string]interface{}) error {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.UpdateOfferFields(ctx, id, fields)
+}
+
+// UpsertOffer upserts the offer and clears the cache if it changed.
+func (db invalidatingDB) UpsertOffer(ctx context.Context, o *Offer) (int64, bool, error) {
+	id, written, err := db.OfferDatabase.UpsertOffer(ctx, o)
+	if written {
+		db.cache.InvalidateAll()
+	}
+	return id, written, err
+}
+
+// BulkUpsertOffers upserts the offers and clears the cache if any changed.
+func (db invalidatingDB) BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error) {
+	n, err := db.OfferDatabase.BulkUpsertOffers(ctx, offers)
+	if n > 0 {
+		db.cache.InvalidateAll()
+	}
+	return n, err
+}
+
+// WithTx runs fn in a transaction and clears the cache once it ends, since
+// the writes bypass the cache.
+func (db invalidatingDB) WithTx(ctx context.Context, fn func(SyncWriter) error) error {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.WithTx(ctx, fn)
+}
+
+// DeleteOffer deletes the offer and clears the cache.
+func (db invalidatingDB) DeleteOffer(ctx context.Context, id string) error {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.DeleteOffer(ctx, id)
+}
+
+// RecomputeConvertedPrices recomputes converted prices and clears the cache.
+func (db invalidatingDB) RecomputeConvertedPrices(ctx context.Context, converter CurrencyConverter, displayCurrency string) (int64, error) {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.RecomputeConvertedPrices(ctx, converter, displayCurrency)
+}
+
+// SetCanonicalProducts links duplicate offers and clears the cache.
+func (db invalidatingDB) SetCanonicalProducts(ctx context.Context, links map[string]string) error {
+	defer db.cache.InvalidateAll()
+	return db.OfferDatabase.SetCanonicalProducts(ctx, links)
+}
+
+// SetMetaOverrides stores the overrides and drops cached results containing
+// the offer.
+func (db invalidatingDB) SetMetaOverrides(ctx context.Context, offerID, title, description string) error {
+	defer db.cache.InvalidateCache(offerID)
+	return db.OfferDatabase.SetMetaOverrides(ctx, offerID, title, description)
+}
+
+// copyOffers returns a deep copy of offers, so callers can't modify cached
+// values.
+func copyOffers(offers []*Offer) []*Offer {
+	c := make([]*Offer, len(offers))
+	for i, o := range offers {
+		oc := *o
+		c[i] = &oc
+	}
+	return c
+}
+
+// lruCache is a size-bounded cache whose entries expire after a fixed TTL,
+// evicting the least recently used entry when full. It is not safe for
+// concurrent use.
+type lruCache struct {
+	max   int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(max int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		max:   max,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the unexpired value stored under key.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(e)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+// add stores value under key, evicting the least recently used entry if the
+// cache is full.
+func (c *lruCache) add(key string, value interface{}) {
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		entry := e.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	if c.ll.Len() > c.max {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// clear drops all entries.
+func (c *lruCache) clear() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// removeIf drops all entries whose value matches f.
+func (c *lruCache) removeIf(f func(interface{}) bool) {
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if f(e.Value.(*lruEntry).value) {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+// remove drops the entry with the given key, if any.
+func (c *lruCache) remove(key string) {
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*lruEntry).key)
+}
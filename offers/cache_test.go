@@ -0,0 +1,370 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers_test
+
+import (
+	"context"
+	"offers"
+	"offers/offerstest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// searchDB returns a mock database whose searches return n offers, and a
+// cache of it.
+func searchDB(n int, opts offers.CacheOptions) (*offerstest.MockDB, offers.OfferDatabase) {
+	mock := &offerstest.MockDB{
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			var list []*offers.Offer
+			for i := 0; i < n; i++ {
+				list = append(list, &offers.Offer{ID: strconv.Itoa(i), Title: q})
+			}
+			return list, nil
+		},
+	}
+	return mock, offers.NewCachedDB(mock, opts)
+}
+
+// search runs the search, failing the test on an error.
+func search(t *testing.T, db offers.OfferDatabase, q string, limit int) []*offers.Offer {
+	t.Helper()
+	list, err := db.SearchOffers(context.Background(), q, "", limit)
+	if err != nil {
+		t.Fatalf("SearchOffers(%q): %v", q, err)
+	}
+	return list
+}
+
+// checkSearches fails the test if the mock wasn't searched n times.
+func checkSearches(t *testing.T, mock *offerstest.MockDB, name string, n int) {
+	t.Helper()
+	if got := len(mock.CallsTo("SearchOffers")); got != n {
+		t.Errorf("%s: %d searches reached the database, want %d", name, got, n)
+	}
+}
+
+func TestCachedSearch(t *testing.T) {
+	mock, db := searchDB(3, offers.CacheOptions{})
+	defer db.Close()
+
+	search(t, db, "chair", 0)
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "repeated search", 1)
+
+	// Queries are normalized: case and the default limit don't matter.
+	search(t, db, "Chair", 0)
+	search(t, db, "CHAIR", offers.DefaultSearchLimit)
+	checkSearches(t, mock, "normalized search", 1)
+
+	// Another page size is another result.
+	search(t, db, "chair", offers.DefaultSearchLimit+1)
+	checkSearches(t, mock, "different limit", 2)
+}
+
+func TestCachedSearchCopies(t *testing.T) {
+	_, db := searchDB(1, offers.CacheOptions{})
+	defer db.Close()
+
+	search(t, db, "chair", 0)[0].Title = "changed"
+	if got := search(t, db, "chair", 0)[0].Title; got != "chair" {
+		t.Errorf("cached title = %q after changing a result, want %q", got, "chair")
+	}
+}
+
+func TestCachedSearchInvalidatedByWrites(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name  string
+		write func(db offers.OfferDatabase) error
+	}{
+		{"AddOffer", func(db offers.OfferDatabase) error {
+			_, err := db.AddOffer(ctx, &offers.Offer{ID: "new"})
+			return err
+		}},
+		{"UpdateOffer", func(db offers.OfferDatabase) error {
+			return db.UpdateOffer(ctx, &offers.Offer{ID: "0"})
+		}},
+		{"DeleteOffer", func(db offers.OfferDatabase) error {
+			return db.DeleteOffer(ctx, "0")
+		}},
+		{"WithTx", func(db offers.OfferDatabase) error {
+			return db.WithTx(ctx, func(tx offers.SyncWriter) error { return nil })
+		}},
+		{"InvalidateAll", func(db offers.OfferDatabase) error {
+			db.(offers.CacheInvalidator).InvalidateAll()
+			return nil
+		}},
+		{"InvalidateCache", func(db offers.OfferDatabase) error {
+			db.(offers.CacheInvalidator).InvalidateCache("1")
+			return nil
+		}},
+	} {
+		mock, db := searchDB(3, offers.CacheOptions{})
+		search(t, db, "chair", 0)
+		if err := tt.write(db); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		search(t, db, "chair", 0)
+		checkSearches(t, mock, "search after "+tt.name, 2)
+		db.Close()
+	}
+}
+
+func TestCachedSearchNotInvalidatedByUnchangedUpsert(t *testing.T) {
+	mock, db := searchDB(3, offers.CacheOptions{})
+	defer db.Close()
+
+	search(t, db, "chair", 0)
+	// The mock writes nothing, as if the offer was unchanged.
+	if _, _, err := db.UpsertOffer(context.Background(), &offers.Offer{ID: "0"}); err != nil {
+		t.Fatal(err)
+	}
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "search after an unchanged upsert", 1)
+}
+
+func TestCachedSearchSkipsLargeResults(t *testing.T) {
+	mock, db := searchDB(3, offers.CacheOptions{MaxResultSize: 2})
+	defer db.Close()
+
+	search(t, db, "chair", 0)
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "search with a large result", 2)
+}
+
+func TestCachedSearchBounded(t *testing.T) {
+	mock, db := searchDB(1, offers.CacheOptions{MaxEntries: 2})
+	defer db.Close()
+
+	search(t, db, "a", 0)
+	search(t, db, "b", 0)
+	search(t, db, "a", 0) // a is now the most recently used
+	search(t, db, "c", 0) // evicts b
+	checkSearches(t, mock, "filling the cache", 3)
+
+	search(t, db, "a", 0)
+	search(t, db, "c", 0)
+	checkSearches(t, mock, "searches still cached", 3)
+	search(t, db, "b", 0)
+	checkSearches(t, mock, "evicted search", 4)
+}
+
+func TestCachedSearchExpires(t *testing.T) {
+	mock, db := searchDB(1, offers.CacheOptions{TTL: 20 * time.Millisecond})
+	defer db.Close()
+
+	search(t, db, "chair", 0)
+	time.Sleep(40 * time.Millisecond)
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "search after the TTL", 2)
+}
+
+// catalogDB returns a mock database whose searches return the offers with
+// the IDs listed for the query, and a cache of it.
+func catalogDB(results map[string][]string, opts offers.CacheOptions) (*offerstest.MockDB, offers.OfferDatabase) {
+	mock := &offerstest.MockDB{
+		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+			var list []*offers.Offer
+			for _, id := range results[q] {
+				list = append(list, &offers.Offer{ID: id})
+			}
+			return list, nil
+		},
+		GetOfferFunc: func(ctx context.Context, id string) (*offers.Offer, error) {
+			return &offers.Offer{ID: id}, nil
+		},
+	}
+	return mock, offers.NewCachedDB(mock, opts)
+}
+
+// checkGets fails the test if the mock's GetOffer wasn't called for want, in
+// order.
+func checkGets(t *testing.T, mock *offerstest.MockDB, name string, want ...string) {
+	t.Helper()
+	var got []string
+	for _, args := range mock.CallsTo("GetOffer") {
+		got = append(got, args[0].(string))
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("%s: offers read from the database = %q, want %q", name, got, want)
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	ctx := context.Background()
+	mock, db := catalogDB(map[string][]string{"chair": {"1", "2"}, "table": {"3"}}, offers.CacheOptions{})
+	defer db.Close()
+	search(t, db, "chair", 0)
+	search(t, db, "table", 0)
+	for _, id := range []string{"1", "3"} {
+		if _, err := db.GetOffer(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mock.Reset()
+
+	// Only the offer and the results containing it are dropped.
+	db.(offers.CacheInvalidator).InvalidateCache("1")
+	search(t, db, "chair", 0)
+	search(t, db, "table", 0)
+	if calls := mock.CallsTo("SearchOffers"); len(calls) != 1 || calls[0][0] != "chair" {
+		t.Errorf("searches after invalidating offer 1 = %v, want one for chair", calls)
+	}
+	for _, id := range []string{"1", "3"} {
+		if _, err := db.GetOffer(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkGets(t, mock, "after invalidating offer 1", "1")
+	mock.Reset()
+
+	db.(offers.CacheInvalidator).InvalidateAll()
+	search(t, db, "chair", 0)
+	search(t, db, "table", 0)
+	checkSearches(t, mock, "after invalidating all", 2)
+	if _, err := db.GetOffer(ctx, "3"); err != nil {
+		t.Fatal(err)
+	}
+	checkGets(t, mock, "after invalidating all", "3")
+}
+
+// getOffer reads the offer from db, failing the test on an error.
+func getOffer(t *testing.T, db offers.OfferDatabase, id string) *offers.Offer {
+	t.Helper()
+	o, err := db.GetOffer(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetOffer(%s): %v", id, err)
+	}
+	return o
+}
+
+func TestCachedGetOffer(t *testing.T) {
+	mock, db := catalogDB(nil, offers.CacheOptions{})
+	defer db.Close()
+
+	getOffer(t, db, "1").Title = "changed by the caller"
+	if o := getOffer(t, db, "1"); o.Title != "" {
+		t.Errorf("cached offer has title %q, want it unaffected by callers", o.Title)
+	}
+	checkGets(t, mock, "reading an offer twice", "1")
+
+	// Errors aren't cached.
+	mock.GetOfferFunc = func(ctx context.Context, id string) (*offers.Offer, error) {
+		return nil, offers.ErrOfferNotFound
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetOffer(context.Background(), "2"); err != offers.ErrOfferNotFound {
+			t.Fatalf("GetOffer of a missing offer = %v, want ErrOfferNotFound", err)
+		}
+	}
+	checkGets(t, mock, "reading a missing offer twice", "1", "2", "2")
+}
+
+func TestCachedGetOfferInvalidatedByWrites(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name  string
+		write func(db offers.OfferDatabase) error
+	}{
+		{"UpdateOffer", func(db offers.OfferDatabase) error {
+			return db.UpdateOffer(ctx, &offers.Offer{ID: "1"})
+		}},
+		{"DeleteOffer", func(db offers.OfferDatabase) error {
+			return db.DeleteOffer(ctx, "1")
+		}},
+		{"sync", func(db offers.OfferDatabase) error {
+			return db.WithTx(ctx, func(tx offers.SyncWriter) error {
+				_, err := tx.DeleteOffers(ctx)
+				return err
+			})
+		}},
+	} {
+		mock, db := catalogDB(nil, offers.CacheOptions{})
+		getOffer(t, db, "1")
+		if err := tt.write(db); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		getOffer(t, db, "1")
+		checkGets(t, mock, "reading an offer after "+tt.name, "1", "1")
+		db.Close()
+	}
+}
+
+func TestCachedGetOfferBounded(t *testing.T) {
+	mock, db := catalogDB(nil, offers.CacheOptions{MaxOffers: 2, TTL: 20 * time.Millisecond})
+	defer db.Close()
+
+	for _, id := range []string{"1", "2", "1", "3", "1", "2"} {
+		getOffer(t, db, id)
+	}
+	// 3 evicts 2, the least recently used.
+	checkGets(t, mock, "filling the cache", "1", "2", "3", "2")
+
+	time.Sleep(40 * time.Millisecond)
+	getOffer(t, db, "1")
+	checkGets(t, mock, "reading an offer after the TTL", "1", "2", "3", "2", "1")
+}
+
+// waitFor polls cond until it is true, failing the test after a second.
+func waitFor(t *testing.T, name string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", name)
+		}
+	}
+}
+
+func TestCachePollInvalidates(t *testing.T) {
+	var mu sync.Mutex
+	token := "1"
+	setToken := func(v string) {
+		mu.Lock()
+		token = v
+		mu.Unlock()
+	}
+	mock, _ := catalogDB(map[string][]string{"chair": {"1"}}, offers.CacheOptions{})
+	mock.ChangeTokenFunc = func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return token, nil
+	}
+	const interval = 5 * time.Millisecond
+	db := offers.NewCachedDB(mock, offers.CacheOptions{PollInterval: interval})
+	searches := func() int { return len(mock.CallsTo("SearchOffers")) }
+	polls := func() int { return len(mock.CallsTo("ChangeToken")) }
+
+	search(t, db, "chair", 0)
+	// While the token doesn't change, results stay cached.
+	waitFor(t, "polls", func() bool { return polls() > 3 })
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "unchanged token", 1)
+
+	// An out-of-band write changes the token, and the next poll flushes
+	// the cache.
+	setToken("2")
+	waitFor(t, "the cache to be flushed", func() bool {
+		search(t, db, "chair", 0)
+		return searches() == 2
+	})
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "after the flush", 2)
+
+	// Closing stops polling.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n := polls()
+	time.Sleep(5 * interval)
+	if got := polls(); got != n {
+		t.Errorf("polled %d times after Close", got-n)
+	}
+	if calls := mock.CallsTo("Close"); len(calls) != 1 {
+		t.Errorf("inner database closed %d times, want once", len(calls))
+	}
+}
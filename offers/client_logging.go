@@ -1,14 +1,120 @@
 package offers
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
+// LogConfig configures logging of the Content API requests and responses
+// made by RunUpdate. The zero value disables logging.
+type LogConfig struct {
+	// Enabled turns logging on.
+	Enabled bool
+
+	// Path is the log file. Relative paths are resolved against the user's
+	// home directory. Missing parent directories are created.
+	Path string
+
+	// MaxSize is the size in bytes beyond which the log file is rotated,
+	// keeping the previous file with a ".1" suffix. If zero, the file grows
+	// without limit.
+	MaxSize int64
+}
+
+// resolvePath returns the absolute path of the log file.
+func (c LogConfig) resolvePath() (string, error) {
+	if c.Path == "" {
+		return "", errors.New("log: no path set")
+	}
+	if c.MaxSize < 0 {
+		return "", fmt.Errorf("log: negative max size %d", c.MaxSize)
+	}
+	if filepath.IsAbs(c.Path) {
+		return filepath.Clean(c.Path), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("log: could not resolve %q: %v", c.Path, err)
+	}
+	return filepath.Join(home, c.Path), nil
+}
+
+// open opens the log file for appending. It returns nil if logging is
+// disabled.
+func (c LogConfig) open() (io.WriteCloser, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	path, err := c.resolvePath()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("log: could not create directory: %v", err)
+	}
+	f := &rotatingFile{path: path, maxSize: c.MaxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// rotatingFile is a log file that is rotated when it exceeds maxSize. It is
+// not safe for concurrent use.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("log: could not open log file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("log: could not open log file: %v", err)
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return fmt.Errorf("log: could not close log file: %v", err)
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return fmt.Errorf("log: could not rotate log file: %v", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
 type loggedRoundTripper struct {
 	Output      io.Writer
 	OutputMutex *sync.Mutex
@@ -63,9 +169,13 @@ func (lrt loggedRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 }
 
 func logClient(client *http.Client, writer io.Writer) {
+	delegate := client.Transport
+	if delegate == nil {
+		delegate = http.DefaultTransport
+	}
 	client.Transport = loggedRoundTripper{
 		Output:      writer,
 		OutputMutex: &sync.Mutex{},
-		Delegate:    client.Transport,
+		Delegate:    delegate,
 	}
 }
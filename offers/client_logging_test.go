@@ -0,0 +1,125 @@
+package offers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogConfigResolvePath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	abs := filepath.Join(t.TempDir(), "logs", "api.log")
+
+	for _, tt := range []struct {
+		cfg     LogConfig
+		want    string
+		wantErr bool
+	}{
+		{cfg: LogConfig{Path: "api.log"}, want: filepath.Join(home, "api.log")},
+		{cfg: LogConfig{Path: "logs/../logs/api.log"}, want: filepath.Join(home, "logs", "api.log")},
+		{cfg: LogConfig{Path: abs}, want: abs},
+		{cfg: LogConfig{Path: abs + "/"}, want: abs},
+		{cfg: LogConfig{}, wantErr: true},
+		{cfg: LogConfig{Path: "api.log", MaxSize: -1}, wantErr: true},
+	} {
+		got, err := tt.cfg.resolvePath()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolvePath(%+v) = %q, want an error", tt.cfg, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolvePath(%+v): %v", tt.cfg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolvePath(%+v) = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestLogConfigDisabled(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	// A disabled config isn't validated and creates nothing.
+	for _, cfg := range []LogConfig{
+		{},
+		{Path: filepath.Join(t.TempDir(), "logs", "api.log")},
+		{Path: "api.log", MaxSize: -1},
+	} {
+		w, err := cfg.open()
+		if err != nil {
+			t.Errorf("open(%+v): %v", cfg, err)
+		}
+		if w != nil {
+			w.Close()
+			t.Errorf("open(%+v) returned a writer, want nil", cfg)
+		}
+		if cfg.Path != "" && filepath.IsAbs(cfg.Path) {
+			if _, err := os.Stat(filepath.Dir(cfg.Path)); !os.IsNotExist(err) {
+				t.Errorf("open(%+v) created the log directory", cfg)
+			}
+		}
+	}
+}
+
+func TestLogConfigOpenCreatesDirectories(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	w, err := LogConfig{Enabled: true, Path: "logs/content/api.log"}.open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := w.Write([]byte("request\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(home, "logs", "content", "api.log"))
+	if err != nil {
+		t.Fatalf("reading log: %v", err)
+	}
+	if string(b) != "request\n" {
+		t.Errorf("log = %q, want %q", b, "request\n")
+	}
+
+	// Reopening appends to the existing file.
+	w, err = LogConfig{Enabled: true, Path: "logs/content/api.log"}.open()
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	w.Write([]byte("again\n"))
+	w.Close()
+	b, _ = ioutil.ReadFile(filepath.Join(home, "logs", "content", "api.log"))
+	if string(b) != "request\nagain\n" {
+		t.Errorf("log after reopening = %q, want both writes", b)
+	}
+}
+
+func TestLogConfigRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	w, err := LogConfig{Enabled: true, Path: path, MaxSize: 10}.open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer w.Close()
+
+	for _, s := range []string{"aaaaaa", "bbbb", "cccccc"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("Write(%q): %v", s, err)
+		}
+	}
+	// The third write would take the file past 10 bytes, so it starts a
+	// new one and the first two are kept aside.
+	if b, _ := ioutil.ReadFile(path + ".1"); !bytes.Equal(b, []byte("aaaaaabbbb")) {
+		t.Errorf("rotated log = %q, want %q", b, "aaaaaabbbb")
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, []byte("cccccc")) {
+		t.Errorf("log = %q, want %q", b, "cccccc")
+	}
+}
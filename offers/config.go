@@ -6,14 +6,61 @@ package offers
 
 import (
 	"database/sql"
-	"log"
+	"fmt"
 	"os"
 )
 
 var (
+	// DB is the database offers are served from. It is nil until
+	// OpenDatabases is called.
 	DB OfferDatabase
+
+	// SyncDB is the database RunUpdate writes synced offers to. It is DB
+	// unless a separate sync connection is configured, which keeps heavy
+	// syncs from slowing down the storefront.
+	SyncDB OfferDatabase
+)
+
+// backendEnv selects the database backend: mysqlBackend, the default, or
+// memoryBackend, which keeps offers in memory for local development and is
+// emptied on every restart.
+const (
+	backendEnv    = "DB_BACKEND"
+	mysqlBackend  = "mysql"
+	memoryBackend = "memory"
 )
 
+// The serving connection is configured with these environment variables.
+// The user defaults to root with an empty password, which suits a local
+// MySQL server.
+const (
+	userEnv     = "DB_USER"
+	passwordEnv = "DB_PASSWORD"
+	instanceEnv = "DB_INSTANCE"
+)
+
+// Connections are encrypted as configured by these environment variables:
+// the TLSMode, and optional PEM files of the trusted CAs and of a client
+// certificate and key.
+const (
+	tlsModeEnv = "DB_TLS_MODE"
+	tlsCAEnv   = "DB_TLS_CA"
+	tlsCertEnv = "DB_TLS_CERT"
+	tlsKeyEnv  = "DB_TLS_KEY"
+)
+
+// The sync connection is configured with these environment variables. Unset
+// values default to those of the serving connection.
+const (
+	syncUserEnv     = "SYNC_DB_USER"
+	syncPasswordEnv = "SYNC_DB_PASSWORD"
+	syncInstanceEnv = "SYNC_DB_INSTANCE"
+)
+
+// createTableStatements create the database and its tables. The updated
+// column of offers is no longer used, since syncs keep track of the offers
+// they have seen themselves, but it is kept because scanOffer reads the
+// columns in order.
 var createTableStatements = []string{
 	`CREATE DATABASE IF NOT EXISTS library DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci';`,
 	`USE library;`,
@@ -21,70 +68,302 @@ var createTableStatements = []string{
 		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
 		offerId VARCHAR(255) NOT NULL,
 		title VARCHAR(255) NULL,
-		price VARCHAR(255) NULL,
+		price DECIMAL(15,2) NULL,
 		currency VARCHAR(255) NULL,
 		imageUrl VARCHAR(255) NULL,
 		description TEXT NULL,
 		merchantUrl VARCHAR(255) NULL,
 		updated BOOLEAN NOT NULL default 1,
-		PRIMARY KEY (id)
+		contentHash CHAR(64) NULL,
+		itemGroupId VARCHAR(255) NULL,
+		convertedPrice VARCHAR(255) NULL,
+		convertedCurrency VARCHAR(255) NULL,
+		updatedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		gtin VARCHAR(50) NULL,
+		canonicalProductId VARCHAR(255) NULL,
+		metaTitle VARCHAR(255) NULL,
+		metaDescription TEXT NULL,
+		quantity BIGINT NOT NULL DEFAULT 0,
+		brand VARCHAR(255) NULL,
+		createdAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		deletedAt DATETIME NULL,
+		category VARCHAR(255) NOT NULL DEFAULT '',
+		availability VARCHAR(32) NOT NULL DEFAULT '',
+		itemCondition VARCHAR(32) NOT NULL DEFAULT '',
+		salePrice DECIMAL(15,2) NULL,
+		version INT NOT NULL DEFAULT 0,
+		slug VARCHAR(255) NULL,
+		merchantId BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (id),
+		UNIQUE KEY uniq_offerId (offerId),
+		UNIQUE KEY uniq_slug (slug),
+		INDEX idx_itemGroupId (itemGroupId),
+		INDEX idx_updatedAt (updatedAt),
+		INDEX idx_canonicalProductId (canonicalProductId),
+		INDEX idx_brand (brand),
+		INDEX idx_createdAt (createdAt),
+		INDEX idx_deletedAt (deletedAt),
+		INDEX idx_category (category),
+		INDEX idx_merchantId (merchantId)
+	)`,
+	`CREATE TABLE IF NOT EXISTS offer_views (
+		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+		offerId VARCHAR(255) NOT NULL,
+		viewedAt DATETIME NOT NULL,
+		PRIMARY KEY (id),
+		INDEX idx_viewedAt (viewedAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS featured_offers (
+		offerId VARCHAR(255) NOT NULL,
+		position INT NOT NULL,
+		PRIMARY KEY (offerId)
+	)`,
+	`CREATE TABLE IF NOT EXISTS reservations (
+		id CHAR(32) NOT NULL,
+		offerId VARCHAR(255) NOT NULL,
+		quantity INT NOT NULL,
+		expiresAt DATETIME NOT NULL,
+		PRIMARY KEY (id),
+		INDEX idx_offerId_expiresAt (offerId, expiresAt),
+		INDEX idx_expiresAt (expiresAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS offer_reports (
+		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+		offerId VARCHAR(255) NOT NULL,
+		reason TEXT NOT NULL,
+		createdAt DATETIME NOT NULL,
+		PRIMARY KEY (id),
+		INDEX idx_createdAt (createdAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS reviews (
+		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+		offerId VARCHAR(255) NOT NULL,
+		rating TINYINT NOT NULL,
+		text TEXT NOT NULL,
+		createdAt DATETIME NOT NULL,
+		PRIMARY KEY (id),
+		INDEX idx_offerId_createdAt (offerId, createdAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_alerts (
+		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+		offerId VARCHAR(255) NOT NULL,
+		targetPrice DECIMAL(15,2) NOT NULL,
+		contact VARCHAR(255) NOT NULL,
+		createdAt DATETIME NOT NULL,
+		firedAt DATETIME NULL,
+		PRIMARY KEY (id),
+		INDEX idx_firedAt_offerId (firedAt, offerId)
 	)`,
 }
 
+// migrationStatements bring offers tables created by earlier versions up to
+// date. They are run in order on every start; statements that have already
+// been applied fail with a duplicate column or key error, which is ignored.
+var migrationStatements = []string{
+	`ALTER TABLE offers ADD COLUMN contentHash CHAR(64) NULL`,
+	`ALTER TABLE offers ADD COLUMN itemGroupId VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD INDEX idx_itemGroupId (itemGroupId)`,
+	`ALTER TABLE offers ADD COLUMN convertedPrice VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD COLUMN convertedCurrency VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD COLUMN updatedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP`,
+	`ALTER TABLE offers ADD INDEX idx_updatedAt (updatedAt)`,
+	`ALTER TABLE offers ADD COLUMN gtin VARCHAR(50) NULL`,
+	`ALTER TABLE offers ADD COLUMN canonicalProductId VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD INDEX idx_canonicalProductId (canonicalProductId)`,
+	`ALTER TABLE offers ADD COLUMN metaTitle VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD COLUMN metaDescription TEXT NULL`,
+	`ALTER TABLE offers ADD COLUMN quantity BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE offers ADD COLUMN brand VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD INDEX idx_brand (brand)`,
+	`ALTER TABLE offers ADD COLUMN deletedAt DATETIME NULL`,
+	`ALTER TABLE offers ADD INDEX idx_deletedAt (deletedAt)`,
+	`ALTER TABLE offers ADD COLUMN category VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE offers ADD INDEX idx_category (category)`,
+	`ALTER TABLE offers ADD COLUMN availability VARCHAR(32) NOT NULL DEFAULT ''`,
+	`ALTER TABLE offers ADD COLUMN itemCondition VARCHAR(32) NOT NULL DEFAULT ''`,
+	`ALTER TABLE offers ADD COLUMN salePrice DECIMAL(15,2) NULL`,
+	`ALTER TABLE offers ADD COLUMN version INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE offers ADD COLUMN slug VARCHAR(255) NULL`,
+	`ALTER TABLE offers ADD UNIQUE KEY uniq_slug (slug)`,
+	`ALTER TABLE offers ADD COLUMN merchantId BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE offers ADD INDEX idx_merchantId (merchantId)`,
+	// Keep only the newest row of offers stored more than once, which the
+	// unique index below requires. Once it exists, this deletes nothing.
+	`DELETE o FROM offers o JOIN offers newer ON newer.offerId = o.offerId AND newer.id > o.id`,
+	`ALTER TABLE offers ADD UNIQUE KEY uniq_offerId (offerId)`,
+}
+
 // mysqlDB persists offers to a MySQL instance.
 type mysqlDB struct {
 	conn *sql.DB
 
-	list          *sql.Stmt
-	listBy        *sql.Stmt
-	insert        *sql.Stmt
-	get           *sql.Stmt
-	update        *sql.Stmt
-	updateUpdated *sql.Stmt
-	delete        *sql.Stmt
+	// maxOpenConns and maxIdleConns are the pool limits conn was opened with.
+	maxOpenConns int
+	maxIdleConns int
+
+	// stop and done are set if a keepalive is running; see StartKeepalive.
+	stop chan struct{}
+	done chan struct{}
+
+	list         map[SortOrder]*sql.Stmt
+	listCount    *sql.Stmt
+	search       map[SortOrder]*sql.Stmt
+	searchCount  *sql.Stmt
+	priceRange   *sql.Stmt
+	purchasable  map[SortOrder]*sql.Stmt
+	all          *sql.Stmt
+	allSearch    *sql.Stmt
+	version      *sql.Stmt
+	changeToken  *sql.Stmt
+	listBy       *sql.Stmt
+	insert       *sql.Stmt
+	get          *sql.Stmt
+	bySlug       *sql.Stmt
+	unslugged    *sql.Stmt
+	takenSlugs   *sql.Stmt
+	setSlug      *sql.Stmt
+	exists       *sql.Stmt
+	variants     *sql.Stmt
+	update       *sql.Stmt
+	upsert       *sql.Stmt
+	deleteOne    *sql.Stmt
+	recordView   *sql.Stmt
+	trending     *sql.Stmt
+	newOffers    *sql.Stmt
+	category     *sql.Stmt
+	byMerchant   *sql.Stmt
+	restore      *sql.Stmt
+	purgeDeleted *sql.Stmt
+	pruneViews   *sql.Stmt
+	featured     *sql.Stmt
+	addReport    *sql.Stmt
+	listReports  *sql.Stmt
+	addReview    *sql.Stmt
+	getReviews   *sql.Stmt
+	rating       *sql.Stmt
+	addAlert     *sql.Stmt
+	listAlerts   *sql.Stmt
+	deleteAlert  *sql.Stmt
+	triggered    *sql.Stmt
+	fireAlert    *sql.Stmt
+	unfireAlert  *sql.Stmt
+	setMeta      *sql.Stmt
+	check        *sql.Stmt
+	duplicates   *sql.Stmt
+	brands       *sql.Stmt
+
+	purchasableCount   *sql.Stmt
+	releaseReservation *sql.Stmt
+	pruneReservations  *sql.Stmt
+}
+
+// OpenDatabases connects to the serving and sync databases, creating their
+// tables if needed, and sets DB and SyncDB. Nothing connects when the package
+// is imported, so it must be called before either is used. The databases are
+// configured by the file named by CONFIG_FILE if it is set, and otherwise by
+// the environment variables above. It returns an error if the configuration
+// names an unsupported backend.
+func OpenDatabases() error {
+	if path := os.Getenv(configFileEnv); path != "" {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			return err
+		}
+		return InitDB(cfg)
+	}
+	return InitDB(envConfig())
 }
 
-func init() {
-	var err error
+// envConfig returns the configuration set by the environment variables.
+func envConfig() DBConfig {
+	cfg := DBConfig{Backend: os.Getenv(backendEnv)}
 
 	// [START cloudsql]
-	// To use Cloud SQL, update the username,
-	// password and instance connection string. When running locally,
-	// localhost:3306 is used, and the instance name is ignored.
-	DB, err = configureCloudSQL(cloudSQLConfig{
+	// To use Cloud SQL, set DB_USER, DB_PASSWORD and DB_INSTANCE. When
+	// running locally, localhost:3306 is used, and the instance name is
+	// ignored.
+	serving := cloudSQLConfig{
 		Username: "root",
-		Password: "M@nnabhola0305",
-		// 	// The connection name of the Cloud SQL v2 instance, i.e.,
-		// 	// "project:region:instance-id"
-		// 	// Cloud SQL v1 instances are not supported.
-		Instance: "",
-	})
+		Password: os.Getenv(passwordEnv),
+		// The connection name of the Cloud SQL v2 instance, i.e.,
+		// "project:region:instance-id"
+		// Cloud SQL v1 instances are not supported.
+		Instance: os.Getenv(instanceEnv),
+	}
+	if v := os.Getenv(userEnv); v != "" {
+		serving.Username = v
+	}
+	cfg.MySQL = serving.mysqlConfig()
 	// [END cloudsql]
 
+	sync := serving
+	if v := os.Getenv(syncUserEnv); v != "" {
+		sync.Username = v
+		sync.Password = os.Getenv(syncPasswordEnv)
+	}
+	if v := os.Getenv(syncInstanceEnv); v != "" {
+		sync.Instance = v
+	}
+	if sync != serving {
+		c := sync.mysqlConfig()
+		cfg.Sync = &c
+	}
+	return cfg
+}
+
+// InitDB connects to the databases cfg describes, creating their tables if
+// needed, and sets DB and SyncDB, like OpenDatabases.
+func InitDB(cfg DBConfig) error {
+	switch cfg.Backend {
+	case "", mysqlBackend:
+	case memoryBackend:
+		DB = NewMemoryDB()
+		SyncDB = DB
+		return nil
+	default:
+		return fmt.Errorf("unknown backend %q; supported backends are %s and %s",
+			cfg.Backend, mysqlBackend, memoryBackend)
+	}
+
+	db, err := newMySQLDB(cfg.MySQL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	syncDB := db
+	if cfg.Sync != nil {
+		if syncDB, err = newMySQLDB(*cfg.Sync); err != nil {
+			db.Close()
+			return fmt.Errorf("sync database: %v", err)
+		}
+	}
+	DB, SyncDB = db, syncDB
+	return nil
 }
 
 type cloudSQLConfig struct {
 	Username, Password, Instance string
 }
 
-func configureCloudSQL(config cloudSQLConfig) (OfferDatabase, error) {
+// mysqlConfig returns the connection to the Cloud SQL instance through its
+// socket on App Engine, and to localhost:3306 elsewhere, encrypted as set by
+// the DB_TLS_ environment variables.
+func (config cloudSQLConfig) mysqlConfig() MySQLConfig {
+	c := MySQLConfig{
+		Username:       config.Username,
+		Password:       config.Password,
+		TLSMode:        TLSMode(os.Getenv(tlsModeEnv)),
+		CACertPath:     os.Getenv(tlsCAEnv),
+		ClientCertPath: os.Getenv(tlsCertEnv),
+		ClientKeyPath:  os.Getenv(tlsKeyEnv),
+	}
 	if os.Getenv("GAE_INSTANCE") != "" {
 		// Running in production.
-		return newMySQLDB(MySQLConfig{
-			Username:   config.Username,
-			Password:   config.Password,
-			UnixSocket: "/cloudsql/" + config.Instance,
-		})
+		c.UnixSocket = "/cloudsql/" + config.Instance
+		return c
 	}
 
 	// Running locally.
-	return newMySQLDB(MySQLConfig{
-		Username: config.Username,
-		Password: config.Password,
-		Host:     "localhost",
-		Port:     3306,
-	})
+	c.Host = "localhost"
+	c.Port = 3306
+	return c
 }
@@ -0,0 +1,188 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFileEnv optionally names a JSON or YAML file configuring the
+// databases, read with LoadConfig. If it is set, the DB_ and SYNC_DB_
+// environment variables are ignored.
+const configFileEnv = "CONFIG_FILE"
+
+// DBConfig describes the databases OpenDatabases connects to.
+type DBConfig struct {
+	// Backend is mysqlBackend, the default, or memoryBackend, which
+	// ignores the other fields.
+	Backend string
+
+	// MySQL configures the serving connection.
+	MySQL MySQLConfig
+
+	// Sync optionally configures a separate connection that RunUpdate
+	// writes synced offers through. If nil, SyncDB is DB.
+	Sync *MySQLConfig
+}
+
+// configFile is the layout of a file read by LoadConfig.
+type configFile struct {
+	Backend string           `json:"backend" yaml:"backend"`
+	MySQL   mysqlConfigFile  `json:"mysql" yaml:"mysql"`
+	Sync    *mysqlConfigFile `json:"sync" yaml:"sync"`
+}
+
+// mysqlConfigFile is the layout of a MySQL connection in a config file.
+type mysqlConfigFile struct {
+	Host     string `json:"host" yaml:"host"`
+	Port     int    `json:"port" yaml:"port"`
+	Socket   string `json:"socket" yaml:"socket"`
+	Instance string `json:"instance" yaml:"instance"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+
+	MaxOpenConns    int    `json:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns    int    `json:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxLifetime string `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+
+	TLS struct {
+		Mode string `json:"mode" yaml:"mode"`
+		CA   string `json:"ca" yaml:"ca"`
+		Cert string `json:"cert" yaml:"cert"`
+		Key  string `json:"key" yaml:"key"`
+	} `json:"tls" yaml:"tls"`
+}
+
+// envReference matches the ${VAR} references expanded in config files.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadConfig reads the database configuration from the JSON or YAML file at
+// path, as told by its .json, .yaml or .yml extension. For example:
+//
+//	backend: mysql
+//	mysql:
+//	  instance: project:region:instance
+//	  user: offers
+//	  password: ${DB_PASSWORD}
+//	  max_open_conns: 10
+//	  conn_max_lifetime: 5m
+//	  tls:
+//	    mode: verify-ca
+//	    ca: /etc/mysql/server-ca.pem
+//	sync:
+//	  instance: project:region:instance
+//	  user: sync
+//	  password: ${SYNC_DB_PASSWORD}
+//
+// A connection names a Cloud SQL instance, connected to through its socket
+// on App Engine and through localhost:3306 elsewhere, or a socket, or a
+// host and port, which default to localhost and 3306. ${VAR} in string
+// values is replaced by the environment variable VAR, so secrets needn't be
+// kept in the file; it is an error if VAR isn't set.
+func LoadConfig(path string) (DBConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return DBConfig{}, fmt.Errorf("config: %v", err)
+	}
+	var f configFile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		err = d.Decode(&f)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &f)
+	default:
+		return DBConfig{}, fmt.Errorf("config: unsupported file type %q; use .json, .yaml or .yml", ext)
+	}
+	if err != nil {
+		return DBConfig{}, fmt.Errorf("config: could not parse %s: %v", path, err)
+	}
+
+	cfg := DBConfig{}
+	if cfg.Backend, err = expandEnv(f.Backend); err != nil {
+		return DBConfig{}, err
+	}
+	if cfg.MySQL, err = f.MySQL.mysqlConfig(); err != nil {
+		return DBConfig{}, err
+	}
+	if f.Sync != nil {
+		sync, err := f.Sync.mysqlConfig()
+		if err != nil {
+			return DBConfig{}, fmt.Errorf("%v in sync", err)
+		}
+		cfg.Sync = &sync
+	}
+	return cfg, nil
+}
+
+// mysqlConfig returns the connection c describes, with its ${VAR}
+// references expanded.
+func (c mysqlConfigFile) mysqlConfig() (MySQLConfig, error) {
+	fields := []*string{
+		&c.Host, &c.Socket, &c.Instance, &c.User, &c.Password, &c.ConnMaxLifetime,
+		&c.TLS.Mode, &c.TLS.CA, &c.TLS.Cert, &c.TLS.Key,
+	}
+	for _, f := range fields {
+		v, err := expandEnv(*f)
+		if err != nil {
+			return MySQLConfig{}, err
+		}
+		*f = v
+	}
+
+	var config MySQLConfig
+	if c.Instance != "" {
+		config = cloudSQLConfig{Username: c.User, Password: c.Password, Instance: c.Instance}.mysqlConfig()
+	} else {
+		config = MySQLConfig{Username: c.User, Password: c.Password, Host: c.Host, Port: c.Port, UnixSocket: c.Socket}
+		if config.UnixSocket == "" && config.Host == "" {
+			config.Host = "localhost"
+		}
+		if config.UnixSocket == "" && config.Port == 0 {
+			config.Port = 3306
+		}
+	}
+	config.MaxOpenConns = c.MaxOpenConns
+	config.MaxIdleConns = c.MaxIdleConns
+	if c.ConnMaxLifetime != "" {
+		d, err := time.ParseDuration(c.ConnMaxLifetime)
+		if err != nil {
+			return MySQLConfig{}, fmt.Errorf("config: invalid conn_max_lifetime %q", c.ConnMaxLifetime)
+		}
+		config.ConnMaxLifetime = d
+	}
+	config.TLSMode = TLSMode(c.TLS.Mode)
+	config.CACertPath = c.TLS.CA
+	config.ClientCertPath = c.TLS.Cert
+	config.ClientKeyPath = c.TLS.Key
+	return config, nil
+}
+
+// expandEnv replaces the ${VAR} references in s with the values of the
+// environment variables they name. Other uses of $, such as in passwords,
+// are left alone.
+func expandEnv(s string) (string, error) {
+	var err error
+	s = envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("config: %s is not set", name)
+		}
+		return v
+	})
+	return s, err
+}
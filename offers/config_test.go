@@ -0,0 +1,306 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dbAfterInit and syncDBAfterInit are DB and SyncDB once the package's init
+// functions have run. Test files' init functions run after those of the
+// package, and none of them may connect to a database.
+var dbAfterInit, syncDBAfterInit OfferDatabase
+
+func init() {
+	dbAfterInit, syncDBAfterInit = DB, SyncDB
+}
+
+func TestEnvConfigSync(t *testing.T) {
+	t.Setenv("GAE_INSTANCE", "instance-1")
+	t.Setenv(userEnv, "storefront")
+	t.Setenv(passwordEnv, "serve-secret")
+	t.Setenv(instanceEnv, "project:region:serving")
+
+	// Without sync settings, syncs share the serving connection.
+	for _, env := range []string{syncUserEnv, syncPasswordEnv, syncInstanceEnv} {
+		t.Setenv(env, "")
+	}
+	if cfg := envConfig(); cfg.Sync != nil {
+		t.Errorf("sync config = %+v without sync settings, want none", *cfg.Sync)
+	}
+
+	t.Setenv(syncUserEnv, "sync")
+	t.Setenv(syncPasswordEnv, "sync-secret")
+	cfg := envConfig()
+	if cfg.Sync == nil {
+		t.Fatal("no sync config with a sync user set")
+	}
+	if cfg.Sync.Username != "sync" || cfg.Sync.Password != "sync-secret" || cfg.Sync.UnixSocket != "/cloudsql/project:region:serving" {
+		t.Errorf("sync config = %+v, want the sync user on the serving instance", *cfg.Sync)
+	}
+	if cfg.MySQL.Username != "storefront" || cfg.MySQL.Password != "serve-secret" {
+		t.Errorf("serving config = %+v, want the serving user", cfg.MySQL)
+	}
+
+	// A separate instance keeps the serving user unless another is set.
+	t.Setenv(syncUserEnv, "")
+	t.Setenv(syncInstanceEnv, "project:region:replica")
+	cfg = envConfig()
+	if cfg.Sync == nil {
+		t.Fatal("no sync config with a sync instance set")
+	}
+	if cfg.Sync.Username != "storefront" || cfg.Sync.UnixSocket != "/cloudsql/project:region:replica" {
+		t.Errorf("sync config = %+v, want the serving user on the sync instance", *cfg.Sync)
+	}
+	if cfg.MySQL.UnixSocket != "/cloudsql/project:region:serving" {
+		t.Errorf("serving socket = %q, want the serving instance", cfg.MySQL.UnixSocket)
+	}
+}
+
+func TestEnvConfigCredentials(t *testing.T) {
+	for _, env := range []string{"GAE_INSTANCE", userEnv, passwordEnv, instanceEnv, syncUserEnv, syncPasswordEnv, syncInstanceEnv} {
+		t.Setenv(env, "")
+	}
+	// Locally, the defaults suit a MySQL server without a root password.
+	cfg := envConfig()
+	if c := cfg.MySQL; c.Username != "root" || c.Password != "" || c.Host != "localhost" || c.Port != 3306 {
+		t.Errorf("default config = %+v, want root without a password on localhost:3306", c)
+	}
+
+	t.Setenv("GAE_INSTANCE", "instance-1")
+	t.Setenv(userEnv, "storefront")
+	t.Setenv(passwordEnv, "from-the-env")
+	t.Setenv(instanceEnv, "project:region:offers")
+	cfg = envConfig()
+	if c := cfg.MySQL; c.Username != "storefront" || c.Password != "from-the-env" || c.UnixSocket != "/cloudsql/project:region:offers" {
+		t.Errorf("config = %+v, want the user, password and instance from the environment", c)
+	}
+}
+
+func TestNoCredentialLiterals(t *testing.T) {
+	password := regexp.MustCompile(`(?i)password\s*[:=]+\s*"[^"]+"`)
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range password.FindAll(src, -1) {
+			t.Errorf("%s sets a password literal: %s", name, m)
+		}
+	}
+}
+
+func TestInitDBMemory(t *testing.T) {
+	savedDB, savedSyncDB := DB, SyncDB
+	defer func() { DB, SyncDB = savedDB, savedSyncDB }()
+
+	if err := InitDB(DBConfig{Backend: memoryBackend}); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	if DB == nil || SyncDB != DB {
+		t.Errorf("memory backend: DB = %v, SyncDB = %v, want one database", DB, SyncDB)
+	}
+	if err := InitDB(DBConfig{Backend: "postgres"}); err == nil {
+		t.Error("InitDB with an unknown backend succeeded")
+	}
+}
+
+func TestOpenDatabasesBackend(t *testing.T) {
+	savedDB, savedSyncDB := DB, SyncDB
+	defer func() { DB, SyncDB = savedDB, savedSyncDB }()
+	t.Setenv(configFileEnv, "")
+
+	t.Setenv(backendEnv, "memory")
+	if err := OpenDatabases(); err != nil {
+		t.Fatalf("OpenDatabases with %s=memory: %v", backendEnv, err)
+	}
+	if _, ok := DB.(*memoryDB); !ok {
+		t.Errorf("%s=memory: DB is a %T, want a *memoryDB", backendEnv, DB)
+	}
+	if SyncDB != DB {
+		t.Errorf("%s=memory: SyncDB = %v, want DB", backendEnv, SyncDB)
+	}
+
+	DB, SyncDB = nil, nil
+	t.Setenv(backendEnv, "postgres")
+	err := OpenDatabases()
+	if err == nil {
+		t.Fatalf("OpenDatabases with %s=postgres succeeded", backendEnv)
+	}
+	if !strings.Contains(err.Error(), `"postgres"`) || !strings.Contains(err.Error(), "mysql and memory") {
+		t.Errorf("unknown backend error %q doesn't list the supported backends", err)
+	}
+	if DB != nil || SyncDB != nil {
+		t.Errorf("an unknown backend set DB = %v, SyncDB = %v", DB, SyncDB)
+	}
+
+	// Without the variable the backend is MySQL, as it always was.
+	t.Setenv(backendEnv, "")
+	if cfg := envConfig(); cfg.Backend != "" && cfg.Backend != mysqlBackend {
+		t.Errorf("backend = %q without %s, want MySQL", cfg.Backend, backendEnv)
+	}
+}
+
+// writeConfig writes a config file with the given name and contents in a
+// temporary directory, returning its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("GAE_INSTANCE", "instance-1")
+	t.Setenv("TEST_DB_PASSWORD", "serve$ecret")
+	t.Setenv("TEST_SYNC_DB_PASSWORD", "sync-secret")
+	want := DBConfig{
+		Backend: mysqlBackend,
+		MySQL: MySQLConfig{
+			Username:        "offers",
+			Password:        "serve$ecret",
+			UnixSocket:      "/cloudsql/project:region:offers",
+			MaxOpenConns:    10,
+			ConnMaxLifetime: 5 * time.Minute,
+			TLSMode:         TLSVerifyCA,
+			CACertPath:      "/etc/mysql/server-ca.pem",
+		},
+		Sync: &MySQLConfig{Username: "sync", Password: "sync-secret", Host: "db.example.com", Port: 3306, MaxIdleConns: 2},
+	}
+	for _, path := range []string{
+		writeConfig(t, "offers.yaml", `
+backend: mysql
+mysql:
+  instance: project:region:offers
+  user: offers
+  password: ${TEST_DB_PASSWORD}
+  max_open_conns: 10
+  conn_max_lifetime: 5m
+  tls:
+    mode: verify-ca
+    ca: /etc/mysql/server-ca.pem
+sync:
+  host: db.example.com
+  user: sync
+  password: ${TEST_SYNC_DB_PASSWORD}
+  max_idle_conns: 2
+`),
+		writeConfig(t, "offers.json", `{
+  "backend": "mysql",
+  "mysql": {
+    "instance": "project:region:offers",
+    "user": "offers",
+    "password": "${TEST_DB_PASSWORD}",
+    "max_open_conns": 10,
+    "conn_max_lifetime": "5m",
+    "tls": {"mode": "verify-ca", "ca": "/etc/mysql/server-ca.pem"}
+  },
+  "sync": {"host": "db.example.com", "user": "sync", "password": "${TEST_SYNC_DB_PASSWORD}", "max_idle_conns": 2}
+}`),
+	} {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("LoadConfig(%s): %v", filepath.Base(path), err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("LoadConfig(%s) = %+v, sync %+v; want %+v, sync %+v", filepath.Base(path), cfg, cfg.Sync, want, want.Sync)
+		}
+	}
+
+	// Outside App Engine, an instance is reached through localhost.
+	t.Setenv("GAE_INSTANCE", "")
+	cfg, err := LoadConfig(writeConfig(t, "local.yml", "mysql:\n  instance: project:region:offers\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := cfg.MySQL; c.Host != "localhost" || c.Port != 3306 || c.UnixSocket != "" || cfg.Sync != nil {
+		t.Errorf("local config = %+v, sync %v; want localhost:3306 and no sync connection", c, cfg.Sync)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Setenv("TEST_UNSET_PASSWORD", "")
+	os.Unsetenv("TEST_UNSET_PASSWORD")
+	for _, tt := range []struct {
+		name, contents, want string
+	}{
+		{"unset.yaml", "mysql:\n  password: ${TEST_UNSET_PASSWORD}\n", "TEST_UNSET_PASSWORD is not set"},
+		{"unset-sync.json", `{"sync": {"password": "${TEST_UNSET_PASSWORD}"}}`, "in sync"},
+		{"unknown.yaml", "mysql:\n  hostname: db\n", "hostname"},
+		{"unknown.json", `{"mysql": {"hostname": "db"}}`, "hostname"},
+		{"lifetime.yaml", "mysql:\n  conn_max_lifetime: forever\n", "conn_max_lifetime"},
+		{"offers.toml", "backend = \"mysql\"\n", "unsupported file type"},
+	} {
+		_, err := LoadConfig(writeConfig(t, tt.name, tt.contents))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadConfig(%s) = %v, want an error mentioning %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfig of a missing file succeeded")
+	}
+}
+
+func TestOpenDatabasesConfigFile(t *testing.T) {
+	savedDB, savedSyncDB := DB, SyncDB
+	defer func() { DB, SyncDB = savedDB, savedSyncDB }()
+	// The file takes precedence over the environment.
+	t.Setenv(backendEnv, "postgres")
+	t.Setenv("TEST_BACKEND", "memory")
+	t.Setenv(configFileEnv, writeConfig(t, "offers.yaml", "backend: ${TEST_BACKEND}\n"))
+
+	if err := OpenDatabases(); err != nil {
+		t.Fatalf("OpenDatabases with %s: %v", configFileEnv, err)
+	}
+	if _, ok := DB.(*memoryDB); !ok || SyncDB != DB {
+		t.Errorf("memory backend from a file: DB is a %T and SyncDB %v, want one *memoryDB", DB, SyncDB)
+	}
+
+	DB, SyncDB = nil, nil
+	t.Setenv(configFileEnv, writeConfig(t, "offers.json", `{"backend": "postgres"}`))
+	if err := OpenDatabases(); err == nil || DB != nil {
+		t.Errorf("OpenDatabases with an unknown backend in the file = %v, DB %v; want an error and no database", err, DB)
+	}
+}
+
+func TestImportDoesNotConnect(t *testing.T) {
+	// This test binary runs without MySQL or network access, so it would
+	// have exited before any test ran if importing the package connected.
+	if dbAfterInit != nil || syncDBAfterInit != nil {
+		t.Fatalf("DB = %v, SyncDB = %v after init, want nil until InitDB", dbAfterInit, syncDBAfterInit)
+	}
+
+	savedDB, savedSyncDB := DB, SyncDB
+	defer func() { DB, SyncDB = savedDB, savedSyncDB }()
+	if err := InitDB(DBConfig{Backend: memoryBackend}); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := DB.AddOffer(ctx, testOffer("a", "Chair", "10.00")); err != nil {
+		t.Fatalf("AddOffer: %v", err)
+	}
+	o, err := SyncDB.GetOffer(ctx, "a")
+	if err != nil || o.Title != "Chair" {
+		t.Errorf("GetOffer = %v, %v; want the added offer", o, err)
+	}
+}
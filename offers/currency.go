@@ -0,0 +1,48 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// CurrencyConverter converts prices between currencies.
+type CurrencyConverter interface {
+	// Convert converts amount, a decimal number, from one ISO 4217 currency
+	// code to another.
+	Convert(amount string, from, to string) (string, error)
+}
+
+// StaticRates is a CurrencyConverter using fixed exchange rates. Each rate is
+// the value of one unit of a common base currency in the keyed currency, so
+// with {"USD": 1, "EUR": 0.9}, 10 USD converts to 9.00 EUR.
+type StaticRates map[string]float64
+
+// Ensure StaticRates conforms to the CurrencyConverter interface.
+var _ CurrencyConverter = StaticRates{}
+
+// Convert converts amount using the static rates, rounding to two decimal
+// places. It returns an error if either currency has no rate.
+func (r StaticRates) Convert(amount string, from, to string) (string, error) {
+	a, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return "", fmt.Errorf("currency: invalid amount %q", amount)
+	}
+	if from == to {
+		return amount, nil
+	}
+	fromRate, ok := r[from]
+	if !ok || fromRate <= 0 {
+		return "", fmt.Errorf("currency: no rate for %q", from)
+	}
+	toRate, ok := r[to]
+	if !ok || toRate <= 0 {
+		return "", fmt.Errorf("currency: no rate for %q", to)
+	}
+	a.Mul(a, new(big.Rat).SetFloat64(toRate))
+	a.Quo(a, new(big.Rat).SetFloat64(fromRate))
+	return a.FloatString(2), nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import "testing"
+
+func TestStaticRatesConvert(t *testing.T) {
+	rates := StaticRates{"USD": 1, "EUR": 0.9, "GBP": 0.125, "JPY": 150}
+	for _, tt := range []struct {
+		amount, from, to string
+		want             string
+	}{
+		{"10.00", "USD", "EUR", "9.00"},
+		{"10", "EUR", "USD", "11.11"},
+		{"10.00", "EUR", "JPY", "1666.67"},
+		// Halves are rounded away from zero.
+		{"1.00", "USD", "GBP", "0.13"},
+		{"0.04", "USD", "GBP", "0.01"},
+		{"0.03", "USD", "GBP", "0.00"},
+		{"0", "USD", "EUR", "0.00"},
+		// Amounts already in the currency are returned as they are, even if
+		// there is no rate for it.
+		{"10.5", "USD", "USD", "10.5"},
+		{"10.00", "CHF", "CHF", "10.00"},
+	} {
+		got, err := rates.Convert(tt.amount, tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("Convert(%s %s to %s) = %q, %v; want %q", tt.amount, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		amount, from, to string
+	}{
+		{"10.00", "CHF", "USD"},
+		{"10.00", "USD", "CHF"},
+		{"10.00", "usd", "EUR"},
+		{"10.00", "", "EUR"},
+		{"ten", "USD", "EUR"},
+		{"ten", "USD", "USD"},
+	} {
+		if got, err := rates.Convert(tt.amount, tt.from, tt.to); err == nil {
+			t.Errorf("Convert(%s %s to %s) = %q, want an error", tt.amount, tt.from, tt.to, got)
+		}
+	}
+	if got, err := (StaticRates{"USD": 1, "EUR": 0}).Convert("1.00", "USD", "EUR"); err == nil {
+		t.Errorf("Convert with a zero rate = %q, want an error", got)
+	}
+}
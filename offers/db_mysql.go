@@ -5,11 +5,19 @@
 package offers
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 )
@@ -35,28 +43,93 @@ type MySQLConfig struct {
 	//
 	// If set, Host and Port should be unset.
 	UnixSocket string
+
+	// MaxOpenConns limits the number of open connections, which Cloud SQL
+	// caps per instance. It defaults to defaultMaxOpenConns.
+	MaxOpenConns int
+
+	// MaxIdleConns is the number of idle connections kept open for reuse.
+	// It defaults to defaultMaxIdleConns.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is how long a connection is reused before it is
+	// replaced. It should be shorter than the server's wait_timeout, so
+	// connections aren't used after the server has closed them. It defaults
+	// to defaultConnMaxLifetime.
+	ConnMaxLifetime time.Duration
+
+	// TLSMode is how connections are encrypted. It defaults to TLSDisable.
+	TLSMode TLSMode
+
+	// CACertPath is a PEM file of the CAs trusted to sign the server's
+	// certificate. If unset, the system's CAs are trusted.
+	CACertPath string
+
+	// ClientCertPath and ClientKeyPath are PEM files of a certificate and
+	// key presented to the server, for mutual TLS. They are optional.
+	ClientCertPath, ClientKeyPath string
+
+	// tlsName is the name under which registerTLS registered the TLS
+	// configuration, or "" if TLS is disabled.
+	tlsName string
 }
 
-// dataStoreName returns a connection string suitable for sql.Open.
-func (c MySQLConfig) dataStoreName(databaseName string) string {
-	var cred string
-	// [username[:password]@]
-	if c.Username != "" {
-		cred = c.Username
-		if c.Password != "" {
-			cred = cred + ":" + c.Password
-		}
-		cred = cred + "@"
+// Connection pool defaults, used for zero MySQLConfig fields.
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 10
+	defaultConnMaxLifetime = 5 * time.Minute
+)
+
+// withPoolDefaults returns c with the defaults applied to unset pool
+// settings.
+func (c MySQLConfig) withPoolDefaults() MySQLConfig {
+	if c.MaxOpenConns <= 0 {
+		c.MaxOpenConns = defaultMaxOpenConns
+	}
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = defaultMaxIdleConns
 	}
+	if c.ConnMaxLifetime <= 0 {
+		c.ConnMaxLifetime = defaultConnMaxLifetime
+	}
+	return c
+}
+
+// applyPool applies c's pool settings to conn.
+func (c MySQLConfig) applyPool(conn *sql.DB) {
+	conn.SetMaxOpenConns(c.MaxOpenConns)
+	conn.SetMaxIdleConns(c.MaxIdleConns)
+	conn.SetConnMaxLifetime(c.ConnMaxLifetime)
+}
 
+// dataStoreName returns a connection string suitable for sql.Open. It is
+// formatted by the driver rather than by hand, so that credentials and
+// addresses containing characters like '@', '/' or '?' are kept apart from
+// the rest of the string instead of changing how it is parsed.
+func (c MySQLConfig) dataStoreName(databaseName string) string {
+	cfg := mysql.NewConfig()
+	cfg.User = c.Username
+	cfg.Passwd = c.Password
+	cfg.DBName = databaseName
+	// ParseTime makes the driver scan DATETIME columns into time.Time.
+	cfg.ParseTime = true
+	cfg.TLSConfig = c.tlsName
 	if c.UnixSocket != "" {
-		return fmt.Sprintf("%sunix(%s)/%s", cred, c.UnixSocket, databaseName)
+		cfg.Net, cfg.Addr = "unix", c.UnixSocket
+	} else {
+		cfg.Net, cfg.Addr = "tcp", net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
 	}
-	return fmt.Sprintf("%stcp([%s]:%d)/%s", cred, c.Host, c.Port, databaseName)
+	return cfg.FormatDSN()
 }
 
 // newMySQLDB creates a new OfferDatabase backed by a given MySQL server.
 func newMySQLDB(config MySQLConfig) (OfferDatabase, error) {
+	var err error
+	if config.tlsName, err = config.registerTLS(); err != nil {
+		return nil, err
+	}
+
 	// Check database and table exists. If not, create it.
 	if err := config.ensureTableExists(); err != nil {
 		return nil, err
@@ -66,41 +139,230 @@ func newMySQLDB(config MySQLConfig) (OfferDatabase, error) {
 	if err != nil {
 		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
 	}
+	config = config.withPoolDefaults()
+	config.applyPool(conn)
 	if err = conn.Ping(); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
 	}
 
 	db := &mysqlDB{
-		conn: conn,
+		conn:         conn,
+		maxOpenConns: config.MaxOpenConns,
+		maxIdleConns: config.MaxIdleConns,
 	}
 
 	// Prepared statements. The actual SQL queries are in the code near the
 	// relevant method.
-	if db.list, err = conn.Prepare(listStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare list: %v", err)
+	db.list = map[SortOrder]*sql.Stmt{}
+	db.purchasable = map[SortOrder]*sql.Stmt{}
+	for _, s := range SortOrders {
+		if db.list[s], err = conn.Prepare(listStatement + orderBy[s]); err != nil {
+			return nil, fmt.Errorf("mysql: prepare list by %s: %v", s, err)
+		}
+		if db.purchasable[s], err = conn.Prepare(purchasableStatement + orderBy[s]); err != nil {
+			return nil, fmt.Errorf("mysql: prepare purchasable by %s: %v", s, err)
+		}
+	}
+	if db.listCount, err = conn.Prepare(listCountStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare list count: %v", err)
+	}
+	if db.purchasableCount, err = conn.Prepare(purchasableCountStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare purchasable count: %v", err)
+	}
+	db.search = map[SortOrder]*sql.Stmt{}
+	for _, s := range SearchOrders {
+		if db.search[s], err = conn.Prepare(searchStatement + searchOrderBy[s]); err != nil {
+			return nil, fmt.Errorf("mysql: prepare search by %s: %v", s, err)
+		}
+	}
+	if db.searchCount, err = conn.Prepare(searchCountStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare search count: %v", err)
+	}
+	if db.priceRange, err = conn.Prepare(priceRangeStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare price range: %v", err)
+	}
+	if db.all, err = conn.Prepare(allStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare all: %v", err)
+	}
+	if db.allSearch, err = conn.Prepare(allSearchStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare all search results: %v", err)
+	}
+	if db.version, err = conn.Prepare(versionStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare version: %v", err)
+	}
+	if db.changeToken, err = conn.Prepare(changeTokenStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare change token: %v", err)
 	}
 	if db.get, err = conn.Prepare(getStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare get: %v", err)
 	}
+	if db.bySlug, err = conn.Prepare(bySlugStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare by slug: %v", err)
+	}
+	if db.unslugged, err = conn.Prepare(unsluggedStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare unslugged: %v", err)
+	}
+	if db.takenSlugs, err = conn.Prepare(takenSlugsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare taken slugs: %v", err)
+	}
+	if db.setSlug, err = conn.Prepare(setSlugStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare set slug: %v", err)
+	}
+	if db.exists, err = conn.Prepare(existsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare exists: %v", err)
+	}
+	if db.variants, err = conn.Prepare(variantsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare variants: %v", err)
+	}
 	if db.insert, err = conn.Prepare(insertStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare insert: %v", err)
 	}
+	if db.deleteOne, err = conn.Prepare(deleteOneStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare delete one: %v", err)
+	}
 	if db.update, err = conn.Prepare(updateStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare update: %v", err)
 	}
-	if db.delete, err = conn.Prepare(deleteStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare delete: %v", err)
+	if db.upsert, err = conn.Prepare(upsertStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare upsert: %v", err)
+	}
+	if db.recordView, err = conn.Prepare(recordViewStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare record view: %v", err)
+	}
+	if db.trending, err = conn.Prepare(trendingStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare trending: %v", err)
+	}
+	if db.newOffers, err = conn.Prepare(newOffersStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare new offers: %v", err)
+	}
+	if db.byMerchant, err = conn.Prepare(byMerchantStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare by merchant: %v", err)
+	}
+	if db.category, err = conn.Prepare(categoryStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare category: %v", err)
+	}
+	if db.restore, err = conn.Prepare(restoreStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare restore: %v", err)
+	}
+	if db.purgeDeleted, err = conn.Prepare(purgeDeletedStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare purge deleted: %v", err)
+	}
+	if db.pruneViews, err = conn.Prepare(pruneViewsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare prune views: %v", err)
+	}
+	if db.featured, err = conn.Prepare(featuredStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare featured: %v", err)
+	}
+	if db.addReport, err = conn.Prepare(addReportStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare add report: %v", err)
+	}
+	if db.listReports, err = conn.Prepare(listReportsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare list reports: %v", err)
+	}
+	if db.addReview, err = conn.Prepare(addReviewStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare add review: %v", err)
+	}
+	if db.getReviews, err = conn.Prepare(getReviewsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare get reviews: %v", err)
+	}
+	if db.rating, err = conn.Prepare(ratingStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare rating: %v", err)
+	}
+	if db.addAlert, err = conn.Prepare(addAlertStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare add alert: %v", err)
+	}
+	if db.listAlerts, err = conn.Prepare(listAlertsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare list alerts: %v", err)
+	}
+	if db.deleteAlert, err = conn.Prepare(deleteAlertStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare delete alert: %v", err)
+	}
+	if db.triggered, err = conn.Prepare(triggeredStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare triggered alerts: %v", err)
+	}
+	if db.fireAlert, err = conn.Prepare(fireAlertStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare fire alert: %v", err)
+	}
+	if db.unfireAlert, err = conn.Prepare(unfireAlertStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare unfire alert: %v", err)
+	}
+	if db.setMeta, err = conn.Prepare(setMetaStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare set meta: %v", err)
+	}
+	if db.check, err = conn.Prepare(checkStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare check: %v", err)
+	}
+	if db.duplicates, err = conn.Prepare(duplicatesStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare duplicates: %v", err)
+	}
+	if db.brands, err = conn.Prepare(brandsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare brands: %v", err)
+	}
+	if db.releaseReservation, err = conn.Prepare(releaseReservationStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare release reservation: %v", err)
 	}
-	if db.updateUpdated, err = conn.Prepare(updateUpdatedStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare update updated: %v", err)
+	if db.pruneReservations, err = conn.Prepare(pruneReservationsStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare prune reservations: %v", err)
 	}
+
+	// Give offers stored before slugs were added theirs.
+	db.assignSlugs(context.Background())
 	return db, nil
 }
 
 // Close closes the database, freeing up any resources.
-func (db *mysqlDB) Close() {
-	db.conn.Close()
+func (db *mysqlDB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+	}
+	if err := db.conn.Close(); err != nil {
+		return fmt.Errorf("mysql: could not close: %v", err)
+	}
+	return nil
+}
+
+// SlowQueryThreshold, if set, is the duration beyond which database calls
+// are logged. Only the method and timing are logged, not the arguments,
+// which may contain user data. It must be set before the database is used.
+var SlowQueryThreshold time.Duration
+
+// logSlow starts timing a call to the named method. The returned function
+// logs the call if it has taken longer than SlowQueryThreshold; defer it
+// when the method starts:
+//
+//	defer logSlow("ListOffers")()
+func logSlow(method string) func() {
+	threshold := SlowQueryThreshold
+	if threshold <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		if elapsed := time.Since(start); elapsed >= threshold {
+			log.Printf("slow query: method=%s elapsed=%v threshold=%v", method, elapsed, threshold)
+		}
+	}
+}
+
+// checkStatement reads at most one row through the primary key, so it is
+// cheap however large the table is.
+const checkStatement = `SELECT id FROM offers LIMIT 1`
+
+// Check pings the database and runs a prepared statement, which can fail
+// after a failover even if the ping succeeds.
+func (db *mysqlDB) Check(ctx context.Context) error {
+	defer logSlow("Check")()
+	if err := db.conn.PingContext(ctx); err != nil {
+		return fmt.Errorf("mysql: ping failed: %v", err)
+	}
+	var id int64
+	err := db.check.QueryRowContext(ctx).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("mysql: check query failed: %v", err)
+	}
+	return nil
 }
 
 // rowScanner is implemented by sql.Row and sql.Rows
@@ -120,9 +382,33 @@ func scanOffer(s rowScanner) (*Offer, error) {
 		description sql.NullString
 		merchantURL sql.NullString
 		updated     sql.NullBool
+		contentHash sql.NullString
+		itemGroupID sql.NullString
+		convPrice   sql.NullString
+		convCurr    sql.NullString
+		updatedAt   time.Time
+		gtin        sql.NullString
+		canonicalID sql.NullString
+		metaTitle   sql.NullString
+		metaDesc    sql.NullString
+		quantity    int64
+		brand       sql.NullString
+		createdAt   time.Time
+		deletedAt   mysql.NullTime
+		category    string
+		avail       string
+		condition   string
+		salePrice   sql.NullString
+		version     int
+		slug        sql.NullString
+		merchantID  int64
 	)
 	if err := s.Scan(&id, &offerID, &title, &price, &currency, &imageURL,
-		&description, &merchantURL, &updated); err != nil {
+		&description, &merchantURL, &updated, &contentHash,
+		&itemGroupID, &convPrice, &convCurr, &updatedAt, &gtin,
+		&canonicalID, &metaTitle, &metaDesc, &quantity,
+		&brand, &createdAt, &deletedAt, &category,
+		&avail, &condition, &salePrice, &version, &slug, &merchantID); err != nil {
 		return nil, err
 	}
 
@@ -134,18 +420,39 @@ func scanOffer(s rowScanner) (*Offer, error) {
 		ImageURL:    imageURL.String,
 		Description: description.String,
 		MerchantURL: merchantURL.String,
+		ItemGroupID: itemGroupID.String,
+
+		ConvertedPrice:    convPrice.String,
+		ConvertedCurrency: convCurr.String,
+		CreatedAt:         createdAt,
+		UpdatedAt:         updatedAt,
+
+		GTIN:               gtin.String,
+		CanonicalProductID: canonicalID.String,
+
+		CustomMetaTitle:       metaTitle.String,
+		CustomMetaDescription: metaDesc.String,
+
+		Quantity: quantity,
+		Brand:    brand.String,
+		Category: category,
+
+		Availability: avail,
+		Condition:    condition,
+		SalePrice:    salePrice.String,
+
+		Slug:       slug.String,
+		Version:    version,
+		MerchantID: merchantID,
+	}
+	if deletedAt.Valid {
+		offer.DeletedAt = &deletedAt.Time
 	}
 	return offer, nil
 }
 
-const listStatement = `SELECT * FROM offers limit 50`
-
-// ListOffers returns a list of offers, ordered by title.
-func (db *mysqlDB) ListOffers() ([]*Offer, error) {
-	rows, err := db.list.Query()
-	if err != nil {
-		return nil, err
-	}
+// scanOffers reads all offers from rows and closes them.
+func scanOffers(rows *sql.Rows) ([]*Offer, error) {
 	defer rows.Close()
 
 	var offers []*Offer
@@ -154,164 +461,1839 @@ func (db *mysqlDB) ListOffers() ([]*Offer, error) {
 		if err != nil {
 			return nil, fmt.Errorf("mysql: could not read row: %v", err)
 		}
-
 		offers = append(offers, offer)
 	}
-
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mysql: could not read rows: %v", err)
+	}
 	return offers, nil
 }
 
-// SearchOffer retrieves an offer by its description.
-func (db *mysqlDB) SearchOffers(s string) ([]*Offer, error) {
-	rows, err := db.list.Query()
+// orderBy holds the ORDER BY and LIMIT clauses of list statements for each
+// sort order. Ties are broken by id so pages don't overlap.
+var orderBy = map[SortOrder]string{
+	SortByTitle:     ` ORDER BY title, id LIMIT ? OFFSET ?`,
+	SortByPrice:     ` ORDER BY CAST(price AS DECIMAL(15,2)), id LIMIT ? OFFSET ?`,
+	SortByInsertion: ` ORDER BY id LIMIT ? OFFSET ?`,
+}
+
+// notDeleted excludes soft-deleted offers. Every statement reading offers
+// applies it, except where ListOptions.IncludeDeleted is honored.
+const notDeleted = `deletedAt IS NULL`
+
+// listWhere applies notDeleted unless its first argument, IncludeDeleted, is
+// true, and skips offers out of stock if its second, InStock, is true.
+const listWhere = ` WHERE (` + notDeleted + ` OR ?) AND (availability <> '` + availabilityOutOfStock + `' OR NOT ?)`
+
+// listStatement and purchasableStatement are completed by orderBy.
+const (
+	listStatement      = `SELECT * FROM offers` + listWhere
+	listCountStatement = `SELECT COUNT(*) FROM offers` + listWhere
+)
+
+// sortedStatement returns the statement listing offers in the requested
+// order.
+func sortedStatement(stmts map[SortOrder]*sql.Stmt, opts ListOptions) (*sql.Stmt, error) {
+	stmt, ok := stmts[opts.sort()]
+	if !ok {
+		return nil, fmt.Errorf("mysql: unknown sort order %q", opts.Sort)
+	}
+	return stmt, nil
+}
+
+// ListOffers returns a page of offers, ordered by title unless another
+// order is requested, and the total number of offers.
+func (db *mysqlDB) ListOffers(ctx context.Context, opts ListOptions) ([]*Offer, int, error) {
+	defer logSlow("ListOffers")()
+	stmt, err := sortedStatement(db.list, opts)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer rows.Close()
-	var offers []*Offer
-	for rows.Next() {
-		offer, err := scanOffer(rows)
-		if err != nil {
-			return nil, fmt.Errorf("mysql: could not read row: %v", err)
-		}
-		if strings.Contains(strings.ToLower(offer.Description), strings.ToLower(s)) {
-			offers = append(offers, offer)
-		}
+	var total int
+	if err := db.listCount.QueryRowContext(ctx, opts.IncludeDeleted, opts.InStock).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("mysql: could not count offers: %v", err)
 	}
-	if len(offers) == 0 {
-		return nil, fmt.Errorf("mysql: could not find offer with description %s", s)
+	rows, err := stmt.QueryContext(ctx, opts.IncludeDeleted, opts.InStock, opts.limit(), opts.Offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("mysql: could not list offers: %v", err)
 	}
+	offers, err := scanOffers(rows)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: could not get offer: %v", err)
+		return nil, 0, err
 	}
-	return offers, nil
+	if offers == nil {
+		offers = []*Offer{}
+	}
+	return offers, total, nil
 }
 
-const getStatement = "SELECT * FROM offers WHERE offerId = ?"
+// purchasableWhere cheaply excludes offers without a link. Links are fully
+// validated by Offer.Purchasable.
+const purchasableWhere = `merchantUrl LIKE 'http://%' OR merchantUrl LIKE 'https://%'`
 
-// GetOffer retrieves an offer by its ID.
-func (db *mysqlDB) GetOffer(id string) (*Offer, error) {
-	offer, err := scanOffer(db.get.QueryRow(id))
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("mysql: could not find offer with id %s", id)
+const (
+	purchasableStatement      = `SELECT * FROM offers` + listWhere + ` AND (` + purchasableWhere + `)`
+	purchasableCountStatement = `SELECT COUNT(*) FROM offers` + listWhere + ` AND (` + purchasableWhere + `)`
+)
+
+// ListPurchasableOffers returns a page of offers with a valid merchant URL.
+// Pages and the total are counted before links are fully validated, so a
+// page may be short if some links are malformed.
+func (db *mysqlDB) ListPurchasableOffers(ctx context.Context, opts ListOptions) ([]*Offer, int, error) {
+	defer logSlow("ListPurchasableOffers")()
+	stmt, err := sortedStatement(db.purchasable, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := db.purchasableCount.QueryRowContext(ctx, opts.IncludeDeleted, opts.InStock).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("mysql: could not count offers: %v", err)
 	}
+	rows, err := stmt.QueryContext(ctx, opts.IncludeDeleted, opts.InStock, opts.limit(), opts.Offset)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: could not get offer: %v", err)
+		return nil, 0, fmt.Errorf("mysql: could not list offers: %v", err)
 	}
-	return offer, nil
+	offers, err := scanOffers(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	purchasable := []*Offer{}
+	for _, o := range offers {
+		if o.Purchasable() {
+			purchasable = append(purchasable, o)
+		}
+	}
+	return purchasable, total, nil
 }
 
-const insertStatement = `
-  INSERT INTO offers (
-    offerId, title, price, currency, imageUrl, description, merchantUrl
-  ) VALUES (?, ?, ?, ?, ?, ?, ?)`
+// maxSearchResults bounds the number of offers returned by
+// SearchOffersByPriceRange.
+const maxSearchResults = 50
+
+// searchMatch matches case-insensitively through the utf8_general_ci
+// collation. The term, passed twice, is escaped by escapeLike, so it matches
+// literally.
+const searchMatch = `
+  WHERE ` + notDeleted + ` AND (description LIKE CONCAT('%', ?, '%') OR title LIKE CONCAT('%', ?, '%'))`
+
+// searchStatement is completed by searchOrderBy.
+const (
+	searchStatement      = `SELECT * FROM offers` + searchMatch
+	searchCountStatement = `SELECT COUNT(*) FROM offers` + searchMatch
+)
+
+// searchOrderBy holds the ORDER BY and LIMIT clauses of searchStatement for
+// each search order. The relevance order takes the term twice more.
+var searchOrderBy = map[SortOrder]string{
+	SortByRelevance: `
+  ORDER BY CASE WHEN title LIKE CONCAT(?, '%') THEN 0 WHEN title LIKE CONCAT('%', ?, '%') THEN 1 ELSE 2 END,
+    title, id LIMIT ?`,
+	SortByTitle: ` ORDER BY title, id LIMIT ?`,
+	SortByPrice: ` ORDER BY price, id LIMIT ?`,
+}
+
+// CountOffers returns the number of offers.
+func (db *mysqlDB) CountOffers(ctx context.Context) (int, error) {
+	defer logSlow("CountOffers")()
+	var n int
+	if err := db.listCount.QueryRowContext(ctx, false, false).Scan(&n); err != nil {
+		return 0, fmt.Errorf("mysql: could not count offers: %v", err)
+	}
+	return n, nil
+}
+
+// CountSearchOffers returns the number of offers whose description or title
+// contains s.
+func (db *mysqlDB) CountSearchOffers(ctx context.Context, s string) (int, error) {
+	defer logSlow("CountSearchOffers")()
+	term := escapeLike(s)
+	var n int
+	if err := db.searchCount.QueryRowContext(ctx, term, term).Scan(&n); err != nil {
+		return 0, fmt.Errorf("mysql: could not count search results: %v", err)
+	}
+	return n, nil
+}
 
-// AddOffer saves a given offer, assigning it a new ID.
-func (db *mysqlDB) AddOffer(o *Offer) (id int64, err error) {
-	r, err := execAffectingOneRow(db.insert, o.ID, o.Title, o.Price, o.Currency,
-		o.ImageURL, o.Description, o.MerchantURL)
+// SearchOffers returns the offers whose description or title contains s, in
+// the given order. It returns an empty slice if none do.
+func (db *mysqlDB) SearchOffers(ctx context.Context, s string, order SortOrder, limit int) ([]*Offer, error) {
+	defer logSlow("SearchOffers")()
+	order, ok := searchOrder(order)
+	if !ok {
+		return nil, fmt.Errorf("mysql: unknown search order %q", order)
+	}
+	term := escapeLike(s)
+	args := []interface{}{term, term}
+	if order == SortByRelevance {
+		args = append(args, term, term)
+	}
+	rows, err := db.search[order].QueryContext(ctx, append(args, searchLimit(limit))...)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("mysql: could not search offers: %v", err)
 	}
+	offers, err := scanOffers(rows)
+	if err != nil {
+		return nil, err
+	}
+	if offers == nil {
+		offers = []*Offer{}
+	}
+	return offers, nil
+}
 
-	lastInsertID, err := r.LastInsertId()
+// priceRangeStatement is searchStatement restricted to a price range. A NULL
+// upper bound or an empty currency doesn't restrict the results.
+const priceRangeStatement = `
+  SELECT * FROM offers
+  WHERE ` + notDeleted + ` AND (description LIKE CONCAT('%', ?, '%') OR title LIKE CONCAT('%', ?, '%'))
+    AND price >= ? AND (? IS NULL OR price <= ?)
+    AND (? = '' OR currency = ?)
+  ORDER BY price, id LIMIT ?`
+
+// SearchOffersByPriceRange returns up to maxSearchResults offers containing
+// q and priced within the range.
+func (db *mysqlDB) SearchOffersByPriceRange(ctx context.Context, q string, min, max float64, currency string) ([]*Offer, error) {
+	defer logSlow("SearchOffersByPriceRange")()
+	term := escapeLike(q)
+	var upper interface{}
+	if !math.IsInf(max, 1) {
+		upper = max
+	}
+	rows, err := db.priceRange.QueryContext(ctx, term, term, min, upper, upper, currency, currency, maxSearchResults)
 	if err != nil {
-		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+		return nil, fmt.Errorf("mysql: could not search offers by price: %v", err)
+	}
+	offers, err := scanOffers(rows)
+	if err != nil {
+		return nil, err
 	}
-	return lastInsertID, nil
+	if offers == nil {
+		offers = []*Offer{}
+	}
+	return offers, nil
 }
 
-const deleteStatement = `DELETE FROM offers WHERE updated = false`
+// maxBrands bounds the number of brands returned by ListBrandsWithCounts.
+const maxBrands = 50
 
-// DeleteOffer removes a given offer by its ID.
-func (db *mysqlDB) DeleteOffers() error {
-	_, err := db.delete.Exec()
+const brandsStatement = `
+  SELECT brand, COUNT(*) FROM offers WHERE ` + notDeleted + ` AND brand <> ''
+  GROUP BY brand ORDER BY COUNT(*) DESC, brand LIMIT ?`
+
+// ListBrandsWithCounts returns up to maxBrands brands with their offer
+// counts.
+func (db *mysqlDB) ListBrandsWithCounts(ctx context.Context) ([]BrandCount, error) {
+	defer logSlow("ListBrandsWithCounts")()
+	rows, err := db.brands.QueryContext(ctx, maxBrands)
 	if err != nil {
-		return fmt.Errorf("mysql: could not execute delete statement: %v", err)
+		return nil, fmt.Errorf("mysql: could not list brands: %v", err)
 	}
-	return nil
+	defer rows.Close()
+
+	var brands []BrandCount
+	for rows.Next() {
+		var b BrandCount
+		if err := rows.Scan(&b.Brand, &b.Count); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		brands = append(brands, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mysql: could not read rows: %v", err)
+	}
+	return brands, nil
 }
 
-const updateStatement = `
-  UPDATE offers
-  SET offerId=?, title=?, price=?, currency=?, imageUrl=?,
-	description=?, merchantUrl=?,
-	updated = true WHERE id = ?`
+// versionStatement combines a checksum of every offer's ID, content hash,
+// slug and meta overrides, so any insert, update or delete, including soft
+// deletes, changes the result, as do the fields set outside syncs. Reviews
+// are never changed or deleted, so counting them is enough.
+const versionStatement = `
+  SELECT COUNT(*), COALESCE(BIT_XOR(CRC32(CONCAT(offerId, ':', COALESCE(contentHash, ''),
+      ':', COALESCE(slug, ''), ':', COALESCE(metaTitle, ''), ':', COALESCE(metaDescription, '')))), 0),
+    (SELECT COUNT(*) FROM reviews)
+  FROM offers WHERE ` + notDeleted
 
-// UpdateOffer updates the entry for a given offer.
-func (db *mysqlDB) UpdateOffer(o *Offer) error {
-	if o.ID == "" {
-		return errors.New("mysql: offer with unassigned ID passed into updateOffer")
+// CatalogVersion returns the current version of the offers and reviews
+// tables.
+func (db *mysqlDB) CatalogVersion(ctx context.Context) (string, error) {
+	defer logSlow("CatalogVersion")()
+	var count, checksum, reviews int64
+	if err := db.version.QueryRowContext(ctx).Scan(&count, &checksum, &reviews); err != nil {
+		return "", fmt.Errorf("mysql: could not get catalog version: %v", err)
 	}
+	return fmt.Sprintf("%d-%x-%d", count, checksum, reviews), nil
+}
 
-	_, err := execAffectingOneRow(db.update, o.ID, o.Title, o.Price, o.Currency, o.ImageURL, o.Description, o.MerchantURL)
-	return err
+// changeTokenStatement uses the updatedAt index, so it is cheap enough to
+// poll. MySQL maintains updatedAt on every change to an offer, including
+// soft deletes, and the count catches purges.
+const changeTokenStatement = `SELECT COUNT(*), MAX(updatedAt) FROM offers`
+
+// ChangeToken returns the number of offers and when one was last written.
+func (db *mysqlDB) ChangeToken(ctx context.Context) (string, error) {
+	defer logSlow("ChangeToken")()
+	var count int64
+	var updated mysql.NullTime
+	if err := db.changeToken.QueryRowContext(ctx).Scan(&count, &updated); err != nil {
+		return "", fmt.Errorf("mysql: could not get change token: %v", err)
+	}
+	return fmt.Sprintf("%d-%d", count, updated.Time.UnixNano()), nil
 }
 
-const updateUpdatedStatement = `UPDATE offers SET updated=false`
+// allStatement lists every offer, and allSearchStatement every offer
+// matching a search term, given twice.
+const (
+	allStatement       = `SELECT * FROM offers WHERE ` + notDeleted
+	allSearchStatement = `SELECT * FROM offers` + searchMatch
+)
 
-// UpdateUpdatedField sets "updated" field to false.
-func (db *mysqlDB) UpdateUpdated() error {
+// ForEachOffer streams every offer to fn.
+func (db *mysqlDB) ForEachOffer(ctx context.Context, fn func(*Offer) error) error {
+	return forEach(ctx, db.all, fn)
+}
 
-	_, err := db.updateUpdated.Exec()
-	return err
+// ForEachSearchResult streams every offer matching q to fn. The offers are
+// matched by the query, like SearchOffers, so only they are read.
+func (db *mysqlDB) ForEachSearchResult(ctx context.Context, q string, fn func(*Offer) error) error {
+	term := escapeLike(q)
+	return forEach(ctx, db.allSearch, fn, term, term)
 }
 
-// ensureTableExists checks the table exists. If not, it creates it.
-func (config MySQLConfig) ensureTableExists() error {
-	conn, err := sql.Open("mysql", config.dataStoreName(""))
+// forEach calls fn for each offer the statement returns, closing the rows as
+// soon as fn returns an error.
+func forEach(ctx context.Context, stmt *sql.Stmt, fn func(*Offer) error, args ...interface{}) error {
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
-		return fmt.Errorf("mysql: could not get a connection: %v", err)
+		return fmt.Errorf("mysql: could not list offers: %v", err)
 	}
-	defer conn.Close()
+	defer rows.Close()
 
-	// Check the connection.
-	if conn.Ping() == driver.ErrBadConn {
-		return fmt.Errorf("mysql: could not connect to the database. " +
-			"could be bad address, or this address is not whitelisted for access.")
+	for rows.Next() {
+		offer, err := scanOffer(rows)
+		if err != nil {
+			return fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		if err := fn(offer); err != nil {
+			return err
+		}
 	}
+	return rows.Err()
+}
 
-	if _, err := conn.Exec("USE library"); err != nil {
-		// MySQL error 1049 is "database does not exist"
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1049 {
-			return createTable(conn)
-		}
+const getStatement = "SELECT * FROM offers WHERE offerId = ? AND " + notDeleted
+
+// GetOffer retrieves an offer by its ID.
+func (db *mysqlDB) GetOffer(ctx context.Context, id string) (*Offer, error) {
+	defer logSlow("GetOffer")()
+	offer, err := scanOffer(db.get.QueryRowContext(ctx, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrOfferNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get offer: %v", err)
 	}
+	return offer, nil
+}
 
-	if _, err := conn.Exec("DESCRIBE offers"); err != nil {
-		// MySQL error 1146 is "table does not exist"
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1146 {
-			return createTable(conn)
-		}
-		// Unknown error.
-		return fmt.Errorf("mysql: could not connect to the database: %v", err)
+const bySlugStatement = "SELECT * FROM offers WHERE slug = ? AND " + notDeleted
+
+// GetOfferBySlug retrieves an offer by its slug.
+func (db *mysqlDB) GetOfferBySlug(ctx context.Context, slug string) (*Offer, error) {
+	defer logSlow("GetOfferBySlug")()
+	offer, err := scanOffer(db.bySlug.QueryRowContext(ctx, slug))
+	if err == sql.ErrNoRows {
+		return nil, ErrOfferNotFound
 	}
-	return nil
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get offer by slug: %v", err)
+	}
+	return offer, nil
 }
 
-// createTable creates the table, and if necessary, the database.
-func createTable(conn *sql.DB) error {
-	for _, stmt := range createTableStatements {
-		_, err := conn.Exec(stmt)
-		if err != nil {
-			return err
+const (
+	unsluggedStatement = `SELECT offerId, title FROM offers WHERE slug IS NULL`
+	// Slugs only hold letters, digits and hyphens, so base needn't be
+	// escaped in the pattern.
+	takenSlugsStatement = `SELECT slug FROM offers WHERE slug = ? OR slug LIKE CONCAT(?, '-%')`
+	setSlugStatement    = `UPDATE offers SET slug = ?, updatedAt = updatedAt WHERE offerId = ? AND slug IS NULL`
+)
+
+// assignSlugs gives the offers without a slug, which are those added since
+// it last ran, a unique one derived from their title. It is run after every
+// write that can add offers. Errors are logged rather than failing the
+// write: the offers are still served by ID, and given a slug the next time.
+func (db *mysqlDB) assignSlugs(ctx context.Context) {
+	defer logSlow("assignSlugs")()
+	rows, err := db.unslugged.QueryContext(ctx)
+	if err != nil {
+		log.Printf("mysql: could not list offers without a slug: %v", err)
+		return
+	}
+	var ids, titles []string
+	for rows.Next() {
+		var id string
+		var title sql.NullString
+		if err := rows.Scan(&id, &title); err != nil {
+			rows.Close()
+			log.Printf("mysql: could not list offers without a slug: %v", err)
+			return
+		}
+		ids = append(ids, id)
+		titles = append(titles, title.String)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("mysql: could not list offers without a slug: %v", err)
+		return
+	}
+	for i, id := range ids {
+		if err := db.assignSlug(ctx, id, titles[i]); err != nil {
+			log.Printf("mysql: could not assign a slug to offer %s: %v", id, err)
+			return
 		}
 	}
-	return nil
 }
 
-// execAffectingOneRow executes a given statement, expecting one row to be affected.
-func execAffectingOneRow(stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
-	r, err := stmt.Exec(args...)
+// assignSlug gives the offer the first free candidate slug for title.
+func (db *mysqlDB) assignSlug(ctx context.Context, id, title string) error {
+	base := slugify(title)
+	rows, err := db.takenSlugs.QueryContext(ctx, base, base)
 	if err != nil {
-		return r, fmt.Errorf("mysql: could not execute statement: %v", err)
+		return err
 	}
-	rowsAffected, err := r.RowsAffected()
-	if err != nil {
-		return r, fmt.Errorf("mysql: could not get rows affected: %v", err)
-	} else if rowsAffected != 1 {
-		return r, fmt.Errorf("mysql: expected 1 row affected, got %d", rowsAffected)
+	taken := map[string]bool{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			rows.Close()
+			return err
+		}
+		taken[s] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for {
+		slug := uniqueSlug(base, func(s string) bool { return taken[s] })
+		_, err := db.setSlug.ExecContext(ctx, slug, id)
+		// Another instance may have taken the slug since it was read, in
+		// which case the unique index rejects it with "duplicate entry".
+		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1062 {
+			taken[slug] = true
+			continue
+		}
+		return err
 	}
-	return r, nil
 }
 
+// idBatchSize is the number of IDs GetOffersByIDs looks up per query, which
+// keeps long lists below MySQL's placeholder and packet size limits.
+const idBatchSize = 1000
+
+// GetOffersByIDs retrieves several offers, with one query per idBatchSize IDs.
+func (db *mysqlDB) GetOffersByIDs(ctx context.Context, ids []string) ([]*Offer, error) {
+	defer logSlow("GetOffersByIDs")()
+	if len(ids) == 0 {
+		return []*Offer{}, nil
+	}
+	var found []*Offer
+	for start := 0; start < len(ids); start += idBatchSize {
+		end := start + idBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		rows, err := db.conn.QueryContext(ctx, "SELECT * FROM offers WHERE "+notDeleted+" AND offerId IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not get offers: %v", err)
+		}
+		offers, err := scanOffers(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, offers...)
+	}
+	return orderByIDs(found, ids), nil
+}
+
+// FilteredSearch returns up to limit offers, skipping offset, whose
+// description or title contains q and that match the applied filters,
+// ordered by offer ID so pages are stable.
+func (db *mysqlDB) FilteredSearch(ctx context.Context, q string, applied FilterOptions, offset, limit int) ([]*Offer, error) {
+	defer logSlow("FilteredSearch")()
+	where, args := searchWhere(q, applied, "")
+	rows, err := db.conn.QueryContext(ctx, "SELECT * FROM offers WHERE "+where+" ORDER BY offerId LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not search offers: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+// SearchFacets counts the offers matching q for each brand, currency and
+// price bucket. Each facet is counted in its own query, ignoring the values
+// applied to it. Brands are limited to the maxBrands with the most offers.
+func (db *mysqlDB) SearchFacets(ctx context.Context, q string, applied FilterOptions) (Facets, error) {
+	defer logSlow("SearchFacets")()
+	var f Facets
+	var err error
+	if f.Brands, err = db.countFacet(ctx, q, applied, brandFacet, "brand", maxBrands); err != nil {
+		return Facets{}, err
+	}
+	if f.Currencies, err = db.countFacet(ctx, q, applied, currencyFacet, "currency", 0); err != nil {
+		return Facets{}, err
+	}
+	prices, err := db.countFacet(ctx, q, applied, priceFacet, priceBucketExpr(), 0)
+	if err != nil {
+		return Facets{}, err
+	}
+	// List every bucket, in ascending order, rather than by count.
+	counts := map[string]int{}
+	for _, c := range prices {
+		counts[c.Value] = c.Count
+	}
+	for _, b := range PriceBuckets {
+		f.Prices = append(f.Prices, FacetCount{Value: b.Label, Count: counts[b.Label]})
+	}
+	f.Brands = facetCounts(f.Brands, applied.Brands)
+	f.Currencies = facetCounts(f.Currencies, applied.Currencies)
+	f.Prices = facetCounts(f.Prices, applied.Prices)
+	return f, nil
+}
+
+// countFacet returns the number of offers matching q and the filters not
+// applied to facet for each value of expr, most offers first. Empty values
+// are skipped. If limit is positive, at most limit values are returned.
+func (db *mysqlDB) countFacet(ctx context.Context, q string, applied FilterOptions, facet, expr string, limit int) ([]FacetCount, error) {
+	where, args := searchWhere(q, applied, facet)
+	query := "SELECT " + expr + " AS value, COUNT(*) FROM offers WHERE " + where +
+		" GROUP BY value HAVING value <> '' ORDER BY COUNT(*) DESC, value"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not count %s facet: %v", facet, err)
+	}
+	defer rows.Close()
+
+	var counts []FacetCount
+	for rows.Next() {
+		var c FacetCount
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mysql: could not read rows: %v", err)
+	}
+	return counts, nil
+}
+
+// FilterOffers returns up to limit offers matching the filter. The query is
+// built from the filter's allowlisted columns and operators, with values
+// passed as arguments.
+func (db *mysqlDB) FilterOffers(ctx context.Context, f *Filter, limit int) ([]*Offer, error) {
+	defer logSlow("FilterOffers")()
+	where, args := f.where()
+	rows, err := db.conn.QueryContext(ctx, "SELECT * FROM offers WHERE "+notDeleted+" AND ("+where+") LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not filter offers: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const existsStatement = "SELECT 1 FROM offers WHERE offerId = ? AND " + notDeleted + " LIMIT 1"
+
+// OfferExists reports whether an offer with the given ID exists, without
+// reading the rest of the row.
+func (db *mysqlDB) OfferExists(ctx context.Context, id string) (bool, error) {
+	defer logSlow("OfferExists")()
+	var one int
+	err := db.exists.QueryRowContext(ctx, id).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("mysql: could not check offer exists: %v", err)
+	}
+	return true, nil
+}
+
+// RelatedOffers returns the offers sharing the most title words with the
+// offer with the given ID.
+func (db *mysqlDB) RelatedOffers(ctx context.Context, id string, limit int) ([]*Offer, error) {
+	defer logSlow("RelatedOffers")()
+	o, err := db.GetOffer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	related := []*Offer{}
+	keywords := relatedKeywords(o)
+	if len(keywords) == 0 {
+		return related, nil
+	}
+	query, args := relatedQuery(id, keywords, limit)
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list related offers: %v", err)
+	}
+	offers, err := scanOffers(rows)
+	if err != nil {
+		return nil, err
+	}
+	return append(related, offers...), nil
+}
+
+const variantsStatement = `SELECT * FROM offers WHERE itemGroupId = ? AND ` + notDeleted + ` ORDER BY title`
+
+// GetVariants returns the offers in the given item group, ordered by title.
+func (db *mysqlDB) GetVariants(ctx context.Context, itemGroupID string) ([]*Offer, error) {
+	defer logSlow("GetVariants")()
+	if itemGroupID == "" {
+		return nil, nil
+	}
+	rows, err := db.variants.QueryContext(ctx, itemGroupID)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get variants: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const insertStatement = `
+  INSERT INTO offers (
+    offerId, title, price, currency, imageUrl, description, merchantUrl,
+    contentHash, itemGroupId, gtin, quantity, brand, category,
+    availability, itemCondition, salePrice, merchantId
+  ) VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`
+
+// restoreStatement rewrites a soft-deleted offer and undeletes it. Like
+// upsertStatement, it makes the row's id the statement's insert ID.
+const restoreStatement = `
+  UPDATE offers
+  SET id = LAST_INSERT_ID(id), title=?, price=NULLIF(?, ''), currency=?, imageUrl=?,
+	description=?, merchantUrl=?, contentHash=?, itemGroupId=?, gtin=?, quantity=?,
+	brand=?, category=?, availability=?, itemCondition=?, salePrice=NULLIF(?, ''),
+	merchantId=?, version = version + 1, deletedAt = NULL
+  WHERE offerId = ? AND deletedAt IS NOT NULL`
+
+// AddOffer saves a given offer, assigning it a new ID. If the driver can't
+// report the ID of the inserted row, AddOffer returns 0 and no error. An
+// offer with the ID of a soft-deleted one restores it, keeping its row.
+func (db *mysqlDB) AddOffer(ctx context.Context, o *Offer) (id int64, err error) {
+	defer logSlow("AddOffer")()
+	if err := o.Validate(); err != nil {
+		return 0, err
+	}
+	r, err := db.insert.ExecContext(ctx, o.ID, o.Title, o.Price, o.Currency,
+		o.ImageURL, o.Description, o.MerchantURL, o.contentHash(), o.ItemGroupID,
+		o.GTIN, o.Quantity, o.Brand, o.Category, o.Availability, o.Condition, o.SalePrice, o.MerchantID)
+	// MySQL error 1062 is "duplicate entry" for the unique offerId index.
+	if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1062 {
+		r, err = db.restore.ExecContext(ctx, o.Title, o.Price, o.Currency,
+			o.ImageURL, o.Description, o.MerchantURL, o.contentHash(), o.ItemGroupID,
+			o.GTIN, o.Quantity, o.Brand, o.Category, o.Availability, o.Condition, o.SalePrice, o.MerchantID, o.ID)
+		if err != nil {
+			return 0, fmt.Errorf("mysql: could not restore offer: %v", err)
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("mysql: could not get rows affected: %v", err)
+		}
+		if n == 0 {
+			return 0, ErrDuplicateOffer
+		}
+		return insertID(r), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	db.assignSlugs(ctx)
+	return insertID(r), nil
+}
+
+// insertID returns the ID of the row inserted by r, or 0 if it is not
+// available. Not every driver or table supports LastInsertId, and the insert
+// itself has already succeeded by the time it is called.
+func insertID(r sql.Result) int64 {
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// deleteStaleStatement, followed by a placeholder per offerId and ")", and
+// deleteOneStatement soft-delete offers, keeping their rows until
+// PurgeDeleted. Offers already deleted keep their deletion time.
+const deleteStaleStatement = `UPDATE offers SET deletedAt = ? WHERE deletedAt IS NULL AND offerId IN (`
+
+const deleteOneStatement = `UPDATE offers SET deletedAt = ? WHERE offerId = ? AND deletedAt IS NULL`
+
+// DeleteOffer removes the offer with the given ID.
+func (db *mysqlDB) DeleteOffer(ctx context.Context, id string) error {
+	defer logSlow("DeleteOffer")()
+	r, err := db.deleteOne.ExecContext(ctx, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("mysql: could not delete offer: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	if n == 0 {
+		return ErrOfferNotFound
+	}
+	return nil
+}
+
+const updateStatement = `
+  UPDATE offers
+  SET title=?, price=NULLIF(?, ''), currency=?, imageUrl=?, description=?, merchantUrl=?,
+	contentHash=?, itemGroupId=?, gtin=?, quantity=?, brand=?, category=?,
+	availability=?, itemCondition=?, salePrice=NULLIF(?, ''), merchantId=?,
+	version = version + 1
+  WHERE offerId = ? AND version = ? AND ` + notDeleted
+
+// UpdateOffer updates the entry for a given offer if its version is the
+// stored one. It returns ErrOfferNotFound if the offer doesn't exist, and
+// ErrConcurrentModification if it has a different version.
+func (db *mysqlDB) UpdateOffer(ctx context.Context, o *Offer) error {
+	defer logSlow("UpdateOffer")()
+	if o.ID == "" {
+		return errors.New("mysql: offer with unassigned ID passed into updateOffer")
+	}
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	r, err := db.update.ExecContext(ctx, o.Title, o.Price, o.Currency, o.ImageURL, o.Description, o.MerchantURL, o.contentHash(), o.ItemGroupID, o.GTIN, o.Quantity, o.Brand, o.Category, o.Availability, o.Condition, o.SalePrice, o.MerchantID, o.ID, o.Version)
+	if err != nil {
+		return fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	switch {
+	case n == 1:
+		o.Version++
+		return nil
+	case n > 1:
+		return fmt.Errorf("mysql: expected 1 row affected, got %d", n)
+	}
+	// Every update changes the version, so no rows are affected only if the
+	// offer is missing or was written since it was read.
+	exists, err := db.OfferExists(ctx, o.ID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrOfferNotFound
+	}
+	return ErrConcurrentModification
+}
+
+// UpdateOfferFields sets the given fields of an offer, reading and
+// rewriting it in a transaction so concurrent writes can't interleave with
+// the validation.
+func (db *mysqlDB) UpdateOfferFields(ctx context.Context, id string, fields map[string]interface{}) error {
+	defer logSlow("UpdateOfferFields")()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	o, err := scanOffer(tx.QueryRowContext(ctx, getStatement+" FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return ErrOfferNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("mysql: could not get offer: %v", err)
+	}
+	names, err := applyPatch(o, fields)
+	if err != nil {
+		return err
+	}
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	set, args := patchAssignments(o, names)
+	args = append(args, o.contentHash(), id)
+	query := "UPDATE offers SET " + set + ", contentHash = ?, version = version + 1 WHERE offerId = ? AND " + notDeleted
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit update: %v", err)
+	}
+	return nil
+}
+
+// upsertStatement inserts an offer or, if one with the same offerId exists,
+// rewrites it, restoring it if it was soft-deleted. Assigning id through
+// LAST_INSERT_ID makes the existing row's id the statement's insert ID. Rows
+// rewritten with the values they already have aren't counted as affected,
+// which tells unchanged offers apart, so version is only incremented for
+// changed or restored offers, before contentHash and deletedAt are replaced.
+const upsertStatement = `
+  INSERT INTO offers (
+    offerId, title, price, currency, imageUrl, description, merchantUrl,
+    contentHash, itemGroupId, gtin, quantity, brand, category,
+    availability, itemCondition, salePrice, merchantId
+  ) VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)
+  ON DUPLICATE KEY UPDATE
+    id = LAST_INSERT_ID(id),
+    version = IF(contentHash <=> VALUES(contentHash) AND deletedAt IS NULL, version, version + 1),
+    title = VALUES(title), price = VALUES(price),
+    currency = VALUES(currency), imageUrl = VALUES(imageUrl),
+    description = VALUES(description), merchantUrl = VALUES(merchantUrl),
+    contentHash = VALUES(contentHash), itemGroupId = VALUES(itemGroupId),
+    gtin = VALUES(gtin), quantity = VALUES(quantity), brand = VALUES(brand),
+    category = VALUES(category), availability = VALUES(availability),
+    itemCondition = VALUES(itemCondition), salePrice = VALUES(salePrice),
+    merchantId = VALUES(merchantId),
+    deletedAt = NULL`
+
+// UpsertOffer adds the offer if it doesn't exist and otherwise updates it,
+// in one statement, so concurrent calls for the same offer can't insert it
+// twice. The row of an unchanged offer is left as it is.
+func (db *mysqlDB) UpsertOffer(ctx context.Context, o *Offer) (int64, bool, error) {
+	defer logSlow("UpsertOffer")()
+	if o.ID == "" {
+		return 0, false, errors.New("mysql: offer with unassigned ID passed into upsertOffer")
+	}
+	if err := o.validatePrice(); err != nil {
+		return 0, false, err
+	}
+
+	r, err := db.upsert.ExecContext(ctx, o.ID, o.Title, o.Price, o.Currency, o.ImageURL,
+		o.Description, o.MerchantURL, o.contentHash(), o.ItemGroupID, o.GTIN, o.Quantity, o.Brand, o.Category,
+		o.Availability, o.Condition, o.SalePrice, o.MerchantID)
+	if err != nil {
+		return 0, false, fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, false, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+	}
+	// 1 row is affected by an insert, 2 by a change and 0 otherwise.
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, false, fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	if n == 1 {
+		db.assignSlugs(ctx)
+	}
+	return id, n > 0, nil
+}
+
+// upsertBatchSize is the number of offers BulkUpsertOffers writes with one
+// statement, well below MySQL's limit of 65535 placeholders.
+const upsertBatchSize = 500
+
+// A batch of offers is upserted by bulkUpsertColumns followed by a
+// bulkUpsertRow per new or changed offer and bulkUpsertUpdate. Assignments
+// are applied in order, so updatedAt and version are compared with the
+// stored content hash before it is replaced, and kept if it matches and the
+// offer isn't being restored: an offer that was changed back by another
+// write after its hash was read isn't counted as written either.
+const bulkUpsertColumns = `
+  INSERT INTO offers (
+    offerId, title, price, currency, imageUrl, description, merchantUrl,
+    contentHash, itemGroupId, gtin, quantity, brand, category,
+    availability, itemCondition, salePrice, merchantId
+  ) VALUES `
+
+const bulkUpsertRow = "(?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)"
+
+const bulkUpsertUpdate = `
+  ON DUPLICATE KEY UPDATE
+    updatedAt = IF(contentHash <=> VALUES(contentHash) AND deletedAt IS NULL, updatedAt, CURRENT_TIMESTAMP),
+    version = IF(contentHash <=> VALUES(contentHash) AND deletedAt IS NULL, version, version + 1),
+    title = VALUES(title), price = VALUES(price),
+    currency = VALUES(currency), imageUrl = VALUES(imageUrl),
+    description = VALUES(description), merchantUrl = VALUES(merchantUrl),
+    contentHash = VALUES(contentHash), itemGroupId = VALUES(itemGroupId),
+    gtin = VALUES(gtin), quantity = VALUES(quantity), brand = VALUES(brand),
+    category = VALUES(category), availability = VALUES(availability),
+    itemCondition = VALUES(itemCondition), salePrice = VALUES(salePrice),
+    merchantId = VALUES(merchantId),
+    deletedAt = NULL`
+
+// BulkUpsertOffers upserts the offers in batches within one transaction.
+// The stored content hashes are read first, so the offers that haven't
+// changed are left out of the statements and their rows aren't written.
+func (db *mysqlDB) BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error) {
+	defer logSlow("BulkUpsertOffers")()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	changed, err := bulkUpsertOffers(ctx, tx, offers)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("mysql: could not commit offers: %v", err)
+	}
+	db.assignSlugs(ctx)
+	return changed, nil
+}
+
+// bulkUpsertOffers upserts the offers in batches within tx.
+func bulkUpsertOffers(ctx context.Context, tx *sql.Tx, offers []*Offer) (int, error) {
+	for _, o := range offers {
+		if o.ID == "" {
+			return 0, errors.New("mysql: offer with unassigned ID passed into BulkUpsertOffers")
+		}
+		if err := o.validatePrice(); err != nil {
+			return 0, err
+		}
+	}
+	changed := 0
+	for start := 0; start < len(offers); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(offers) {
+			end = len(offers)
+		}
+		n, err := upsertOffers(ctx, tx, offers[start:end])
+		if err != nil {
+			return 0, err
+		}
+		changed += n
+	}
+	return changed, nil
+}
+
+// upsertOffers writes the new and changed offers of a batch with one
+// statement, and returns how many rows it wrote.
+func upsertOffers(ctx context.Context, tx *sql.Tx, batch []*Offer) (int, error) {
+	ids := make([]interface{}, len(batch))
+	for i, o := range batch {
+		ids[i] = o.ID
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+	// Soft-deleted offers are read without a hash, so they count as changed
+	// when they are restored.
+	rows, err := tx.QueryContext(ctx, "SELECT offerId, IF("+notDeleted+", contentHash, NULL) FROM offers WHERE offerId IN ("+placeholders+")", ids...)
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get content hashes: %v", err)
+	}
+	hashes := map[string]string{}
+	for rows.Next() {
+		var id string
+		var hash sql.NullString
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("mysql: could not read content hash: %v", err)
+		}
+		hashes[id] = hash.String
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("mysql: could not read content hashes: %v", err)
+	}
+
+	// An offer listed twice in the batch is written once, with the last of
+	// its values, like a sequence of UpsertOffer calls would leave it.
+	last := map[string]*Offer{}
+	for _, o := range batch {
+		last[o.ID] = o
+	}
+	rowCount, inserts := 0, 0
+	args := make([]interface{}, 0, 17*len(batch))
+	for _, o := range batch {
+		if last[o.ID] != o {
+			continue
+		}
+		hash := o.contentHash()
+		old, ok := hashes[o.ID]
+		if ok && old == hash {
+			continue
+		}
+		if !ok {
+			inserts++
+		}
+		rowCount++
+		args = append(args, o.ID, o.Title, o.Price, o.Currency, o.ImageURL,
+			o.Description, o.MerchantURL, hash, o.ItemGroupID, o.GTIN, o.Quantity, o.Brand, o.Category,
+			o.Availability, o.Condition, o.SalePrice, o.MerchantID)
+	}
+	if rowCount == 0 {
+		return 0, nil
+	}
+	values := strings.TrimSuffix(strings.Repeat(bulkUpsertRow+", ", rowCount), ", ")
+	r, err := tx.ExecContext(ctx, bulkUpsertColumns+values+bulkUpsertUpdate, args...)
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not upsert offers: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	// MySQL counts 1 affected row per insert, 2 per changed row and none
+	// for a row left as it was.
+	return inserts + int(n-int64(inserts))/2, nil
+}
+
+// WithTx runs fn in a transaction. The rows it writes stay locked until the
+// transaction ends, so other writes to them wait for the sync; reads see the
+// offers as they were until it commits.
+func (db *mysqlDB) WithTx(ctx context.Context, fn func(SyncWriter) error) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := fn(&mysqlTx{db: db, tx: tx, seen: map[string]bool{}, kept: map[int64]bool{}}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit sync: %v", err)
+	}
+	db.assignSlugs(ctx)
+	return nil
+}
+
+// mysqlTx is the SyncWriter of a transaction started by WithTx.
+type mysqlTx struct {
+	db *mysqlDB
+	tx *sql.Tx
+	// seen holds the IDs of the offers upserted since UpdateUpdated, and
+	// kept the merchants whose offers are all kept.
+	seen map[string]bool
+	kept map[int64]bool
+}
+
+// UpdateUpdated forgets the offers seen so far.
+func (t *mysqlTx) UpdateUpdated(ctx context.Context) error {
+	t.seen, t.kept = map[string]bool{}, map[int64]bool{}
+	return nil
+}
+
+// KeepMerchantOffers marks the merchant's offers as seen.
+func (t *mysqlTx) KeepMerchantOffers(ctx context.Context, merchantID int64) error {
+	t.kept[merchantID] = true
+	return nil
+}
+
+// BulkUpsertOffers upserts the offers within the transaction.
+func (t *mysqlTx) BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error) {
+	defer logSlow("BulkUpsertOffers")()
+	n, err := bulkUpsertOffers(ctx, t.tx, offers)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range offers {
+		t.seen[o.ID] = true
+	}
+	return n, nil
+}
+
+// liveIDsStatement lists the offers DeleteOffers may find stale, and the
+// merchants they were synced from.
+const liveIDsStatement = `SELECT offerId, merchantId FROM offers WHERE ` + notDeleted
+
+// DeleteOffers soft-deletes the offers not seen since UpdateUpdated within
+// the transaction. The IDs of all the offers are read to find them, so only
+// the rows of the deleted offers are written.
+func (t *mysqlTx) DeleteOffers(ctx context.Context) (int64, error) {
+	defer logSlow("DeleteOffers")()
+	rows, err := t.tx.QueryContext(ctx, liveIDsStatement)
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not list offers: %v", err)
+	}
+	var stale []interface{}
+	for rows.Next() {
+		var id string
+		var merchantID int64
+		if err := rows.Scan(&id, &merchantID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("mysql: could not read offer ID: %v", err)
+		}
+		if !t.seen[id] && !t.kept[merchantID] {
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("mysql: could not list offers: %v", err)
+	}
+
+	now := time.Now().UTC()
+	var deleted int64
+	for start := 0; start < len(stale); start += idBatchSize {
+		end := start + idBatchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+		batch := stale[start:end]
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		r, err := t.tx.ExecContext(ctx, deleteStaleStatement+placeholders+")", append([]interface{}{now}, batch...)...)
+		if err != nil {
+			return 0, fmt.Errorf("mysql: could not delete stale offers: %v", err)
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("mysql: could not get rows affected: %v", err)
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+const recordViewStatement = `INSERT INTO offer_views (offerId, viewedAt) VALUES (?, ?)`
+
+// RecordView records a view of the given offer at the current time.
+func (db *mysqlDB) RecordView(ctx context.Context, id string) error {
+	defer logSlow("RecordView")()
+	if _, err := db.recordView.ExecContext(ctx, id, time.Now().UTC()); err != nil {
+		return fmt.Errorf("mysql: could not record view: %v", err)
+	}
+	return nil
+}
+
+const trendingStatement = `
+  SELECT o.* FROM offers o
+  JOIN (
+    SELECT ov.offerId, COUNT(*) AS views FROM offer_views ov
+    JOIN offers d ON d.offerId = ov.offerId AND d.` + notDeleted + `
+    WHERE ov.viewedAt >= ?
+    GROUP BY ov.offerId
+    ORDER BY views DESC
+    LIMIT ?
+  ) v ON v.offerId = o.offerId
+  ORDER BY v.views DESC, o.title`
+
+// TrendingOffers returns the offers viewed most often within the window.
+func (db *mysqlDB) TrendingOffers(ctx context.Context, window time.Duration, limit int) ([]*Offer, error) {
+	defer logSlow("TrendingOffers")()
+	rows, err := db.trending.QueryContext(ctx, time.Now().UTC().Add(-window), limit)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list trending offers: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const newOffersStatement = `
+  SELECT * FROM offers WHERE createdAt >= ? AND ` + notDeleted + `
+  ORDER BY createdAt DESC, id DESC LIMIT ?`
+
+// ListNewOffers returns the offers first stored since the given time.
+func (db *mysqlDB) ListNewOffers(ctx context.Context, since time.Time, limit int) ([]*Offer, error) {
+	defer logSlow("ListNewOffers")()
+	rows, err := db.newOffers.QueryContext(ctx, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list new offers: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const categoryStatement = `
+  SELECT * FROM offers WHERE category = ? AND ` + notDeleted + `
+  ORDER BY title, id LIMIT ? OFFSET ?`
+
+// ListByCategory returns a page of the offers in the given category.
+func (db *mysqlDB) ListByCategory(ctx context.Context, category string, limit, offset int) ([]*Offer, error) {
+	defer logSlow("ListByCategory")()
+	rows, err := db.category.QueryContext(ctx, storedCategory(category), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list offers by category: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const byMerchantStatement = `
+  SELECT * FROM offers WHERE merchantId = ? AND ` + notDeleted + `
+  ORDER BY title, id LIMIT ? OFFSET ?`
+
+// ListOffersByMerchant returns a page of the offers synced from the given
+// account.
+func (db *mysqlDB) ListOffersByMerchant(ctx context.Context, merchantID int64, limit, offset int) ([]*Offer, error) {
+	defer logSlow("ListOffersByMerchant")()
+	rows, err := db.byMerchant.QueryContext(ctx, merchantID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list offers by merchant: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const purgeDeletedStatement = `DELETE FROM offers WHERE deletedAt < ?`
+
+// PurgeDeleted removes the offers soft-deleted before the given time.
+func (db *mysqlDB) PurgeDeleted(ctx context.Context, olderThan time.Time) (int64, error) {
+	defer logSlow("PurgeDeleted")()
+	r, err := db.purgeDeleted.ExecContext(ctx, olderThan.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not purge deleted offers: %v", err)
+	}
+	return r.RowsAffected()
+}
+
+const pruneViewsStatement = `DELETE FROM offer_views WHERE viewedAt < ?`
+
+// PruneViews deletes views recorded before the given time.
+func (db *mysqlDB) PruneViews(ctx context.Context, before time.Time) (int64, error) {
+	defer logSlow("PruneViews")()
+	r, err := db.pruneViews.ExecContext(ctx, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not prune views: %v", err)
+	}
+	return r.RowsAffected()
+}
+
+const (
+	// lockQuantityStatement locks the offer's row, so concurrent
+	// reservations of the offer are serialized.
+	lockQuantityStatement = `SELECT quantity FROM offers WHERE offerId = ? AND ` + notDeleted + ` FOR UPDATE`
+	reservedStatement     = `
+  SELECT COALESCE(SUM(quantity), 0) FROM reservations
+  WHERE offerId = ? AND expiresAt > ?`
+	addReservationStatement = `
+  INSERT INTO reservations (id, offerId, quantity, expiresAt) VALUES (?, ?, ?, ?)`
+)
+
+// ReserveOffer reserves qty items of the offer in a transaction. The
+// available quantity is the offer's quantity less its unexpired
+// reservations, so reservations stop counting once they expire, and syncs
+// that update the quantity don't lose them.
+func (db *mysqlDB) ReserveOffer(ctx context.Context, offerID string, qty int, ttl time.Duration) (string, error) {
+	defer logSlow("ReserveOffer")()
+	if qty <= 0 {
+		return "", fmt.Errorf("mysql: invalid reservation quantity %d", qty)
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("mysql: invalid reservation ttl %v", ttl)
+	}
+	id, err := newReservationID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var quantity, reserved int64
+	err = tx.QueryRowContext(ctx, lockQuantityStatement, offerID).Scan(&quantity)
+	if err == sql.ErrNoRows {
+		return "", ErrOfferNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("mysql: could not get quantity: %v", err)
+	}
+	if quantity == 0 {
+		return "", ErrQuantityUnknown
+	}
+	if err := tx.QueryRowContext(ctx, reservedStatement, offerID, now).Scan(&reserved); err != nil {
+		return "", fmt.Errorf("mysql: could not get reserved quantity: %v", err)
+	}
+	if quantity-reserved < int64(qty) {
+		return "", ErrInsufficientQuantity
+	}
+	if _, err := tx.ExecContext(ctx, addReservationStatement, id, offerID, qty, now.Add(ttl)); err != nil {
+		return "", fmt.Errorf("mysql: could not add reservation: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("mysql: could not commit reservation: %v", err)
+	}
+	return id, nil
+}
+
+// newReservationID returns a random reservation ID, which can't be guessed
+// to release other shoppers' reservations.
+func newReservationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("mysql: could not generate reservation id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+const releaseReservationStatement = `DELETE FROM reservations WHERE id = ?`
+
+// ReleaseReservation deletes the reservation.
+func (db *mysqlDB) ReleaseReservation(ctx context.Context, id string) error {
+	defer logSlow("ReleaseReservation")()
+	if _, err := db.releaseReservation.ExecContext(ctx, id); err != nil {
+		return fmt.Errorf("mysql: could not release reservation: %v", err)
+	}
+	return nil
+}
+
+const pruneReservationsStatement = `DELETE FROM reservations WHERE expiresAt <= ?`
+
+// PruneReservations deletes expired reservations.
+func (db *mysqlDB) PruneReservations(ctx context.Context) (int64, error) {
+	defer logSlow("PruneReservations")()
+	r, err := db.pruneReservations.ExecContext(ctx, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not prune reservations: %v", err)
+	}
+	return r.RowsAffected()
+}
+
+// SetFeatured replaces the featured offers list within a transaction.
+func (db *mysqlDB) SetFeatured(ctx context.Context, ids []string) error {
+	defer logSlow("SetFeatured")()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM featured_offers"); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("mysql: could not clear featured offers: %v", err)
+	}
+	for i, id := range uniqueIDs(ids) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO featured_offers (offerId, position) VALUES (?, ?)", id, i); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("mysql: could not add featured offer %s: %v", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit featured offers: %v", err)
+	}
+	return nil
+}
+
+const featuredStatement = `
+  SELECT o.* FROM featured_offers f
+  JOIN offers o ON o.offerId = f.offerId
+  WHERE o.` + notDeleted + `
+  ORDER BY f.position`
+
+// GetFeaturedOffers returns the featured offers in position order.
+func (db *mysqlDB) GetFeaturedOffers(ctx context.Context) ([]*Offer, error) {
+	defer logSlow("GetFeaturedOffers")()
+	rows, err := db.featured.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list featured offers: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const addReportStatement = `INSERT INTO offer_reports (offerId, reason, createdAt) VALUES (?, ?, ?)`
+
+// AddReport stores a report about an offer.
+func (db *mysqlDB) AddReport(ctx context.Context, offerID, reason string) error {
+	defer logSlow("AddReport")()
+	if _, err := execAffectingOneRow(ctx, db.addReport, offerID, reason, time.Now().UTC()); err != nil {
+		return err
+	}
+	return nil
+}
+
+const listReportsStatement = `
+  SELECT id, offerId, reason, createdAt FROM offer_reports
+  ORDER BY createdAt DESC, id DESC LIMIT ?`
+
+// ListReports returns the most recent reports.
+func (db *mysqlDB) ListReports(ctx context.Context, limit int) ([]*OfferReport, error) {
+	defer logSlow("ListReports")()
+	rows, err := db.listReports.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list reports: %v", err)
+	}
+	defer rows.Close()
+
+	var reports []*OfferReport
+	for rows.Next() {
+		r := &OfferReport{}
+		if err := rows.Scan(&r.ID, &r.OfferID, &r.Reason, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+const addReviewStatement = `INSERT INTO reviews (offerId, rating, text, createdAt) VALUES (?, ?, ?, ?)`
+
+// AddReview stores a review of an offer.
+func (db *mysqlDB) AddReview(ctx context.Context, offerID string, rating int, text string) error {
+	defer logSlow("AddReview")()
+	if rating < MinRating || rating > MaxRating {
+		return ErrInvalidRating
+	}
+	if _, err := execAffectingOneRow(ctx, db.addReview, offerID, rating, text, time.Now().UTC()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// maxReviews bounds the number of reviews returned by GetReviews.
+const maxReviews = 100
+
+const getReviewsStatement = `
+  SELECT id, offerId, rating, text, createdAt FROM reviews
+  WHERE offerId = ? ORDER BY createdAt DESC, id DESC LIMIT ?`
+
+// GetReviews returns up to maxReviews of an offer's most recent reviews.
+func (db *mysqlDB) GetReviews(ctx context.Context, offerID string) ([]*Review, error) {
+	defer logSlow("GetReviews")()
+	rows, err := db.getReviews.QueryContext(ctx, offerID, maxReviews)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get reviews: %v", err)
+	}
+	defer rows.Close()
+
+	var reviews []*Review
+	for rows.Next() {
+		r := &Review{}
+		if err := rows.Scan(&r.ID, &r.OfferID, &r.Rating, &r.Text, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		reviews = append(reviews, r)
+	}
+	return reviews, rows.Err()
+}
+
+const ratingStatement = `SELECT COALESCE(AVG(rating), 0), COUNT(*) FROM reviews WHERE offerId = ?`
+
+// AverageRating returns the average rating of an offer's reviews.
+func (db *mysqlDB) AverageRating(ctx context.Context, offerID string) (Rating, error) {
+	defer logSlow("AverageRating")()
+	var r Rating
+	if err := db.rating.QueryRowContext(ctx, offerID).Scan(&r.Average, &r.Count); err != nil {
+		return Rating{}, fmt.Errorf("mysql: could not get rating: %v", err)
+	}
+	return r, nil
+}
+
+// AverageRatings returns the average ratings of several offers with one
+// query.
+func (db *mysqlDB) AverageRatings(ctx context.Context, offerIDs []string) (map[string]Rating, error) {
+	defer logSlow("AverageRatings")()
+	ratings := map[string]Rating{}
+	if len(offerIDs) == 0 {
+		return ratings, nil
+	}
+	args := make([]interface{}, len(offerIDs))
+	for i, id := range offerIDs {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(offerIDs)), ", ")
+	rows, err := db.conn.QueryContext(ctx, "SELECT offerId, AVG(rating), COUNT(*) FROM reviews WHERE offerId IN ("+placeholders+") GROUP BY offerId", args...)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get ratings: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var r Rating
+		if err := rows.Scan(&id, &r.Average, &r.Count); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		ratings[id] = r
+	}
+	return ratings, rows.Err()
+}
+
+const addAlertStatement = `
+  INSERT INTO price_alerts (offerId, targetPrice, contact, createdAt) VALUES (?, ?, ?, ?)`
+
+// AddPriceAlert stores a pending price alert.
+func (db *mysqlDB) AddPriceAlert(ctx context.Context, offerID, targetPrice, contact string) (int64, error) {
+	defer logSlow("AddPriceAlert")()
+	r, err := execAffectingOneRow(ctx, db.addAlert, offerID, targetPrice, contact, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+	}
+	return id, nil
+}
+
+const alertColumns = `a.id, a.offerId, a.targetPrice, a.contact, a.createdAt, a.firedAt`
+
+const listAlertsStatement = `
+  SELECT ` + alertColumns + ` FROM price_alerts a
+  ORDER BY a.createdAt DESC, a.id DESC LIMIT ?`
+
+// ListPriceAlerts returns the most recent price alerts.
+func (db *mysqlDB) ListPriceAlerts(ctx context.Context, limit int) ([]*PriceAlert, error) {
+	defer logSlow("ListPriceAlerts")()
+	rows, err := db.listAlerts.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list price alerts: %v", err)
+	}
+	return scanAlerts(rows)
+}
+
+const deleteAlertStatement = `DELETE FROM price_alerts WHERE id = ?`
+
+// DeletePriceAlert deletes a price alert.
+func (db *mysqlDB) DeletePriceAlert(ctx context.Context, id int64) error {
+	defer logSlow("DeletePriceAlert")()
+	if _, err := execAffectingOneRow(ctx, db.deleteAlert, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+const triggeredStatement = `
+  SELECT ` + alertColumns + ` FROM price_alerts a
+  JOIN offers o ON o.offerId = a.offerId
+  WHERE a.firedAt IS NULL AND o.` + notDeleted + ` AND CAST(o.price AS DECIMAL(15,2)) <= a.targetPrice`
+
+// TriggeredPriceAlerts returns the pending alerts whose offer's price is at
+// or below the target.
+func (db *mysqlDB) TriggeredPriceAlerts(ctx context.Context) ([]*PriceAlert, error) {
+	defer logSlow("TriggeredPriceAlerts")()
+	rows, err := db.triggered.QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list triggered price alerts: %v", err)
+	}
+	return scanAlerts(rows)
+}
+
+const (
+	fireAlertStatement   = `UPDATE price_alerts SET firedAt = ? WHERE id = ? AND firedAt IS NULL`
+	unfireAlertStatement = `UPDATE price_alerts SET firedAt = NULL WHERE id = ? AND firedAt IS NOT NULL`
+)
+
+// SetPriceAlertFired marks a price alert as fired or pending, reporting
+// whether it changed.
+func (db *mysqlDB) SetPriceAlertFired(ctx context.Context, id int64, fired bool) (bool, error) {
+	defer logSlow("SetPriceAlertFired")()
+	var r sql.Result
+	var err error
+	if fired {
+		r, err = db.fireAlert.ExecContext(ctx, time.Now().UTC(), id)
+	} else {
+		r, err = db.unfireAlert.ExecContext(ctx, id)
+	}
+	if err != nil {
+		return false, fmt.Errorf("mysql: could not update price alert: %v", err)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	return n == 1, nil
+}
+
+// scanAlerts reads price alerts selected with alertColumns and closes rows.
+func scanAlerts(rows *sql.Rows) ([]*PriceAlert, error) {
+	defer rows.Close()
+	var alerts []*PriceAlert
+	for rows.Next() {
+		a := &PriceAlert{}
+		var fired mysql.NullTime
+		if err := rows.Scan(&a.ID, &a.OfferID, &a.TargetPrice, &a.Contact, &a.CreatedAt, &fired); err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		if fired.Valid {
+			a.FiredAt = fired.Time
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// convertBatchSize is the number of offers updated per statement by
+// RecomputeConvertedPrices.
+const convertBatchSize = 500
+
+// convertedPrice is the converted price of one offer.
+type convertedPrice struct {
+	offerID string
+	price   sql.NullString
+}
+
+// RecomputeConvertedPrices recomputes all converted prices in one
+// transaction, only writing offers whose converted price changed.
+func (db *mysqlDB) RecomputeConvertedPrices(ctx context.Context, converter CurrencyConverter, displayCurrency string) (int64, error) {
+	defer logSlow("RecomputeConvertedPrices")()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+	  SELECT offerId, price, currency, convertedPrice, convertedCurrency
+	  FROM offers FOR UPDATE`)
+	if err != nil {
+		return 0, fmt.Errorf("mysql: could not read prices: %v", err)
+	}
+	// The rows must be fully read before the updates run on the same
+	// connection.
+	var changes []convertedPrice
+	for rows.Next() {
+		var offerID string
+		var price, currency, oldPrice, oldCurrency sql.NullString
+		if err := rows.Scan(&offerID, &price, &currency, &oldPrice, &oldCurrency); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+		var c convertedPrice
+		c.offerID = offerID
+		if v, err := converter.Convert(price.String, currency.String, displayCurrency); err == nil {
+			c.price = sql.NullString{String: v, Valid: true}
+		}
+		if c.price != oldPrice || oldCurrency.String != displayCurrency {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("mysql: could not read prices: %v", err)
+	}
+
+	for start := 0; start < len(changes); start += convertBatchSize {
+		end := start + convertBatchSize
+		if end > len(changes) {
+			end = len(changes)
+		}
+		if err := updateConvertedPrices(ctx, tx, changes[start:end], displayCurrency); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("mysql: could not commit converted prices: %v", err)
+	}
+	return int64(len(changes)), nil
+}
+
+// updateConvertedPrices writes a batch of converted prices with one statement.
+func updateConvertedPrices(ctx context.Context, tx *sql.Tx, batch []convertedPrice, currency string) error {
+	var cases strings.Builder
+	args := make([]interface{}, 0, 3*len(batch)+1)
+	for _, c := range batch {
+		cases.WriteString(" WHEN ? THEN ?")
+		args = append(args, c.offerID, c.price)
+	}
+	args = append(args, currency)
+	for _, c := range batch {
+		args = append(args, c.offerID)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+	stmt := "UPDATE offers SET convertedPrice = CASE offerId" + cases.String() + " END, " +
+		"convertedCurrency = ? WHERE offerId IN (" + placeholders + ")"
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return fmt.Errorf("mysql: could not update converted prices: %v", err)
+	}
+	return nil
+}
+
+const duplicatesStatement = `
+  SELECT * FROM offers WHERE canonicalProductId IS NOT NULL AND ` + notDeleted + `
+  ORDER BY canonicalProductId, offerId LIMIT ?`
+
+// ListDuplicateOffers returns offers linked to a canonical product.
+func (db *mysqlDB) ListDuplicateOffers(ctx context.Context, limit int) ([]*Offer, error) {
+	defer logSlow("ListDuplicateOffers")()
+	rows, err := db.duplicates.QueryContext(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list duplicate offers: %v", err)
+	}
+	return scanOffers(rows)
+}
+
+const clearCanonicalStatement = `
+  UPDATE offers SET canonicalProductId = NULL
+  WHERE canonicalProductId IS NOT NULL`
+
+const setCanonicalStatement = `
+  UPDATE offers SET canonicalProductId = ? WHERE offerId = ?`
+
+// SetCanonicalProducts replaces the canonical product links in one
+// transaction, so readers never see a partially linked catalog.
+func (db *mysqlDB) SetCanonicalProducts(ctx context.Context, links map[string]string) error {
+	defer logSlow("SetCanonicalProducts")()
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("mysql: could not begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, clearCanonicalStatement); err != nil {
+		return fmt.Errorf("mysql: could not clear canonical products: %v", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, setCanonicalStatement)
+	if err != nil {
+		return fmt.Errorf("mysql: prepare set canonical: %v", err)
+	}
+	defer stmt.Close()
+	for offerID, canonicalID := range links {
+		if _, err := stmt.ExecContext(ctx, canonicalID, offerID); err != nil {
+			return fmt.Errorf("mysql: could not set canonical product: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql: could not commit canonical products: %v", err)
+	}
+	return nil
+}
+
+const setMetaStatement = `
+  UPDATE offers SET metaTitle = NULLIF(?, ''), metaDescription = NULLIF(?, '')
+  WHERE offerId = ?`
+
+// SetMetaOverrides stores the offer's custom meta title and description.
+func (db *mysqlDB) SetMetaOverrides(ctx context.Context, offerID, title, description string) error {
+	defer logSlow("SetMetaOverrides")()
+	if _, err := db.setMeta.ExecContext(ctx, title, description, offerID); err != nil {
+		return fmt.Errorf("mysql: could not set meta overrides: %v", err)
+	}
+	return nil
+}
+
+// ensureTableExists checks the table exists. If not, it creates it.
+func (config MySQLConfig) ensureTableExists() error {
+	conn, err := sql.Open("mysql", config.dataStoreName(""))
+	if err != nil {
+		return fmt.Errorf("mysql: could not get a connection: %v", err)
+	}
+	defer conn.Close()
+
+	// Check the connection.
+	if conn.Ping() == driver.ErrBadConn {
+		return fmt.Errorf("mysql: could not connect to the database. " +
+			"could be bad address, or this address is not whitelisted for access.")
+	}
+
+	if _, err := conn.Exec("USE library"); err != nil {
+		// MySQL error 1049 is "database does not exist"
+		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1049 {
+			return createTable(conn)
+		}
+	}
+
+	if _, err := conn.Exec("DESCRIBE offers"); err != nil {
+		// MySQL error 1146 is "table does not exist"
+		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1146 {
+			return createTable(conn)
+		}
+		// Unknown error.
+		return fmt.Errorf("mysql: could not connect to the database: %v", err)
+	}
+	// The offers table exists, but tables added since it was created may not.
+	// Every statement is idempotent, so it is safe to run them all again.
+	// Columns and indexes added since are applied by migrate; for example,
+	// tables created before offerIds were unique have duplicate rows removed,
+	// keeping the newest, and then get the uniq_offerId index.
+	if err := createTable(conn); err != nil {
+		return err
+	}
+	return migrate(conn)
+}
+
+// migrate applies migrationStatements to an existing database.
+func migrate(conn *sql.DB) error {
+	for _, stmt := range migrationStatements {
+		if _, err := conn.Exec(stmt); err != nil {
+			// MySQL errors 1060 and 1061 are "duplicate column name" and
+			// "duplicate key name": the migration was already applied.
+			if mErr, ok := err.(*mysql.MySQLError); ok && (mErr.Number == 1060 || mErr.Number == 1061) {
+				continue
+			}
+			return fmt.Errorf("mysql: could not migrate: %v", err)
+		}
+	}
+	if err := migratePriceColumn(conn); err != nil {
+		return err
+	}
+	return migrateCreatedAtColumn(conn)
+}
+
+// migrateCreatedAtColumn adds the createdAt column to tables created by
+// earlier versions. Their offers are given their updatedAt as creation time,
+// the closest record there is, rather than the time of the migration. It
+// isn't a migration statement since the backfill must only run once. The
+// column is placed after brand, ahead of the columns migrationStatements
+// added since, so the columns are in the order scanOffer reads them.
+func migrateCreatedAtColumn(conn *sql.DB) error {
+	var n int
+	err := conn.QueryRow(`
+	  SELECT COUNT(*) FROM information_schema.COLUMNS
+	  WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'offers' AND COLUMN_NAME = 'createdAt'`).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("mysql: could not look up createdAt column: %v", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	for _, stmt := range []string{
+		`ALTER TABLE offers ADD COLUMN createdAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER brand`,
+		`UPDATE offers SET createdAt = updatedAt, updatedAt = updatedAt`,
+		`ALTER TABLE offers ADD INDEX idx_createdAt (createdAt)`,
+	} {
+		if _, err := conn.Exec(stmt); err != nil {
+			return fmt.Errorf("mysql: could not migrate createdAt column: %v", err)
+		}
+	}
+	return nil
+}
+
+// migratePriceColumn converts the price column of tables created by earlier
+// versions, which stored prices as text, to DECIMAL. Prices that aren't
+// numbers are cleared first; the next sync rejects them with a logged error.
+// Tables already converted are left alone, so the table isn't rebuilt on
+// every start.
+func migratePriceColumn(conn *sql.DB) error {
+	var dataType string
+	err := conn.QueryRow(`
+	  SELECT DATA_TYPE FROM information_schema.COLUMNS
+	  WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'offers' AND COLUMN_NAME = 'price'`).Scan(&dataType)
+	if err != nil {
+		return fmt.Errorf("mysql: could not get price column type: %v", err)
+	}
+	if strings.EqualFold(dataType, "decimal") {
+		return nil
+	}
+	for _, stmt := range []string{
+		`UPDATE offers SET price = NULL WHERE price NOT REGEXP '^[0-9]{1,13}(\\.[0-9]{1,2})?$'`,
+		`ALTER TABLE offers MODIFY COLUMN price DECIMAL(15,2) NULL`,
+	} {
+		if _, err := conn.Exec(stmt); err != nil {
+			return fmt.Errorf("mysql: could not migrate price column: %v", err)
+		}
+	}
+	return nil
+}
+
+// createTable creates the table, and if necessary, the database.
+func createTable(conn *sql.DB) error {
+	for _, stmt := range createTableStatements {
+		_, err := conn.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execAffectingOneRow executes a given statement, expecting one row to be affected.
+func execAffectingOneRow(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
+	r, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return r, fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return r, fmt.Errorf("mysql: could not get rows affected: %v", err)
+	} else if rowsAffected != 1 {
+		return r, fmt.Errorf("mysql: expected 1 row affected, got %d", rowsAffected)
+	}
+	return r, nil
+}
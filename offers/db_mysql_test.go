@@ -0,0 +1,689 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The MySQL tests run against the server at OFFERS_TEST_MYSQL_ADDR, such as
+// "localhost:3306", as root with the password OFFERS_TEST_MYSQL_PASSWORD.
+// They are skipped if it is unset. Every test empties the tables of the
+// library database, so the server must not hold data worth keeping.
+const (
+	mysqlTestAddrEnv     = "OFFERS_TEST_MYSQL_ADDR"
+	mysqlTestPasswordEnv = "OFFERS_TEST_MYSQL_PASSWORD"
+)
+
+// mysqlTestTables are the tables emptied before each test.
+var mysqlTestTables = []string{
+	"offers", "offer_views", "featured_offers", "reservations",
+	"offer_reports", "reviews", "price_alerts",
+}
+
+// newTestMySQLDB connects to the test server, creating the tables if needed,
+// and empties them. It skips the test if no server is configured.
+func newTestMySQLDB(t testing.TB) *mysqlDB {
+	t.Helper()
+	addr := os.Getenv(mysqlTestAddrEnv)
+	if addr == "" {
+		t.Skipf("%s is not set", mysqlTestAddrEnv)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("invalid %s %q: %v", mysqlTestAddrEnv, addr, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("invalid %s %q: %v", mysqlTestAddrEnv, addr, err)
+	}
+	db, err := newMySQLDB(MySQLConfig{
+		Username: "root",
+		Password: os.Getenv(mysqlTestPasswordEnv),
+		Host:     host,
+		Port:     p,
+	})
+	if err != nil {
+		t.Fatalf("newMySQLDB: %v", err)
+	}
+	m := db.(*mysqlDB)
+	t.Cleanup(func() { m.Close() })
+	for _, table := range mysqlTestTables {
+		if _, err := m.conn.Exec("DELETE FROM " + table); err != nil {
+			t.Fatalf("emptying %s: %v", table, err)
+		}
+	}
+	return m
+}
+
+// stubResult is an insert result whose LastInsertId returns id, or err if
+// it is set.
+type stubResult struct {
+	id  int64
+	err error
+}
+
+func (r stubResult) LastInsertId() (int64, error) { return r.id, r.err }
+func (r stubResult) RowsAffected() (int64, error) { return 1, nil }
+
+// errNoInsertID is returned by drivers that can't tell the inserted row.
+var errNoInsertID = errors.New("LastInsertId is not supported by this driver")
+
+// noInsertIDDriver is a database driver whose statements all succeed,
+// without reporting the IDs of inserted rows. Queries return no rows.
+type noInsertIDDriver struct{}
+
+func (noInsertIDDriver) Open(name string) (driver.Conn, error) { return noInsertIDConn{}, nil }
+
+type noInsertIDConn struct{}
+
+func (noInsertIDConn) Prepare(query string) (driver.Stmt, error) { return noInsertIDStmt{}, nil }
+func (noInsertIDConn) Close() error                              { return nil }
+func (noInsertIDConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
+
+type noInsertIDStmt struct{}
+
+func (noInsertIDStmt) Close() error  { return nil }
+func (noInsertIDStmt) NumInput() int { return -1 }
+func (noInsertIDStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return stubResult{err: errNoInsertID}, nil
+}
+func (noInsertIDStmt) Query(args []driver.Value) (driver.Rows, error) { return noRows{}, nil }
+
+type noRows struct{}
+
+func (noRows) Columns() []string              { return []string{"offerId", "title"} }
+func (noRows) Close() error                   { return nil }
+func (noRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("offers-no-insert-id", noInsertIDDriver{})
+}
+
+// checkConnector connects to a database whose pings fail with pingErr and
+// whose queries fail with queryErr, if they are set. Queries take delay.
+type checkConnector struct {
+	pingErr, queryErr error
+	delay             time.Duration
+}
+
+func (c checkConnector) Connect(context.Context) (driver.Conn, error) { return checkConn{c}, nil }
+func (c checkConnector) Driver() driver.Driver                        { return noInsertIDDriver{} }
+
+type checkConn struct {
+	checkConnector
+}
+
+func (c checkConn) Prepare(query string) (driver.Stmt, error) {
+	return checkStmt{c.checkConnector}, nil
+}
+func (checkConn) Close() error                 { return nil }
+func (checkConn) Begin() (driver.Tx, error)    { return nil, errors.New("no transactions") }
+func (c checkConn) Ping(context.Context) error { return c.pingErr }
+
+// recordingConnector connects to a database whose statements check their
+// number of arguments against their placeholders, and record the arguments
+// they are executed or queried with. Executions affect one row, queries
+// return no rows, and transactions do nothing.
+type recordingConnector struct {
+	mu      sync.Mutex
+	execs   [][]driver.Value
+	queries [][]driver.Value
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{c}, nil
+}
+func (c *recordingConnector) Driver() driver.Driver { return noInsertIDDriver{} }
+
+type recordingConn struct {
+	c *recordingConnector
+}
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{c.c, strings.Count(query, "?")}, nil
+}
+func (recordingConn) Close() error              { return nil }
+func (recordingConn) Begin() (driver.Tx, error) { return recordingTx{}, nil }
+
+type recordingTx struct{}
+
+func (recordingTx) Commit() error   { return nil }
+func (recordingTx) Rollback() error { return nil }
+
+type recordingStmt struct {
+	c        *recordingConnector
+	numInput int
+}
+
+func (recordingStmt) Close() error    { return nil }
+func (s recordingStmt) NumInput() int { return s.numInput }
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.c.execs = append(s.c.execs, args)
+	return stubResult{id: 1}, nil
+}
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.c.queries = append(s.c.queries, args)
+	return noRows{}, nil
+}
+
+// scriptedConnector connects to a database whose statements are executed by
+// exec. Queries return no rows.
+type scriptedConnector struct {
+	exec func(query string, args []driver.Value) (driver.Result, error)
+}
+
+func (c scriptedConnector) Connect(context.Context) (driver.Conn, error) { return scriptedConn{c}, nil }
+func (c scriptedConnector) Driver() driver.Driver                        { return noInsertIDDriver{} }
+
+type scriptedConn struct {
+	scriptedConnector
+}
+
+func (c scriptedConn) Prepare(query string) (driver.Stmt, error) {
+	return scriptedStmt{c.scriptedConnector, query}, nil
+}
+func (scriptedConn) Close() error              { return nil }
+func (scriptedConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type scriptedStmt struct {
+	scriptedConnector
+	query string
+}
+
+func (scriptedStmt) Close() error  { return nil }
+func (scriptedStmt) NumInput() int { return -1 }
+func (s scriptedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.exec(s.query, args)
+}
+func (scriptedStmt) Query(args []driver.Value) (driver.Rows, error) { return noRows{}, nil }
+
+// affectedResult is the result of a statement affecting n rows, the last
+// inserted or touched of which has the given id.
+type affectedResult struct {
+	id, n int64
+}
+
+func (r affectedResult) LastInsertId() (int64, error) { return r.id, nil }
+func (r affectedResult) RowsAffected() (int64, error) { return r.n, nil }
+
+type checkStmt struct {
+	checkConnector
+}
+
+func (checkStmt) Close() error  { return nil }
+func (checkStmt) NumInput() int { return -1 }
+func (checkStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s checkStmt) Query(args []driver.Value) (driver.Rows, error) {
+	time.Sleep(s.delay)
+	if s.queryErr != nil {
+		return nil, s.queryErr
+	}
+	return noRows{}, nil
+}
+
+func TestInsertID(t *testing.T) {
+	if id := insertID(stubResult{id: 42}); id != 42 {
+		t.Errorf("insertID = %d, want 42", id)
+	}
+	// The insert succeeded even if the driver can't tell the row's ID.
+	if id := insertID(stubResult{err: errNoInsertID}); id != 0 {
+		t.Errorf("insertID without LastInsertId = %d, want 0", id)
+	}
+}
+
+func TestAddOfferWithoutInsertID(t *testing.T) {
+	conn, err := sql.Open("offers-no-insert-id", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	db := &mysqlDB{conn: conn}
+	if db.insert, err = conn.Prepare(insertStatement); err != nil {
+		t.Fatal(err)
+	}
+	if db.unslugged, err = conn.Prepare(unsluggedStatement); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := db.AddOffer(context.Background(), testOffer("a", "Chair", "10.00"))
+	if err != nil {
+		t.Fatalf("AddOffer = %v, want the successful insert to be reported", err)
+	}
+	if id != 0 {
+		t.Errorf("AddOffer returned ID %d, want 0 since the driver can't tell", id)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		conn    checkConnector
+		wantErr bool
+	}{
+		{"healthy", checkConnector{}, false},
+		{"ping fails", checkConnector{pingErr: errors.New("connection refused")}, true},
+		// After a failover the server may no longer know the statement,
+		// though it answers pings.
+		{"stale statement", checkConnector{queryErr: errors.New("Error 1243: Unknown prepared statement handler")}, true},
+	} {
+		conn := sql.OpenDB(tt.conn)
+		db := &mysqlDB{conn: conn}
+		var err error
+		if db.check, err = conn.Prepare(checkStatement); err != nil {
+			t.Fatal(err)
+		}
+		err = db.Check(context.Background())
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: Check succeeded, want an error", tt.name)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: Check = %v, want nil", tt.name, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSearchOffersEmpty(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		conn    checkConnector
+		wantErr bool
+	}{
+		{"no matches", checkConnector{}, false},
+		{"query fails", checkConnector{queryErr: errors.New("connection reset")}, true},
+	} {
+		conn := sql.OpenDB(tt.conn)
+		db := &mysqlDB{conn: conn, search: map[SortOrder]*sql.Stmt{}}
+		var err error
+		if db.search[SortByRelevance], err = conn.Prepare(searchStatement + searchOrderBy[SortByRelevance]); err != nil {
+			t.Fatal(err)
+		}
+		list, err := db.SearchOffers(context.Background(), "zebra", SortByRelevance, 0)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("%s: SearchOffers succeeded, want an error", tt.name)
+		case !tt.wantErr && err != nil:
+			t.Errorf("%s: SearchOffers = %v, want nil", tt.name, err)
+		case !tt.wantErr && (list == nil || len(list) != 0):
+			t.Errorf("%s: SearchOffers = %#v, want an empty slice", tt.name, list)
+		}
+		conn.Close()
+	}
+}
+
+// blockingConnector connects to a database whose queries block until their
+// context is done.
+type blockingConnector struct{}
+
+func (blockingConnector) Connect(context.Context) (driver.Conn, error) { return blockingConn{}, nil }
+func (blockingConnector) Driver() driver.Driver                        { return noInsertIDDriver{} }
+
+type blockingConn struct{}
+
+func (blockingConn) Prepare(query string) (driver.Stmt, error) { return blockingStmt{}, nil }
+func (blockingConn) Close() error                              { return nil }
+func (blockingConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
+
+type blockingStmt struct{}
+
+func (blockingStmt) Close() error  { return nil }
+func (blockingStmt) NumInput() int { return -1 }
+func (blockingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (blockingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+func (blockingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueryCanceled(t *testing.T) {
+	conn := sql.OpenDB(blockingConnector{})
+	defer conn.Close()
+	db := &mysqlDB{conn: conn, search: map[SortOrder]*sql.Stmt{}}
+	var err error
+	if db.get, err = conn.Prepare(getStatement); err != nil {
+		t.Fatal(err)
+	}
+	if db.search[SortByRelevance], err = conn.Prepare(searchStatement + searchOrderBy[SortByRelevance]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"GetOffer", func(ctx context.Context) error {
+			_, err := db.GetOffer(ctx, "a")
+			return err
+		}},
+		{"SearchOffers", func(ctx context.Context) error {
+			_, err := db.SearchOffers(ctx, "chair", SortByRelevance, 0)
+			return err
+		}},
+	} {
+		// The query is abandoned when its context is canceled mid-flight.
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		done := make(chan error, 1)
+		go func() { done <- tt.call(ctx) }()
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+				t.Errorf("%s with a canceled context = %v, want a cancellation error", tt.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s didn't return after its context was canceled", tt.name)
+		}
+
+		// A context canceled beforehand doesn't reach the database.
+		if err := tt.call(ctx); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Errorf("%s with a context canceled beforehand = %v, want a cancellation error", tt.name, err)
+		}
+	}
+}
+
+func TestPoolSettings(t *testing.T) {
+	if c := (MySQLConfig{}).withPoolDefaults(); c.MaxOpenConns != defaultMaxOpenConns || c.MaxIdleConns != defaultMaxIdleConns || c.ConnMaxLifetime != defaultConnMaxLifetime {
+		t.Errorf("defaults = %d open, %d idle, %v lifetime", c.MaxOpenConns, c.MaxIdleConns, c.ConnMaxLifetime)
+	}
+
+	conn := sql.OpenDB(&pingCounter{})
+	defer conn.Close()
+	const lifetime = 50 * time.Millisecond
+	MySQLConfig{MaxOpenConns: 3, MaxIdleConns: 1, ConnMaxLifetime: lifetime}.withPoolDefaults().applyPool(conn)
+	if n := conn.Stats().MaxOpenConnections; n != 3 {
+		t.Errorf("MaxOpenConnections = %d, want 3", n)
+	}
+
+	// Of three connections released together, only one stays idle.
+	ctx := context.Background()
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		c, err := conn.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if s := conn.Stats(); s.Idle != 1 || s.MaxIdleClosed != 2 {
+		t.Errorf("after releasing 3 connections, %d idle and %d closed, want 1 idle and 2 closed", s.Idle, s.MaxIdleClosed)
+	}
+
+	// Connections older than the lifetime are closed rather than reused.
+	time.Sleep(2 * lifetime)
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if s := conn.Stats(); s.MaxLifetimeClosed < 1 {
+		t.Errorf("MaxLifetimeClosed = %d after the lifetime, want at least 1", s.MaxLifetimeClosed)
+	}
+}
+
+func TestDeleteOfferRowsAffected(t *testing.T) {
+	for _, tt := range []struct {
+		affected int64
+		want     error
+	}{
+		{1, nil},
+		{0, ErrOfferNotFound},
+	} {
+		conn := sql.OpenDB(scriptedConnector{exec: func(query string, args []driver.Value) (driver.Result, error) {
+			if len(args) != 2 || args[1] != "a" {
+				t.Errorf("delete args = %v, want the time and the offer ID", args)
+			}
+			return affectedResult{n: tt.affected}, nil
+		}})
+		db := &mysqlDB{conn: conn}
+		var err error
+		if db.deleteOne, err = conn.Prepare(deleteOneStatement); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteOffer(context.Background(), "a"); err != tt.want {
+			t.Errorf("DeleteOffer affecting %d rows = %v, want %v", tt.affected, err, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestBulkUpsertOffersBatches(t *testing.T) {
+	for _, tt := range []struct {
+		offers int
+		want   []int // offers per statement
+	}{
+		{1, []int{1}},
+		{upsertBatchSize, []int{upsertBatchSize}},
+		{1000, []int{upsertBatchSize, upsertBatchSize}},
+		{1001, []int{upsertBatchSize, upsertBatchSize, 1}},
+	} {
+		rec := &recordingConnector{}
+		conn := sql.OpenDB(rec)
+		tx, err := conn.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []*Offer
+		for i := 0; i < tt.offers; i++ {
+			list = append(list, testOffer(fmt.Sprintf("o%d", i), "Chair", "10.00"))
+		}
+		if _, err := bulkUpsertOffers(context.Background(), tx, list); err != nil {
+			t.Fatalf("bulkUpsertOffers(%d offers): %v", tt.offers, err)
+		}
+		tx.Commit()
+		var got []int
+		for _, args := range rec.execs {
+			got = append(got, len(args)/17)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d offers upserted in statements of %v offers, want %v", tt.offers, got, tt.want)
+		}
+		if last := rec.execs[len(rec.execs)-1]; last[len(last)-17] != list[len(list)-1].ID {
+			t.Errorf("%d offers: last statement starts its last row with %v, want %s", tt.offers, last[len(last)-17], list[len(list)-1].ID)
+		}
+		conn.Close()
+	}
+}
+
+func TestLogSlow(t *testing.T) {
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	saved := SlowQueryThreshold
+	defer func() { SlowQueryThreshold = saved }()
+
+	for _, tt := range []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		wantLog   bool
+	}{
+		{"slow", 10 * time.Millisecond, 30 * time.Millisecond, true},
+		{"fast", time.Second, 0, false},
+		{"disabled", 0, 30 * time.Millisecond, false},
+	} {
+		buf.Reset()
+		SlowQueryThreshold = tt.threshold
+		conn := sql.OpenDB(checkConnector{delay: tt.delay})
+		db := &mysqlDB{conn: conn}
+		var err error
+		if db.get, err = conn.Prepare(getStatement); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetOffer(context.Background(), "secret-id"); err != ErrOfferNotFound {
+			t.Errorf("%s: GetOffer = %v, want ErrOfferNotFound", tt.name, err)
+		}
+		conn.Close()
+
+		got := buf.String()
+		if logged := strings.Contains(got, "slow query: method=GetOffer elapsed="); logged != tt.wantLog {
+			t.Errorf("%s: logged %q, want a slow query entry: %t", tt.name, got, tt.wantLog)
+		}
+		// Arguments may hold user data, so they aren't logged.
+		if strings.Contains(got, "secret-id") {
+			t.Errorf("%s: log %q includes the query arguments", tt.name, got)
+		}
+	}
+}
+
+func TestGetOffersByIDsBatches(t *testing.T) {
+	for _, tt := range []struct {
+		ids  int
+		want []int // IDs per query
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{idBatchSize, []int{idBatchSize}},
+		{2*idBatchSize + 1, []int{idBatchSize, idBatchSize, 1}},
+	} {
+		rec := &recordingConnector{}
+		conn := sql.OpenDB(rec)
+		db := &mysqlDB{conn: conn}
+		ids := make([]string, tt.ids)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("o%d", i)
+		}
+		list, err := db.GetOffersByIDs(context.Background(), ids)
+		if err != nil || list == nil || len(list) != 0 {
+			t.Errorf("GetOffersByIDs(%d IDs) = %v, %v; want an empty slice", tt.ids, list, err)
+		}
+		var got []int
+		for _, args := range rec.queries {
+			got = append(got, len(args))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetOffersByIDs(%d IDs) made queries of %v IDs, want %v", tt.ids, got, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestUpdateOfferBindsEveryPlaceholder(t *testing.T) {
+	rec := &recordingConnector{}
+	conn := sql.OpenDB(rec)
+	defer conn.Close()
+	db := &mysqlDB{conn: conn}
+	var err error
+	if db.update, err = conn.Prepare(updateStatement); err != nil {
+		t.Fatal(err)
+	}
+
+	o := testOffer("online:en:US:a", "Chair", "10.00")
+	o.Version = 3
+	// The statement fails if it isn't given an argument for each
+	// placeholder.
+	if err := db.UpdateOffer(context.Background(), o); err != nil {
+		t.Fatalf("UpdateOffer: %v", err)
+	}
+	if len(rec.execs) != 1 {
+		t.Fatalf("UpdateOffer executed %d statements, want 1", len(rec.execs))
+	}
+	// The row is matched on its offer ID and the version read.
+	args := rec.execs[0]
+	if got := args[len(args)-2:]; got[0] != "online:en:US:a" || got[1] != int64(3) {
+		t.Errorf("WHERE arguments = %v, want the offer ID and version 3", got)
+	}
+	if o.Version != 4 {
+		t.Errorf("version after updating one row = %d, want 4", o.Version)
+	}
+}
+
+func TestAddOfferDuplicateEntry(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		restored int64 // rows the restore statement affects
+		wantID   int64
+		wantErr  error
+	}{
+		// The ID is taken by an offer that isn't deleted.
+		{"duplicate", 0, 0, ErrDuplicateOffer},
+		// The ID is that of a soft-deleted offer, which is restored.
+		{"deleted", 1, 7, nil},
+	} {
+		var restores int
+		conn := sql.OpenDB(scriptedConnector{exec: func(query string, args []driver.Value) (driver.Result, error) {
+			switch query {
+			case insertStatement:
+				return nil, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a' for key 'uniq_offerId'"}
+			case restoreStatement:
+				restores++
+				return affectedResult{id: 7, n: tt.restored}, nil
+			}
+			return affectedResult{n: 1}, nil
+		}})
+		db := &mysqlDB{conn: conn}
+		var err error
+		if db.insert, err = conn.Prepare(insertStatement); err != nil {
+			t.Fatal(err)
+		}
+		if db.restore, err = conn.Prepare(restoreStatement); err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := db.AddOffer(context.Background(), testOffer("a", "Chair", "10.00"))
+		if err != tt.wantErr || id != tt.wantID {
+			t.Errorf("%s: AddOffer = %d, %v; want %d, %v", tt.name, id, err, tt.wantID, tt.wantErr)
+		}
+		if restores != 1 {
+			t.Errorf("%s: restore ran %d times, want once", tt.name, restores)
+		}
+		conn.Close()
+	}
+}
+
+func TestDataStoreName(t *testing.T) {
+	for _, c := range []MySQLConfig{
+		{Username: "offers", Password: "p@ss/word?x=1&tls=false#", Host: "db.example.com", Port: 3306},
+		{Username: "sync@offers", Password: `a"b'c\d)(`, Host: "::1", Port: 3307},
+		{Username: "offers", Password: "@unix(/evil)/other?", UnixSocket: "/cloudsql/project:region:instance"},
+	} {
+		dsn := c.dataStoreName("library")
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			t.Errorf("ParseDSN(%q): %v", dsn, err)
+			continue
+		}
+		wantNet, wantAddr := "tcp", net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+		if c.UnixSocket != "" {
+			wantNet, wantAddr = "unix", c.UnixSocket
+		}
+		if cfg.User != c.Username || cfg.Passwd != c.Password || cfg.Net != wantNet || cfg.Addr != wantAddr || cfg.DBName != "library" {
+			t.Errorf("DSN %q parses as user %q, password %q, %s address %q, database %q; want %q, %q, %s %q, library",
+				dsn, cfg.User, cfg.Passwd, cfg.Net, cfg.Addr, cfg.DBName, c.Username, c.Password, wantNet, wantAddr)
+		}
+		if !cfg.ParseTime || cfg.TLSConfig != "" {
+			t.Errorf("DSN %q has parseTime %v and tls %q, want parseTime and no TLS", dsn, cfg.ParseTime, cfg.TLSConfig)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/big"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// minTitleTokens is the number of words a title needs before offers without
+// a GTIN are grouped by it. Shorter titles, like "Shoes", are too ambiguous.
+const minTitleTokens = 3
+
+// DuplicateGroup is a set of offers that are the same product.
+type DuplicateGroup struct {
+	// CanonicalID is stored as the CanonicalProductID of each offer in the
+	// group. It is derived from the GTIN or title, so it is stable across
+	// runs.
+	CanonicalID string
+
+	// GTIN is the group's GTIN. It is empty for groups matched only by title.
+	GTIN string
+
+	OfferIDs []string
+}
+
+// DetectDuplicates groups offers that are the same product, links each of
+// them to its group with a canonical product ID and returns the groups.
+// Offers are grouped by GTIN; offers without one join a group whose offers
+// have the same title, ignoring case, punctuation and word order.
+func DetectDuplicates(ctx context.Context) ([]DuplicateGroup, error) {
+	groups := map[string]*DuplicateGroup{}
+	byTitle := map[string]*DuplicateGroup{}
+	var order []*DuplicateGroup
+	group := func(id, gtin string) *DuplicateGroup {
+		if g, ok := groups[id]; ok {
+			return g
+		}
+		g := &DuplicateGroup{CanonicalID: id, GTIN: gtin}
+		groups[id] = g
+		order = append(order, g)
+		return g
+	}
+
+	// Collect offers with a GTIN first, so titles of offers without one can
+	// be matched against them.
+	var noGTIN []*Offer
+	err := SyncDB.ForEachOffer(ctx, func(o *Offer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if o.GTIN == "" {
+			noGTIN = append(noGTIN, &Offer{ID: o.ID, Title: o.Title})
+			return nil
+		}
+		g := group("gtin:"+o.GTIN, o.GTIN)
+		g.OfferIDs = append(g.OfferIDs, o.ID)
+		if key := titleKey(o.Title); key != "" && byTitle[key] == nil {
+			byTitle[key] = g
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range noGTIN {
+		key := titleKey(o.Title)
+		if key == "" {
+			continue
+		}
+		g, ok := byTitle[key]
+		if !ok {
+			h := sha1.Sum([]byte(key))
+			g = group("title:"+hex.EncodeToString(h[:8]), "")
+			byTitle[key] = g
+		}
+		g.OfferIDs = append(g.OfferIDs, o.ID)
+	}
+
+	var dups []DuplicateGroup
+	links := map[string]string{}
+	for _, g := range order {
+		if len(g.OfferIDs) < 2 {
+			continue
+		}
+		sort.Strings(g.OfferIDs)
+		for _, id := range g.OfferIDs {
+			links[id] = g.CanonicalID
+		}
+		dups = append(dups, *g)
+	}
+	if err := SyncDB.SetCanonicalProducts(ctx, links); err != nil {
+		return nil, err
+	}
+	return dups, nil
+}
+
+// PriceComparison is an offer's price converted to a common currency.
+type PriceComparison struct {
+	Offer *Offer
+
+	// Price is the offer's price in the comparison currency, or "" if it
+	// couldn't be converted.
+	Price string
+
+	// Cheapest is set on the offers with the lowest converted price.
+	Cheapest bool
+}
+
+// ComparePrices converts the prices of a group of duplicate offers to
+// currency, so they can be compared, and marks the cheapest. Offers whose
+// prices can't be converted are never the cheapest.
+func ComparePrices(group []*Offer, converter CurrencyConverter, currency string) []PriceComparison {
+	cmp := make([]PriceComparison, len(group))
+	values := make([]*big.Rat, len(group))
+	var min *big.Rat
+	for i, o := range group {
+		cmp[i].Offer = o
+		p, err := converter.Convert(o.Price, o.Currency, currency)
+		if err != nil {
+			continue
+		}
+		v, ok := new(big.Rat).SetString(p)
+		if !ok {
+			continue
+		}
+		cmp[i].Price = p
+		values[i] = v
+		if min == nil || v.Cmp(min) < 0 {
+			min = v
+		}
+	}
+	for i, v := range values {
+		cmp[i].Cheapest = v != nil && v.Cmp(min) == 0
+	}
+	return cmp
+}
+
+// titleKey normalizes a title for fuzzy matching: it is lowercased, split
+// into words at anything but letters and digits, and the words are sorted.
+// It returns "" for titles with fewer than minTitleTokens words.
+func titleKey(title string) string {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) < minTitleTokens {
+		return ""
+	}
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// useSyncDB makes db the sync database until the test ends.
+func useSyncDB(t *testing.T, db OfferDatabase) {
+	saved := SyncDB
+	t.Cleanup(func() { SyncDB = saved })
+	SyncDB = db
+}
+
+// merchantOffer returns a test offer from the given merchant with a GTIN.
+func merchantOffer(id, title string, merchantID int64, gtin string) *Offer {
+	o := testOffer(id, title, "10.00")
+	o.MerchantID, o.GTIN = merchantID, gtin
+	return o
+}
+
+func TestTitleKey(t *testing.T) {
+	for _, tt := range []struct {
+		title, want string
+	}{
+		{"Acme Garden Chair", "acme chair garden"},
+		{"chair, garden (ACME)", "acme chair garden"},
+		{"Garden chair", ""},
+		{"  ", ""},
+		{"Chaise de jardin Acmé", "acmé chaise de jardin"},
+	} {
+		if got := titleKey(tt.title); got != tt.want {
+			t.Errorf("titleKey(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestDetectDuplicates(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		useSyncDB(t, db)
+		addOffers(t, db,
+			merchantOffer("m1-chair", "Acme Garden Chair", 1, "00012345678905"),
+			merchantOffer("m2-chair", "Garden chair by Acme", 2, "00012345678905"),
+			// Without a GTIN, an offer joins the group with its title.
+			merchantOffer("m3-chair", "garden chair, acme", 3, ""),
+			// Offers without a GTIN are grouped by title too.
+			merchantOffer("m1-lamp", "Brass Desk Lamp", 1, ""),
+			merchantOffer("m2-lamp", "Desk lamp (brass)", 2, ""),
+			// Titles that are too short aren't matched.
+			merchantOffer("m1-shoes", "Shoes", 1, ""),
+			merchantOffer("m2-shoes", "Shoes", 2, ""),
+			// An offer with a unique GTIN has no duplicates.
+			merchantOffer("m1-table", "Oak Table", 1, "00098765432109"))
+
+		groups, err := DetectDuplicates(ctx)
+		if err != nil {
+			t.Fatalf("DetectDuplicates: %v", err)
+		}
+		got := map[string][]string{}
+		for _, g := range groups {
+			got[g.CanonicalID] = g.OfferIDs
+		}
+		lampID := ""
+		for _, g := range groups {
+			if g.GTIN == "" {
+				lampID = g.CanonicalID
+			}
+		}
+		want := map[string][]string{
+			"gtin:00012345678905": {"m1-chair", "m2-chair", "m3-chair"},
+			lampID:                {"m1-lamp", "m2-lamp"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("groups = %q, want %q", got, want)
+		}
+
+		canonical := map[string]string{
+			"m1-chair": "gtin:00012345678905",
+			"m2-chair": "gtin:00012345678905",
+			"m3-chair": "gtin:00012345678905",
+			"m1-lamp":  lampID,
+			"m2-lamp":  lampID,
+			"m1-shoes": "",
+			"m2-shoes": "",
+			"m1-table": "",
+		}
+		for id, want := range canonical {
+			if o := getOffer(t, db, id); o.CanonicalProductID != want {
+				t.Errorf("%s canonical product = %q, want %q", id, o.CanonicalProductID, want)
+			}
+		}
+		dups, err := db.ListDuplicateOffers(ctx, 10)
+		if err != nil {
+			t.Fatalf("ListDuplicateOffers: %v", err)
+		}
+		if len(dups) != 5 {
+			t.Errorf("ListDuplicateOffers = %q, want the 5 grouped offers", offerIDs(dups))
+		}
+
+		// Canonical IDs are stable, and links of offers that are no longer
+		// duplicates are removed.
+		if err := db.DeleteOffer(ctx, "m2-lamp"); err != nil {
+			t.Fatal(err)
+		}
+		again, err := DetectDuplicates(ctx)
+		if err != nil {
+			t.Fatalf("DetectDuplicates again: %v", err)
+		}
+		if len(again) != 1 || again[0].CanonicalID != "gtin:00012345678905" {
+			t.Errorf("groups after deleting a lamp = %+v, want only the chairs", again)
+		}
+		if o := getOffer(t, db, "m1-lamp"); o.CanonicalProductID != "" {
+			t.Errorf("m1-lamp still linked to %q without duplicates", o.CanonicalProductID)
+		}
+	})
+}
+
+func TestComparePrices(t *testing.T) {
+	eur := testOffer("eur", "Chair", "9.00")
+	eur.Currency = "EUR"
+	yen := testOffer("yen", "Chair", "100")
+	yen.Currency = "JPY"
+	group := []*Offer{testOffer("usd", "Chair", "10.00"), eur, yen, testOffer("usd2", "Chair", "12.00")}
+
+	cmp := ComparePrices(group, StaticRates{"USD": 1, "EUR": 0.9}, "USD")
+	var got []string
+	for _, c := range cmp {
+		s := c.Offer.ID + " " + c.Price
+		if c.Cheapest {
+			s += " cheapest"
+		}
+		got = append(got, s)
+	}
+	// The yen price can't be converted, so it can't be the cheapest.
+	want := []string{"usd 10.00 cheapest", "eur 10.00 cheapest", "yen ", "usd2 12.00"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ComparePrices = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxFacetValues limits how many values of each facet can be applied.
+const maxFacetValues = 20
+
+// FilterOptions narrows search results to offers with any of the given
+// values of each facet. Empty facets don't narrow the results.
+type FilterOptions struct {
+	Brands     []string
+	Currencies []string
+	// Prices are labels of PriceBuckets.
+	Prices []string
+}
+
+// FacetCount is the number of matching offers with a facet value.
+type FacetCount struct {
+	Value string
+	Count int
+	// Selected is set if the value is applied.
+	Selected bool
+}
+
+// Facets lists the values search results can be narrowed down by. The
+// counts of each facet take into account the values applied to the other
+// facets, but not its own, so applying a value doesn't hide the others.
+type Facets struct {
+	Brands     []FacetCount
+	Currencies []FacetCount
+	Prices     []FacetCount
+}
+
+// PriceBucket is a range of prices, from Min up to but not including Max.
+// A Max of 0 is unbounded.
+type PriceBucket struct {
+	Label    string
+	Min, Max float64
+}
+
+// PriceBuckets are the ranges of the price facet, in ascending order.
+var PriceBuckets = []PriceBucket{
+	{"0-25", 0, 25},
+	{"25-50", 25, 50},
+	{"50-100", 50, 100},
+	{"100-250", 100, 250},
+	{"250+", 250, 0},
+}
+
+// Validate checks that the options only apply known price buckets and
+// aren't too large.
+func (o FilterOptions) Validate() error {
+	for _, values := range [][]string{o.Brands, o.Currencies, o.Prices} {
+		if len(values) > maxFacetValues {
+			return fmt.Errorf("facets: more than %d values applied", maxFacetValues)
+		}
+	}
+	for _, p := range o.Prices {
+		if priceBucketIndex(p) < 0 {
+			return fmt.Errorf("facets: unknown price range %q", p)
+		}
+	}
+	return nil
+}
+
+func priceBucketIndex(label string) int {
+	for i, b := range PriceBuckets {
+		if b.Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// Facet names, used to exclude a facet's own values when counting it.
+const (
+	brandFacet    = "brand"
+	currencyFacet = "currency"
+	priceFacet    = "price"
+)
+
+// priceBucketExpr is an SQL expression evaluating to the label of an
+// offer's price bucket. It is built from PriceBuckets only.
+func priceBucketExpr() string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for _, pb := range PriceBuckets {
+		if pb.Max == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, " WHEN CAST(price AS DECIMAL(15,2)) < %s THEN '%s'",
+			strconv.FormatFloat(pb.Max, 'f', -1, 64), pb.Label)
+	}
+	b.WriteString(" ELSE '" + PriceBuckets[len(PriceBuckets)-1].Label + "' END")
+	return b.String()
+}
+
+// searchWhere returns an SQL condition, with placeholders, selecting offers
+// whose description or title contains q and that match the applied
+// options of every facet but except, and the arguments for it. q may be
+// empty. Soft-deleted offers are never selected.
+func searchWhere(q string, applied FilterOptions, except string) (string, []interface{}) {
+	conds := []string{notDeleted}
+	var args []interface{}
+	if q != "" {
+		conds = append(conds, "(description LIKE ? OR title LIKE ?)")
+		pattern := "%" + escapeLike(q) + "%"
+		args = append(args, pattern, pattern)
+	}
+	in := func(facet, expr string, values []string) {
+		if facet == except || len(values) == 0 {
+			return
+		}
+		conds = append(conds, expr+" IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")+")")
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+	in(brandFacet, "brand", applied.Brands)
+	in(currencyFacet, "currency", applied.Currencies)
+	in(priceFacet, priceBucketExpr(), applied.Prices)
+	return strings.Join(conds, " AND "), args
+}
+
+// matches reports whether o contains q and matches the applied options of
+// every facet but except, like the SQL from searchWhere.
+func (o FilterOptions) matches(offer *Offer, q string, except string) bool {
+	if q != "" && !matchesSearch(offer, q) {
+		return false
+	}
+	in := func(facet, v string, values []string) bool {
+		if facet == except || len(values) == 0 {
+			return true
+		}
+		for _, want := range values {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return in(brandFacet, offer.Brand, o.Brands) &&
+		in(currencyFacet, offer.Currency, o.Currencies) &&
+		in(priceFacet, priceBucket(offer.Price), o.Prices)
+}
+
+// priceBucket returns the label of the bucket of price, like
+// priceBucketExpr.
+func priceBucket(price string) string {
+	p := parsePrice(price)
+	for _, b := range PriceBuckets {
+		if b.Max != 0 && p < b.Max {
+			return b.Label
+		}
+	}
+	return PriceBuckets[len(PriceBuckets)-1].Label
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// facetCounts marks the applied values in counts, adding any that have no
+// matching offers so they can still be removed.
+func facetCounts(counts []FacetCount, applied []string) []FacetCount {
+	selected := map[string]bool{}
+	for _, v := range applied {
+		selected[v] = true
+	}
+	for i := range counts {
+		if selected[counts[i].Value] {
+			counts[i].Selected = true
+			delete(selected, counts[i].Value)
+		}
+	}
+	for _, v := range applied {
+		if selected[v] {
+			counts = append(counts, FacetCount{Value: v, Selected: true})
+			delete(selected, v)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// facetStrings formats facet counts as "value count", with a "*" after
+// selected values.
+func facetStrings(counts []FacetCount) []string {
+	s := []string{}
+	for _, c := range counts {
+		v := fmt.Sprintf("%s %d", c.Value, c.Count)
+		if c.Selected {
+			v += "*"
+		}
+		s = append(s, v)
+	}
+	return s
+}
+
+func TestSearchFacets(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		offer := func(id, title, brand, price, currency string) *Offer {
+			o := testOffer(id, title, price)
+			o.Brand, o.Currency = brand, currency
+			return o
+		}
+		addOffers(t, db,
+			offer("a", "Garden chair", "Acme", "10.00", "USD"),
+			offer("b", "Garden table", "Acme", "30.00", "EUR"),
+			offer("c", "Garden bench", "Bolt", "60.00", "USD"),
+			offer("d", "Garden shed", "Bolt", "300.00", "USD"),
+			offer("e", "Kitchen chair", "Acme", "20.00", "USD"))
+
+		for _, tt := range []struct {
+			name                      string
+			applied                   FilterOptions
+			offers                    []string
+			brands, currencies, price []string
+		}{
+			{
+				name:       "none",
+				offers:     []string{"a", "b", "c", "d"},
+				brands:     []string{"Acme 2", "Bolt 2"},
+				currencies: []string{"USD 3", "EUR 1"},
+				price:      []string{"0-25 1", "25-50 1", "50-100 1", "250+ 1"},
+			},
+			{
+				// The brand counts ignore the applied brand, so its
+				// alternatives stay visible; the other facets shrink.
+				name:       "brand",
+				applied:    FilterOptions{Brands: []string{"Bolt"}},
+				offers:     []string{"c", "d"},
+				brands:     []string{"Acme 2", "Bolt 2*"},
+				currencies: []string{"USD 2"},
+				price:      []string{"50-100 1", "250+ 1"},
+			},
+			{
+				name:       "brand and currency",
+				applied:    FilterOptions{Brands: []string{"Acme"}, Currencies: []string{"USD"}},
+				offers:     []string{"a"},
+				brands:     []string{"Bolt 2", "Acme 1*"},
+				currencies: []string{"EUR 1", "USD 1*"},
+				price:      []string{"0-25 1"},
+			},
+			{
+				// Applied values without matches are still listed.
+				name:       "no matches",
+				applied:    FilterOptions{Currencies: []string{"EUR"}, Prices: []string{"250+"}},
+				offers:     nil,
+				brands:     []string{},
+				currencies: []string{"USD 1", "EUR 0*"},
+				price:      []string{"25-50 1", "250+ 0*"},
+			},
+		} {
+			list, err := db.FilteredSearch(ctx, "garden", tt.applied, 0, 10)
+			if err != nil {
+				t.Fatalf("%s: FilteredSearch: %v", tt.name, err)
+			}
+			checkIDs(t, tt.name+" results", list, tt.offers...)
+
+			f, err := db.SearchFacets(ctx, "garden", tt.applied)
+			if err != nil {
+				t.Fatalf("%s: SearchFacets: %v", tt.name, err)
+			}
+			for _, facet := range []struct {
+				name      string
+				got, want []string
+			}{
+				{"brands", facetStrings(f.Brands), tt.brands},
+				{"currencies", facetStrings(f.Currencies), tt.currencies},
+				{"prices", facetStrings(f.Prices), tt.price},
+			} {
+				if !reflect.DeepEqual(facet.got, facet.want) {
+					t.Errorf("%s: %s = %q, want %q", tt.name, facet.name, facet.got, facet.want)
+				}
+			}
+		}
+
+		// Results are paged.
+		list, err := db.FilteredSearch(ctx, "garden", FilterOptions{}, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "second page", list, "b", "c")
+
+		if _, err := db.SearchFacets(ctx, "", FilterOptions{Prices: []string{"cheap"}}); err == nil {
+			t.Error("SearchFacets with an unknown price range succeeded")
+		}
+	})
+}
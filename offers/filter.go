@@ -0,0 +1,261 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxFilterConditions limits the size of filters, and so of the queries
+// they produce.
+const maxFilterConditions = 20
+
+// filterField is a field that can be filtered on.
+type filterField struct {
+	// column is the SQL expression the field is compared with.
+	column string
+	// value returns the field of an offer, for databases that don't use SQL.
+	value func(*Offer) string
+	// numeric fields are compared as numbers and support ordering
+	// operators; other fields only support = and !=.
+	numeric bool
+}
+
+// filterFields lists the fields filters may use. Only these columns, and
+// the operators in filterOps, ever appear in generated SQL; values are
+// always passed as query arguments.
+var filterFields = map[string]filterField{
+	"id":            {column: "offerId", value: func(o *Offer) string { return o.ID }},
+	"title":         {column: "title", value: func(o *Offer) string { return o.Title }},
+	"price":         {column: "CAST(price AS DECIMAL(15,2))", value: func(o *Offer) string { return o.Price }, numeric: true},
+	"currency":      {column: "currency", value: func(o *Offer) string { return o.Currency }},
+	"brand":         {column: "brand", value: func(o *Offer) string { return o.Brand }},
+	"gtin":          {column: "gtin", value: func(o *Offer) string { return o.GTIN }},
+	"item_group_id": {column: "itemGroupId", value: func(o *Offer) string { return o.ItemGroupID }},
+}
+
+var filterOps = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+// Filter selects offers by conditions on their fields, such as
+// "price<2000 AND currency=USD". It is created by ParseFilter.
+type Filter struct {
+	// or holds groups of conditions that are ANDed together; a matching
+	// offer satisfies at least one group.
+	or [][]filterCondition
+}
+
+type filterCondition struct {
+	field filterField
+	op    string
+	value interface{}
+}
+
+// ParseFilter parses a filter expression: conditions of the form
+// field op value, joined by AND and OR. AND binds more tightly than OR, and
+// parentheses aren't supported. Values containing spaces or operator
+// characters must be double-quoted.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("filter: empty filter")
+	}
+	f := &Filter{}
+	var group []filterCondition
+	n := 0
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("filter: incomplete condition at %q", tokens[0].text)
+		}
+		c, err := parseCondition(tokens[0], tokens[1], tokens[2])
+		if err != nil {
+			return nil, err
+		}
+		if n++; n > maxFilterConditions {
+			return nil, fmt.Errorf("filter: more than %d conditions", maxFilterConditions)
+		}
+		group = append(group, c)
+		tokens = tokens[3:]
+		if len(tokens) == 0 {
+			break
+		}
+		switch kw := tokens[0]; {
+		case kw.kind == wordToken && strings.EqualFold(kw.text, "AND"):
+		case kw.kind == wordToken && strings.EqualFold(kw.text, "OR"):
+			f.or = append(f.or, group)
+			group = nil
+		default:
+			return nil, fmt.Errorf("filter: expected AND or OR, got %q", kw.text)
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("filter: expression ends with a keyword")
+		}
+	}
+	f.or = append(f.or, group)
+	return f, nil
+}
+
+func parseCondition(field, op, value filterToken) (filterCondition, error) {
+	if field.kind != wordToken {
+		return filterCondition{}, fmt.Errorf("filter: expected a field name, got %q", field.text)
+	}
+	ff, ok := filterFields[strings.ToLower(field.text)]
+	if !ok {
+		return filterCondition{}, fmt.Errorf("filter: unknown field %q", field.text)
+	}
+	if op.kind != opToken || !filterOps[op.text] {
+		return filterCondition{}, fmt.Errorf("filter: unknown operator %q", op.text)
+	}
+	if value.kind == opToken {
+		return filterCondition{}, fmt.Errorf("filter: expected a value, got %q", value.text)
+	}
+	c := filterCondition{field: ff, op: op.text, value: value.text}
+	if ff.numeric {
+		v, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return filterCondition{}, fmt.Errorf("filter: %s must be compared with a number, got %q", field.text, value.text)
+		}
+		c.value = v
+	} else if op.text != "=" && op.text != "!=" {
+		return filterCondition{}, fmt.Errorf("filter: %s only supports = and !=", field.text)
+	}
+	return c, nil
+}
+
+// where returns the filter as an SQL condition with placeholders, and the
+// arguments for them.
+func (f *Filter) where() (string, []interface{}) {
+	var or []string
+	var args []interface{}
+	for _, group := range f.or {
+		var and []string
+		for _, c := range group {
+			op := c.op
+			if op == "!=" {
+				op = "<>"
+			}
+			and = append(and, c.field.column+" "+op+" ?")
+			args = append(args, c.value)
+		}
+		or = append(or, "("+strings.Join(and, " AND ")+")")
+	}
+	return strings.Join(or, " OR "), args
+}
+
+// matches reports whether o satisfies the filter, comparing like the SQL
+// from where: strings ignoring case, and numbers that don't parse as 0.
+func (f *Filter) matches(o *Offer) bool {
+	for _, group := range f.or {
+		ok := true
+		for _, c := range group {
+			if !c.matches(o) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c filterCondition) matches(o *Offer) bool {
+	v := c.field.value(o)
+	if !c.field.numeric {
+		eq := strings.EqualFold(v, c.value.(string))
+		return eq == (c.op == "=")
+	}
+	n, want := parsePrice(v), c.value.(float64)
+	switch c.op {
+	case "=":
+		return n == want
+	case "!=":
+		return n != want
+	case "<":
+		return n < want
+	case "<=":
+		return n <= want
+	case ">":
+		return n > want
+	default:
+		return n >= want
+	}
+}
+
+// parsePrice parses a price like MySQL casts it to a number, treating
+// prices that don't parse as 0.
+func parsePrice(s string) float64 {
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+type filterTokenKind int
+
+const (
+	wordToken filterTokenKind = iota
+	quotedToken
+	opToken
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+// lexFilter splits a filter expression into words, quoted strings and
+// operators.
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	r := []rune(expr)
+	for i := 0; i < len(r); {
+		switch c := r[i]; {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(r) && r[j] != '"'; j++ {
+				if r[j] == '\\' && j+1 < len(r) {
+					j++
+				}
+				b.WriteRune(r[j])
+			}
+			if j == len(r) {
+				return nil, fmt.Errorf("filter: unterminated string")
+			}
+			tokens = append(tokens, filterToken{quotedToken, b.String()})
+			i = j + 1
+		case strings.ContainsRune("=!<>", c):
+			j := i + 1
+			for j < len(r) && strings.ContainsRune("=!<>", r[j]) {
+				j++
+			}
+			tokens = append(tokens, filterToken{opToken, string(r[i:j])})
+			i = j
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_-.", c):
+			j := i + 1
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || strings.ContainsRune("_-.", r[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{wordToken, string(r[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("filter: unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, tt := range []struct {
+		expr      string
+		wantWhere string
+		wantArgs  []interface{}
+	}{
+		{
+			"price<2000 AND currency=USD",
+			"(CAST(price AS DECIMAL(15,2)) < ? AND currency = ?)",
+			[]interface{}{2000.0, "USD"},
+		},
+		{
+			"brand = Acme or brand=\"Garden & Co\"",
+			"(brand = ?) OR (brand = ?)",
+			[]interface{}{"Acme", "Garden & Co"},
+		},
+		{
+			"PRICE>=9.99 and Title!=\"say \\\"hi\\\"\" OR item_group_id=shirt",
+			"(CAST(price AS DECIMAL(15,2)) >= ? AND title <> ?) OR (itemGroupId = ?)",
+			[]interface{}{9.99, `say "hi"`, "shirt"},
+		},
+		{
+			"id=online:en:US:1",
+			"",
+			nil,
+		},
+		{
+			`id="online:en:US:1"`,
+			"(offerId = ?)",
+			[]interface{}{"online:en:US:1"},
+		},
+	} {
+		f, err := ParseFilter(tt.expr)
+		if tt.wantWhere == "" {
+			if err == nil {
+				t.Errorf("ParseFilter(%q) succeeded, want an error for the unquoted colons", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		where, args := f.where()
+		if where != tt.wantWhere {
+			t.Errorf("ParseFilter(%q) where = %q, want %q", tt.expr, where, tt.wantWhere)
+		}
+		if !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("ParseFilter(%q) args = %#v, want %#v", tt.expr, args, tt.wantArgs)
+		}
+	}
+}
+
+func TestParseFilterRejects(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"   ",
+		"price",
+		"price<",
+		"price<10 AND",
+		"price<10 currency=USD",
+		"name=chair",
+		"price=~10",
+		"price<=>10",
+		"price<cheap",
+		"title<chair",
+		"currency=<USD",
+		`title="unterminated`,
+		"(price<10)",
+		// Injection attempts: only allowlisted columns and operators reach
+		// the SQL, and values are never spliced into it.
+		"price<10; DROP TABLE offers",
+		"title=x' OR '1'='1",
+		"title=x OR 1=1",
+		"price<10 -- comment",
+		"offerId=1 UNION SELECT password FROM users",
+		"title=`x`",
+		"CAST(price AS DECIMAL(15,2))<10",
+		"price<10 OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 " +
+			"OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 " +
+			"OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 OR price<10 OR price<10",
+	} {
+		if f, err := ParseFilter(expr); err == nil {
+			where, args := f.where()
+			t.Errorf("ParseFilter(%q) = %q %v, want an error", expr, where, args)
+		}
+	}
+
+	// Quoted values can hold anything, but stay arguments.
+	expr := `title="x' OR '1'='1; DROP TABLE offers --"`
+	f, err := ParseFilter(expr)
+	if err != nil {
+		t.Fatalf("ParseFilter(%q): %v", expr, err)
+	}
+	where, args := f.where()
+	if where != "(title = ?)" || strings.Contains(where, "DROP") {
+		t.Errorf("ParseFilter(%q) where = %q, want the value as an argument", expr, where)
+	}
+	if want := []interface{}{"x' OR '1'='1; DROP TABLE offers --"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("ParseFilter(%q) args = %q, want %q", expr, args, want)
+	}
+}
+
+func TestFilterOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		a := testOffer("a", "Chair", "10.00")
+		a.Brand = "Acme"
+		b := testOffer("b", "Table", "2500.00")
+		b.Brand = "Acme"
+		c := testOffer("c", "Lamp", "15.50")
+		c.Currency = "EUR"
+		addOffers(t, db, a, b, c)
+
+		for _, tt := range []struct {
+			expr string
+			want []string
+		}{
+			{"price<2000 AND currency=USD", []string{"a"}},
+			{"price<2000", []string{"a", "c"}},
+			{"brand=acme", []string{"a", "b"}},
+			{"brand!=Acme", []string{"c"}},
+			{"price>=2500 OR currency=EUR", []string{"b", "c"}},
+			{"title=chair AND title=table", nil},
+		} {
+			f, err := ParseFilter(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseFilter(%q): %v", tt.expr, err)
+			}
+			list, err := db.FilterOffers(context.Background(), f, 10)
+			if err != nil {
+				t.Fatalf("FilterOffers(%q): %v", tt.expr, err)
+			}
+			checkIDs(t, "FilterOffers("+tt.expr+")", list, tt.want...)
+		}
+
+		f, _ := ParseFilter("price>0")
+		list, err := db.FilterOffers(context.Background(), f, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 {
+			t.Errorf("FilterOffers with limit 2 returned %d offers", len(list))
+		}
+	})
+}
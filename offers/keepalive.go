@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// KeepaliveOptions configure pinging of idle database connections. Cloud SQL
+// closes connections that have been idle for a while, which otherwise fails
+// the first request after a quiet period.
+type KeepaliveOptions struct {
+	// Interval is how often connections are pinged. It must be positive.
+	Interval time.Duration
+
+	// MinConns is the number of connections kept open. It defaults to 1.
+	MinConns int
+}
+
+// Keepaliver is implemented by databases that can keep idle connections
+// open. The MySQL database implements it; cached databases don't, so start
+// the keepalive before wrapping a database with NewCachedDB.
+type Keepaliver interface {
+	// StartKeepalive pings connections as configured until the database is
+	// closed. It may only be called once.
+	StartKeepalive(opts KeepaliveOptions)
+}
+
+var _ Keepaliver = &mysqlDB{}
+
+// StartKeepalive starts pinging opts.MinConns connections every
+// opts.Interval in the background. MinConns is capped at the pool's maximum
+// number of open connections, and raises its idle limit if needed.
+func (db *mysqlDB) StartKeepalive(opts KeepaliveOptions) {
+	if opts.MinConns < 1 {
+		opts.MinConns = 1
+	}
+	if opts.MinConns > db.maxOpenConns {
+		opts.MinConns = db.maxOpenConns
+	}
+	if opts.MinConns > db.maxIdleConns {
+		db.conn.SetMaxIdleConns(opts.MinConns)
+	}
+	db.stop = make(chan struct{})
+	db.done = make(chan struct{})
+	go db.keepalive(opts)
+}
+
+// keepalive pings connections until the database is closed.
+func (db *mysqlDB) keepalive(opts KeepaliveOptions) {
+	defer close(db.done)
+	t := time.NewTicker(opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-t.C:
+		}
+		if err := db.pingConns(opts.MinConns, opts.Interval); err != nil {
+			log.Printf("mysql: keepalive: %v", err)
+		}
+	}
+}
+
+// pingConns pings n connections, holding all of them at once so that n
+// distinct connections are used and returned to the pool. It gives up after
+// timeout.
+func (db *mysqlDB) pingConns(n int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c, err := db.conn.Conn(ctx)
+		if err != nil {
+			return fmt.Errorf("could not get connection: %v", err)
+		}
+		conns = append(conns, c)
+		if err := c.PingContext(ctx); err != nil {
+			return fmt.Errorf("could not ping connection: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pingCounter is a connector recording the connections it opens and the
+// pings they receive.
+type pingCounter struct {
+	mu    sync.Mutex
+	conns int
+	pings []time.Time
+}
+
+func (p *pingCounter) Connect(context.Context) (driver.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns++
+	return pingCounterConn{p}, nil
+}
+
+func (p *pingCounter) Driver() driver.Driver { return noInsertIDDriver{} }
+
+// counts returns the number of connections opened and pings received.
+func (p *pingCounter) counts() (conns, pings int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns, len(p.pings)
+}
+
+type pingCounterConn struct {
+	p *pingCounter
+}
+
+func (c pingCounterConn) Prepare(query string) (driver.Stmt, error) { return noInsertIDStmt{}, nil }
+func (c pingCounterConn) Close() error                              { return nil }
+func (c pingCounterConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (c pingCounterConn) Ping(context.Context) error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	c.p.pings = append(c.p.pings, time.Now())
+	return nil
+}
+
+// newPingCounterDB returns a database connecting through counter, with at
+// most maxOpen connections.
+func newPingCounterDB(counter *pingCounter, maxOpen int) *mysqlDB {
+	conn := sql.OpenDB(counter)
+	conn.SetMaxOpenConns(maxOpen)
+	conn.SetMaxIdleConns(defaultMaxIdleConns)
+	return &mysqlDB{conn: conn, maxOpenConns: maxOpen, maxIdleConns: defaultMaxIdleConns}
+}
+
+func TestKeepalive(t *testing.T) {
+	counter := &pingCounter{}
+	db := newPingCounterDB(counter, 10)
+	const interval = 50 * time.Millisecond
+	start := time.Now()
+	db.StartKeepalive(KeepaliveOptions{Interval: interval, MinConns: 2})
+
+	time.Sleep(5*interval + interval/2)
+	conns, pings := counter.counts()
+	// Each tick pings both connections, which are kept open between ticks.
+	if pings < 2*3 || pings > 2*6 || pings%2 != 0 {
+		t.Errorf("%d pings after 5 intervals, want 2 per interval", pings)
+	}
+	if conns != 2 {
+		t.Errorf("opened %d connections, want the 2 kept alive", conns)
+	}
+	counter.mu.Lock()
+	if first := counter.pings[0].Sub(start); first < interval {
+		t.Errorf("first ping after %v, want it after the interval of %v", first, interval)
+	}
+	counter.mu.Unlock()
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	_, pings = counter.counts()
+	time.Sleep(3 * interval)
+	if _, after := counter.counts(); after != pings {
+		t.Errorf("%d pings after Close, want none", after-pings)
+	}
+}
+
+func TestKeepaliveConns(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		minConns, maxOpen int
+		want              int
+	}{
+		{"default", 0, 10, 1},
+		{"more than idle", 4, 10, 4},
+		{"more than open", 4, 3, 3},
+	} {
+		counter := &pingCounter{}
+		db := newPingCounterDB(counter, tt.maxOpen)
+		db.StartKeepalive(KeepaliveOptions{Interval: 10 * time.Millisecond, MinConns: tt.minConns})
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, pings := counter.counts(); pings >= 3*tt.want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: keepalive didn't ping", tt.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		db.Close()
+		// The connections stay idle in the pool between pings, rather than
+		// new ones being opened each time.
+		if conns, _ := counter.counts(); conns != tt.want {
+			t.Errorf("%s: opened %d connections, want %d", tt.name, conns, tt.want)
+		}
+	}
+}
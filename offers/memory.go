@@ -0,0 +1,1145 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDB is an OfferDatabase held in memory, for tests and local
+// development without MySQL. Its contents are lost when the process exits.
+type memoryDB struct {
+	mu sync.RWMutex
+
+	offers map[string]*memoryRow
+	// deleted holds the soft-deleted offers, so only the lists including
+	// them need to look there.
+	deleted map[string]*memoryRow
+	// slugs maps the slugs of stored offers, including soft-deleted ones,
+	// to their IDs.
+	slugs map[string]string
+	// lastID is the ID of the last row stored, so rows can be listed in
+	// insertion order.
+	lastID int64
+	// version is incremented by every write to an offer.
+	version int64
+
+	views        []memoryView
+	reservations map[string]memoryReservation
+	featured     []string
+	reports      []*OfferReport
+	reviews      []*Review
+	alerts       []*PriceAlert
+	lastReportID int64
+	lastReviewID int64
+	lastAlertID  int64
+}
+
+// memoryRow is a stored offer, and the columns the MySQL table keeps
+// alongside it.
+type memoryRow struct {
+	id    int64
+	offer Offer
+	hash  string
+}
+
+type memoryView struct {
+	offerID  string
+	viewedAt time.Time
+}
+
+type memoryReservation struct {
+	offerID   string
+	quantity  int
+	expiresAt time.Time
+}
+
+// Ensure memoryDB conforms to the OfferDatabase interface.
+var _ OfferDatabase = &memoryDB{}
+
+// NewMemoryDB returns an empty in-memory OfferDatabase.
+func NewMemoryDB() OfferDatabase {
+	return &memoryDB{
+		offers:       map[string]*memoryRow{},
+		deleted:      map[string]*memoryRow{},
+		slugs:        map[string]string{},
+		reservations: map[string]memoryReservation{},
+	}
+}
+
+// rows returns the stored rows matching match, in insertion order. The
+// caller must hold db.mu.
+func (db *memoryDB) rows(match func(*Offer) bool) []*memoryRow {
+	var rows []*memoryRow
+	for _, r := range db.offers {
+		if match == nil || match(&r.offer) {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].id < rows[j].id })
+	return rows
+}
+
+// copies returns copies of the rows' offers, so callers can't modify the
+// stored values.
+func copies(rows []*memoryRow) []*Offer {
+	offers := make([]*Offer, len(rows))
+	for i, r := range rows {
+		o := r.offer
+		offers[i] = &o
+	}
+	return offers
+}
+
+// memoryOrders sort rows like the ORDER BY clauses of the MySQL lists.
+var memoryOrders = map[SortOrder]func(a, b *memoryRow) bool{
+	SortByTitle: func(a, b *memoryRow) bool {
+		if !strings.EqualFold(a.offer.Title, b.offer.Title) {
+			return strings.ToLower(a.offer.Title) < strings.ToLower(b.offer.Title)
+		}
+		return a.id < b.id
+	},
+	SortByPrice: func(a, b *memoryRow) bool {
+		if pa, pb := parsePrice(a.offer.Price), parsePrice(b.offer.Price); pa != pb {
+			return pa < pb
+		}
+		return a.id < b.id
+	},
+	SortByInsertion: func(a, b *memoryRow) bool { return a.id < b.id },
+}
+
+// page returns a page of the offers matching match, and how many match.
+func (db *memoryDB) page(opts ListOptions, match func(*Offer) bool) ([]*Offer, int, error) {
+	less, ok := memoryOrders[opts.sort()]
+	if !ok {
+		return nil, 0, fmt.Errorf("memory: unknown sort order %q", opts.Sort)
+	}
+	if opts.InStock {
+		inner := match
+		match = func(o *Offer) bool { return !o.OutOfStock() && (inner == nil || inner(o)) }
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rows := db.rows(match)
+	if opts.IncludeDeleted {
+		for _, r := range db.deleted {
+			if match == nil || match(&r.offer) {
+				rows = append(rows, r)
+			}
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	total := len(rows)
+	start, end := opts.Offset, opts.Offset+opts.limit()
+	if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+	return copies(rows[start:end]), total, nil
+}
+
+// ListOffers returns a page of offers in the requested order.
+func (db *memoryDB) ListOffers(ctx context.Context, opts ListOptions) ([]*Offer, int, error) {
+	return db.page(opts, nil)
+}
+
+// ListPurchasableOffers returns a page of the purchasable offers.
+func (db *memoryDB) ListPurchasableOffers(ctx context.Context, opts ListOptions) ([]*Offer, int, error) {
+	return db.page(opts, (*Offer).Purchasable)
+}
+
+// GetOffer retrieves an offer by its ID.
+func (db *memoryDB) GetOffer(ctx context.Context, id string) (*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	r, ok := db.offers[id]
+	if !ok {
+		return nil, ErrOfferNotFound
+	}
+	return copies([]*memoryRow{r})[0], nil
+}
+
+// GetOfferBySlug retrieves the offer with the given slug.
+func (db *memoryDB) GetOfferBySlug(ctx context.Context, slug string) (*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	r, ok := db.offers[db.slugs[slug]]
+	if !ok {
+		return nil, ErrOfferNotFound
+	}
+	return copies([]*memoryRow{r})[0], nil
+}
+
+// GetOffersByIDs retrieves the offers with the given IDs, in that order.
+func (db *memoryDB) GetOffersByIDs(ctx context.Context, ids []string) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var rows []*memoryRow
+	for _, id := range ids {
+		if r, ok := db.offers[id]; ok {
+			rows = append(rows, r)
+		}
+	}
+	return orderByIDs(copies(rows), ids), nil
+}
+
+// OfferExists reports whether an offer with the given ID exists.
+func (db *memoryDB) OfferExists(ctx context.Context, id string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.offers[id]
+	return ok, nil
+}
+
+// CountOffers returns the number of offers.
+func (db *memoryDB) CountOffers(ctx context.Context) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.offers), nil
+}
+
+// CountSearchOffers returns the number of offers whose description or title
+// contains q.
+func (db *memoryDB) CountSearchOffers(ctx context.Context, q string) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.rows(func(o *Offer) bool { return matchesSearch(o, q) })), nil
+}
+
+// SearchOffers returns up to limit offers whose description or title
+// contains q, in the given order.
+func (db *memoryDB) SearchOffers(ctx context.Context, q string, order SortOrder, limit int) ([]*Offer, error) {
+	order, ok := searchOrder(order)
+	if !ok {
+		return nil, fmt.Errorf("memory: unknown search order %q", order)
+	}
+	limit = searchLimit(limit)
+	if order != SortByRelevance {
+		list, _, err := db.page(ListOptions{Limit: limit, Sort: order}, func(o *Offer) bool {
+			return matchesSearch(o, q)
+		})
+		return list, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rows := db.rows(func(o *Offer) bool { return matchesSearch(o, q) })
+	sort.SliceStable(rows, func(i, j int) bool {
+		if ri, rj := searchRank(&rows[i].offer, q), searchRank(&rows[j].offer, q); ri != rj {
+			return ri < rj
+		}
+		return memoryOrders[SortByTitle](rows[i], rows[j])
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return copies(rows), nil
+}
+
+// SearchOffersByPriceRange returns up to maxSearchResults offers containing
+// q and priced within the range, cheapest first.
+func (db *memoryDB) SearchOffersByPriceRange(ctx context.Context, q string, min, max float64, currency string) ([]*Offer, error) {
+	list, _, err := db.page(ListOptions{Limit: maxSearchResults, Sort: SortByPrice}, func(o *Offer) bool {
+		p := parsePrice(o.Price)
+		return o.Price != "" && matchesSearch(o, q) && p >= min && p <= max &&
+			(currency == "" || strings.EqualFold(o.Currency, currency))
+	})
+	return list, err
+}
+
+// FilterOffers returns up to limit offers matching the filter.
+func (db *memoryDB) FilterOffers(ctx context.Context, f *Filter, limit int) ([]*Offer, error) {
+	list, _, err := db.page(ListOptions{Limit: limit, Sort: SortByInsertion}, f.matches)
+	return list, err
+}
+
+// ListBrandsWithCounts returns up to maxBrands brands with their offer
+// counts, most offers first.
+func (db *memoryDB) ListBrandsWithCounts(ctx context.Context) ([]BrandCount, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	counts := map[string]int{}
+	for _, r := range db.offers {
+		if r.offer.Brand != "" {
+			counts[r.offer.Brand]++
+		}
+	}
+	var brands []BrandCount
+	for b, n := range counts {
+		brands = append(brands, BrandCount{Brand: b, Count: n})
+	}
+	sort.Slice(brands, func(i, j int) bool {
+		return moreCommon(brands[i].Brand, brands[i].Count, brands[j].Brand, brands[j].Count)
+	})
+	if len(brands) > maxBrands {
+		brands = brands[:maxBrands]
+	}
+	return brands, nil
+}
+
+// moreCommon orders values counted ni and nj times, most common first and
+// then by value.
+func moreCommon(vi string, ni int, vj string, nj int) bool {
+	if ni != nj {
+		return ni > nj
+	}
+	return vi < vj
+}
+
+// FilteredSearch returns a page of the offers matching q and the applied
+// filters, ordered by offer ID.
+func (db *memoryDB) FilteredSearch(ctx context.Context, q string, applied FilterOptions, offset, limit int) ([]*Offer, error) {
+	if err := applied.Validate(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rows := db.rows(func(o *Offer) bool { return applied.matches(o, q, "") })
+	sort.Slice(rows, func(i, j int) bool { return rows[i].offer.ID < rows[j].offer.ID })
+	if offset > len(rows) {
+		offset = len(rows)
+	}
+	if limit > len(rows)-offset {
+		limit = len(rows) - offset
+	}
+	return copies(rows[offset : offset+limit]), nil
+}
+
+// SearchFacets counts the offers matching q for each facet value.
+func (db *memoryDB) SearchFacets(ctx context.Context, q string, applied FilterOptions) (Facets, error) {
+	if err := applied.Validate(); err != nil {
+		return Facets{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	count := func(facet string, value func(*Offer) string, limit int) []FacetCount {
+		n := map[string]int{}
+		for _, r := range db.rows(func(o *Offer) bool { return applied.matches(o, q, facet) }) {
+			if v := value(&r.offer); v != "" {
+				n[v]++
+			}
+		}
+		var counts []FacetCount
+		for v, c := range n {
+			counts = append(counts, FacetCount{Value: v, Count: c})
+		}
+		sort.Slice(counts, func(i, j int) bool {
+			return moreCommon(counts[i].Value, counts[i].Count, counts[j].Value, counts[j].Count)
+		})
+		if limit > 0 && len(counts) > limit {
+			counts = counts[:limit]
+		}
+		return counts
+	}
+
+	var f Facets
+	f.Brands = facetCounts(count(brandFacet, func(o *Offer) string { return o.Brand }, maxBrands), applied.Brands)
+	f.Currencies = facetCounts(count(currencyFacet, func(o *Offer) string { return o.Currency }, 0), applied.Currencies)
+	prices := count(priceFacet, func(o *Offer) string { return priceBucket(o.Price) }, 0)
+	sort.Slice(prices, func(i, j int) bool {
+		return priceBucketIndex(prices[i].Value) < priceBucketIndex(prices[j].Value)
+	})
+	f.Prices = facetCounts(prices, applied.Prices)
+	return f, nil
+}
+
+// CatalogVersion returns a version built from the number of offers, the
+// number of offer writes and the number of reviews.
+func (db *memoryDB) CatalogVersion(ctx context.Context) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fmt.Sprintf("%d-%d-%d", len(db.offers), db.version, len(db.reviews)), nil
+}
+
+// ChangeToken returns the number of offers and offer writes.
+func (db *memoryDB) ChangeToken(ctx context.Context) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fmt.Sprintf("%d-%d", len(db.offers), db.version), nil
+}
+
+// ForEachOffer calls fn for every offer, in insertion order. fn is called
+// on a snapshot, so it may write to the database.
+func (db *memoryDB) ForEachOffer(ctx context.Context, fn func(*Offer) error) error {
+	return db.ForEachSearchResult(ctx, "", fn)
+}
+
+// ForEachSearchResult calls fn for every offer matching q.
+func (db *memoryDB) ForEachSearchResult(ctx context.Context, q string, fn func(*Offer) error) error {
+	db.mu.RLock()
+	list := copies(db.rows(func(o *Offer) bool { return q == "" || matchesSearch(o, q) }))
+	db.mu.RUnlock()
+	for _, o := range list {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncedFields returns the fields of o that AddOffer and UpdateOffer store,
+// keeping the other fields of old.
+func syncedFields(old, o *Offer) Offer {
+	s := *old
+	s.ID, s.Title, s.Price, s.Currency = o.ID, o.Title, o.Price, o.Currency
+	s.ImageURL, s.Description, s.MerchantURL = o.ImageURL, o.Description, o.MerchantURL
+	s.ItemGroupID, s.GTIN, s.Quantity, s.Brand = o.ItemGroupID, o.GTIN, o.Quantity, o.Brand
+	s.Category, s.Availability, s.Condition, s.SalePrice = o.Category, o.Availability, o.Condition, o.SalePrice
+	s.MerchantID = o.MerchantID
+	return s
+}
+
+// insert stores a new offer. The caller must hold db.mu for writing.
+func (db *memoryDB) insert(o *Offer) int64 {
+	db.lastID++
+	db.version++
+	now := time.Now().UTC()
+	slug := uniqueSlug(slugify(o.Title), func(s string) bool {
+		_, ok := db.slugs[s]
+		return ok
+	})
+	db.slugs[slug] = o.ID
+	db.offers[o.ID] = &memoryRow{
+		id:    db.lastID,
+		offer: syncedFields(&Offer{CreatedAt: now, UpdatedAt: now, Slug: slug}, o),
+		hash:  o.contentHash(),
+	}
+	return db.lastID
+}
+
+// update replaces the synced fields of a stored offer and increments its
+// Version. The caller must hold db.mu for writing.
+func (db *memoryDB) update(r *memoryRow, o *Offer) {
+	db.version++
+	r.offer = syncedFields(&r.offer, o)
+	r.offer.Version++
+	// Like MySQL, only offers whose fields change are given a new UpdatedAt.
+	if hash := o.contentHash(); hash != r.hash {
+		r.offer.UpdatedAt = time.Now().UTC()
+		r.hash = hash
+	}
+}
+
+// remove soft-deletes a stored offer. The caller must hold db.mu for
+// writing.
+func (db *memoryDB) remove(r *memoryRow) {
+	db.version++
+	now := time.Now().UTC()
+	r.offer.DeletedAt = &now
+	r.offer.UpdatedAt = now
+	delete(db.offers, r.offer.ID)
+	db.deleted[r.offer.ID] = r
+}
+
+// restore undeletes the soft-deleted offer with the given ID, if there is
+// one, and returns its row. The caller must hold db.mu for writing.
+func (db *memoryDB) restore(id string) (*memoryRow, bool) {
+	r, ok := db.deleted[id]
+	if !ok {
+		return nil, false
+	}
+	db.version++
+	r.offer.DeletedAt = nil
+	r.offer.UpdatedAt = time.Now().UTC()
+	// Like MySQL, which reads deleted offers without a hash, count the offer
+	// as changed.
+	r.hash = ""
+	delete(db.deleted, id)
+	db.offers[id] = r
+	return r, true
+}
+
+// AddOffer adds an offer, returning ErrDuplicateOffer if its ID is taken.
+func (db *memoryDB) AddOffer(ctx context.Context, o *Offer) (int64, error) {
+	if err := o.Validate(); err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.offers[o.ID]; ok {
+		return 0, ErrDuplicateOffer
+	}
+	if r, ok := db.restore(o.ID); ok {
+		db.update(r, o)
+		return r.id, nil
+	}
+	return db.insert(o), nil
+}
+
+// UpdateOffer updates the offer with o's ID if o.Version is the stored one.
+func (db *memoryDB) UpdateOffer(ctx context.Context, o *Offer) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r, ok := db.offers[o.ID]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	if r.offer.Version != o.Version {
+		return ErrConcurrentModification
+	}
+	db.update(r, o)
+	o.Version = r.offer.Version
+	return nil
+}
+
+// UpdateOfferFields sets the given fields of the offer with the given ID.
+func (db *memoryDB) UpdateOfferFields(ctx context.Context, id string, fields map[string]interface{}) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r, ok := db.offers[id]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	o := r.offer
+	if _, err := applyPatch(&o, fields); err != nil {
+		return err
+	}
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	db.update(r, &o)
+	return nil
+}
+
+// UpsertOffer adds or updates the offer. Unchanged offers are left as they
+// are.
+func (db *memoryDB) UpsertOffer(ctx context.Context, o *Offer) (int64, bool, error) {
+	if err := o.validatePrice(); err != nil {
+		return 0, false, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r, ok := db.offers[o.ID]
+	if !ok {
+		r, ok = db.restore(o.ID)
+	}
+	if !ok {
+		return db.insert(o), true, nil
+	}
+	if r.hash == o.contentHash() {
+		return r.id, false, nil
+	}
+	db.update(r, o)
+	return r.id, true, nil
+}
+
+// BulkUpsertOffers upserts all the offers like UpsertOffer.
+func (db *memoryDB) BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error) {
+	for _, o := range offers {
+		if err := o.validatePrice(); err != nil {
+			return 0, err
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	changed := 0
+	for _, o := range offers {
+		r, ok := db.offers[o.ID]
+		if !ok {
+			r, ok = db.restore(o.ID)
+		}
+		switch {
+		case !ok:
+			db.insert(o)
+		case r.hash == o.contentHash():
+			continue
+		default:
+			db.update(r, o)
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// WithTx calls fn with a writer of db, and restores the offers as they were
+// before if it fails. The writes are not isolated: they are seen before fn
+// returns, and other writes made meanwhile are lost with a rollback.
+func (db *memoryDB) WithTx(ctx context.Context, fn func(SyncWriter) error) error {
+	db.mu.RLock()
+	saved, savedDeleted := copyRows(db.offers), copyRows(db.deleted)
+	db.mu.RUnlock()
+	if err := fn(&memoryTx{db: db, seen: map[string]bool{}, kept: map[int64]bool{}}); err != nil {
+		db.mu.Lock()
+		db.offers, db.deleted = saved, savedDeleted
+		db.version++
+		db.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// memoryTx is the SyncWriter of WithTx.
+type memoryTx struct {
+	db *memoryDB
+	// seen holds the IDs of the offers upserted since UpdateUpdated, and
+	// kept the merchants whose offers are all kept.
+	seen map[string]bool
+	kept map[int64]bool
+}
+
+// UpdateUpdated forgets the offers seen so far.
+func (t *memoryTx) UpdateUpdated(ctx context.Context) error {
+	t.seen, t.kept = map[string]bool{}, map[int64]bool{}
+	return nil
+}
+
+// KeepMerchantOffers marks the merchant's offers as seen.
+func (t *memoryTx) KeepMerchantOffers(ctx context.Context, merchantID int64) error {
+	t.kept[merchantID] = true
+	return nil
+}
+
+// BulkUpsertOffers upserts the offers and marks them as seen.
+func (t *memoryTx) BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error) {
+	n, err := t.db.BulkUpsertOffers(ctx, offers)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range offers {
+		t.seen[o.ID] = true
+	}
+	return n, nil
+}
+
+// DeleteOffers soft-deletes the offers not seen since UpdateUpdated.
+func (t *memoryTx) DeleteOffers(ctx context.Context) (int64, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	var n int64
+	for id, r := range t.db.offers {
+		if !t.seen[id] && !t.kept[r.offer.MerchantID] {
+			t.db.remove(r)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// copyRows returns a copy of rows, sharing nothing with it.
+func copyRows(rows map[string]*memoryRow) map[string]*memoryRow {
+	c := make(map[string]*memoryRow, len(rows))
+	for id, r := range rows {
+		r := *r
+		c[id] = &r
+	}
+	return c
+}
+
+// DeleteOffer soft-deletes the offer with the given ID.
+func (db *memoryDB) DeleteOffer(ctx context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r, ok := db.offers[id]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	db.remove(r)
+	return nil
+}
+
+// PurgeDeleted removes the offers soft-deleted before olderThan.
+func (db *memoryDB) PurgeDeleted(ctx context.Context, olderThan time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int64
+	for id, r := range db.deleted {
+		if r.offer.DeletedAt.Before(olderThan) {
+			delete(db.deleted, id)
+			delete(db.slugs, r.offer.Slug)
+			n++
+		}
+	}
+	if n > 0 {
+		db.version++
+	}
+	return n, nil
+}
+
+// RecordView records a view of the offer.
+func (db *memoryDB) RecordView(ctx context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.views = append(db.views, memoryView{offerID: id, viewedAt: time.Now().UTC()})
+	return nil
+}
+
+// ListNewOffers returns the offers first stored since the given time.
+func (db *memoryDB) ListNewOffers(ctx context.Context, since time.Time, limit int) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var rows []*memoryRow
+	for _, r := range db.offers {
+		if !r.offer.CreatedAt.Before(since) {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].offer.CreatedAt.Equal(rows[j].offer.CreatedAt) {
+			return rows[i].offer.CreatedAt.After(rows[j].offer.CreatedAt)
+		}
+		return rows[i].id > rows[j].id
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return copies(rows), nil
+}
+
+// ListByCategory returns a page of the offers in the given category.
+func (db *memoryDB) ListByCategory(ctx context.Context, category string, limit, offset int) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	category = storedCategory(category)
+	rows := db.rows(func(o *Offer) bool { return o.Category == category })
+	sort.SliceStable(rows, func(i, j int) bool { return memoryOrders[SortByTitle](rows[i], rows[j]) })
+	if offset >= len(rows) {
+		return nil, nil
+	}
+	rows = rows[offset:]
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return copies(rows), nil
+}
+
+// ListOffersByMerchant returns a page of the offers synced from the given
+// account.
+func (db *memoryDB) ListOffersByMerchant(ctx context.Context, merchantID int64, limit, offset int) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rows := db.rows(func(o *Offer) bool { return o.MerchantID == merchantID })
+	sort.SliceStable(rows, func(i, j int) bool { return memoryOrders[SortByTitle](rows[i], rows[j]) })
+	if offset >= len(rows) {
+		return nil, nil
+	}
+	rows = rows[offset:]
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return copies(rows), nil
+}
+
+// RelatedOffers returns the offers sharing the most title words with the
+// offer with the given ID.
+func (db *memoryDB) RelatedOffers(ctx context.Context, id string, limit int) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	src, ok := db.offers[id]
+	if !ok {
+		return nil, ErrOfferNotFound
+	}
+	keywords := relatedKeywords(&src.offer)
+	scores := map[string]int{}
+	rows := db.rows(func(o *Offer) bool {
+		scores[o.ID] = relatedScore(o, keywords)
+		return o.ID != id && scores[o.ID] > 0
+	})
+	sort.SliceStable(rows, func(i, j int) bool {
+		if si, sj := scores[rows[i].offer.ID], scores[rows[j].offer.ID]; si != sj {
+			return si > sj
+		}
+		return memoryOrders[SortByTitle](rows[i], rows[j])
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return copies(rows), nil
+}
+
+// TrendingOffers returns the offers viewed most often within the window.
+func (db *memoryDB) TrendingOffers(ctx context.Context, window time.Duration, limit int) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	since := time.Now().UTC().Add(-window)
+	views := map[string]int{}
+	for _, v := range db.views {
+		if !v.viewedAt.Before(since) {
+			views[v.offerID]++
+		}
+	}
+	// Views of deleted offers don't take up the limit.
+	var ids []string
+	for id := range views {
+		if _, ok := db.offers[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return moreCommon(ids[i], views[ids[i]], ids[j], views[ids[j]]) })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	var rows []*memoryRow
+	for _, id := range ids {
+		rows = append(rows, db.offers[id])
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if vi, vj := views[rows[i].offer.ID], views[rows[j].offer.ID]; vi != vj {
+			return vi > vj
+		}
+		return rows[i].offer.Title < rows[j].offer.Title
+	})
+	return copies(rows), nil
+}
+
+// PruneViews deletes views recorded before the given time.
+func (db *memoryDB) PruneViews(ctx context.Context, before time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	kept := db.views[:0]
+	for _, v := range db.views {
+		if !v.viewedAt.Before(before) {
+			kept = append(kept, v)
+		}
+	}
+	n := int64(len(db.views) - len(kept))
+	db.views = kept
+	return n, nil
+}
+
+// GetVariants returns the offers with the given item group ID, ordered by
+// title.
+func (db *memoryDB) GetVariants(ctx context.Context, itemGroupID string) ([]*Offer, error) {
+	if itemGroupID == "" {
+		return nil, nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rows := db.rows(func(o *Offer) bool { return o.ItemGroupID == itemGroupID })
+	sort.SliceStable(rows, func(i, j int) bool { return memoryOrders[SortByTitle](rows[i], rows[j]) })
+	return copies(rows), nil
+}
+
+// ReserveOffer reserves qty items of the offer, if they are available after
+// its unexpired reservations.
+func (db *memoryDB) ReserveOffer(ctx context.Context, offerID string, qty int, ttl time.Duration) (string, error) {
+	if qty <= 0 {
+		return "", fmt.Errorf("memory: invalid reservation quantity %d", qty)
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("memory: invalid reservation ttl %v", ttl)
+	}
+	id, err := newReservationID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r, ok := db.offers[offerID]
+	if !ok {
+		return "", ErrOfferNotFound
+	}
+	if r.offer.Quantity == 0 {
+		return "", ErrQuantityUnknown
+	}
+	var reserved int64
+	for _, res := range db.reservations {
+		if res.offerID == offerID && res.expiresAt.After(now) {
+			reserved += int64(res.quantity)
+		}
+	}
+	if r.offer.Quantity-reserved < int64(qty) {
+		return "", ErrInsufficientQuantity
+	}
+	db.reservations[id] = memoryReservation{offerID: offerID, quantity: qty, expiresAt: now.Add(ttl)}
+	return id, nil
+}
+
+// ReleaseReservation deletes the reservation.
+func (db *memoryDB) ReleaseReservation(ctx context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.reservations, id)
+	return nil
+}
+
+// PruneReservations deletes expired reservations.
+func (db *memoryDB) PruneReservations(ctx context.Context) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now().UTC()
+	var n int64
+	for id, res := range db.reservations {
+		if !res.expiresAt.After(now) {
+			delete(db.reservations, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SetFeatured replaces the featured offers.
+func (db *memoryDB) SetFeatured(ctx context.Context, ids []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.featured = uniqueIDs(ids)
+	return nil
+}
+
+// GetFeaturedOffers returns the featured offers that still exist, in order.
+func (db *memoryDB) GetFeaturedOffers(ctx context.Context) ([]*Offer, error) {
+	db.mu.RLock()
+	ids := db.featured
+	db.mu.RUnlock()
+	return db.GetOffersByIDs(ctx, ids)
+}
+
+// AddReport stores a report about the offer.
+func (db *memoryDB) AddReport(ctx context.Context, offerID, reason string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastReportID++
+	db.reports = append(db.reports, &OfferReport{
+		ID:        db.lastReportID,
+		OfferID:   offerID,
+		Reason:    reason,
+		CreatedAt: time.Now().UTC(),
+	})
+	return nil
+}
+
+// ListReports returns up to limit reports, newest first.
+func (db *memoryDB) ListReports(ctx context.Context, limit int) ([]*OfferReport, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var reports []*OfferReport
+	for i := len(db.reports) - 1; i >= 0 && len(reports) < limit; i-- {
+		r := *db.reports[i]
+		reports = append(reports, &r)
+	}
+	return reports, nil
+}
+
+// AddReview stores a review of the offer.
+func (db *memoryDB) AddReview(ctx context.Context, offerID string, rating int, text string) error {
+	if rating < MinRating || rating > MaxRating {
+		return ErrInvalidRating
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastReviewID++
+	db.reviews = append(db.reviews, &Review{
+		ID:        db.lastReviewID,
+		OfferID:   offerID,
+		Rating:    rating,
+		Text:      text,
+		CreatedAt: time.Now().UTC(),
+	})
+	return nil
+}
+
+// GetReviews returns up to maxReviews of an offer's most recent reviews.
+func (db *memoryDB) GetReviews(ctx context.Context, offerID string) ([]*Review, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var reviews []*Review
+	for i := len(db.reviews) - 1; i >= 0 && len(reviews) < maxReviews; i-- {
+		if db.reviews[i].OfferID == offerID {
+			r := *db.reviews[i]
+			reviews = append(reviews, &r)
+		}
+	}
+	return reviews, nil
+}
+
+// AverageRating returns the average rating of an offer's reviews.
+func (db *memoryDB) AverageRating(ctx context.Context, offerID string) (Rating, error) {
+	ratings, err := db.AverageRatings(ctx, []string{offerID})
+	if err != nil {
+		return Rating{}, err
+	}
+	return ratings[offerID], nil
+}
+
+// AverageRatings returns the average ratings of the reviewed offers among
+// offerIDs.
+func (db *memoryDB) AverageRatings(ctx context.Context, offerIDs []string) (map[string]Rating, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	want := map[string]bool{}
+	for _, id := range offerIDs {
+		want[id] = true
+	}
+	sums := map[string]int{}
+	ratings := map[string]Rating{}
+	for _, r := range db.reviews {
+		if want[r.OfferID] {
+			sums[r.OfferID] += r.Rating
+			rating := ratings[r.OfferID]
+			rating.Count++
+			rating.Average = float64(sums[r.OfferID]) / float64(rating.Count)
+			ratings[r.OfferID] = rating
+		}
+	}
+	return ratings, nil
+}
+
+// AddPriceAlert stores a pending price alert.
+func (db *memoryDB) AddPriceAlert(ctx context.Context, offerID, targetPrice, contact string) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastAlertID++
+	db.alerts = append(db.alerts, &PriceAlert{
+		ID:          db.lastAlertID,
+		OfferID:     offerID,
+		TargetPrice: targetPrice,
+		Contact:     contact,
+		CreatedAt:   time.Now().UTC(),
+	})
+	return db.lastAlertID, nil
+}
+
+// ListPriceAlerts returns up to limit alerts, newest first.
+func (db *memoryDB) ListPriceAlerts(ctx context.Context, limit int) ([]*PriceAlert, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var alerts []*PriceAlert
+	for i := len(db.alerts) - 1; i >= 0 && len(alerts) < limit; i-- {
+		a := *db.alerts[i]
+		alerts = append(alerts, &a)
+	}
+	return alerts, nil
+}
+
+// DeletePriceAlert deletes a price alert.
+func (db *memoryDB) DeletePriceAlert(ctx context.Context, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, a := range db.alerts {
+		if a.ID == id {
+			db.alerts = append(db.alerts[:i], db.alerts[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("memory: could not find price alert with id %d", id)
+}
+
+// TriggeredPriceAlerts returns the pending alerts whose offer's price is at
+// or below the target.
+func (db *memoryDB) TriggeredPriceAlerts(ctx context.Context) ([]*PriceAlert, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var alerts []*PriceAlert
+	for _, a := range db.alerts {
+		r, ok := db.offers[a.OfferID]
+		if ok && a.FiredAt.IsZero() && parsePrice(r.offer.Price) <= parsePrice(a.TargetPrice) {
+			c := *a
+			alerts = append(alerts, &c)
+		}
+	}
+	return alerts, nil
+}
+
+// SetPriceAlertFired marks a price alert as fired or pending, reporting
+// whether it changed.
+func (db *memoryDB) SetPriceAlertFired(ctx context.Context, id int64, fired bool) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, a := range db.alerts {
+		if a.ID != id || a.FiredAt.IsZero() != fired {
+			continue
+		}
+		if fired {
+			a.FiredAt = time.Now().UTC()
+		} else {
+			a.FiredAt = time.Time{}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// RecomputeConvertedPrices converts every offer's price to displayCurrency.
+// Like a transaction, it changes no offer if ctx is done before it finishes.
+func (db *memoryDB) RecomputeConvertedPrices(ctx context.Context, converter CurrencyConverter, displayCurrency string) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	changed := map[*memoryRow]string{}
+	for _, r := range db.offers {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		price, err := converter.Convert(r.offer.Price, r.offer.Currency, displayCurrency)
+		if err != nil {
+			price = ""
+		}
+		if price != r.offer.ConvertedPrice || r.offer.ConvertedCurrency != displayCurrency {
+			changed[r] = price
+		}
+	}
+	for r, price := range changed {
+		r.offer.ConvertedPrice, r.offer.ConvertedCurrency = price, displayCurrency
+	}
+	if len(changed) > 0 {
+		db.version++
+	}
+	return int64(len(changed)), nil
+}
+
+// ListDuplicateOffers returns up to limit offers with a canonical product
+// ID, ordered by it and then by offer ID.
+func (db *memoryDB) ListDuplicateOffers(ctx context.Context, limit int) ([]*Offer, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rows := db.rows(func(o *Offer) bool { return o.CanonicalProductID != "" })
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := &rows[i].offer, &rows[j].offer
+		if a.CanonicalProductID != b.CanonicalProductID {
+			return a.CanonicalProductID < b.CanonicalProductID
+		}
+		return a.ID < b.ID
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return copies(rows), nil
+}
+
+// SetCanonicalProducts replaces all canonical product links.
+func (db *memoryDB) SetCanonicalProducts(ctx context.Context, links map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for id, r := range db.offers {
+		if r.offer.CanonicalProductID != links[id] {
+			r.offer.CanonicalProductID = links[id]
+			db.version++
+		}
+	}
+	return nil
+}
+
+// SetMetaOverrides stores the offer's custom meta title and description.
+func (db *memoryDB) SetMetaOverrides(ctx context.Context, offerID, title, description string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if r, ok := db.offers[offerID]; ok {
+		r.offer.CustomMetaTitle, r.offer.CustomMetaDescription = title, description
+		db.version++
+	}
+	return nil
+}
+
+// Check always succeeds; the database is in memory.
+func (db *memoryDB) Check(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing; the database is in memory.
+func (db *memoryDB) Close() error {
+	return nil
+}
@@ -0,0 +1,399 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newSeededMemoryDB returns an in-memory database holding a chair, a table
+// and a lamp. The chair and table are both garden furniture from merchant
+// 1; the lamp's description mentions the garden.
+func newSeededMemoryDB(t *testing.T) OfferDatabase {
+	t.Helper()
+	db := NewMemoryDB()
+	chair := testOffer("chair", "Garden chair", "10.00")
+	chair.Category, chair.MerchantID, chair.ItemGroupID = "Furniture", 1, "garden"
+	table := testOffer("table", "Garden table", "50.00")
+	table.Category, table.MerchantID, table.ItemGroupID = "Furniture", 1, "garden"
+	lamp := testOffer("lamp", "Lamp", "25.00")
+	lamp.Description = "Lights up the GARDEN path"
+	lamp.MerchantID = 2
+	addOffers(t, db, chair, table, lamp)
+	return db
+}
+
+func TestMemoryDB(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		// run calls the method on the seeded database. Offer lists it
+		// returns are compared by their IDs.
+		run     func(db OfferDatabase) (interface{}, error)
+		want    interface{}
+		wantErr error
+	}{
+		{
+			name: "ListOffers",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, total, err := db.ListOffers(ctx, ListOptions{Limit: 2, Sort: SortByTitle})
+				return []interface{}{offerIDs(list), total}, err
+			},
+			want: []interface{}{[]string{"chair", "table"}, 3},
+		},
+		{
+			name: "ListOffers by price",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, _, err := db.ListOffers(ctx, ListOptions{Offset: 1, Sort: SortByPrice})
+				return offerIDs(list), err
+			},
+			want: []string{"lamp", "table"},
+		},
+		{
+			name: "GetOffer",
+			run: func(db OfferDatabase) (interface{}, error) {
+				o, err := db.GetOffer(ctx, "table")
+				if err != nil {
+					return nil, err
+				}
+				return []string{o.Title, o.Price}, nil
+			},
+			want: []string{"Garden table", "50.00"},
+		},
+		{
+			name: "GetOffer not found",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return db.GetOffer(ctx, "sofa")
+			},
+			wantErr: ErrOfferNotFound,
+		},
+		{
+			name: "GetOfferBySlug",
+			run: func(db OfferDatabase) (interface{}, error) {
+				o, err := db.GetOfferBySlug(ctx, "garden-chair")
+				if err != nil {
+					return nil, err
+				}
+				return o.ID, nil
+			},
+			want: "chair",
+		},
+		{
+			name: "GetOffersByIDs",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.GetOffersByIDs(ctx, []string{"lamp", "sofa", "chair"})
+				return offerIDs(list), err
+			},
+			want: []string{"lamp", "chair"},
+		},
+		{
+			name: "OfferExists",
+			run: func(db OfferDatabase) (interface{}, error) {
+				found, err := db.OfferExists(ctx, "lamp")
+				if err != nil {
+					return nil, err
+				}
+				missing, err := db.OfferExists(ctx, "sofa")
+				return []bool{found, missing}, err
+			},
+			want: []bool{true, false},
+		},
+		{
+			name: "CountOffers",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return db.CountOffers(ctx)
+			},
+			want: 3,
+		},
+		{
+			name: "CountSearchOffers",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return db.CountSearchOffers(ctx, "garden")
+			},
+			want: 3,
+		},
+		{
+			// Search matches substrings of the title and description,
+			// ignoring case.
+			name: "SearchOffers",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.SearchOffers(ctx, "gArDeN", SortByPrice, 0)
+				return offerIDs(list), err
+			},
+			want: []string{"chair", "lamp", "table"},
+		},
+		{
+			name: "SearchOffers by description",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.SearchOffers(ctx, "path", SortByRelevance, 0)
+				return offerIDs(list), err
+			},
+			want: []string{"lamp"},
+		},
+		{
+			name: "SearchOffers without matches",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.SearchOffers(ctx, "sofa", SortByRelevance, 0)
+				return offerIDs(list), err
+			},
+			want: []string{},
+		},
+		{
+			name: "SearchOffersByPriceRange",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.SearchOffersByPriceRange(ctx, "garden", 20, 60, "USD")
+				return offerIDs(list), err
+			},
+			want: []string{"lamp", "table"},
+		},
+		{
+			name: "ForEachOffer",
+			run: func(db OfferDatabase) (interface{}, error) {
+				var ids []string
+				err := db.ForEachOffer(ctx, func(o *Offer) error {
+					ids = append(ids, o.ID)
+					return nil
+				})
+				return ids, err
+			},
+			want: []string{"chair", "table", "lamp"},
+		},
+		{
+			name: "ForEachSearchResult",
+			run: func(db OfferDatabase) (interface{}, error) {
+				var ids []string
+				err := db.ForEachSearchResult(ctx, "table", func(o *Offer) error {
+					ids = append(ids, o.ID)
+					return nil
+				})
+				return ids, err
+			},
+			want: []string{"table"},
+		},
+		{
+			name: "AddOffer",
+			run: func(db OfferDatabase) (interface{}, error) {
+				if _, err := db.AddOffer(ctx, testOffer("sofa", "Sofa", "300.00")); err != nil {
+					return nil, err
+				}
+				return db.CountOffers(ctx)
+			},
+			want: 4,
+		},
+		{
+			name: "AddOffer duplicate",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return db.AddOffer(ctx, testOffer("lamp", "Lamp", "25.00"))
+			},
+			wantErr: ErrDuplicateOffer,
+		},
+		{
+			name: "UpdateOffer",
+			run: func(db OfferDatabase) (interface{}, error) {
+				o, err := db.GetOffer(ctx, "lamp")
+				if err != nil {
+					return nil, err
+				}
+				o.Price = "20.00"
+				if err := db.UpdateOffer(ctx, o); err != nil {
+					return nil, err
+				}
+				if o, err = db.GetOffer(ctx, "lamp"); err != nil {
+					return nil, err
+				}
+				return []interface{}{o.Price, o.Version}, nil
+			},
+			want: []interface{}{"20.00", 1},
+		},
+		{
+			name: "UpdateOffer stale version",
+			run: func(db OfferDatabase) (interface{}, error) {
+				o := testOffer("lamp", "Lamp", "20.00")
+				o.Version = 7
+				return nil, db.UpdateOffer(ctx, o)
+			},
+			wantErr: ErrConcurrentModification,
+		},
+		{
+			name: "UpdateOffer not found",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return nil, db.UpdateOffer(ctx, testOffer("sofa", "Sofa", "300.00"))
+			},
+			wantErr: ErrOfferNotFound,
+		},
+		{
+			name: "UpsertOffer",
+			run: func(db OfferDatabase) (interface{}, error) {
+				if _, _, err := db.UpsertOffer(ctx, testOffer("lamp", "Desk lamp", "25.00")); err != nil {
+					return nil, err
+				}
+				if _, _, err := db.UpsertOffer(ctx, testOffer("sofa", "Sofa", "300.00")); err != nil {
+					return nil, err
+				}
+				list, _, err := db.ListOffers(ctx, ListOptions{Sort: SortByTitle})
+				return offerIDs(list), err
+			},
+			want: []string{"lamp", "chair", "table", "sofa"},
+		},
+		{
+			name: "DeleteOffer",
+			run: func(db OfferDatabase) (interface{}, error) {
+				if err := db.DeleteOffer(ctx, "chair"); err != nil {
+					return nil, err
+				}
+				list, _, err := db.ListOffers(ctx, ListOptions{})
+				return offerIDs(list), err
+			},
+			want: []string{"table", "lamp"},
+		},
+		{
+			name: "DeleteOffer not found",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return nil, db.DeleteOffer(ctx, "sofa")
+			},
+			wantErr: ErrOfferNotFound,
+		},
+		{
+			name: "PurgeDeleted",
+			run: func(db OfferDatabase) (interface{}, error) {
+				if err := db.DeleteOffer(ctx, "chair"); err != nil {
+					return nil, err
+				}
+				if n, err := db.PurgeDeleted(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+					return n, err
+				}
+				n, err := db.PurgeDeleted(ctx, time.Now().Add(time.Second))
+				if err != nil {
+					return nil, err
+				}
+				list, _, err := db.ListOffers(ctx, ListOptions{IncludeDeleted: true})
+				return []interface{}{n, offerIDs(list)}, err
+			},
+			want: []interface{}{int64(1), []string{"table", "lamp"}},
+		},
+		{
+			// A sync deletes the offers it didn't see.
+			name: "DeleteOffers",
+			run: func(db OfferDatabase) (interface{}, error) {
+				var deleted int64
+				err := db.WithTx(ctx, func(tx SyncWriter) error {
+					if err := tx.UpdateUpdated(ctx); err != nil {
+						return err
+					}
+					if _, err := tx.BulkUpsertOffers(ctx, []*Offer{testOffer("lamp", "Lamp", "25.00")}); err != nil {
+						return err
+					}
+					var err error
+					deleted, err = tx.DeleteOffers(ctx)
+					return err
+				})
+				if err != nil {
+					return nil, err
+				}
+				list, _, err := db.ListOffers(ctx, ListOptions{})
+				return []interface{}{deleted, offerIDs(list)}, err
+			},
+			want: []interface{}{int64(2), []string{"lamp"}},
+		},
+		{
+			name: "WithTx rolls back",
+			run: func(db OfferDatabase) (interface{}, error) {
+				failed := errors.New("page failed")
+				err := db.WithTx(ctx, func(tx SyncWriter) error {
+					if err := tx.UpdateUpdated(ctx); err != nil {
+						return err
+					}
+					if _, err := tx.DeleteOffers(ctx); err != nil {
+						return err
+					}
+					return failed
+				})
+				if err != failed {
+					return nil, err
+				}
+				return db.CountOffers(ctx)
+			},
+			want: 3,
+		},
+		{
+			name: "ListByCategory",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.ListByCategory(ctx, "Furniture", 10, 1)
+				return offerIDs(list), err
+			},
+			want: []string{"table"},
+		},
+		{
+			name: "ListByCategory uncategorized",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.ListByCategory(ctx, Uncategorized, 10, 0)
+				return offerIDs(list), err
+			},
+			want: []string{"lamp"},
+		},
+		{
+			name: "ListOffersByMerchant",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.ListOffersByMerchant(ctx, 1, 1, 0)
+				return offerIDs(list), err
+			},
+			want: []string{"chair"},
+		},
+		{
+			name: "GetVariants",
+			run: func(db OfferDatabase) (interface{}, error) {
+				list, err := db.GetVariants(ctx, "garden")
+				return offerIDs(list), err
+			},
+			want: []string{"chair", "table"},
+		},
+		{
+			name: "CatalogVersion",
+			run: func(db OfferDatabase) (interface{}, error) {
+				before, err := db.CatalogVersion(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if err := db.DeleteOffer(ctx, "lamp"); err != nil {
+					return nil, err
+				}
+				after, err := db.CatalogVersion(ctx)
+				return before != after, err
+			},
+			want: true,
+		},
+		{
+			name: "Check",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return nil, db.Check(ctx)
+			},
+		},
+		{
+			name: "Close",
+			run: func(db OfferDatabase) (interface{}, error) {
+				return nil, db.Close()
+			},
+		},
+	} {
+		got, err := tt.run(newSeededMemoryDB(t))
+		if tt.wantErr != nil {
+			if err != tt.wantErr {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
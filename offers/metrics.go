@@ -0,0 +1,445 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "offers_db_operation_duration_seconds",
+		Help: "Duration of offer database calls, by method.",
+	}, []string{"method"})
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "offers_db_operation_errors_total",
+		Help: "Number of offer database calls that returned an error, by method.",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(dbDuration, dbErrors)
+}
+
+// tracer creates the spans of database calls with the global tracer
+// provider, so they are only exported once the app sets one up.
+var tracer = otel.Tracer("offers")
+
+// observe starts a span for a call to the named method, as a child of the
+// span in ctx, and starts timing the call. The returned function ends the
+// span and records the call's duration, marking it as failed if *err is not
+// nil. Pass the returned context on to the call, and defer the function:
+//
+//	ctx, end := observe(ctx, "GetOffer", attribute.String("offer.id", id))
+//	defer end(&err)
+func observe(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, func(*error)) {
+	attrs = append(attrs, attribute.String("db.operation", method))
+	ctx, span := tracer.Start(ctx, "OfferDatabase."+method, trace.WithAttributes(attrs...))
+	start := time.Now()
+	return ctx, func(err *error) {
+		dbDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if *err != nil {
+			dbErrors.WithLabelValues(method).Inc()
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+	}
+}
+
+// instrumentedDB records Prometheus metrics and OpenTelemetry spans of the
+// calls to an OfferDatabase.
+type instrumentedDB struct {
+	inner OfferDatabase
+}
+
+var _ OfferDatabase = &instrumentedDB{}
+
+// NewInstrumentedDB returns an OfferDatabase recording the duration and
+// errors of every call to inner, labeled by method, and tracing every call
+// in a span named after the method, with the offer ID as an attribute if
+// there is one. Like NewCachedDB, it
+// hides the interfaces inner implements besides OfferDatabase, such as
+// Keepaliver. The duration of ForEachOffer and ForEachSearchResult includes
+// the time spent in fn.
+func NewInstrumentedDB(inner OfferDatabase) OfferDatabase {
+	return &instrumentedDB{inner: inner}
+}
+
+// WithTx isn't timed itself, since a transaction lasts as long as a sync,
+// but the writes made through it are.
+func (db *instrumentedDB) WithTx(ctx context.Context, fn func(SyncWriter) error) error {
+	return db.inner.WithTx(ctx, func(tx SyncWriter) error {
+		return fn(instrumentedTx{tx})
+	})
+}
+
+// instrumentedTx records the metrics and spans of the writes made through a
+// SyncWriter, under the same methods as those of the database.
+type instrumentedTx struct {
+	inner SyncWriter
+}
+
+func (tx instrumentedTx) UpdateUpdated(ctx context.Context) (err error) {
+	ctx, end := observe(ctx, "UpdateUpdated")
+	defer end(&err)
+	return tx.inner.UpdateUpdated(ctx)
+}
+
+func (tx instrumentedTx) BulkUpsertOffers(ctx context.Context, offers []*Offer) (_ int, err error) {
+	ctx, end := observe(ctx, "BulkUpsertOffers", attribute.Int("offer.count", len(offers)))
+	defer end(&err)
+	return tx.inner.BulkUpsertOffers(ctx, offers)
+}
+
+func (tx instrumentedTx) KeepMerchantOffers(ctx context.Context, merchantID int64) (err error) {
+	ctx, end := observe(ctx, "KeepMerchantOffers", attribute.Int64("merchant.id", merchantID))
+	defer end(&err)
+	return tx.inner.KeepMerchantOffers(ctx, merchantID)
+}
+
+func (tx instrumentedTx) DeleteOffers(ctx context.Context) (_ int64, err error) {
+	ctx, end := observe(ctx, "DeleteOffers")
+	defer end(&err)
+	return tx.inner.DeleteOffers(ctx)
+}
+
+// Close closes inner.
+func (db *instrumentedDB) Close() error {
+	return db.inner.Close()
+}
+
+// The remaining methods record the call and delegate to inner.
+
+func (db *instrumentedDB) ListOffers(ctx context.Context, opts ListOptions) (_ []*Offer, _ int, err error) {
+	ctx, end := observe(ctx, "ListOffers")
+	defer end(&err)
+	return db.inner.ListOffers(ctx, opts)
+}
+
+func (db *instrumentedDB) ListPurchasableOffers(ctx context.Context, opts ListOptions) (_ []*Offer, _ int, err error) {
+	ctx, end := observe(ctx, "ListPurchasableOffers")
+	defer end(&err)
+	return db.inner.ListPurchasableOffers(ctx, opts)
+}
+
+func (db *instrumentedDB) GetOffer(ctx context.Context, id string) (_ *Offer, err error) {
+	ctx, end := observe(ctx, "GetOffer", attribute.String("offer.id", id))
+	defer end(&err)
+	return db.inner.GetOffer(ctx, id)
+}
+
+func (db *instrumentedDB) GetOffersByIDs(ctx context.Context, ids []string) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "GetOffersByIDs")
+	defer end(&err)
+	return db.inner.GetOffersByIDs(ctx, ids)
+}
+
+func (db *instrumentedDB) OfferExists(ctx context.Context, id string) (_ bool, err error) {
+	ctx, end := observe(ctx, "OfferExists", attribute.String("offer.id", id))
+	defer end(&err)
+	return db.inner.OfferExists(ctx, id)
+}
+
+func (db *instrumentedDB) SearchOffers(ctx context.Context, q string, order SortOrder, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "SearchOffers")
+	defer end(&err)
+	return db.inner.SearchOffers(ctx, q, order, limit)
+}
+
+func (db *instrumentedDB) SearchOffersByPriceRange(ctx context.Context, q string, min, max float64, currency string) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "SearchOffersByPriceRange")
+	defer end(&err)
+	return db.inner.SearchOffersByPriceRange(ctx, q, min, max, currency)
+}
+
+func (db *instrumentedDB) FilterOffers(ctx context.Context, f *Filter, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "FilterOffers")
+	defer end(&err)
+	return db.inner.FilterOffers(ctx, f, limit)
+}
+
+func (db *instrumentedDB) CountOffers(ctx context.Context) (_ int, err error) {
+	ctx, end := observe(ctx, "CountOffers")
+	defer end(&err)
+	return db.inner.CountOffers(ctx)
+}
+
+func (db *instrumentedDB) CountSearchOffers(ctx context.Context, q string) (_ int, err error) {
+	ctx, end := observe(ctx, "CountSearchOffers")
+	defer end(&err)
+	return db.inner.CountSearchOffers(ctx, q)
+}
+
+func (db *instrumentedDB) ListBrandsWithCounts(ctx context.Context) (_ []BrandCount, err error) {
+	ctx, end := observe(ctx, "ListBrandsWithCounts")
+	defer end(&err)
+	return db.inner.ListBrandsWithCounts(ctx)
+}
+
+func (db *instrumentedDB) FilteredSearch(ctx context.Context, q string, applied FilterOptions, offset, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "FilteredSearch")
+	defer end(&err)
+	return db.inner.FilteredSearch(ctx, q, applied, offset, limit)
+}
+
+func (db *instrumentedDB) SearchFacets(ctx context.Context, q string, applied FilterOptions) (_ Facets, err error) {
+	ctx, end := observe(ctx, "SearchFacets")
+	defer end(&err)
+	return db.inner.SearchFacets(ctx, q, applied)
+}
+
+func (db *instrumentedDB) CatalogVersion(ctx context.Context) (_ string, err error) {
+	ctx, end := observe(ctx, "CatalogVersion")
+	defer end(&err)
+	return db.inner.CatalogVersion(ctx)
+}
+
+func (db *instrumentedDB) ChangeToken(ctx context.Context) (_ string, err error) {
+	ctx, end := observe(ctx, "ChangeToken")
+	defer end(&err)
+	return db.inner.ChangeToken(ctx)
+}
+
+func (db *instrumentedDB) ForEachOffer(ctx context.Context, fn func(*Offer) error) (err error) {
+	ctx, end := observe(ctx, "ForEachOffer")
+	defer end(&err)
+	return db.inner.ForEachOffer(ctx, fn)
+}
+
+func (db *instrumentedDB) ForEachSearchResult(ctx context.Context, q string, fn func(*Offer) error) (err error) {
+	ctx, end := observe(ctx, "ForEachSearchResult")
+	defer end(&err)
+	return db.inner.ForEachSearchResult(ctx, q, fn)
+}
+
+func (db *instrumentedDB) AddOffer(ctx context.Context, o *Offer) (_ int64, err error) {
+	ctx, end := observe(ctx, "AddOffer")
+	defer end(&err)
+	return db.inner.AddOffer(ctx, o)
+}
+
+func (db *instrumentedDB) UpdateOffer(ctx context.Context, o *Offer) (err error) {
+	ctx, end := observe(ctx, "UpdateOffer")
+	defer end(&err)
+	return db.inner.UpdateOffer(ctx, o)
+}
+
+func (db *instrumentedDB) GetOfferBySlug(ctx context.Context, slug string) (_ *Offer, err error) {
+	ctx, end := observe(ctx, "GetOfferBySlug")
+	defer end(&err)
+	return db.inner.GetOfferBySlug(ctx, slug)
+}
+
+func (db *instrumentedDB) UpdateOfferFields(ctx context.Context, id string, fields map[string]interface{}) (err error) {
+	ctx, end := observe(ctx, "UpdateOfferFields")
+	defer end(&err)
+	return db.inner.UpdateOfferFields(ctx, id, fields)
+}
+
+func (db *instrumentedDB) UpsertOffer(ctx context.Context, o *Offer) (_ int64, _ bool, err error) {
+	ctx, end := observe(ctx, "UpsertOffer")
+	defer end(&err)
+	return db.inner.UpsertOffer(ctx, o)
+}
+
+func (db *instrumentedDB) BulkUpsertOffers(ctx context.Context, offers []*Offer) (_ int, err error) {
+	ctx, end := observe(ctx, "BulkUpsertOffers")
+	defer end(&err)
+	return db.inner.BulkUpsertOffers(ctx, offers)
+}
+
+func (db *instrumentedDB) DeleteOffer(ctx context.Context, id string) (err error) {
+	ctx, end := observe(ctx, "DeleteOffer", attribute.String("offer.id", id))
+	defer end(&err)
+	return db.inner.DeleteOffer(ctx, id)
+}
+
+func (db *instrumentedDB) PurgeDeleted(ctx context.Context, olderThan time.Time) (_ int64, err error) {
+	ctx, end := observe(ctx, "PurgeDeleted")
+	defer end(&err)
+	return db.inner.PurgeDeleted(ctx, olderThan)
+}
+
+func (db *instrumentedDB) RecordView(ctx context.Context, id string) (err error) {
+	ctx, end := observe(ctx, "RecordView", attribute.String("offer.id", id))
+	defer end(&err)
+	return db.inner.RecordView(ctx, id)
+}
+
+func (db *instrumentedDB) TrendingOffers(ctx context.Context, window time.Duration, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "TrendingOffers")
+	defer end(&err)
+	return db.inner.TrendingOffers(ctx, window, limit)
+}
+
+func (db *instrumentedDB) ListNewOffers(ctx context.Context, since time.Time, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "ListNewOffers")
+	defer end(&err)
+	return db.inner.ListNewOffers(ctx, since, limit)
+}
+
+func (db *instrumentedDB) ListOffersByMerchant(ctx context.Context, merchantID int64, limit, offset int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "ListOffersByMerchant", attribute.Int64("offer.merchant_id", merchantID))
+	defer end(&err)
+	return db.inner.ListOffersByMerchant(ctx, merchantID, limit, offset)
+}
+
+func (db *instrumentedDB) ListByCategory(ctx context.Context, category string, limit, offset int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "ListByCategory", attribute.String("offer.category", category))
+	defer end(&err)
+	return db.inner.ListByCategory(ctx, category, limit, offset)
+}
+
+func (db *instrumentedDB) RelatedOffers(ctx context.Context, id string, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "RelatedOffers", attribute.String("offer.id", id))
+	defer end(&err)
+	return db.inner.RelatedOffers(ctx, id, limit)
+}
+
+func (db *instrumentedDB) GetVariants(ctx context.Context, itemGroupID string) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "GetVariants")
+	defer end(&err)
+	return db.inner.GetVariants(ctx, itemGroupID)
+}
+
+func (db *instrumentedDB) ReserveOffer(ctx context.Context, offerID string, qty int, ttl time.Duration) (reservationID string, err error) {
+	ctx, end := observe(ctx, "ReserveOffer", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.ReserveOffer(ctx, offerID, qty, ttl)
+}
+
+func (db *instrumentedDB) ReleaseReservation(ctx context.Context, id string) (err error) {
+	ctx, end := observe(ctx, "ReleaseReservation")
+	defer end(&err)
+	return db.inner.ReleaseReservation(ctx, id)
+}
+
+func (db *instrumentedDB) PruneReservations(ctx context.Context) (_ int64, err error) {
+	ctx, end := observe(ctx, "PruneReservations")
+	defer end(&err)
+	return db.inner.PruneReservations(ctx)
+}
+
+func (db *instrumentedDB) SetFeatured(ctx context.Context, ids []string) (err error) {
+	ctx, end := observe(ctx, "SetFeatured")
+	defer end(&err)
+	return db.inner.SetFeatured(ctx, ids)
+}
+
+func (db *instrumentedDB) GetFeaturedOffers(ctx context.Context) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "GetFeaturedOffers")
+	defer end(&err)
+	return db.inner.GetFeaturedOffers(ctx)
+}
+
+func (db *instrumentedDB) AddReport(ctx context.Context, offerID, reason string) (err error) {
+	ctx, end := observe(ctx, "AddReport", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.AddReport(ctx, offerID, reason)
+}
+
+func (db *instrumentedDB) ListReports(ctx context.Context, limit int) (_ []*OfferReport, err error) {
+	ctx, end := observe(ctx, "ListReports")
+	defer end(&err)
+	return db.inner.ListReports(ctx, limit)
+}
+
+func (db *instrumentedDB) AddReview(ctx context.Context, offerID string, rating int, text string) (err error) {
+	ctx, end := observe(ctx, "AddReview", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.AddReview(ctx, offerID, rating, text)
+}
+
+func (db *instrumentedDB) GetReviews(ctx context.Context, offerID string) (_ []*Review, err error) {
+	ctx, end := observe(ctx, "GetReviews", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.GetReviews(ctx, offerID)
+}
+
+func (db *instrumentedDB) AverageRating(ctx context.Context, offerID string) (_ Rating, err error) {
+	ctx, end := observe(ctx, "AverageRating", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.AverageRating(ctx, offerID)
+}
+
+func (db *instrumentedDB) AverageRatings(ctx context.Context, offerIDs []string) (_ map[string]Rating, err error) {
+	ctx, end := observe(ctx, "AverageRatings")
+	defer end(&err)
+	return db.inner.AverageRatings(ctx, offerIDs)
+}
+
+func (db *instrumentedDB) AddPriceAlert(ctx context.Context, offerID, targetPrice, contact string) (_ int64, err error) {
+	ctx, end := observe(ctx, "AddPriceAlert", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.AddPriceAlert(ctx, offerID, targetPrice, contact)
+}
+
+func (db *instrumentedDB) ListPriceAlerts(ctx context.Context, limit int) (_ []*PriceAlert, err error) {
+	ctx, end := observe(ctx, "ListPriceAlerts")
+	defer end(&err)
+	return db.inner.ListPriceAlerts(ctx, limit)
+}
+
+func (db *instrumentedDB) DeletePriceAlert(ctx context.Context, id int64) (err error) {
+	ctx, end := observe(ctx, "DeletePriceAlert")
+	defer end(&err)
+	return db.inner.DeletePriceAlert(ctx, id)
+}
+
+func (db *instrumentedDB) TriggeredPriceAlerts(ctx context.Context) (_ []*PriceAlert, err error) {
+	ctx, end := observe(ctx, "TriggeredPriceAlerts")
+	defer end(&err)
+	return db.inner.TriggeredPriceAlerts(ctx)
+}
+
+func (db *instrumentedDB) SetPriceAlertFired(ctx context.Context, id int64, fired bool) (_ bool, err error) {
+	ctx, end := observe(ctx, "SetPriceAlertFired")
+	defer end(&err)
+	return db.inner.SetPriceAlertFired(ctx, id, fired)
+}
+
+func (db *instrumentedDB) RecomputeConvertedPrices(ctx context.Context, converter CurrencyConverter, displayCurrency string) (_ int64, err error) {
+	ctx, end := observe(ctx, "RecomputeConvertedPrices")
+	defer end(&err)
+	return db.inner.RecomputeConvertedPrices(ctx, converter, displayCurrency)
+}
+
+func (db *instrumentedDB) ListDuplicateOffers(ctx context.Context, limit int) (_ []*Offer, err error) {
+	ctx, end := observe(ctx, "ListDuplicateOffers")
+	defer end(&err)
+	return db.inner.ListDuplicateOffers(ctx, limit)
+}
+
+func (db *instrumentedDB) SetCanonicalProducts(ctx context.Context, links map[string]string) (err error) {
+	ctx, end := observe(ctx, "SetCanonicalProducts")
+	defer end(&err)
+	return db.inner.SetCanonicalProducts(ctx, links)
+}
+
+func (db *instrumentedDB) SetMetaOverrides(ctx context.Context, offerID, title, description string) (err error) {
+	ctx, end := observe(ctx, "SetMetaOverrides", attribute.String("offer.id", offerID))
+	defer end(&err)
+	return db.inner.SetMetaOverrides(ctx, offerID, title, description)
+}
+
+func (db *instrumentedDB) PruneViews(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, end := observe(ctx, "PruneViews")
+	defer end(&err)
+	return db.inner.PruneViews(ctx, before)
+}
+
+func (db *instrumentedDB) Check(ctx context.Context) (err error) {
+	ctx, end := observe(ctx, "Check")
+	defer end(&err)
+	return db.inner.Check(ctx)
+}
@@ -4,42 +4,684 @@
 
 package offers
 
-// Offer holds metadata about an offer.
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Offer holds metadata about an offer. Its JSON field names match those of
+// the JSON API.
 type Offer struct {
-	ID          string
-	Title       string
-	Price       string
-	Currency    string
-	ImageURL    string
-	Description string
-	MerchantURL string
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Price       string `json:"price"`
+	Currency    string `json:"currency"`
+	ImageURL    string `json:"image_url"`
+	Description string `json:"description"`
+	MerchantURL string `json:"merchant_url"`
+
+	// ItemGroupID is shared by offers that are variants, such as different
+	// sizes or colors, of the same product. It is empty for offers without
+	// variants.
+	ItemGroupID string `json:"item_group_id"`
+
+	// GTIN is the product's Global Trade Item Number, if it has one.
+	GTIN string `json:"gtin"`
+
+	// Brand is the product's brand, if known.
+	Brand string `json:"brand"`
+
+	// MerchantID is the Merchant Center account the offer was synced from,
+	// such as a sub-account of an MCA. It is 0 for offers added otherwise.
+	MerchantID int64 `json:"merchant_id"`
+
+	// Category is the product's Google product category, or else its first
+	// product type. It is empty for uncategorized offers.
+	Category string `json:"category"`
+
+	// Availability is the product's availability in Merchant Center, such
+	// as "in stock" or "out of stock", and Condition is "new", "used" or
+	// "refurbished". Either is empty if unknown.
+	Availability string `json:"availability"`
+	Condition    string `json:"condition"`
+
+	// SalePrice is the discounted price in Currency while the product is on
+	// sale, or empty if it isn't.
+	SalePrice string `json:"sale_price"`
+
+	// Slug names the offer in the URL of its page. It is derived from the
+	// title and made unique by the database when the offer is first stored,
+	// and kept when the title changes, so links keep working.
+	Slug string `json:"slug"`
+
+	// Version is incremented each time the offer's synced fields are
+	// written. UpdateOffer only writes an offer whose Version is the stored
+	// one, so stale copies can't overwrite newer changes.
+	Version int `json:"version"`
+
+	// Quantity is the number of items in stock, or 0 if it isn't known.
+	// Reservations are subtracted from it when reserving, not here. Offers
+	// whose quantity isn't known can't be reserved.
+	Quantity int64 `json:"quantity"`
+
+	// CanonicalProductID is shared by offers found by DetectDuplicates to be
+	// the same product, possibly from different merchants. It is empty for
+	// offers with no duplicates.
+	CanonicalProductID string `json:"canonical_product_id"`
+
+	// CustomMetaTitle and CustomMetaDescription override the generated
+	// MetaTitle and MetaDescription if they are set.
+	CustomMetaTitle       string `json:"custom_meta_title"`
+	CustomMetaDescription string `json:"custom_meta_description"`
+
+	// ConvertedPrice is Price converted to ConvertedCurrency by the last call
+	// to RecomputeConvertedPrices. It is empty if the price couldn't be
+	// converted.
+	ConvertedPrice    string `json:"converted_price"`
+	ConvertedCurrency string `json:"converted_currency"`
+
+	// CreatedAt is when the offer was first stored, and UpdatedAt when its
+	// synced fields last changed. Both are set by the database.
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// DeletedAt is when the offer was soft-deleted, or nil if it wasn't.
+	// Deleted offers are only returned by lists with IncludeDeleted set.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// Rating summarizes the offer's reviews. It isn't stored with the offer;
+	// callers that show it set it from AverageRatings.
+	Rating Rating `json:"rating"`
+}
+
+// contentHash returns a digest of the fields that are synced from Merchant
+// Center, used to detect whether an offer has changed.
+func (o *Offer) contentHash() string {
+	h := sha256.Sum256([]byte(strings.Join([]string{
+		o.Title, o.Price, o.Currency, o.ImageURL, o.Description, o.MerchantURL,
+		o.ItemGroupID, o.GTIN, strconv.FormatInt(o.Quantity, 10), o.Brand,
+		o.Category, o.Availability, o.Condition, o.SalePrice,
+		strconv.FormatInt(o.MerchantID, 10),
+	}, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+// priceRegexp matches the prices the price column can hold: decimal numbers
+// with up to 13 digits before the point and 2 after.
+var priceRegexp = regexp.MustCompile(`^[0-9]{1,13}(\.[0-9]{1,2})?$`)
+
+// validatePrice checks that the offer's price and sale price are empty or
+// non-negative decimal numbers such as "19.99".
+func (o *Offer) validatePrice() error {
+	if o.Price != "" && !priceRegexp.MatchString(o.Price) {
+		return fmt.Errorf("offers: invalid price %q for offer %s: must be a decimal number with at most 2 decimal places", o.Price, o.ID)
+	}
+	if o.SalePrice != "" && !priceRegexp.MatchString(o.SalePrice) {
+		return fmt.Errorf("offers: invalid sale price %q for offer %s: must be a decimal number with at most 2 decimal places", o.SalePrice, o.ID)
+	}
+	return nil
+}
+
+// currencyRegexp matches ISO 4217 currency codes, such as "USD".
+var currencyRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Validate checks that the offer can be shown on the storefront: it must
+// have an ID and a title, absolute image and merchant URLs, a non-negative
+// decimal price and a 3-letter ISO 4217 currency code. Synced offers are
+// only checked with validatePrice, since products may lack a link or image.
+func (o *Offer) Validate() error {
+	if o.ID == "" {
+		return errors.New("offers: offer has no ID")
+	}
+	if strings.TrimSpace(o.Title) == "" {
+		return fmt.Errorf("offers: offer %s has no title", o.ID)
+	}
+	if err := o.validateURL("image URL", o.ImageURL); err != nil {
+		return err
+	}
+	if err := o.validateURL("merchant URL", o.MerchantURL); err != nil {
+		return err
+	}
+	if o.Price == "" {
+		return fmt.Errorf("offers: offer %s has no price", o.ID)
+	}
+	if err := o.validatePrice(); err != nil {
+		return err
+	}
+	if !currencyRegexp.MatchString(o.Currency) {
+		return fmt.Errorf("offers: invalid currency %q for offer %s: must be a 3-letter ISO 4217 code such as USD", o.Currency, o.ID)
+	}
+	return nil
+}
+
+// validateURL checks that the offer's field, named name, is an absolute URL.
+func (o *Offer) validateURL(name, field string) error {
+	u, err := url.Parse(field)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("offers: invalid %s %q for offer %s: must be an absolute URL", name, field, o.ID)
+	}
+	return nil
+}
+
+// Purchasable reports whether the offer has a valid link to buy it from the
+// merchant.
+func (o *Offer) Purchasable() bool {
+	u, err := url.Parse(o.MerchantURL)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// availabilityOutOfStock is the Availability of products Merchant Center
+// lists as out of stock.
+const availabilityOutOfStock = "out of stock"
+
+// OutOfStock reports whether the offer is listed as out of stock.
+func (o *Offer) OutOfStock() bool {
+	return o.Availability == availabilityOutOfStock
+}
+
+// OfferReport is a problem with an offer reported by a shopper.
+type OfferReport struct {
+	ID        int64
+	OfferID   string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// Ratings range from MinRating to MaxRating stars.
+const (
+	MinRating = 1
+	MaxRating = 5
+)
+
+// ErrInvalidRating is returned by AddReview if the rating is out of range.
+var ErrInvalidRating = errors.New("offers: rating must be from 1 to 5")
+
+// Review is a shopper's rating of an offer, with an optional text.
+type Review struct {
+	ID        int64
+	OfferID   string
+	Rating    int
+	Text      string
+	CreatedAt time.Time
+}
+
+// Rating is the average rating of an offer's reviews.
+type Rating struct {
+	Average float64 `json:"average"`
+	// Count is the number of reviews; the offer is unrated if it is 0.
+	Count int `json:"count"`
+}
+
+// ErrOfferNotFound is returned by the methods that look up an offer by ID,
+// such as GetOffer, UpdateOffer and ReserveOffer, if there is no offer with
+// the ID.
+var ErrOfferNotFound = errors.New("offers: offer not found")
+
+// ErrDuplicateOffer is returned by AddOffer if an offer with the same ID is
+// already stored.
+var ErrDuplicateOffer = errors.New("offers: duplicate offer ID")
+
+// ErrConcurrentModification is returned by UpdateOffer, and UpdateOfferFields
+// given a version, if the offer's stored Version is not the expected one.
+var ErrConcurrentModification = errors.New("offers: offer was modified concurrently")
+
+// orderByIDs returns the offers in the order of ids, skipping IDs that are
+// not among offers.
+func orderByIDs(offers []*Offer, ids []string) []*Offer {
+	byID := make(map[string]*Offer, len(offers))
+	for _, o := range offers {
+		byID[o.ID] = o
+	}
+	ordered := make([]*Offer, 0, len(ids))
+	for _, id := range ids {
+		if o, ok := byID[id]; ok {
+			ordered = append(ordered, o)
+		}
+	}
+	return ordered
+}
+
+// uniqueIDs returns ids without repeats, keeping the first of each.
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// matchesSearch reports whether the offer matches the search query q, like
+// SearchOffers: its description or title contains q, ignoring case.
+func matchesSearch(o *Offer, q string) bool {
+	q = strings.ToLower(q)
+	return strings.Contains(strings.ToLower(o.Description), q) || strings.Contains(strings.ToLower(o.Title), q)
+}
+
+// searchRank ranks how well the offer matches q for SortByRelevance, like
+// the MySQL ORDER BY clause: 0 if its title starts with q, 1 if its title
+// contains q and 2 otherwise, ignoring case.
+func searchRank(o *Offer, q string) int {
+	title, q := strings.ToLower(o.Title), strings.ToLower(q)
+	switch {
+	case strings.HasPrefix(title, q):
+		return 0
+	case strings.Contains(title, q):
+		return 1
+	}
+	return 2
+}
+
+// BrandCount is the number of offers of a brand.
+type BrandCount struct {
+	Brand string
+	Count int
+}
+
+// ErrInsufficientQuantity is returned by ReserveOffer if not enough of the
+// offer is available.
+var ErrInsufficientQuantity = errors.New("offers: insufficient quantity")
+
+// ErrQuantityUnknown is returned by ReserveOffer if the offer's Quantity is
+// 0, meaning Merchant Center doesn't say how many are in stock. Such offers
+// can't be reserved, since over-reservations couldn't be detected.
+var ErrQuantityUnknown = errors.New("offers: quantity unknown")
+
+// DefaultPageSize is the number of offers listed if ListOptions.Limit isn't
+// set.
+const DefaultPageSize = 50
+
+// SortOrder is the order offers are listed in.
+type SortOrder string
+
+// The orders offers can be listed in. Ties are broken by insertion order.
+const (
+	// SortByTitle lists offers alphabetically by title. It is the default.
+	SortByTitle SortOrder = "title"
+	// SortByPrice lists the cheapest offers first.
+	SortByPrice SortOrder = "price"
+	// SortByInsertion lists offers in the order they were first stored.
+	SortByInsertion SortOrder = "added"
+	// SortByRelevance lists search results whose title starts with the
+	// query first, then those whose title contains it, each by title. It
+	// only applies to SearchOffers, where it is the default.
+	SortByRelevance SortOrder = "relevance"
+)
+
+// SortOrders lists the valid sort orders of lists.
+var SortOrders = []SortOrder{SortByTitle, SortByPrice, SortByInsertion}
+
+// SearchOrders lists the valid sort orders of search results.
+var SearchOrders = []SortOrder{SortByRelevance, SortByTitle, SortByPrice}
+
+// searchOrder returns the search order to apply for order, defaulting to
+// SortByRelevance, and reports whether it is one of SearchOrders.
+func searchOrder(order SortOrder) (SortOrder, bool) {
+	if order == "" {
+		return SortByRelevance, true
+	}
+	for _, o := range SearchOrders {
+		if o == order {
+			return order, true
+		}
+	}
+	return order, false
+}
+
+// DefaultSearchLimit is the number of offers SearchOffers returns for a zero
+// limit, and MaxSearchLimit the most it returns for any limit. Searches
+// default to a page of offers, so lists and searches change size together.
+const (
+	DefaultSearchLimit = DefaultPageSize
+	MaxSearchLimit     = 500
+)
+
+// searchLimit returns the number of results to return for limit, applying
+// the default and the cap.
+func searchLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return DefaultSearchLimit
+	case limit > MaxSearchLimit:
+		return MaxSearchLimit
+	}
+	return limit
+}
+
+// ListOptions selects a page of a list of offers.
+type ListOptions struct {
+	// Limit is the maximum number of offers returned. It defaults to
+	// DefaultPageSize.
+	Limit int
+
+	// Offset is the number of offers skipped.
+	Offset int
+
+	// Sort is the order of the list. It defaults to SortByTitle.
+	Sort SortOrder
+
+	// IncludeDeleted lists soft-deleted offers too, until they are purged.
+	IncludeDeleted bool
+
+	// InStock skips offers that are OutOfStock. Offers whose availability
+	// isn't known are listed.
+	InStock bool
+}
+
+// limit returns the page size, applying the default.
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return o.Limit
+}
+
+// sort returns the sort order, applying the default.
+func (o ListOptions) sort() SortOrder {
+	if o.Sort == "" {
+		return SortByTitle
+	}
+	return o.Sort
+}
+
+// Uncategorized is the category ListByCategory lists offers without a
+// category under.
+const Uncategorized = "uncategorized"
+
+// storedCategory returns the value of Offer.Category for offers listed under
+// category.
+func storedCategory(category string) string {
+	if category == Uncategorized {
+		return ""
+	}
+	return category
+}
+
+// SyncWriter is the part of an OfferDatabase a sync writes offers through.
+// It keeps track of the offers the sync has seen itself, so offers that
+// haven't changed aren't written at all, not even to mark them as fresh.
+type SyncWriter interface {
+	// UpdateUpdated marks every offer as stale, at the start of a sync. It
+	// writes nothing; the writer forgets the offers it has seen.
+	UpdateUpdated(ctx context.Context) error
+
+	// BulkUpsertOffers upserts the offers like OfferDatabase's, and marks
+	// them as seen.
+	BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error)
+
+	// KeepMerchantOffers marks the offers synced from the merchant account
+	// as seen, so DeleteOffers keeps them. A sync calls it for the
+	// sub-accounts it skips.
+	KeepMerchantOffers(ctx context.Context, merchantID int64) error
+
+	// DeleteOffers soft-deletes the offers still stale since UpdateUpdated,
+	// at the end of a complete sync, and returns how many it deleted.
+	DeleteOffers(ctx context.Context) (int64, error)
 }
 
-// OfferDatabase provides thread-safe access to a database of offers.
+// OfferDatabase provides thread-safe access to a database of offers. Methods
+// stop waiting for the database, and return the context's error, once their
+// context is done.
 type OfferDatabase interface {
-	// ListOffers returns a list of offers.
-	ListOffers() ([]*Offer, error)
+	// ListOffers returns a page of offers, and the total number of offers.
+	// Pages past the last are empty. It returns an error if opts.Sort isn't
+	// one of SortOrders. Soft-deleted offers are skipped, unless
+	// opts.IncludeDeleted is set; every other method skips them.
+	ListOffers(ctx context.Context, opts ListOptions) ([]*Offer, int, error)
+
+	// ListPurchasableOffers is like ListOffers, but excludes offers that
+	// aren't Purchasable.
+	ListPurchasableOffers(ctx context.Context, opts ListOptions) ([]*Offer, int, error)
+
+	// GetOffer retrieves an offer by its ID. It returns ErrOfferNotFound if
+	// there is none.
+	GetOffer(ctx context.Context, id string) (*Offer, error)
+
+	// GetOffersByIDs retrieves the offers with the given IDs, in the same
+	// order. IDs without an offer are skipped.
+	GetOffersByIDs(ctx context.Context, ids []string) ([]*Offer, error)
+
+	// OfferExists reports whether an offer with the given ID exists.
+	OfferExists(ctx context.Context, id string) (bool, error)
+
+	// CountOffers returns the number of offers.
+	CountOffers(ctx context.Context) (int, error)
+
+	// CountSearchOffers returns the number of offers SearchOffers would
+	// find for q if its results weren't limited.
+	CountSearchOffers(ctx context.Context, q string) (int, error)
+
+	// SearchOffers retrieves up to limit offers by description or title, in
+	// the given order, which defaults to SortByRelevance. A limit of 0 or
+	// less returns up to DefaultSearchLimit offers, and larger limits than
+	// MaxSearchLimit are capped. If none match, it returns an empty slice and
+	// no error. It returns an error if order isn't empty or one of
+	// SearchOrders.
+	SearchOffers(ctx context.Context, q string, order SortOrder, limit int) ([]*Offer, error)
+
+	// SearchOffersByPriceRange is like SearchOffers, but only returns offers
+	// priced from min to max inclusive, cheapest first. An empty q matches
+	// every offer with a price. Pass math.Inf(1) as max to leave it
+	// unbounded. If currency is set, offers priced in other currencies are
+	// excluded; otherwise prices are compared regardless of currency.
+	SearchOffersByPriceRange(ctx context.Context, q string, min, max float64, currency string) ([]*Offer, error)
+
+	// FilterOffers returns up to limit offers matching the filter.
+	FilterOffers(ctx context.Context, f *Filter, limit int) ([]*Offer, error)
+
+	// ListBrandsWithCounts returns the brands with the most offers, and how
+	// many offers each has, most offers first.
+	ListBrandsWithCounts(ctx context.Context) ([]BrandCount, error)
+
+	// FilteredSearch returns up to limit offers, skipping offset, whose
+	// description or title contains q and that match the applied filters.
+	FilteredSearch(ctx context.Context, q string, applied FilterOptions, offset, limit int) ([]*Offer, error)
+
+	// SearchFacets counts the offers matching q for each facet value,
+	// constrained by the filters applied to the other facets.
+	SearchFacets(ctx context.Context, q string, applied FilterOptions) (Facets, error)
+
+	// CatalogVersion returns a string that changes whenever any offer is
+	// added, changed, deleted or reviewed, including changes to its slug
+	// and meta overrides.
+	CatalogVersion(ctx context.Context) (string, error)
+
+	// ChangeToken returns a cheap marker that changes whenever any offer row
+	// is written or deleted, including by writes made outside the app.
+	ChangeToken(ctx context.Context) (string, error)
+
+	// ForEachOffer calls fn for every offer, stopping at the first error fn
+	// returns. Offers are streamed rather than loaded into memory at once.
+	ForEachOffer(ctx context.Context, fn func(*Offer) error) error
+
+	// ForEachSearchResult is like ForEachOffer, but only calls fn for offers
+	// matching the search query q.
+	ForEachSearchResult(ctx context.Context, q string, fn func(*Offer) error) error
 
-	// GetOffer retrieves an offer by its ID.
-	GetOffer(id string) (*Offer, error)
+	// AddOffer add an offer to the db. It returns ErrDuplicateOffer if an
+	// offer with the same ID exists; a soft-deleted one is restored instead.
+	// It returns the ID of the new row, or 0 if the backend doesn't report
+	// one. Like UpdateOffer, it returns the error of o.Validate if the offer
+	// is invalid.
+	AddOffer(ctx context.Context, o *Offer) (int64, error)
 
-	// SearchOffers retrieves offers by description.
-	SearchOffers(q string) ([]*Offer, error)
+	// UpdateOffer updates the offer based on given information, if its
+	// Version is the stored one, and increments o.Version to the new one.
+	// It returns ErrOfferNotFound if the offer doesn't exist, and
+	// ErrConcurrentModification if it was written since o was read.
+	UpdateOffer(ctx context.Context, o *Offer) error
 
-	// AddOffer add an offer to the db.
-	AddOffer(o *Offer) (int64, error)
+	// GetOfferBySlug retrieves the offer with the given Slug, or returns
+	// ErrOfferNotFound if there is none.
+	GetOfferBySlug(ctx context.Context, slug string) (*Offer, error)
 
-	// UpdateOffer updates the offer based on given information.
-	UpdateOffer(o *Offer) error
+	// UpdateOfferFields sets only the given fields of the offer with the
+	// given ID, keyed by their names in the JSON API, such as "price" or
+	// "image_url". A "version" field isn't set, but makes the update fail
+	// with ErrConcurrentModification unless it is the stored Version. It
+	// returns ErrOfferNotFound if there is no such offer, an error for
+	// unknown fields or values of the wrong type, and the error of Validate
+	// if the updated offer is invalid.
+	UpdateOfferFields(ctx context.Context, id string, fields map[string]interface{}) error
 
-	// UpdateUpdated sets all "updated" fields to false.
-	UpdateUpdated() error
+	// UpsertOffer adds the offer, or updates it if one with the same ID
+	// already exists, restoring it if it was soft-deleted. It returns the ID
+	// of the stored row, and reports whether the offer was inserted or
+	// changed. It returns an error if the price isn't empty or a decimal
+	// number, but doesn't otherwise validate the offer, since synced products
+	// may lack a link or image.
+	UpsertOffer(ctx context.Context, o *Offer) (int64, bool, error)
 
-	// DeleteOffers deletes stale Offers.
-	DeleteOffers() error
+	// BulkUpsertOffers upserts all the offers like UpsertOffer, atomically,
+	// and returns how many rows were written, that is, inserted or changed.
+	// Unchanged offers aren't written. If any price is invalid, nothing is
+	// written.
+	BulkUpsertOffers(ctx context.Context, offers []*Offer) (int, error)
+
+	// WithTx calls fn with a SyncWriter whose writes are committed together
+	// if fn returns nil, and rolled back if it returns an error, so a failed
+	// sync leaves the offers as they were.
+	WithTx(ctx context.Context, fn func(SyncWriter) error) error
+
+	// DeleteOffer soft-deletes the offer with the given ID. It returns
+	// ErrOfferNotFound if there is none.
+	DeleteOffer(ctx context.Context, id string) error
+
+	// PurgeDeleted removes the offers soft-deleted before olderThan for good,
+	// and returns the number removed.
+	PurgeDeleted(ctx context.Context, olderThan time.Time) (int64, error)
+
+	// RecordView records that the offer with the given ID was viewed.
+	RecordView(ctx context.Context, id string) error
+
+	// TrendingOffers returns up to limit offers with the most views recorded
+	// within the given window, most viewed first.
+	TrendingOffers(ctx context.Context, window time.Duration, limit int) ([]*Offer, error)
+
+	// ListNewOffers returns up to limit offers first stored at or after
+	// since, newest first.
+	ListNewOffers(ctx context.Context, since time.Time, limit int) ([]*Offer, error)
+
+	// ListByCategory returns up to limit offers in the given category,
+	// skipping offset, by title. Offers without a category are listed under
+	// Uncategorized.
+	ListByCategory(ctx context.Context, category string, limit, offset int) ([]*Offer, error)
+
+	// ListOffersByMerchant returns up to limit offers synced from the given
+	// Merchant Center account, skipping offset, by title.
+	ListOffersByMerchant(ctx context.Context, merchantID int64, limit, offset int) ([]*Offer, error)
+
+	// RelatedOffers returns up to limit other offers sharing words of the
+	// title of the offer with the given ID, in their title or description,
+	// those sharing the most words first. It returns an empty slice if there
+	// are none, and ErrOfferNotFound if the offer doesn't exist.
+	RelatedOffers(ctx context.Context, id string, limit int) ([]*Offer, error)
+
+	// GetVariants returns all offers with the given item group ID.
+	GetVariants(ctx context.Context, itemGroupID string) ([]*Offer, error)
+
+	// ReserveOffer holds qty items of the offer for ttl, so they aren't
+	// available to other reservations. It returns ErrOfferNotFound if the
+	// offer doesn't exist, ErrQuantityUnknown if its quantity isn't known,
+	// and ErrInsufficientQuantity if fewer than qty items are available.
+	ReserveOffer(ctx context.Context, offerID string, qty int, ttl time.Duration) (reservationID string, err error)
+
+	// ReleaseReservation makes the items held by a reservation available
+	// again. Releasing an expired or unknown reservation is not an error.
+	ReleaseReservation(ctx context.Context, id string) error
+
+	// PruneReservations deletes expired reservations, returning the number
+	// deleted. Expired reservations don't hold items, so this only frees
+	// space.
+	PruneReservations(ctx context.Context) (int64, error)
+
+	// SetFeatured replaces the featured offers with the offers with the given
+	// IDs, in that order. An ID given more than once is featured at its first
+	// position.
+	SetFeatured(ctx context.Context, ids []string) error
+
+	// GetFeaturedOffers returns the featured offers in order. Featured offers
+	// that no longer exist are skipped.
+	GetFeaturedOffers(ctx context.Context) ([]*Offer, error)
+
+	// AddReport stores a report about the offer with the given ID.
+	AddReport(ctx context.Context, offerID, reason string) error
+
+	// ListReports returns up to limit reports, newest first.
+	ListReports(ctx context.Context, limit int) ([]*OfferReport, error)
+
+	// AddReview stores a review of the offer with the given ID. It returns
+	// ErrInvalidRating if the rating is out of range.
+	AddReview(ctx context.Context, offerID string, rating int, text string) error
+
+	// GetReviews returns the most recent reviews of an offer, newest first.
+	GetReviews(ctx context.Context, offerID string) ([]*Review, error)
+
+	// AverageRating returns the average rating of an offer's reviews.
+	AverageRating(ctx context.Context, offerID string) (Rating, error)
+
+	// AverageRatings returns the average ratings of the offers with the
+	// given IDs. Offers without reviews are omitted.
+	AverageRatings(ctx context.Context, offerIDs []string) (map[string]Rating, error)
+
+	// AddPriceAlert stores a pending alert for when the offer's price drops
+	// to or below targetPrice, and returns its ID.
+	AddPriceAlert(ctx context.Context, offerID, targetPrice, contact string) (int64, error)
+
+	// ListPriceAlerts returns up to limit alerts, newest first.
+	ListPriceAlerts(ctx context.Context, limit int) ([]*PriceAlert, error)
+
+	// DeletePriceAlert deletes the alert with the given ID.
+	DeletePriceAlert(ctx context.Context, id int64) error
+
+	// TriggeredPriceAlerts returns the pending alerts whose offer's price is
+	// at or below the target.
+	TriggeredPriceAlerts(ctx context.Context) ([]*PriceAlert, error)
+
+	// SetPriceAlertFired marks the alert as fired, or as pending if fired is
+	// false. It reports whether the alert changed, so concurrent callers can
+	// tell which of them fired it.
+	SetPriceAlertFired(ctx context.Context, id int64, fired bool) (bool, error)
+
+	// RecomputeConvertedPrices converts every offer's price to
+	// displayCurrency and stores the result as its converted price. It returns
+	// the number of offers whose converted price changed.
+	RecomputeConvertedPrices(ctx context.Context, converter CurrencyConverter, displayCurrency string) (int64, error)
+
+	// ListDuplicateOffers returns up to limit offers that have a canonical
+	// product ID, ordered by it.
+	ListDuplicateOffers(ctx context.Context, limit int) ([]*Offer, error)
+
+	// SetCanonicalProducts replaces all canonical product links with links,
+	// keyed by offer ID.
+	SetCanonicalProducts(ctx context.Context, links map[string]string) error
+
+	// SetMetaOverrides stores the offer's custom meta title and description.
+	// Empty values remove the override.
+	SetMetaOverrides(ctx context.Context, offerID, title, description string) error
+
+	// PruneViews deletes views recorded before the given time and returns the
+	// number of views deleted.
+	PruneViews(ctx context.Context, before time.Time) (int64, error)
+
+	// Check verifies that the database can serve queries, not just that it
+	// is reachable.
+	Check(ctx context.Context) error
 
 	// Close closes the database, freeing up any available resources.
-	// TODO(asheem): Close() should return an error.
-	Close()
+	Close() error
 }
-
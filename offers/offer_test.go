@@ -0,0 +1,2021 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forEachDB runs test against an empty in-memory database, and against an
+// emptied MySQL database if one is configured for tests.
+func forEachDB(t *testing.T, test func(t *testing.T, db OfferDatabase)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryDB())
+	})
+	t.Run("mysql", func(t *testing.T) {
+		test(t, newTestMySQLDB(t))
+	})
+}
+
+// testOffer returns a valid offer with the given ID, title and price.
+func testOffer(id, title, price string) *Offer {
+	return &Offer{
+		ID:          id,
+		Title:       title,
+		Price:       price,
+		Currency:    "USD",
+		ImageURL:    "https://example.com/images/" + id + ".png",
+		MerchantURL: "https://example.com/products/" + id,
+	}
+}
+
+// addOffers adds the offers to db, failing the test if any can't be added.
+func addOffers(t *testing.T, db OfferDatabase, offers ...*Offer) {
+	t.Helper()
+	for _, o := range offers {
+		if _, err := db.AddOffer(context.Background(), o); err != nil {
+			t.Fatalf("AddOffer(%s): %v", o.ID, err)
+		}
+	}
+}
+
+// offerIDs returns the IDs of the offers, in order.
+func offerIDs(offers []*Offer) []string {
+	ids := []string{}
+	for _, o := range offers {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+// checkIDs fails the test if the offers' IDs aren't want, in order.
+func checkIDs(t *testing.T, name string, offers []*Offer, want ...string) {
+	t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	if got := offerIDs(offers); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+// seedView records a view of the offer at the given time.
+func seedView(t *testing.T, db OfferDatabase, id string, at time.Time) {
+	t.Helper()
+	switch db := db.(type) {
+	case *memoryDB:
+		db.mu.Lock()
+		db.views = append(db.views, memoryView{offerID: id, viewedAt: at.UTC()})
+		db.mu.Unlock()
+	case *mysqlDB:
+		if _, err := db.conn.Exec(recordViewStatement, id, at.UTC()); err != nil {
+			t.Fatalf("recording view: %v", err)
+		}
+	default:
+		t.Fatalf("can't seed views in %T", db)
+	}
+}
+
+func TestTrendingOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db,
+			testOffer("old", "Old favourite", "10.00"),
+			testOffer("new", "New hit", "10.00"),
+			testOffer("quiet", "Quiet one", "10.00"),
+			testOffer("gone", "Gone", "10.00"))
+		now := time.Now()
+		week := 7 * 24 * time.Hour
+		// The old offer has the most views overall, but most are outside
+		// the window.
+		for i := 0; i < 5; i++ {
+			seedView(t, db, "old", now.Add(-2*week))
+		}
+		seedView(t, db, "old", now.Add(-time.Hour))
+		seedView(t, db, "new", now.Add(-time.Hour))
+		seedView(t, db, "new", now.Add(-24*time.Hour))
+		seedView(t, db, "new", now.Add(-week+time.Hour))
+		seedView(t, db, "quiet", now.Add(-week-time.Hour))
+		// Views of deleted offers are ignored.
+		seedView(t, db, "gone", now.Add(-time.Hour))
+		seedView(t, db, "gone", now.Add(-time.Hour))
+		seedView(t, db, "gone", now.Add(-time.Hour))
+		seedView(t, db, "gone", now.Add(-time.Hour))
+		if err := db.DeleteOffer(ctx, "gone"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			name   string
+			window time.Duration
+			limit  int
+			want   []string
+		}{
+			{"week", week, 10, []string{"new", "old"}},
+			{"limit", week, 1, []string{"new"}},
+			{"day", 2 * time.Hour, 10, []string{"new", "old"}},
+			{"month", 4 * week, 10, []string{"old", "new", "quiet"}},
+			{"none", time.Minute, 10, nil},
+		} {
+			list, err := db.TrendingOffers(ctx, tt.window, tt.limit)
+			if err != nil {
+				t.Fatalf("%s: TrendingOffers: %v", tt.name, err)
+			}
+			checkIDs(t, tt.name, list, tt.want...)
+		}
+	})
+}
+
+func TestPruneViews(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db,
+			testOffer("a", "A", "1.00"),
+			testOffer("b", "B", "1.00"))
+		now := time.Now()
+		seedView(t, db, "a", now.Add(-30*24*time.Hour))
+		seedView(t, db, "a", now.Add(-10*24*time.Hour))
+		seedView(t, db, "b", now.Add(-time.Hour))
+
+		n, err := db.PruneViews(ctx, now.Add(-7*24*time.Hour))
+		if err != nil {
+			t.Fatalf("PruneViews: %v", err)
+		}
+		if n != 2 {
+			t.Errorf("PruneViews deleted %d views, want 2", n)
+		}
+		// Only the remaining view counts, however long the window.
+		list, err := db.TrendingOffers(ctx, 365*24*time.Hour, 10)
+		if err != nil {
+			t.Fatalf("TrendingOffers: %v", err)
+		}
+		checkIDs(t, "TrendingOffers after pruning", list, "b")
+
+		if n, err := db.PruneViews(ctx, now.Add(-7*24*time.Hour)); err != nil || n != 0 {
+			t.Errorf("second PruneViews = %d, %v; want 0, nil", n, err)
+		}
+	})
+}
+
+// tick waits until the database's clock has moved on, so later writes get
+// later timestamps. MySQL stores them to the second.
+func tick(db OfferDatabase) {
+	if _, ok := db.(*mysqlDB); ok {
+		time.Sleep(1100 * time.Millisecond)
+		return
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestOfferTimestamps(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		start := time.Now().Truncate(time.Second)
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		added := getOffer(t, db, "a")
+		if added.CreatedAt.Before(start) || added.CreatedAt.After(time.Now()) {
+			t.Errorf("CreatedAt = %v, want the time of AddOffer, after %v", added.CreatedAt, start)
+		}
+		if !added.UpdatedAt.Equal(added.CreatedAt) {
+			t.Errorf("UpdatedAt of a new offer = %v, want CreatedAt %v", added.UpdatedAt, added.CreatedAt)
+		}
+
+		tick(db)
+		added.Title = "Teak chair"
+		if err := db.UpdateOffer(ctx, added); err != nil {
+			t.Fatalf("UpdateOffer: %v", err)
+		}
+		updated := getOffer(t, db, "a")
+		if !updated.CreatedAt.Equal(added.CreatedAt) {
+			t.Errorf("CreatedAt after an update = %v, want it unchanged at %v", updated.CreatedAt, added.CreatedAt)
+		}
+		if !updated.UpdatedAt.After(added.UpdatedAt) {
+			t.Errorf("UpdatedAt after an update = %v, want it after %v", updated.UpdatedAt, added.UpdatedAt)
+		}
+	})
+}
+
+func TestListNewOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("old", "Old", "10.00"))
+		since := getOffer(t, db, "old").CreatedAt.Add(time.Millisecond)
+		tick(db)
+		addOffers(t, db, testOffer("a", "A", "10.00"), testOffer("b", "B", "10.00"), testOffer("gone", "Gone", "10.00"))
+		if err := db.DeleteOffer(ctx, "gone"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			name  string
+			since time.Time
+			limit int
+			want  []string
+		}{
+			{"since", since, 10, []string{"b", "a"}},
+			{"limit", since, 1, []string{"b"}},
+			{"all", time.Time{}, 10, []string{"b", "a", "old"}},
+			{"future", time.Now().Add(time.Hour), 10, nil},
+		} {
+			list, err := db.ListNewOffers(ctx, tt.since, tt.limit)
+			if err != nil {
+				t.Fatalf("%s: ListNewOffers: %v", tt.name, err)
+			}
+			checkIDs(t, tt.name, list, tt.want...)
+		}
+	})
+}
+
+func TestOfferExists(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db,
+			testOffer("kept", "Kept", "1.00"),
+			testOffer("deleted", "Deleted", "1.00"))
+		if err := db.DeleteOffer(ctx, "deleted"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			id   string
+			want bool
+		}{
+			{"kept", true},
+			{"missing", false},
+			{"deleted", false},
+			{"", false},
+		} {
+			got, err := db.OfferExists(ctx, tt.id)
+			if err != nil {
+				t.Errorf("OfferExists(%q): %v", tt.id, err)
+			} else if got != tt.want {
+				t.Errorf("OfferExists(%q) = %t, want %t", tt.id, got, tt.want)
+			}
+		}
+	})
+}
+
+// getOffer returns the stored offer with the given ID, failing the test if
+// it can't be read.
+func getOffer(t *testing.T, db OfferDatabase, id string) *Offer {
+	t.Helper()
+	o, err := db.GetOffer(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetOffer(%s): %v", id, err)
+	}
+	return o
+}
+
+func TestUpsertOfferSkipsUnchanged(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		o := testOffer("a", "Chair", "10.00")
+		if _, written, err := db.UpsertOffer(ctx, o); err != nil || !written {
+			t.Fatalf("first UpsertOffer = %t, %v; want true, nil", written, err)
+		}
+		before := getOffer(t, db, "a")
+
+		same := testOffer("a", "Chair", "10.00")
+		if _, written, err := db.UpsertOffer(ctx, same); err != nil || written {
+			t.Errorf("identical UpsertOffer = %t, %v; want false, nil", written, err)
+		}
+		if after := getOffer(t, db, "a"); after.Version != before.Version || !after.UpdatedAt.Equal(before.UpdatedAt) {
+			t.Errorf("identical UpsertOffer changed version %d to %d and updatedAt %v to %v",
+				before.Version, after.Version, before.UpdatedAt, after.UpdatedAt)
+		}
+
+		changed := testOffer("a", "Chair", "12.00")
+		if _, written, err := db.UpsertOffer(ctx, changed); err != nil || !written {
+			t.Errorf("changed UpsertOffer = %t, %v; want true, nil", written, err)
+		}
+		if after := getOffer(t, db, "a"); after.Price != "12.00" || after.Version != before.Version+1 {
+			t.Errorf("after changed UpsertOffer, price = %s and version = %d; want 12.00 and %d", after.Price, after.Version, before.Version+1)
+		}
+	})
+}
+
+func TestBulkUpsertOffersCountsWrittenRows(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		for _, tt := range []struct {
+			name   string
+			offers []*Offer
+			want   int
+		}{
+			{"insert", []*Offer{
+				testOffer("a", "Chair", "10.00"),
+				testOffer("b", "Table", "20.00"),
+			}, 2},
+			{"identical", []*Offer{
+				testOffer("a", "Chair", "10.00"),
+				testOffer("b", "Table", "20.00"),
+			}, 0},
+			{"one changed, one new", []*Offer{
+				testOffer("a", "Chair", "10.00"),
+				testOffer("b", "Table", "25.00"),
+				testOffer("c", "Lamp", "5.00"),
+			}, 2},
+			{"empty", nil, 0},
+		} {
+			n, err := db.BulkUpsertOffers(ctx, tt.offers)
+			if err != nil {
+				t.Fatalf("%s: BulkUpsertOffers: %v", tt.name, err)
+			}
+			if n != tt.want {
+				t.Errorf("%s: BulkUpsertOffers wrote %d rows, want %d", tt.name, n, tt.want)
+			}
+		}
+		if a := getOffer(t, db, "a"); a.Version != 0 {
+			t.Errorf("unchanged offer has version %d, want 0", a.Version)
+		}
+	})
+}
+
+// syncOffers runs a sync that sees the given offers, and returns the rows it
+// wrote and the offers it deleted.
+func syncOffers(t *testing.T, db OfferDatabase, offers ...*Offer) (written int, deleted int64) {
+	t.Helper()
+	err := db.WithTx(context.Background(), func(tx SyncWriter) error {
+		ctx := context.Background()
+		if err := tx.UpdateUpdated(ctx); err != nil {
+			return err
+		}
+		var err error
+		if written, err = tx.BulkUpsertOffers(ctx, offers); err != nil {
+			return err
+		}
+		deleted, err = tx.DeleteOffers(ctx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	return written, deleted
+}
+
+func TestSyncOnlyWritesChanges(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		a, b, c := testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "20.00"), testOffer("c", "Lamp", "5.00")
+		if written, deleted := syncOffers(t, db, a, b, c); written != 3 || deleted != 0 {
+			t.Errorf("first sync wrote %d and deleted %d, want 3 and 0", written, deleted)
+		}
+		before := getOffer(t, db, "a")
+		version, err := db.ChangeToken(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Syncing the same offers again writes nothing.
+		if written, deleted := syncOffers(t, db, a, b, c); written != 0 || deleted != 0 {
+			t.Errorf("identical sync wrote %d and deleted %d, want 0 and 0", written, deleted)
+		}
+		if after, err := db.ChangeToken(context.Background()); err != nil || after != version {
+			t.Errorf("identical sync changed the change token from %q to %q (%v)", version, after, err)
+		}
+
+		// Only the changed offer is written, and only the missing one is
+		// deleted.
+		b2 := testOffer("b", "Table", "22.00")
+		if written, deleted := syncOffers(t, db, a, b2); written != 1 || deleted != 1 {
+			t.Errorf("sync wrote %d and deleted %d, want 1 and 1", written, deleted)
+		}
+		if after := getOffer(t, db, "a"); !after.UpdatedAt.Equal(before.UpdatedAt) || after.Version != before.Version {
+			t.Errorf("unchanged offer was rewritten: %+v, was %+v", after, before)
+		}
+		if got := getOffer(t, db, "b").Price; got != "22.00" {
+			t.Errorf("changed offer has price %s, want 22.00", got)
+		}
+		if _, err := db.GetOffer(context.Background(), "c"); err != ErrOfferNotFound {
+			t.Errorf("GetOffer of the missing offer = %v, want ErrOfferNotFound", err)
+		}
+	})
+}
+
+func TestForEachSearchResult(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		sale := testOffer("sale", "Lamp", "5.00")
+		sale.Description = "Now 50% off"
+		addOffers(t, db,
+			testOffer("chair", "Oak chair", "10.00"),
+			testOffer("table", "Table", "20.00"),
+			testOffer("armchair", "Leather ARMCHAIR", "30.00"),
+			sale,
+			testOffer("deleted", "Old chair", "1.00"))
+		if err := db.DeleteOffer(ctx, "deleted"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			q    string
+			want map[string]bool
+		}{
+			{"chair", map[string]bool{"chair": true, "armchair": true}},
+			{"50%", map[string]bool{"sale": true}},
+			// LIKE wildcards in the query match literally.
+			{"%", map[string]bool{"sale": true}},
+			{"_", map[string]bool{}},
+			{"sofa", map[string]bool{}},
+		} {
+			got := map[string]bool{}
+			err := db.ForEachSearchResult(ctx, tt.q, func(o *Offer) error {
+				got[o.ID] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ForEachSearchResult(%q): %v", tt.q, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ForEachSearchResult(%q) saw %v, want %v", tt.q, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestForEachSearchResultStops(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db,
+			testOffer("a", "Chair one", "1.00"),
+			testOffer("b", "Chair two", "1.00"),
+			testOffer("c", "Chair three", "1.00"))
+		stop := errors.New("stop")
+		calls := 0
+		err := db.ForEachSearchResult(ctx, "chair", func(o *Offer) error {
+			calls++
+			return stop
+		})
+		if err != stop {
+			t.Errorf("ForEachSearchResult = %v, want the callback's error", err)
+		}
+		if calls != 1 {
+			t.Errorf("callback called %d times after returning an error, want 1", calls)
+		}
+		// The rows of the stopped iteration are closed, releasing their
+		// connection.
+		if m, ok := db.(*mysqlDB); ok {
+			if n := m.conn.Stats().InUse; n != 0 {
+				t.Errorf("%d connections still in use after stopping", n)
+			}
+		}
+	})
+}
+
+func TestSearchOffersOrder(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		bench := testOffer("c", "Bench", "20.00")
+		bench.Description = "Seats two, like a wide chair"
+		addOffers(t, db,
+			testOffer("a", "Armchair cover", "30.00"),
+			testOffer("b", "Chair cushion", "5.00"),
+			bench,
+			testOffer("d", "chair", "50.00"),
+			testOffer("e", "Table", "1.00"))
+		for _, tt := range []struct {
+			order SortOrder
+			want  []string
+		}{
+			// Titles starting with the query, then containing it, then
+			// matches in the description only.
+			{"", []string{"d", "b", "a", "c"}},
+			{SortByRelevance, []string{"d", "b", "a", "c"}},
+			{SortByTitle, []string{"a", "c", "d", "b"}},
+			{SortByPrice, []string{"b", "c", "a", "d"}},
+		} {
+			list, err := db.SearchOffers(context.Background(), "Chair", tt.order, 0)
+			if err != nil {
+				t.Fatalf("SearchOffers by %q: %v", tt.order, err)
+			}
+			checkIDs(t, fmt.Sprintf("SearchOffers by %q", tt.order), list, tt.want...)
+		}
+		if _, err := db.SearchOffers(context.Background(), "chair", SortByInsertion, 0); err == nil {
+			t.Error("SearchOffers by insertion succeeded, want an error")
+		}
+	})
+}
+
+func TestListByCategory(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		var list []*Offer
+		for _, o := range []struct{ id, title, category string }{
+			{"chair", "Chair", "Furniture"},
+			{"bench", "Bench", "Furniture"},
+			{"table", "Table", "Furniture"},
+			{"gnome", "Gnome", "Garden"},
+			{"thing", "Thing", ""},
+			{"other", "Another thing", ""},
+		} {
+			offer := testOffer(o.id, o.title, "10.00")
+			offer.Category = o.category
+			list = append(list, offer)
+		}
+		addOffers(t, db, list...)
+		if err := db.DeleteOffer(ctx, "table"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			category      string
+			limit, offset int
+			want          []string
+		}{
+			{"Furniture", 10, 0, []string{"bench", "chair"}},
+			{"Furniture", 1, 0, []string{"bench"}},
+			{"Furniture", 1, 1, []string{"chair"}},
+			{"Furniture", 10, 2, nil},
+			{"Garden", 10, 0, []string{"gnome"}},
+			// Offers without a category are uncategorized.
+			{Uncategorized, 10, 0, []string{"other", "thing"}},
+			{"", 10, 0, []string{"other", "thing"}},
+			{"Toys", 10, 0, nil},
+		} {
+			list, err := db.ListByCategory(ctx, tt.category, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatalf("ListByCategory(%q): %v", tt.category, err)
+			}
+			checkIDs(t, fmt.Sprintf("ListByCategory(%q, %d, %d)", tt.category, tt.limit, tt.offset), list, tt.want...)
+		}
+		if o := getOffer(t, db, "gnome"); o.Category != "Garden" {
+			t.Errorf("stored category = %q, want Garden", o.Category)
+		}
+	})
+}
+
+func TestCountOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		count := func(name string, wantAll, wantSearch int) {
+			t.Helper()
+			if n, err := db.CountOffers(ctx); err != nil || n != wantAll {
+				t.Errorf("%s: CountOffers = %d, %v; want %d", name, n, err, wantAll)
+			}
+			if n, err := db.CountSearchOffers(ctx, "Offer 00"); err != nil || n != wantSearch {
+				t.Errorf("%s: CountSearchOffers = %d, %v; want %d", name, n, err, wantSearch)
+			}
+		}
+		count("empty database", 0, 0)
+
+		// Searches are counted past the result limit.
+		addOffers(t, db, manyOffers(120)...)
+		count("after adding 120 offers", 120, 100)
+		if list, err := db.SearchOffers(ctx, "Offer 00", "", 0); err != nil || len(list) != DefaultSearchLimit {
+			t.Errorf("SearchOffers returned %d offers, %v; want the limit of %d", len(list), err, DefaultSearchLimit)
+		}
+
+		addOffers(t, db, testOffer("chair", "Chair", "10.00"))
+		count("after adding a chair", 121, 100)
+		for _, id := range []string{"chair", "o0000", "o0119"} {
+			if err := db.DeleteOffer(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		count("after deleting 3 offers", 118, 99)
+		if n, err := db.CountSearchOffers(ctx, "zebra"); err != nil || n != 0 {
+			t.Errorf("CountSearchOffers(zebra) = %d, %v; want 0", n, err)
+		}
+	})
+}
+
+func TestListInStock(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		var list []*Offer
+		for _, o := range []struct{ id, availability string }{
+			{"in", "in stock"},
+			{"out", "out of stock"},
+			{"preorder", "preorder"},
+			{"unknown", ""},
+		} {
+			offer := testOffer(o.id, "Offer "+o.id, "10.00")
+			offer.Availability = o.availability
+			list = append(list, offer)
+		}
+		noLink := testOffer("out-no-link", "Offer out without a link", "10.00")
+		noLink.Availability = "out of stock"
+		noLink.MerchantURL = ""
+		syncOffers(t, db, append(list, noLink)...)
+
+		for _, tt := range []struct {
+			name string
+			list func(context.Context, ListOptions) ([]*Offer, int, error)
+			opts ListOptions
+			want []string
+		}{
+			{"ListOffers", db.ListOffers, ListOptions{}, []string{"in", "out", "out-no-link", "preorder", "unknown"}},
+			{"ListOffers in stock", db.ListOffers, ListOptions{InStock: true}, []string{"in", "preorder", "unknown"}},
+			{"ListOffers in stock, second page", db.ListOffers, ListOptions{InStock: true, Limit: 2, Offset: 2}, []string{"unknown"}},
+			{"ListPurchasableOffers", db.ListPurchasableOffers, ListOptions{}, []string{"in", "out", "preorder", "unknown"}},
+			{"ListPurchasableOffers in stock", db.ListPurchasableOffers, ListOptions{InStock: true}, []string{"in", "preorder", "unknown"}},
+		} {
+			tt.opts.Sort = SortByTitle
+			list, total, err := tt.list(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			checkIDs(t, tt.name, list, tt.want...)
+			if wantTotal := len(tt.want) + tt.opts.Offset; total != wantTotal {
+				t.Errorf("%s counts %d offers, want %d", tt.name, total, wantTotal)
+			}
+		}
+		// Out-of-stock offers can still be read directly.
+		if o := getOffer(t, db, "out"); !o.OutOfStock() {
+			t.Errorf("offer out of stock has availability %q", o.Availability)
+		}
+	})
+}
+
+func TestUpdateOfferFields(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		a := testOffer("a", "Chair", "10.00")
+		a.Description, a.Brand, a.Quantity = "A wooden chair", "Acme", 5
+		addOffers(t, db, a, testOffer("b", "Table", "50.00"))
+		before, other := getOffer(t, db, "a"), getOffer(t, db, "b")
+
+		// unchanged strips the fields every write changes.
+		unchanged := func(o *Offer) Offer {
+			c := *o
+			c.Version, c.UpdatedAt = 0, time.Time{}
+			return c
+		}
+		if err := db.UpdateOfferFields(ctx, "a", map[string]interface{}{"price": "12.50", "quantity": float64(3)}); err != nil {
+			t.Fatalf("UpdateOfferFields: %v", err)
+		}
+		after := getOffer(t, db, "a")
+		want := *before
+		want.Price, want.Quantity = "12.50", 3
+		if unchanged(after) != unchanged(&want) {
+			t.Errorf("after setting the price and quantity, offer = %+v, want %+v", *after, want)
+		}
+		if after.Version == before.Version {
+			t.Errorf("version stayed %d after a partial update", after.Version)
+		}
+		if o := getOffer(t, db, "b"); unchanged(o) != unchanged(other) {
+			t.Errorf("partial update of a changed offer b: %+v, was %+v", *o, *other)
+		}
+
+		for _, tt := range []struct {
+			name   string
+			id     string
+			fields map[string]interface{}
+		}{
+			{"no fields", "a", map[string]interface{}{}},
+			{"unknown field", "a", map[string]interface{}{"title = 'x', price": "1.00"}},
+			{"column name", "a", map[string]interface{}{"imageUrl": "https://example.com/x.png"}},
+			{"number for a string", "a", map[string]interface{}{"price": 12.5}},
+			{"fractional quantity", "a", map[string]interface{}{"quantity": 1.5}},
+			{"negative quantity", "a", map[string]interface{}{"quantity": float64(-1)}},
+			{"invalid offer", "a", map[string]interface{}{"title": "Stool", "merchant_url": "not a URL"}},
+		} {
+			if err := db.UpdateOfferFields(ctx, tt.id, tt.fields); err == nil {
+				t.Errorf("UpdateOfferFields with %s succeeded, want an error", tt.name)
+			}
+		}
+		if o := getOffer(t, db, "a"); unchanged(o) != unchanged(after) {
+			t.Errorf("failed partial updates changed the offer to %+v", *o)
+		}
+		if err := db.UpdateOfferFields(ctx, "missing", map[string]interface{}{"title": "Stool"}); err != ErrOfferNotFound {
+			t.Errorf("UpdateOfferFields of a missing offer = %v, want ErrOfferNotFound", err)
+		}
+	})
+}
+
+func TestOfferSlugs(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db,
+			testOffer("a", "Garden Chair", "10.00"),
+			testOffer("b", "Garden chair!", "12.00"),
+			testOffer("c", "Garden  chair", "14.00"),
+			testOffer("d", "Chaise longue – été", "99.00"))
+		for id, want := range map[string]string{
+			"a": "garden-chair",
+			"b": "garden-chair-2",
+			"c": "garden-chair-3",
+			"d": "chaise-longue-été",
+		} {
+			o := getOffer(t, db, id)
+			if o.Slug != want {
+				t.Errorf("offer %s has slug %q, want %q", id, o.Slug, want)
+				continue
+			}
+			got, err := db.GetOfferBySlug(ctx, want)
+			if err != nil || got.ID != id {
+				t.Errorf("GetOfferBySlug(%q) = %v, %v; want offer %s", want, got, err, id)
+			}
+		}
+
+		// Slugs are kept when titles change, so links keep working.
+		o := getOffer(t, db, "a")
+		o.Title = "Teak bench"
+		if err := db.UpdateOffer(ctx, o); err != nil {
+			t.Fatal(err)
+		}
+		if o := getOffer(t, db, "a"); o.Slug != "garden-chair" {
+			t.Errorf("slug after a title change = %q, want garden-chair", o.Slug)
+		}
+		// A deleted offer's slug isn't reused while it can be restored.
+		if err := db.DeleteOffer(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.GetOfferBySlug(ctx, "garden-chair-2"); err != ErrOfferNotFound {
+			t.Errorf("GetOfferBySlug of a deleted offer = %v, want ErrOfferNotFound", err)
+		}
+		addOffers(t, db, testOffer("e", "Garden chair", "16.00"))
+		if o := getOffer(t, db, "e"); o.Slug != "garden-chair-4" {
+			t.Errorf("new offer has slug %q, want garden-chair-4", o.Slug)
+		}
+		if _, err := db.GetOfferBySlug(ctx, "sofa"); err != ErrOfferNotFound {
+			t.Errorf("GetOfferBySlug(sofa) = %v, want ErrOfferNotFound", err)
+		}
+	})
+}
+
+func TestListOffersByMerchant(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		var list []*Offer
+		for _, o := range []struct {
+			id, title  string
+			merchantID int64
+		}{{"a", "Chair", 1}, {"b", "Bench", 1}, {"c", "Armchair", 1}, {"d", "Lamp", 2}, {"e", "Rug", 0}} {
+			offer := testOffer(o.id, o.title, "10.00")
+			offer.MerchantID = o.merchantID
+			list = append(list, offer)
+		}
+		syncOffers(t, db, list...)
+		if err := db.DeleteOffer(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			merchantID    int64
+			limit, offset int
+			want          []string
+		}{
+			{1, 10, 0, []string{"c", "a"}},
+			{1, 1, 1, []string{"a"}},
+			{1, 10, 2, nil},
+			{2, 10, 0, []string{"d"}},
+			{3, 10, 0, nil},
+		} {
+			got, err := db.ListOffersByMerchant(ctx, tt.merchantID, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatalf("ListOffersByMerchant(%d): %v", tt.merchantID, err)
+			}
+			checkIDs(t, fmt.Sprintf("ListOffersByMerchant(%d, %d, %d)", tt.merchantID, tt.limit, tt.offset), got, tt.want...)
+		}
+	})
+}
+
+func TestFeaturedOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db,
+			testOffer("a", "A", "1.00"),
+			testOffer("b", "B", "1.00"),
+			testOffer("c", "C", "1.00"),
+			testOffer("d", "D", "1.00"))
+
+		featured := func(name string, want ...string) {
+			t.Helper()
+			list, err := db.GetFeaturedOffers(ctx)
+			if err != nil {
+				t.Fatalf("%s: GetFeaturedOffers: %v", name, err)
+			}
+			checkIDs(t, name, list, want...)
+		}
+		featured("no featured offers")
+
+		if err := db.SetFeatured(ctx, []string{"c", "a", "d"}); err != nil {
+			t.Fatalf("SetFeatured: %v", err)
+		}
+		featured("position order", "c", "a", "d")
+
+		if err := db.DeleteOffer(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		featured("after deleting a featured offer", "c", "d")
+
+		// Repeated IDs are featured once, at their first position.
+		if err := db.SetFeatured(ctx, []string{"b", "c", "b", "d", "c"}); err != nil {
+			t.Fatalf("SetFeatured with repeated IDs: %v", err)
+		}
+		featured("repeated IDs", "b", "c", "d")
+
+		if err := db.SetFeatured(ctx, nil); err != nil {
+			t.Fatalf("SetFeatured(nil): %v", err)
+		}
+		featured("cleared")
+	})
+}
+
+func TestGetVariants(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		variant := func(id, title, group string) *Offer {
+			o := testOffer(id, title, "10.00")
+			o.ItemGroupID = group
+			return o
+		}
+		addOffers(t, db,
+			variant("shirt-m", "Shirt (M)", "shirt"),
+			variant("shirt-s", "Shirt (S)", "shirt"),
+			variant("shirt-l", "Shirt (L)", "shirt"),
+			variant("mug", "Mug", "mug"),
+			variant("hat", "Hat", ""))
+
+		variants := func(group string, want ...string) {
+			t.Helper()
+			list, err := db.GetVariants(ctx, group)
+			if err != nil {
+				t.Fatalf("GetVariants(%q): %v", group, err)
+			}
+			checkIDs(t, "GetVariants("+group+")", list, want...)
+		}
+		variants("shirt", "shirt-l", "shirt-m", "shirt-s")
+		variants("mug", "mug")
+		variants("unknown")
+		// Offers without a group aren't variants of each other.
+		variants("")
+
+		if err := db.DeleteOffer(ctx, "shirt-m"); err != nil {
+			t.Fatal(err)
+		}
+		variants("shirt", "shirt-l", "shirt-s")
+	})
+}
+
+func TestReports(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "A", "1.00"), testOffer("b", "B", "1.00"))
+		for _, r := range []struct{ id, reason string }{
+			{"a", "wrong price"},
+			{"b", "broken image"},
+			{"a", "out of stock"},
+		} {
+			if err := db.AddReport(ctx, r.id, r.reason); err != nil {
+				t.Fatalf("AddReport(%s): %v", r.id, err)
+			}
+		}
+
+		reports, err := db.ListReports(ctx, 2)
+		if err != nil {
+			t.Fatalf("ListReports: %v", err)
+		}
+		var got []string
+		for _, r := range reports {
+			got = append(got, r.OfferID+": "+r.Reason)
+			if r.ID == 0 || r.CreatedAt.IsZero() {
+				t.Errorf("report %+v has no ID or creation time", r)
+			}
+		}
+		if want := []string{"a: out of stock", "b: broken image"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("ListReports(2) = %q, want the newest %q", got, want)
+		}
+	})
+}
+
+func TestCatalogVersion(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "A", "1.00"), testOffer("b", "B", "2.00"))
+		last, err := db.CatalogVersion(ctx)
+		if err != nil {
+			t.Fatalf("CatalogVersion: %v", err)
+		}
+		// check fails the test unless the version changed as want says.
+		check := func(name string, want bool) {
+			t.Helper()
+			v, err := db.CatalogVersion(ctx)
+			if err != nil {
+				t.Fatalf("%s: CatalogVersion: %v", name, err)
+			}
+			if changed := v != last; changed != want {
+				t.Errorf("%s: version changed = %t, want %t", name, changed, want)
+			}
+			last = v
+		}
+
+		check("nothing written", false)
+		syncOffers(t, db, testOffer("a", "A", "1.00"), testOffer("b", "B", "2.00"))
+		check("identical sync", false)
+		syncOffers(t, db, testOffer("a", "A", "1.50"), testOffer("b", "B", "2.00"))
+		check("sync changing a price", true)
+		addOffers(t, db, testOffer("c", "C", "3.00"))
+		check("AddOffer", true)
+		if err := db.SetMetaOverrides(ctx, "a", "Custom title", ""); err != nil {
+			t.Fatal(err)
+		}
+		check("SetMetaOverrides", true)
+		if err := db.AddReview(ctx, "a", 5, "Great"); err != nil {
+			t.Fatal(err)
+		}
+		check("AddReview", true)
+		if err := db.DeleteOffer(ctx, "c"); err != nil {
+			t.Fatal(err)
+		}
+		check("DeleteOffer", true)
+	})
+}
+
+func TestRecomputeConvertedPrices(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		eur := testOffer("eur", "Lamp", "9.00")
+		eur.Currency = "EUR"
+		yen := testOffer("yen", "Teapot", "1000.00")
+		yen.Currency = "JPY"
+		addOffers(t, db, testOffer("usd", "Chair", "10.00"), eur, yen)
+
+		converted := func(name string, want map[string]string) {
+			t.Helper()
+			for id, price := range want {
+				o := getOffer(t, db, id)
+				if o.ConvertedPrice != price || o.ConvertedCurrency != "USD" {
+					t.Errorf("%s: %s converted to %q %s, want %q USD", name, id, o.ConvertedPrice, o.ConvertedCurrency, price)
+				}
+			}
+		}
+		recompute := func(name string, rates StaticRates, want int64) {
+			t.Helper()
+			n, err := db.RecomputeConvertedPrices(ctx, rates, "USD")
+			if err != nil {
+				t.Fatalf("%s: RecomputeConvertedPrices: %v", name, err)
+			}
+			if n != want {
+				t.Errorf("%s: %d converted prices changed, want %d", name, n, want)
+			}
+		}
+
+		// JPY has no rate, so the teapot has no converted price.
+		recompute("first run", StaticRates{"USD": 1, "EUR": 0.9}, 3)
+		converted("first run", map[string]string{"usd": "10.00", "eur": "10.00", "yen": ""})
+
+		recompute("same rates", StaticRates{"USD": 1, "EUR": 0.9}, 0)
+
+		recompute("rate change", StaticRates{"USD": 1, "EUR": 0.8, "JPY": 100}, 2)
+		converted("rate change", map[string]string{"usd": "10.00", "eur": "11.25", "yen": "10.00"})
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := db.RecomputeConvertedPrices(cancelled, StaticRates{"USD": 1, "EUR": 0.5, "JPY": 200}, "USD"); err == nil {
+			t.Error("RecomputeConvertedPrices with a cancelled context succeeded")
+		}
+		converted("cancelled run", map[string]string{"usd": "10.00", "eur": "11.25", "yen": "10.00"})
+	})
+}
+
+func TestPurchasable(t *testing.T) {
+	for _, tt := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/chair", true},
+		{"http://example.com/chair", true},
+		{"", false},
+		{"example.com/chair", false},
+		{"/chair", false},
+		{"ftp://example.com/chair", false},
+		{"https://", false},
+		{"https://example.com/%zz", false},
+	} {
+		o := &Offer{MerchantURL: tt.url}
+		if got := o.Purchasable(); got != tt.want {
+			t.Errorf("Purchasable with merchant URL %q = %t, want %t", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		change  func(o *Offer)
+		wantErr string // empty if the offer is valid
+	}{
+		{"valid", func(o *Offer) {}, ""},
+		{"no ID", func(o *Offer) { o.ID = "" }, "has no ID"},
+		{"no title", func(o *Offer) { o.Title = "" }, "has no title"},
+		{"blank title", func(o *Offer) { o.Title = "  " }, "has no title"},
+		{"no image URL", func(o *Offer) { o.ImageURL = "" }, "invalid image URL"},
+		{"relative image URL", func(o *Offer) { o.ImageURL = "/images/a.png" }, "invalid image URL"},
+		{"image URL without host", func(o *Offer) { o.ImageURL = "https://" }, "invalid image URL"},
+		{"unparseable image URL", func(o *Offer) { o.ImageURL = "https://example.com/%zz" }, "invalid image URL"},
+		{"no merchant URL", func(o *Offer) { o.MerchantURL = "" }, "invalid merchant URL"},
+		{"relative merchant URL", func(o *Offer) { o.MerchantURL = "example.com/a" }, "invalid merchant URL"},
+		{"no price", func(o *Offer) { o.Price = "" }, "has no price"},
+		{"negative price", func(o *Offer) { o.Price = "-1.00" }, "invalid price"},
+		{"unparseable price", func(o *Offer) { o.Price = "ten" }, "invalid price"},
+		{"too many decimals", func(o *Offer) { o.Price = "1.999" }, "invalid price"},
+		{"unparseable sale price", func(o *Offer) { o.SalePrice = "1,50" }, "invalid sale price"},
+		{"free", func(o *Offer) { o.Price = "0" }, ""},
+		{"no currency", func(o *Offer) { o.Currency = "" }, "invalid currency"},
+		{"lowercase currency", func(o *Offer) { o.Currency = "usd" }, "invalid currency"},
+		{"long currency", func(o *Offer) { o.Currency = "USDT" }, "invalid currency"},
+		{"currency symbol", func(o *Offer) { o.Currency = "$" }, "invalid currency"},
+	} {
+		o := testOffer("a", "Chair", "10.00")
+		tt.change(o)
+		err := o.Validate()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: Validate = %v, want nil", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: Validate = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAddOfferValidates(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		for _, change := range []func(o *Offer){
+			func(o *Offer) { o.Title = "" },
+			func(o *Offer) { o.ImageURL = "not a URL" },
+			func(o *Offer) { o.MerchantURL = "/products/a" },
+			func(o *Offer) { o.Currency = "dollars" },
+			func(o *Offer) { o.Price = "-5" },
+		} {
+			added := testOffer("b", "Table", "20.00")
+			change(added)
+			if _, err := db.AddOffer(ctx, added); err == nil {
+				t.Errorf("AddOffer(%+v) succeeded, want a validation error", added)
+			}
+			updated := getOffer(t, db, "a")
+			change(updated)
+			if err := db.UpdateOffer(ctx, updated); err == nil {
+				t.Errorf("UpdateOffer(%+v) succeeded, want a validation error", updated)
+			}
+		}
+		if o := getOffer(t, db, "a"); o.Title != "Chair" || o.Currency != "USD" || o.ImageURL != "https://example.com/images/a.png" {
+			t.Errorf("offer after rejected updates = %+v", o)
+		}
+		if exists, _ := db.OfferExists(ctx, "b"); exists {
+			t.Error("an invalid offer was added")
+		}
+	})
+}
+
+func TestListPurchasableOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		noLink := testOffer("no-link", "B no link", "1.00")
+		noLink.MerchantURL = ""
+		relative := testOffer("relative", "D relative link", "1.00")
+		relative.MerchantURL = "/products/relative"
+		ftp := testOffer("ftp", "E FTP link", "1.00")
+		ftp.MerchantURL = "ftp://example.com/products/ftp"
+		// Syncs keep offers without a valid link, unlike AddOffer.
+		syncOffers(t, db, testOffer("a", "A", "1.00"), noLink, testOffer("c", "C", "1.00"), relative, ftp)
+
+		all, total, err := db.ListOffers(ctx, ListOptions{Sort: SortByTitle})
+		if err != nil {
+			t.Fatalf("ListOffers: %v", err)
+		}
+		checkIDs(t, "ListOffers", all, "a", "no-link", "c", "relative", "ftp")
+		if total != 5 {
+			t.Errorf("ListOffers total = %d, want 5", total)
+		}
+
+		list, total, err := db.ListPurchasableOffers(ctx, ListOptions{Sort: SortByTitle})
+		if err != nil {
+			t.Fatalf("ListPurchasableOffers: %v", err)
+		}
+		checkIDs(t, "ListPurchasableOffers", list, "a", "c")
+		if total != 2 {
+			t.Errorf("ListPurchasableOffers total = %d, want 2", total)
+		}
+
+		// Pages are of purchasable offers only.
+		list, _, err = db.ListPurchasableOffers(ctx, ListOptions{Sort: SortByTitle, Limit: 1, Offset: 1})
+		if err != nil {
+			t.Fatalf("ListPurchasableOffers: %v", err)
+		}
+		checkIDs(t, "second page of ListPurchasableOffers", list, "c")
+	})
+}
+
+func TestGetOffersByIDs(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "1.00"), testOffer("b", "Table", "2.00"),
+			testOffer("c", "Lamp", "3.00"), testOffer("d", "Sofa", "4.00"))
+		if err := db.DeleteOffer(ctx, "d"); err != nil {
+			t.Fatalf("DeleteOffer: %v", err)
+		}
+		for _, tt := range []struct {
+			ids  []string
+			want []string
+		}{
+			{[]string{"c", "a", "b"}, []string{"c", "a", "b"}},
+			{[]string{"b", "missing", "a"}, []string{"b", "a"}},
+			{[]string{"d", "c"}, []string{"c"}},
+			{[]string{"missing"}, []string{}},
+			{[]string{}, []string{}},
+			{nil, []string{}},
+		} {
+			list, err := db.GetOffersByIDs(ctx, tt.ids)
+			if err != nil {
+				t.Fatalf("GetOffersByIDs(%q): %v", tt.ids, err)
+			}
+			if list == nil {
+				t.Errorf("GetOffersByIDs(%q) = nil, want an empty slice", tt.ids)
+			}
+			if got := offerIDs(list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetOffersByIDs(%q) = %q, want %q", tt.ids, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestUpdateOfferNotFound(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		if err := db.UpdateOffer(context.Background(), testOffer("missing", "Chair", "10.00")); err != ErrOfferNotFound {
+			t.Errorf("UpdateOffer of a missing offer = %v, want ErrOfferNotFound", err)
+		}
+	})
+}
+
+func TestReserveOffer(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		stocked := testOffer("stocked", "Chair", "10.00")
+		stocked.Quantity = 3
+		addOffers(t, db, stocked, testOffer("unknown", "Table", "20.00"))
+		reserve := func(id string, qty int, want error) string {
+			t.Helper()
+			res, err := db.ReserveOffer(ctx, id, qty, time.Hour)
+			if err != want {
+				t.Fatalf("ReserveOffer(%s, %d) = %v, want %v", id, qty, err, want)
+			}
+			if err == nil && res == "" {
+				t.Fatalf("ReserveOffer(%s, %d) returned no reservation ID", id, qty)
+			}
+			return res
+		}
+
+		first := reserve("stocked", 2, nil)
+		reserve("stocked", 1, nil)
+		// Over-reserving fails without holding anything.
+		reserve("stocked", 1, ErrInsufficientQuantity)
+		reserve("stocked", 4, ErrInsufficientQuantity)
+
+		if err := db.ReleaseReservation(ctx, first); err != nil {
+			t.Fatalf("ReleaseReservation: %v", err)
+		}
+		reserve("stocked", 2, nil)
+		reserve("stocked", 1, ErrInsufficientQuantity)
+		if err := db.ReleaseReservation(ctx, "unknown-reservation"); err != nil {
+			t.Errorf("ReleaseReservation of an unknown reservation = %v, want nil", err)
+		}
+
+		reserve("unknown", 1, ErrQuantityUnknown)
+		reserve("missing", 1, ErrOfferNotFound)
+		for _, qty := range []int{0, -1} {
+			if _, err := db.ReserveOffer(ctx, "stocked", qty, time.Hour); err == nil {
+				t.Errorf("ReserveOffer of %d items succeeded", qty)
+			}
+		}
+		if _, err := db.ReserveOffer(ctx, "stocked", 1, 0); err == nil {
+			t.Error("ReserveOffer without a ttl succeeded")
+		}
+	})
+}
+
+func TestReserveOfferExpires(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		o := testOffer("a", "Chair", "10.00")
+		o.Quantity = 1
+		addOffers(t, db, o)
+
+		// MySQL stores expiry times to the second.
+		if _, err := db.ReserveOffer(ctx, "a", 1, time.Second); err != nil {
+			t.Fatalf("ReserveOffer: %v", err)
+		}
+		if _, err := db.ReserveOffer(ctx, "a", 1, time.Hour); err != ErrInsufficientQuantity {
+			t.Fatalf("ReserveOffer while reserved = %v, want ErrInsufficientQuantity", err)
+		}
+		if n, err := db.PruneReservations(ctx); err != nil || n != 0 {
+			t.Errorf("PruneReservations before expiry = %d, %v; want 0", n, err)
+		}
+
+		// Once the reservation expires, its item is available again, even
+		// before it is pruned.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			time.Sleep(100 * time.Millisecond)
+			_, err := db.ReserveOffer(ctx, "a", 1, time.Hour)
+			if err == nil {
+				break
+			}
+			if err != ErrInsufficientQuantity || time.Now().After(deadline) {
+				t.Fatalf("ReserveOffer after expiry = %v, want the item available", err)
+			}
+		}
+		if n, err := db.PruneReservations(ctx); err != nil || n != 1 {
+			t.Errorf("PruneReservations after expiry = %d, %v; want 1", n, err)
+		}
+	})
+}
+
+func TestListBrandsWithCounts(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		n := 0
+		add := func(brand string, count int) {
+			for i := 0; i < count; i++ {
+				n++
+				o := testOffer(fmt.Sprintf("o%03d", n), "Offer", "1.00")
+				o.Brand = brand
+				addOffers(t, db, o)
+			}
+		}
+		add("Zeta", 2)
+		add("Acme", 3)
+		add("Beta", 2)
+		add("", 4)
+		add("Gone", 1)
+		if err := db.DeleteOffer(ctx, fmt.Sprintf("o%03d", n)); err != nil {
+			t.Fatal(err)
+		}
+
+		brands, err := db.ListBrandsWithCounts(ctx)
+		if err != nil {
+			t.Fatalf("ListBrandsWithCounts: %v", err)
+		}
+		// Ties are ordered by brand; offers without a brand and deleted
+		// offers aren't counted.
+		want := []BrandCount{{"Acme", 3}, {"Beta", 2}, {"Zeta", 2}}
+		if !reflect.DeepEqual(brands, want) {
+			t.Errorf("ListBrandsWithCounts = %v, want %v", brands, want)
+		}
+
+		for i := 0; i < maxBrands+5; i++ {
+			add(fmt.Sprintf("Brand %02d", i), 1)
+		}
+		brands, err = db.ListBrandsWithCounts(ctx)
+		if err != nil {
+			t.Fatalf("ListBrandsWithCounts: %v", err)
+		}
+		if len(brands) != maxBrands {
+			t.Fatalf("ListBrandsWithCounts returned %d brands, want at most %d", len(brands), maxBrands)
+		}
+		if got := brands[:4]; !reflect.DeepEqual(got, append(want, BrandCount{"Brand 00", 1})) {
+			t.Errorf("most common brands = %v, want %v then Brand 00", got, want)
+		}
+	})
+}
+
+func TestReviews(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "20.00"))
+
+		for _, rating := range []int{MinRating - 1, MaxRating + 1, -3} {
+			if err := db.AddReview(ctx, "a", rating, "out of range"); err != ErrInvalidRating {
+				t.Errorf("AddReview with rating %d = %v, want ErrInvalidRating", rating, err)
+			}
+		}
+		for i, rating := range []int{5, 4, 4, MinRating, MaxRating} {
+			id := "a"
+			if i >= 3 {
+				id = "b"
+			}
+			if err := db.AddReview(ctx, id, rating, fmt.Sprintf("review %d", i)); err != nil {
+				t.Fatalf("AddReview(%s, %d): %v", id, rating, err)
+			}
+		}
+
+		reviews, err := db.GetReviews(ctx, "a")
+		if err != nil {
+			t.Fatalf("GetReviews: %v", err)
+		}
+		var texts []string
+		for _, r := range reviews {
+			texts = append(texts, fmt.Sprintf("%s %d %s", r.OfferID, r.Rating, r.Text))
+		}
+		if want := []string{"a 4 review 2", "a 4 review 1", "a 5 review 0"}; !reflect.DeepEqual(texts, want) {
+			t.Errorf("GetReviews = %q, want %q, newest first", texts, want)
+		}
+
+		// checkRating compares ratings allowing for MySQL's decimal
+		// averages.
+		checkRating := func(name string, got Rating, average float64, count int) {
+			t.Helper()
+			if got.Count != count || got.Average < average-0.001 || got.Average > average+0.001 {
+				t.Errorf("%s = %+v, want an average of %.3f from %d reviews", name, got, average, count)
+			}
+		}
+		r, err := db.AverageRating(ctx, "a")
+		if err != nil {
+			t.Fatalf("AverageRating: %v", err)
+		}
+		checkRating("AverageRating(a)", r, 13.0/3, 3)
+		if r, err = db.AverageRating(ctx, "unreviewed"); err != nil {
+			t.Fatalf("AverageRating: %v", err)
+		}
+		checkRating("AverageRating(unreviewed)", r, 0, 0)
+
+		ratings, err := db.AverageRatings(ctx, []string{"a", "b", "unreviewed"})
+		if err != nil {
+			t.Fatalf("AverageRatings: %v", err)
+		}
+		if len(ratings) != 2 {
+			t.Errorf("AverageRatings = %v, want only the reviewed offers", ratings)
+		}
+		checkRating("AverageRatings[a]", ratings["a"], 13.0/3, 3)
+		checkRating("AverageRatings[b]", ratings["b"], 3, 2)
+	})
+}
+
+func TestListOffersSorted(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		// Added out of alphabetical and price order. Prices are compared as
+		// numbers, not strings.
+		addOffers(t, db,
+			testOffer("lamp", "Lamp", "9.50"),
+			testOffer("chair", "Chair", "100.00"),
+			testOffer("table", "Table", "20.00"),
+			testOffer("bench", "Bench", "35.00"))
+
+		for _, tt := range []struct {
+			sort SortOrder
+			want []string
+		}{
+			{"", []string{"bench", "chair", "lamp", "table"}},
+			{SortByTitle, []string{"bench", "chair", "lamp", "table"}},
+			{SortByPrice, []string{"lamp", "table", "bench", "chair"}},
+			{SortByInsertion, []string{"lamp", "chair", "table", "bench"}},
+		} {
+			list, _, err := db.ListOffers(ctx, ListOptions{Sort: tt.sort})
+			if err != nil {
+				t.Fatalf("ListOffers(%q): %v", tt.sort, err)
+			}
+			checkIDs(t, fmt.Sprintf("ListOffers sorted by %q", tt.sort), list, tt.want...)
+		}
+
+		// Listing again after an update keeps the order.
+		setPrice(t, db, "chair", "1.00")
+		list, _, err := db.ListOffers(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "ListOffers after an update", list, "bench", "chair", "lamp", "table")
+
+		if _, _, err := db.ListOffers(ctx, ListOptions{Sort: "title; DROP TABLE offers"}); err == nil {
+			t.Error("ListOffers with an unknown sort order succeeded")
+		}
+	})
+}
+
+func TestUpdateOffer(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "20.00"))
+
+		o := getOffer(t, db, "a")
+		stale := *o
+		o.Title = "Garden chair"
+		o.Price = "12.50"
+		o.Currency = "EUR"
+		o.Description = "Folding"
+		o.ImageURL = "https://example.com/images/garden-chair.png"
+		o.MerchantURL = "https://example.com/products/garden-chair"
+		if err := db.UpdateOffer(ctx, o); err != nil {
+			t.Fatalf("UpdateOffer: %v", err)
+		}
+		if o.Version != stale.Version+1 {
+			t.Errorf("version after UpdateOffer = %d, want %d", o.Version, stale.Version+1)
+		}
+
+		got := getOffer(t, db, "a")
+		if got.Title != o.Title || got.Price != o.Price || got.Currency != o.Currency ||
+			got.Description != o.Description || got.ImageURL != o.ImageURL || got.MerchantURL != o.MerchantURL {
+			t.Errorf("offer after UpdateOffer = %+v, want the new values %+v", got, o)
+		}
+		if got.Version != o.Version {
+			t.Errorf("stored version = %d, want %d", got.Version, o.Version)
+		}
+		// Only the offer with the ID is written.
+		if b := getOffer(t, db, "b"); b.Title != "Table" || b.Price != "20.00" {
+			t.Errorf("other offer = %+v, want it unchanged", b)
+		}
+
+		stale.Title = "Stale chair"
+		if err := db.UpdateOffer(ctx, &stale); err != ErrConcurrentModification {
+			t.Errorf("UpdateOffer with a stale version = %v, want ErrConcurrentModification", err)
+		}
+		if got := getOffer(t, db, "a"); got.Title != "Garden chair" {
+			t.Errorf("title after a rejected update = %q, want %q", got.Title, "Garden chair")
+		}
+	})
+}
+
+func TestOfferVersions(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		version := func() int { return getOffer(t, db, "a").Version }
+		v0 := version()
+
+		// Two editors read the same version; the second write is stale.
+		first, second := getOffer(t, db, "a"), getOffer(t, db, "a")
+		first.Price = "11.00"
+		if err := db.UpdateOffer(ctx, first); err != nil {
+			t.Fatalf("first UpdateOffer: %v", err)
+		}
+		second.Title = "Armchair"
+		if err := db.UpdateOffer(ctx, second); err != ErrConcurrentModification {
+			t.Errorf("second UpdateOffer = %v, want ErrConcurrentModification", err)
+		}
+		// Retrying on the current version succeeds.
+		second = getOffer(t, db, "a")
+		second.Title = "Armchair"
+		if err := db.UpdateOffer(ctx, second); err != nil {
+			t.Fatalf("retried UpdateOffer: %v", err)
+		}
+		if o := getOffer(t, db, "a"); o.Title != "Armchair" || o.Price != "11.00" || o.Version != v0+2 {
+			t.Errorf("offer after both edits = %+v, want both changes at version %d", o, v0+2)
+		}
+
+		// Upserts only move the version when the offer changes.
+		unchanged := getOffer(t, db, "a")
+		unchanged.Version = 0
+		if _, _, err := db.UpsertOffer(ctx, unchanged); err != nil {
+			t.Fatal(err)
+		}
+		if v := version(); v != v0+2 {
+			t.Errorf("version after an unchanged upsert = %d, want %d", v, v0+2)
+		}
+		unchanged.Price = "12.00"
+		if _, _, err := db.UpsertOffer(ctx, unchanged); err != nil {
+			t.Fatal(err)
+		}
+		if v := version(); v != v0+3 {
+			t.Errorf("version after a changing upsert = %d, want %d", v, v0+3)
+		}
+
+		// Partial updates check a version if one is given.
+		if err := db.UpdateOfferFields(ctx, "a", map[string]interface{}{"version": float64(v0), "title": "Stool"}); err != ErrConcurrentModification {
+			t.Errorf("UpdateOfferFields with a stale version = %v, want ErrConcurrentModification", err)
+		}
+		if err := db.UpdateOfferFields(ctx, "a", map[string]interface{}{"version": float64(v0 + 3), "title": "Stool"}); err != nil {
+			t.Errorf("UpdateOfferFields with the current version: %v", err)
+		}
+		if o := getOffer(t, db, "a"); o.Title != "Stool" || o.Version != v0+4 {
+			t.Errorf("offer after a versioned partial update = %+v, want Stool at version %d", o, v0+4)
+		}
+	})
+}
+
+func TestUpsertOffer(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		count := func() int {
+			t.Helper()
+			n := 0
+			if err := db.ForEachOffer(ctx, func(*Offer) error { n++; return nil }); err != nil {
+				t.Fatalf("ForEachOffer: %v", err)
+			}
+			return n
+		}
+
+		id, _, err := db.UpsertOffer(ctx, testOffer("a", "Chair", "10.00"))
+		if err != nil {
+			t.Fatalf("first UpsertOffer: %v", err)
+		}
+		latest := testOffer("a", "Garden chair", "12.00")
+		latest.Brand = "Acme"
+		again, _, err := db.UpsertOffer(ctx, latest)
+		if err != nil {
+			t.Fatalf("second UpsertOffer: %v", err)
+		}
+		if again != id {
+			t.Errorf("second UpsertOffer returned row %d, want the first's %d", again, id)
+		}
+		if n := count(); n != 1 {
+			t.Errorf("%d rows after upserting one offer ID twice, want 1", n)
+		}
+		if got := getOffer(t, db, "a"); got.Title != "Garden chair" || got.Price != "12.00" || got.Brand != "Acme" {
+			t.Errorf("offer = %+v, want the latest values", got)
+		}
+
+		// Concurrent upserts of a new offer store one row.
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, _, err := db.UpsertOffer(ctx, testOffer("b", fmt.Sprintf("Table %d", i), "20.00"))
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("concurrent UpsertOffer: %v", err)
+			}
+		}
+		if n := count(); n != 2 {
+			t.Errorf("%d rows after concurrent upserts, want 2", n)
+		}
+
+		if _, _, err := db.UpsertOffer(ctx, testOffer("c", "Lamp", "cheap")); err == nil {
+			t.Error("UpsertOffer with an invalid price succeeded")
+		}
+	})
+}
+
+func TestAddOfferDuplicate(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		if _, err := db.AddOffer(ctx, testOffer("a", "Other chair", "12.00")); err != ErrDuplicateOffer {
+			t.Errorf("AddOffer with a taken ID = %v, want ErrDuplicateOffer", err)
+		}
+		if got := getOffer(t, db, "a"); got.Title != "Chair" {
+			t.Errorf("title after a rejected AddOffer = %q, want %q", got.Title, "Chair")
+		}
+
+		// A deleted offer's ID can be added again.
+		if err := db.DeleteOffer(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.AddOffer(ctx, testOffer("a", "New chair", "15.00")); err != nil {
+			t.Errorf("AddOffer with a deleted offer's ID: %v", err)
+		}
+		if got := getOffer(t, db, "a"); got.Title != "New chair" {
+			t.Errorf("title after re-adding = %q, want %q", got.Title, "New chair")
+		}
+	})
+}
+
+func TestSearchOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		for i := 0; i < 60; i++ {
+			addOffers(t, db, testOffer(fmt.Sprintf("o%02d", i), fmt.Sprintf("Plain offer %02d", i), "1.00"))
+		}
+		// The matches come after the first 50 rows, in title and
+		// description, and in another case.
+		byTitle := testOffer("title", "Folding Garden Chair", "10.00")
+		byDescription := testOffer("description", "Bench", "20.00")
+		byDescription.Description = "A bench for the GARDEN"
+		addOffers(t, db, byTitle, byDescription)
+
+		for _, tt := range []struct {
+			q    string
+			want []string
+		}{
+			{"garden", []string{"description", "title"}},
+			{"Garden Chair", []string{"title"}},
+			{"for the garden", []string{"description"}},
+			{"offer 5", []string{"o50", "o51", "o52", "o53", "o54", "o55", "o56", "o57", "o58", "o59"}},
+		} {
+			list, err := db.SearchOffers(ctx, tt.q, SortByTitle, 0)
+			if err != nil {
+				t.Fatalf("SearchOffers(%q): %v", tt.q, err)
+			}
+			checkIDs(t, fmt.Sprintf("SearchOffers(%q)", tt.q), list, tt.want...)
+			n, err := db.CountSearchOffers(ctx, tt.q)
+			if err != nil {
+				t.Fatalf("CountSearchOffers(%q): %v", tt.q, err)
+			}
+			if n != len(tt.want) {
+				t.Errorf("CountSearchOffers(%q) = %d, want %d", tt.q, n, len(tt.want))
+			}
+		}
+
+		// Wildcards in the query are matched literally.
+		for _, q := range []string{"%", "_"} {
+			list, err := db.SearchOffers(ctx, q, "", 0)
+			if err != nil {
+				t.Fatalf("SearchOffers(%q): %v", q, err)
+			}
+			checkIDs(t, fmt.Sprintf("SearchOffers(%q)", q), list)
+		}
+
+		list, err := db.SearchOffers(ctx, "plain", SortByTitle, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "SearchOffers with limit 5", list, "o00", "o01", "o02", "o03", "o04")
+	})
+}
+
+func TestSearchOffersNoMatch(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		addOffers(t, db, testOffer("a", "Garden chair", "10.00"))
+		for _, order := range []SortOrder{SortByRelevance, SortByTitle, SortByPrice} {
+			list, err := db.SearchOffers(context.Background(), "zebra", order, 0)
+			if err != nil {
+				t.Errorf("SearchOffers by %s without matches: %v", order, err)
+			}
+			if list == nil || len(list) != 0 {
+				t.Errorf("SearchOffers by %s without matches = %#v, want an empty slice", order, list)
+			}
+		}
+	})
+}
+
+func TestMalformedPrices(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		for _, price := range []string{"12.9.9", "abc", "-1.00", "1.999", "1,50", " 10.00", "$10", "1e3", ".50", "12345678901234"} {
+			if _, err := db.AddOffer(ctx, testOffer("b", "Table", price)); err == nil || !strings.Contains(err.Error(), "invalid price") {
+				t.Errorf("AddOffer with price %q = %v, want an invalid price error", price, err)
+			}
+			o := getOffer(t, db, "a")
+			o.Price = price
+			if err := db.UpdateOffer(ctx, o); err == nil || !strings.Contains(err.Error(), "invalid price") {
+				t.Errorf("UpdateOffer with price %q = %v, want an invalid price error", price, err)
+			}
+			sale := testOffer("a", "Chair", "10.00")
+			sale.SalePrice = price
+			if _, _, err := db.UpsertOffer(ctx, sale); err == nil || !strings.Contains(err.Error(), "invalid sale price") {
+				t.Errorf("UpsertOffer with sale price %q = %v, want an invalid sale price error", price, err)
+			}
+		}
+		if o := getOffer(t, db, "a"); o.Price != "10.00" || o.SalePrice != "" {
+			t.Errorf("offer after rejected writes has price %q and sale price %q", o.Price, o.SalePrice)
+		}
+		if exists, _ := db.OfferExists(ctx, "b"); exists {
+			t.Error("an offer with a malformed price was added")
+		}
+
+		for _, price := range []string{"0", "9", "9.5", "1234567890123.45"} {
+			o := getOffer(t, db, "a")
+			o.Price = price
+			if err := db.UpdateOffer(ctx, o); err != nil {
+				t.Errorf("UpdateOffer with price %q: %v", price, err)
+			}
+		}
+	})
+}
+
+func TestSearchOffersByPriceRange(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		euro := testOffer("euro", "Garden lamp", "20.00")
+		euro.Currency = "EUR"
+		addOffers(t, db,
+			testOffer("cheap", "Garden chair", "10.00"),
+			testOffer("mid", "Garden table", "20.00"),
+			testOffer("dear", "Garden shed", "300.00"),
+			testOffer("other", "Kitchen chair", "15.00"),
+			euro)
+		inf := math.Inf(1)
+		for _, tt := range []struct {
+			name     string
+			min, max float64
+			currency string
+			want     []string
+		}{
+			// Both bounds are inclusive, and results are cheapest first.
+			{"both bounds", 10, 20, "USD", []string{"cheap", "mid"}},
+			{"single price", 20, 20, "USD", []string{"mid"}},
+			{"min only", 20, inf, "USD", []string{"mid", "dear"}},
+			{"max only", 0, 19.99, "USD", []string{"cheap"}},
+			{"no bounds", 0, inf, "USD", []string{"cheap", "mid", "dear"}},
+			// Prices in another currency aren't compared.
+			{"other currency", 10, 20, "EUR", []string{"euro"}},
+			{"unknown currency", 0, inf, "GBP", nil},
+			{"any currency", 20, 20, "", []string{"mid", "euro"}},
+			{"empty range", 20.01, 299.99, "USD", nil},
+		} {
+			list, err := db.SearchOffersByPriceRange(context.Background(), "garden", tt.min, tt.max, tt.currency)
+			if err != nil {
+				t.Fatalf("%s: SearchOffersByPriceRange: %v", tt.name, err)
+			}
+			if tt.name == "any currency" {
+				// Equal prices may come in either order.
+				sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+			}
+			checkIDs(t, tt.name, list, tt.want...)
+		}
+	})
+}
+
+func TestDeleteOffer(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"), testOffer("b", "Table", "50.00"))
+		if err := db.DeleteOffer(ctx, "a"); err != nil {
+			t.Fatalf("DeleteOffer: %v", err)
+		}
+		if _, err := db.GetOffer(ctx, "a"); err != ErrOfferNotFound {
+			t.Errorf("GetOffer of a deleted offer = %v, want ErrOfferNotFound", err)
+		}
+		list, _, err := db.ListOffers(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "offers after deleting a", list, "b")
+
+		for _, id := range []string{"a", "missing"} {
+			if err := db.DeleteOffer(ctx, id); err != ErrOfferNotFound {
+				t.Errorf("DeleteOffer(%s) = %v, want ErrOfferNotFound", id, err)
+			}
+		}
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Garden chair", "10.00"), testOffer("b", "Garden table", "50.00"))
+		before := time.Now().Truncate(time.Second)
+		if err := db.DeleteOffer(ctx, "a"); err != nil {
+			t.Fatalf("DeleteOffer: %v", err)
+		}
+
+		// The deleted offer is hidden from reads.
+		if exists, err := db.OfferExists(ctx, "a"); err != nil || exists {
+			t.Errorf("OfferExists of a deleted offer = %t, %v", exists, err)
+		}
+		if n, err := db.CountOffers(ctx); err != nil || n != 1 {
+			t.Errorf("CountOffers = %d, %v; want 1", n, err)
+		}
+		found, err := db.SearchOffers(ctx, "garden", SortByTitle, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "search after deleting a", found, "b")
+		byIDs, err := db.GetOffersByIDs(ctx, []string{"a", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "GetOffersByIDs after deleting a", byIDs, "b")
+
+		// Until it is purged, it can still be listed.
+		all, _, err := db.ListOffers(ctx, ListOptions{Sort: SortByTitle, IncludeDeleted: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "offers including deleted ones", all, "a", "b")
+		if d := all[0].DeletedAt; d == nil || d.Before(before) || d.After(time.Now()) {
+			t.Errorf("DeletedAt = %v, want the time of DeleteOffer, after %v", d, before)
+		}
+		if all[1].DeletedAt != nil {
+			t.Errorf("DeletedAt of a live offer = %v, want nil", all[1].DeletedAt)
+		}
+
+		// Only offers deleted before the cutoff are purged.
+		if n, err := db.PurgeDeleted(ctx, before.Add(-time.Hour)); err != nil || n != 0 {
+			t.Errorf("PurgeDeleted before the deletion = %d, %v; want 0", n, err)
+		}
+		if n, err := db.PurgeDeleted(ctx, time.Now().Add(time.Second)); err != nil || n != 1 {
+			t.Errorf("PurgeDeleted after the deletion = %d, %v; want 1", n, err)
+		}
+		all, _, err = db.ListOffers(ctx, ListOptions{IncludeDeleted: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "offers including deleted ones after the purge", all, "b")
+		if n, err := db.PurgeDeleted(ctx, time.Now().Add(time.Second)); err != nil || n != 0 {
+			t.Errorf("PurgeDeleted without deleted offers = %d, %v; want 0", n, err)
+		}
+	})
+}
+
+func TestAddOfferRestoresDeleted(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		addOffers(t, db, testOffer("a", "Chair", "10.00"))
+		created := getOffer(t, db, "a").CreatedAt
+		if err := db.DeleteOffer(ctx, "a"); err != nil {
+			t.Fatalf("DeleteOffer: %v", err)
+		}
+		if _, err := db.AddOffer(ctx, testOffer("a", "Teak chair", "12.00")); err != nil {
+			t.Fatalf("AddOffer of a deleted offer: %v", err)
+		}
+		o := getOffer(t, db, "a")
+		if o.Title != "Teak chair" || o.DeletedAt != nil || !o.CreatedAt.Equal(created) {
+			t.Errorf("restored offer has title %q, DeletedAt %v and CreatedAt %v; want the new title, no DeletedAt and CreatedAt %v",
+				o.Title, o.DeletedAt, o.CreatedAt, created)
+		}
+	})
+}
+
+func TestRelatedOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		byDescription := testOffer("desc", "Bench", "30.00")
+		byDescription.Description = "For the GARDEN"
+		addOffers(t, db,
+			testOffer("src", "Teak garden chair", "10.00"),
+			testOffer("both", "Teak garden bench", "20.00"),
+			byDescription,
+			testOffer("chair", "Folding chair", "15.00"),
+			testOffer("table", "Garden table", "40.00"),
+			testOffer("lamp", "Lamp", "5.00"),
+			testOffer("gone", "Garden gnome", "8.00"),
+			testOffer("tv", "TV", "99.00"))
+		if err := db.DeleteOffer(ctx, "gone"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			id    string
+			limit int
+			want  []string
+		}{
+			// Offers sharing more words come first, then by title. The
+			// offer itself is never related.
+			{"src", 10, []string{"both", "desc", "chair", "table"}},
+			{"src", 2, []string{"both", "desc"}},
+			{"lamp", 10, []string{}},
+			// Titles without words long enough to match on relate nothing.
+			{"tv", 10, []string{}},
+		} {
+			list, err := db.RelatedOffers(ctx, tt.id, tt.limit)
+			if err != nil {
+				t.Fatalf("RelatedOffers(%s, %d): %v", tt.id, tt.limit, err)
+			}
+			if list == nil {
+				t.Errorf("RelatedOffers(%s, %d) = nil, want an empty slice", tt.id, tt.limit)
+			}
+			checkIDs(t, fmt.Sprintf("RelatedOffers(%s, %d)", tt.id, tt.limit), list, tt.want...)
+		}
+
+		for _, id := range []string{"missing", "gone"} {
+			if _, err := db.RelatedOffers(ctx, id, 10); err != ErrOfferNotFound {
+				t.Errorf("RelatedOffers(%s) = %v, want ErrOfferNotFound", id, err)
+			}
+		}
+	})
+}
+
+// manyOffers returns n offers with distinct IDs and titles.
+func manyOffers(n int) []*Offer {
+	list := make([]*Offer, n)
+	for i := range list {
+		list[i] = testOffer(fmt.Sprintf("o%04d", i), fmt.Sprintf("Offer %04d", i), fmt.Sprintf("%d.99", i))
+	}
+	return list
+}
+
+func TestSearchAndListLimits(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		if _, err := db.BulkUpsertOffers(ctx, manyOffers(MaxSearchLimit+20)); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			limit, want int
+		}{
+			{0, DefaultSearchLimit},
+			{-1, DefaultSearchLimit},
+			{7, 7},
+			{MaxSearchLimit, MaxSearchLimit},
+			{100000, MaxSearchLimit},
+		} {
+			list, err := db.SearchOffers(ctx, "offer", SortByTitle, tt.limit)
+			if err != nil {
+				t.Fatalf("SearchOffers with limit %d: %v", tt.limit, err)
+			}
+			if len(list) != tt.want || list[0].ID != "o0000" {
+				t.Errorf("SearchOffers with limit %d returned %d offers, want the first %d", tt.limit, len(list), tt.want)
+			}
+		}
+		for _, tt := range []struct {
+			limit, want int
+		}{{0, DefaultPageSize}, {7, 7}, {200, 200}} {
+			list, total, err := db.ListOffers(ctx, ListOptions{Limit: tt.limit})
+			if err != nil {
+				t.Fatalf("ListOffers with limit %d: %v", tt.limit, err)
+			}
+			if len(list) != tt.want || total != MaxSearchLimit+20 {
+				t.Errorf("ListOffers with limit %d returned %d of %d offers, want %d of %d", tt.limit, len(list), total, tt.want, MaxSearchLimit+20)
+			}
+		}
+	})
+}
+
+func TestListAndSearchPageSize(t *testing.T) {
+	if DefaultSearchLimit != DefaultPageSize {
+		t.Errorf("DefaultSearchLimit = %d, want DefaultPageSize, %d", DefaultSearchLimit, DefaultPageSize)
+	}
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		if _, err := db.BulkUpsertOffers(ctx, manyOffers(2*DefaultPageSize+1)); err != nil {
+			t.Fatal(err)
+		}
+		listed, _, err := db.ListOffers(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		purchasable, _, err := db.ListPurchasableOffers(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := db.SearchOffers(ctx, "offer", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != DefaultPageSize || len(purchasable) != DefaultPageSize || len(found) != DefaultPageSize {
+			t.Errorf("default pages have %d listed, %d purchasable and %d found offers, want %d each", len(listed), len(purchasable), len(found), DefaultPageSize)
+		}
+	})
+
+	// The limits are bound, not written into the statements.
+	literal := regexp.MustCompile(`(?i)\blimit\s+[0-9]{2,}`)
+	src, err := ioutil.ReadFile("db_mysql.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range literal.FindAll(src, -1) {
+		t.Errorf("db_mysql.go has a literal limit: %s", m)
+	}
+}
+
+func TestBulkUpsertThousandOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		list := manyOffers(1000)
+		if n, err := db.BulkUpsertOffers(ctx, list); err != nil || n != len(list) {
+			t.Fatalf("BulkUpsertOffers = %d, %v; want %d written", n, err, len(list))
+		}
+		if n, err := db.CountOffers(ctx); err != nil || n != len(list) {
+			t.Errorf("CountOffers = %d, %v; want %d", n, err, len(list))
+		}
+		for _, i := range []int{0, 499, 500, 999} {
+			o := getOffer(t, db, list[i].ID)
+			if o.Title != list[i].Title || o.Price != list[i].Price {
+				t.Errorf("offer %s = %q at %s, want %q at %s", o.ID, o.Title, o.Price, list[i].Title, list[i].Price)
+			}
+		}
+
+		// Upserting again writes only the changed offers, across batches.
+		for _, i := range []int{1, 498, 501, 998} {
+			list[i].Price = "0.50"
+		}
+		if n, err := db.BulkUpsertOffers(ctx, list); err != nil || n != 4 {
+			t.Errorf("BulkUpsertOffers with 4 changes = %d, %v; want 4 written", n, err)
+		}
+		if o := getOffer(t, db, list[998].ID); o.Price != "0.50" {
+			t.Errorf("changed offer has price %s, want 0.50", o.Price)
+		}
+		if n, _ := db.CountOffers(ctx); n != len(list) {
+			t.Errorf("%d offers after the second upsert, want %d", n, len(list))
+		}
+	})
+}
+
+// BenchmarkUpsertOffers compares upserting 1000 offers one at a time with
+// upserting them in batches.
+func BenchmarkUpsertOffers(b *testing.B) {
+	ctx := context.Background()
+	for _, backend := range []struct {
+		name string
+		open func(b *testing.B) OfferDatabase
+	}{
+		{"memory", func(*testing.B) OfferDatabase { return NewMemoryDB() }},
+		{"mysql", func(b *testing.B) OfferDatabase { return newTestMySQLDB(b) }},
+	} {
+		b.Run(backend.name+"/per-row", func(b *testing.B) {
+			db := backend.open(b)
+			for i := 0; i < b.N; i++ {
+				// Each run changes every offer, so each is written.
+				list := manyOffers(1000)
+				for _, o := range list {
+					o.Description = strconv.Itoa(i)
+					if _, _, err := db.UpsertOffer(ctx, o); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		b.Run(backend.name+"/batched", func(b *testing.B) {
+			db := backend.open(b)
+			for i := 0; i < b.N; i++ {
+				list := manyOffers(1000)
+				for _, o := range list {
+					o.Description = strconv.Itoa(i)
+				}
+				if _, err := db.BulkUpsertOffers(ctx, list); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
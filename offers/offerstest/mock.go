@@ -0,0 +1,618 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package offerstest provides a mock offers.OfferDatabase for testing code
+// that uses the offers database, such as the app's handlers, without MySQL.
+//
+// Each method calls the function of the matching field if it is set, and
+// otherwise returns zero values and no error. Every call is recorded first:
+//
+//	db := &offerstest.MockDB{
+//		SearchOffersFunc: func(ctx context.Context, q string, order offers.SortOrder, limit int) ([]*offers.Offer, error) {
+//			return []*offers.Offer{{ID: "1", Title: "Chair"}}, nil
+//		},
+//	}
+//	offers.DB = db
+//	// Serve GET /search?q=chair...
+//	if calls := db.CallsTo("SearchOffers"); len(calls) != 1 || calls[0][0] != "chair" {
+//		t.Errorf("SearchOffers calls = %v, want one for \"chair\"", calls)
+//	}
+package offerstest
+
+import (
+	"context"
+	"offers"
+	"sync"
+	"time"
+)
+
+// Call is a recorded call to a MockDB method. Args are the method's
+// arguments in order, without the context.
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// MockDB is an offers.OfferDatabase whose methods are set by tests. Its
+// zero value is ready to use, and it is safe for concurrent use as long as
+// the functions it calls are. WithTx calls fn with the MockDB itself unless
+// WithTxFunc is set, so it also implements the methods of offers.SyncWriter.
+type MockDB struct {
+	// The functions called by the methods of the same name, if set.
+	ListOffersFunc               func(context.Context, offers.ListOptions) ([]*offers.Offer, int, error)
+	ListPurchasableOffersFunc    func(context.Context, offers.ListOptions) ([]*offers.Offer, int, error)
+	GetOfferFunc                 func(context.Context, string) (*offers.Offer, error)
+	GetOfferBySlugFunc           func(context.Context, string) (*offers.Offer, error)
+	GetOffersByIDsFunc           func(context.Context, []string) ([]*offers.Offer, error)
+	OfferExistsFunc              func(context.Context, string) (bool, error)
+	SearchOffersFunc             func(context.Context, string, offers.SortOrder, int) ([]*offers.Offer, error)
+	SearchOffersByPriceRangeFunc func(context.Context, string, float64, float64, string) ([]*offers.Offer, error)
+	FilterOffersFunc             func(context.Context, *offers.Filter, int) ([]*offers.Offer, error)
+	CountOffersFunc              func(context.Context) (int, error)
+	CountSearchOffersFunc        func(context.Context, string) (int, error)
+	ListBrandsWithCountsFunc     func(context.Context) ([]offers.BrandCount, error)
+	FilteredSearchFunc           func(context.Context, string, offers.FilterOptions, int, int) ([]*offers.Offer, error)
+	SearchFacetsFunc             func(context.Context, string, offers.FilterOptions) (offers.Facets, error)
+	CatalogVersionFunc           func(context.Context) (string, error)
+	ChangeTokenFunc              func(context.Context) (string, error)
+	ForEachOfferFunc             func(context.Context, func(*offers.Offer) error) error
+	ForEachSearchResultFunc      func(context.Context, string, func(*offers.Offer) error) error
+	AddOfferFunc                 func(context.Context, *offers.Offer) (int64, error)
+	UpdateOfferFunc              func(context.Context, *offers.Offer) error
+	UpdateOfferFieldsFunc        func(context.Context, string, map[string]interface{}) error
+	UpsertOfferFunc              func(context.Context, *offers.Offer) (int64, bool, error)
+	BulkUpsertOffersFunc         func(context.Context, []*offers.Offer) (int, error)
+	UpdateUpdatedFunc            func(context.Context) error
+	KeepMerchantOffersFunc       func(context.Context, int64) error
+	DeleteOffersFunc             func(context.Context) (int64, error)
+	WithTxFunc                   func(context.Context, func(offers.SyncWriter) error) error
+	DeleteOfferFunc              func(context.Context, string) error
+	PurgeDeletedFunc             func(context.Context, time.Time) (int64, error)
+	RecordViewFunc               func(context.Context, string) error
+	TrendingOffersFunc           func(context.Context, time.Duration, int) ([]*offers.Offer, error)
+	ListNewOffersFunc            func(context.Context, time.Time, int) ([]*offers.Offer, error)
+	ListByCategoryFunc           func(context.Context, string, int, int) ([]*offers.Offer, error)
+	ListOffersByMerchantFunc     func(context.Context, int64, int, int) ([]*offers.Offer, error)
+	RelatedOffersFunc            func(context.Context, string, int) ([]*offers.Offer, error)
+	GetVariantsFunc              func(context.Context, string) ([]*offers.Offer, error)
+	ReserveOfferFunc             func(context.Context, string, int, time.Duration) (string, error)
+	ReleaseReservationFunc       func(context.Context, string) error
+	PruneReservationsFunc        func(context.Context) (int64, error)
+	SetFeaturedFunc              func(context.Context, []string) error
+	GetFeaturedOffersFunc        func(context.Context) ([]*offers.Offer, error)
+	AddReportFunc                func(context.Context, string, string) error
+	ListReportsFunc              func(context.Context, int) ([]*offers.OfferReport, error)
+	AddReviewFunc                func(context.Context, string, int, string) error
+	GetReviewsFunc               func(context.Context, string) ([]*offers.Review, error)
+	AverageRatingFunc            func(context.Context, string) (offers.Rating, error)
+	AverageRatingsFunc           func(context.Context, []string) (map[string]offers.Rating, error)
+	AddPriceAlertFunc            func(context.Context, string, string, string) (int64, error)
+	ListPriceAlertsFunc          func(context.Context, int) ([]*offers.PriceAlert, error)
+	DeletePriceAlertFunc         func(context.Context, int64) error
+	TriggeredPriceAlertsFunc     func(context.Context) ([]*offers.PriceAlert, error)
+	SetPriceAlertFiredFunc       func(context.Context, int64, bool) (bool, error)
+	RecomputeConvertedPricesFunc func(context.Context, offers.CurrencyConverter, string) (int64, error)
+	ListDuplicateOffersFunc      func(context.Context, int) ([]*offers.Offer, error)
+	SetCanonicalProductsFunc     func(context.Context, map[string]string) error
+	SetMetaOverridesFunc         func(context.Context, string, string, string) error
+	PruneViewsFunc               func(context.Context, time.Time) (int64, error)
+	CheckFunc                    func(context.Context) error
+	CloseFunc                    func() error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Ensure MockDB conforms to the OfferDatabase and SyncWriter interfaces.
+var (
+	_ offers.OfferDatabase = &MockDB{}
+	_ offers.SyncWriter    = &MockDB{}
+)
+
+// record adds a call to the calls made.
+func (m *MockDB) record(method string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls made so far, in order.
+func (m *MockDB) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// CallsTo returns the arguments of each call made so far to the named
+// method, in order.
+func (m *MockDB) CallsTo(method string) [][]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var args [][]interface{}
+	for _, c := range m.calls {
+		if c.Method == method {
+			args = append(args, c.Args)
+		}
+	}
+	return args
+}
+
+// Reset forgets the calls made so far. The functions set are kept.
+func (m *MockDB) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = nil
+}
+
+func (m *MockDB) ListOffers(ctx context.Context, opts offers.ListOptions) (_ []*offers.Offer, _ int, _ error) {
+	m.record("ListOffers", opts)
+	if m.ListOffersFunc != nil {
+		return m.ListOffersFunc(ctx, opts)
+	}
+	return
+}
+
+func (m *MockDB) ListPurchasableOffers(ctx context.Context, opts offers.ListOptions) (_ []*offers.Offer, _ int, _ error) {
+	m.record("ListPurchasableOffers", opts)
+	if m.ListPurchasableOffersFunc != nil {
+		return m.ListPurchasableOffersFunc(ctx, opts)
+	}
+	return
+}
+
+func (m *MockDB) GetOffer(ctx context.Context, id string) (_ *offers.Offer, _ error) {
+	m.record("GetOffer", id)
+	if m.GetOfferFunc != nil {
+		return m.GetOfferFunc(ctx, id)
+	}
+	return
+}
+
+func (m *MockDB) GetOfferBySlug(ctx context.Context, slug string) (_ *offers.Offer, _ error) {
+	m.record("GetOfferBySlug", slug)
+	if m.GetOfferBySlugFunc != nil {
+		return m.GetOfferBySlugFunc(ctx, slug)
+	}
+	return
+}
+
+func (m *MockDB) GetOffersByIDs(ctx context.Context, ids []string) (_ []*offers.Offer, _ error) {
+	m.record("GetOffersByIDs", ids)
+	if m.GetOffersByIDsFunc != nil {
+		return m.GetOffersByIDsFunc(ctx, ids)
+	}
+	return
+}
+
+func (m *MockDB) OfferExists(ctx context.Context, id string) (_ bool, _ error) {
+	m.record("OfferExists", id)
+	if m.OfferExistsFunc != nil {
+		return m.OfferExistsFunc(ctx, id)
+	}
+	return
+}
+
+func (m *MockDB) SearchOffers(ctx context.Context, q string, order offers.SortOrder, limit int) (_ []*offers.Offer, _ error) {
+	m.record("SearchOffers", q, order, limit)
+	if m.SearchOffersFunc != nil {
+		return m.SearchOffersFunc(ctx, q, order, limit)
+	}
+	return
+}
+
+func (m *MockDB) SearchOffersByPriceRange(ctx context.Context, q string, min float64, max float64, currency string) (_ []*offers.Offer, _ error) {
+	m.record("SearchOffersByPriceRange", q, min, max, currency)
+	if m.SearchOffersByPriceRangeFunc != nil {
+		return m.SearchOffersByPriceRangeFunc(ctx, q, min, max, currency)
+	}
+	return
+}
+
+func (m *MockDB) FilterOffers(ctx context.Context, f *offers.Filter, limit int) (_ []*offers.Offer, _ error) {
+	m.record("FilterOffers", f, limit)
+	if m.FilterOffersFunc != nil {
+		return m.FilterOffersFunc(ctx, f, limit)
+	}
+	return
+}
+
+func (m *MockDB) CountOffers(ctx context.Context) (_ int, _ error) {
+	m.record("CountOffers")
+	if m.CountOffersFunc != nil {
+		return m.CountOffersFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) CountSearchOffers(ctx context.Context, q string) (_ int, _ error) {
+	m.record("CountSearchOffers", q)
+	if m.CountSearchOffersFunc != nil {
+		return m.CountSearchOffersFunc(ctx, q)
+	}
+	return
+}
+
+func (m *MockDB) ListBrandsWithCounts(ctx context.Context) (_ []offers.BrandCount, _ error) {
+	m.record("ListBrandsWithCounts")
+	if m.ListBrandsWithCountsFunc != nil {
+		return m.ListBrandsWithCountsFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) FilteredSearch(ctx context.Context, q string, applied offers.FilterOptions, offset int, limit int) (_ []*offers.Offer, _ error) {
+	m.record("FilteredSearch", q, applied, offset, limit)
+	if m.FilteredSearchFunc != nil {
+		return m.FilteredSearchFunc(ctx, q, applied, offset, limit)
+	}
+	return
+}
+
+func (m *MockDB) SearchFacets(ctx context.Context, q string, applied offers.FilterOptions) (_ offers.Facets, _ error) {
+	m.record("SearchFacets", q, applied)
+	if m.SearchFacetsFunc != nil {
+		return m.SearchFacetsFunc(ctx, q, applied)
+	}
+	return
+}
+
+func (m *MockDB) CatalogVersion(ctx context.Context) (_ string, _ error) {
+	m.record("CatalogVersion")
+	if m.CatalogVersionFunc != nil {
+		return m.CatalogVersionFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) ChangeToken(ctx context.Context) (_ string, _ error) {
+	m.record("ChangeToken")
+	if m.ChangeTokenFunc != nil {
+		return m.ChangeTokenFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) ForEachOffer(ctx context.Context, fn func(*offers.Offer) error) error {
+	m.record("ForEachOffer", fn)
+	if m.ForEachOfferFunc != nil {
+		return m.ForEachOfferFunc(ctx, fn)
+	}
+	return nil
+}
+
+func (m *MockDB) ForEachSearchResult(ctx context.Context, q string, fn func(*offers.Offer) error) error {
+	m.record("ForEachSearchResult", q, fn)
+	if m.ForEachSearchResultFunc != nil {
+		return m.ForEachSearchResultFunc(ctx, q, fn)
+	}
+	return nil
+}
+
+func (m *MockDB) AddOffer(ctx context.Context, o *offers.Offer) (_ int64, _ error) {
+	m.record("AddOffer", o)
+	if m.AddOfferFunc != nil {
+		return m.AddOfferFunc(ctx, o)
+	}
+	return
+}
+
+func (m *MockDB) UpdateOffer(ctx context.Context, o *offers.Offer) error {
+	m.record("UpdateOffer", o)
+	if m.UpdateOfferFunc != nil {
+		return m.UpdateOfferFunc(ctx, o)
+	}
+	return nil
+}
+
+func (m *MockDB) UpdateOfferFields(ctx context.Context, id string, fields map[string]interface{}) error {
+	m.record("UpdateOfferFields", id, fields)
+	if m.UpdateOfferFieldsFunc != nil {
+		return m.UpdateOfferFieldsFunc(ctx, id, fields)
+	}
+	return nil
+}
+
+func (m *MockDB) UpsertOffer(ctx context.Context, o *offers.Offer) (_ int64, _ bool, _ error) {
+	m.record("UpsertOffer", o)
+	if m.UpsertOfferFunc != nil {
+		return m.UpsertOfferFunc(ctx, o)
+	}
+	return
+}
+
+func (m *MockDB) BulkUpsertOffers(ctx context.Context, offers []*offers.Offer) (_ int, _ error) {
+	m.record("BulkUpsertOffers", offers)
+	if m.BulkUpsertOffersFunc != nil {
+		return m.BulkUpsertOffersFunc(ctx, offers)
+	}
+	return
+}
+
+func (m *MockDB) UpdateUpdated(ctx context.Context) error {
+	m.record("UpdateUpdated")
+	if m.UpdateUpdatedFunc != nil {
+		return m.UpdateUpdatedFunc(ctx)
+	}
+	return nil
+}
+
+func (m *MockDB) KeepMerchantOffers(ctx context.Context, merchantID int64) error {
+	m.record("KeepMerchantOffers", merchantID)
+	if m.KeepMerchantOffersFunc != nil {
+		return m.KeepMerchantOffersFunc(ctx, merchantID)
+	}
+	return nil
+}
+
+func (m *MockDB) DeleteOffers(ctx context.Context) (_ int64, _ error) {
+	m.record("DeleteOffers")
+	if m.DeleteOffersFunc != nil {
+		return m.DeleteOffersFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) WithTx(ctx context.Context, fn func(offers.SyncWriter) error) error {
+	m.record("WithTx", fn)
+	if m.WithTxFunc != nil {
+		return m.WithTxFunc(ctx, fn)
+	}
+	return fn(m)
+}
+
+func (m *MockDB) DeleteOffer(ctx context.Context, id string) error {
+	m.record("DeleteOffer", id)
+	if m.DeleteOfferFunc != nil {
+		return m.DeleteOfferFunc(ctx, id)
+	}
+	return nil
+}
+
+func (m *MockDB) PurgeDeleted(ctx context.Context, olderThan time.Time) (_ int64, _ error) {
+	m.record("PurgeDeleted", olderThan)
+	if m.PurgeDeletedFunc != nil {
+		return m.PurgeDeletedFunc(ctx, olderThan)
+	}
+	return
+}
+
+func (m *MockDB) RecordView(ctx context.Context, id string) error {
+	m.record("RecordView", id)
+	if m.RecordViewFunc != nil {
+		return m.RecordViewFunc(ctx, id)
+	}
+	return nil
+}
+
+func (m *MockDB) TrendingOffers(ctx context.Context, window time.Duration, limit int) (_ []*offers.Offer, _ error) {
+	m.record("TrendingOffers", window, limit)
+	if m.TrendingOffersFunc != nil {
+		return m.TrendingOffersFunc(ctx, window, limit)
+	}
+	return
+}
+
+func (m *MockDB) ListNewOffers(ctx context.Context, since time.Time, limit int) (_ []*offers.Offer, _ error) {
+	m.record("ListNewOffers", since, limit)
+	if m.ListNewOffersFunc != nil {
+		return m.ListNewOffersFunc(ctx, since, limit)
+	}
+	return
+}
+
+func (m *MockDB) ListOffersByMerchant(ctx context.Context, merchantID int64, limit, offset int) (_ []*offers.Offer, _ error) {
+	m.record("ListOffersByMerchant", merchantID, limit, offset)
+	if m.ListOffersByMerchantFunc != nil {
+		return m.ListOffersByMerchantFunc(ctx, merchantID, limit, offset)
+	}
+	return
+}
+
+func (m *MockDB) ListByCategory(ctx context.Context, category string, limit, offset int) (_ []*offers.Offer, _ error) {
+	m.record("ListByCategory", category, limit, offset)
+	if m.ListByCategoryFunc != nil {
+		return m.ListByCategoryFunc(ctx, category, limit, offset)
+	}
+	return
+}
+
+func (m *MockDB) RelatedOffers(ctx context.Context, id string, limit int) (_ []*offers.Offer, _ error) {
+	m.record("RelatedOffers", id, limit)
+	if m.RelatedOffersFunc != nil {
+		return m.RelatedOffersFunc(ctx, id, limit)
+	}
+	return
+}
+
+func (m *MockDB) GetVariants(ctx context.Context, itemGroupID string) (_ []*offers.Offer, _ error) {
+	m.record("GetVariants", itemGroupID)
+	if m.GetVariantsFunc != nil {
+		return m.GetVariantsFunc(ctx, itemGroupID)
+	}
+	return
+}
+
+func (m *MockDB) ReserveOffer(ctx context.Context, offerID string, qty int, ttl time.Duration) (_ string, _ error) {
+	m.record("ReserveOffer", offerID, qty, ttl)
+	if m.ReserveOfferFunc != nil {
+		return m.ReserveOfferFunc(ctx, offerID, qty, ttl)
+	}
+	return
+}
+
+func (m *MockDB) ReleaseReservation(ctx context.Context, id string) error {
+	m.record("ReleaseReservation", id)
+	if m.ReleaseReservationFunc != nil {
+		return m.ReleaseReservationFunc(ctx, id)
+	}
+	return nil
+}
+
+func (m *MockDB) PruneReservations(ctx context.Context) (_ int64, _ error) {
+	m.record("PruneReservations")
+	if m.PruneReservationsFunc != nil {
+		return m.PruneReservationsFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) SetFeatured(ctx context.Context, ids []string) error {
+	m.record("SetFeatured", ids)
+	if m.SetFeaturedFunc != nil {
+		return m.SetFeaturedFunc(ctx, ids)
+	}
+	return nil
+}
+
+func (m *MockDB) GetFeaturedOffers(ctx context.Context) (_ []*offers.Offer, _ error) {
+	m.record("GetFeaturedOffers")
+	if m.GetFeaturedOffersFunc != nil {
+		return m.GetFeaturedOffersFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) AddReport(ctx context.Context, offerID string, reason string) error {
+	m.record("AddReport", offerID, reason)
+	if m.AddReportFunc != nil {
+		return m.AddReportFunc(ctx, offerID, reason)
+	}
+	return nil
+}
+
+func (m *MockDB) ListReports(ctx context.Context, limit int) (_ []*offers.OfferReport, _ error) {
+	m.record("ListReports", limit)
+	if m.ListReportsFunc != nil {
+		return m.ListReportsFunc(ctx, limit)
+	}
+	return
+}
+
+func (m *MockDB) AddReview(ctx context.Context, offerID string, rating int, text string) error {
+	m.record("AddReview", offerID, rating, text)
+	if m.AddReviewFunc != nil {
+		return m.AddReviewFunc(ctx, offerID, rating, text)
+	}
+	return nil
+}
+
+func (m *MockDB) GetReviews(ctx context.Context, offerID string) (_ []*offers.Review, _ error) {
+	m.record("GetReviews", offerID)
+	if m.GetReviewsFunc != nil {
+		return m.GetReviewsFunc(ctx, offerID)
+	}
+	return
+}
+
+func (m *MockDB) AverageRating(ctx context.Context, offerID string) (_ offers.Rating, _ error) {
+	m.record("AverageRating", offerID)
+	if m.AverageRatingFunc != nil {
+		return m.AverageRatingFunc(ctx, offerID)
+	}
+	return
+}
+
+func (m *MockDB) AverageRatings(ctx context.Context, offerIDs []string) (_ map[string]offers.Rating, _ error) {
+	m.record("AverageRatings", offerIDs)
+	if m.AverageRatingsFunc != nil {
+		return m.AverageRatingsFunc(ctx, offerIDs)
+	}
+	return
+}
+
+func (m *MockDB) AddPriceAlert(ctx context.Context, offerID string, targetPrice string, contact string) (_ int64, _ error) {
+	m.record("AddPriceAlert", offerID, targetPrice, contact)
+	if m.AddPriceAlertFunc != nil {
+		return m.AddPriceAlertFunc(ctx, offerID, targetPrice, contact)
+	}
+	return
+}
+
+func (m *MockDB) ListPriceAlerts(ctx context.Context, limit int) (_ []*offers.PriceAlert, _ error) {
+	m.record("ListPriceAlerts", limit)
+	if m.ListPriceAlertsFunc != nil {
+		return m.ListPriceAlertsFunc(ctx, limit)
+	}
+	return
+}
+
+func (m *MockDB) DeletePriceAlert(ctx context.Context, id int64) error {
+	m.record("DeletePriceAlert", id)
+	if m.DeletePriceAlertFunc != nil {
+		return m.DeletePriceAlertFunc(ctx, id)
+	}
+	return nil
+}
+
+func (m *MockDB) TriggeredPriceAlerts(ctx context.Context) (_ []*offers.PriceAlert, _ error) {
+	m.record("TriggeredPriceAlerts")
+	if m.TriggeredPriceAlertsFunc != nil {
+		return m.TriggeredPriceAlertsFunc(ctx)
+	}
+	return
+}
+
+func (m *MockDB) SetPriceAlertFired(ctx context.Context, id int64, fired bool) (_ bool, _ error) {
+	m.record("SetPriceAlertFired", id, fired)
+	if m.SetPriceAlertFiredFunc != nil {
+		return m.SetPriceAlertFiredFunc(ctx, id, fired)
+	}
+	return
+}
+
+func (m *MockDB) RecomputeConvertedPrices(ctx context.Context, converter offers.CurrencyConverter, displayCurrency string) (_ int64, _ error) {
+	m.record("RecomputeConvertedPrices", converter, displayCurrency)
+	if m.RecomputeConvertedPricesFunc != nil {
+		return m.RecomputeConvertedPricesFunc(ctx, converter, displayCurrency)
+	}
+	return
+}
+
+func (m *MockDB) ListDuplicateOffers(ctx context.Context, limit int) (_ []*offers.Offer, _ error) {
+	m.record("ListDuplicateOffers", limit)
+	if m.ListDuplicateOffersFunc != nil {
+		return m.ListDuplicateOffersFunc(ctx, limit)
+	}
+	return
+}
+
+func (m *MockDB) SetCanonicalProducts(ctx context.Context, links map[string]string) error {
+	m.record("SetCanonicalProducts", links)
+	if m.SetCanonicalProductsFunc != nil {
+		return m.SetCanonicalProductsFunc(ctx, links)
+	}
+	return nil
+}
+
+func (m *MockDB) SetMetaOverrides(ctx context.Context, offerID string, title string, description string) error {
+	m.record("SetMetaOverrides", offerID, title, description)
+	if m.SetMetaOverridesFunc != nil {
+		return m.SetMetaOverridesFunc(ctx, offerID, title, description)
+	}
+	return nil
+}
+
+func (m *MockDB) PruneViews(ctx context.Context, before time.Time) (_ int64, _ error) {
+	m.record("PruneViews", before)
+	if m.PruneViewsFunc != nil {
+		return m.PruneViewsFunc(ctx, before)
+	}
+	return
+}
+
+func (m *MockDB) Check(ctx context.Context) error {
+	m.record("Check")
+	if m.CheckFunc != nil {
+		return m.CheckFunc(ctx)
+	}
+	return nil
+}
+
+func (m *MockDB) Close() error {
+	m.record("Close")
+	if m.CloseFunc != nil {
+		return m.CloseFunc()
+	}
+	return nil
+}
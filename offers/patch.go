@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// patchField is an offer field UpdateOfferFields can set.
+type patchField struct {
+	// column is the field's column, and placeholder its value in the SET
+	// clause.
+	column      string
+	placeholder string
+	// str returns the field, or nil for Quantity, the only field that isn't
+	// a string.
+	str func(o *Offer) *string
+}
+
+// patchFields are the fields UpdateOfferFields can set, by their names in
+// the JSON API. Only these names are ever written into SQL, so they also
+// guard against injection through field names.
+var patchFields = map[string]patchField{
+	"title":         {"title", "?", func(o *Offer) *string { return &o.Title }},
+	"price":         {"price", "NULLIF(?, '')", func(o *Offer) *string { return &o.Price }},
+	"currency":      {"currency", "?", func(o *Offer) *string { return &o.Currency }},
+	"image_url":     {"imageUrl", "?", func(o *Offer) *string { return &o.ImageURL }},
+	"description":   {"description", "?", func(o *Offer) *string { return &o.Description }},
+	"merchant_url":  {"merchantUrl", "?", func(o *Offer) *string { return &o.MerchantURL }},
+	"item_group_id": {"itemGroupId", "?", func(o *Offer) *string { return &o.ItemGroupID }},
+	"gtin":          {"gtin", "?", func(o *Offer) *string { return &o.GTIN }},
+	"brand":         {"brand", "?", func(o *Offer) *string { return &o.Brand }},
+	"category":      {"category", "?", func(o *Offer) *string { return &o.Category }},
+	"availability":  {"availability", "?", func(o *Offer) *string { return &o.Availability }},
+	"condition":     {"itemCondition", "?", func(o *Offer) *string { return &o.Condition }},
+	"sale_price":    {"salePrice", "NULLIF(?, '')", func(o *Offer) *string { return &o.SalePrice }},
+	"quantity":      {"quantity", "?", nil},
+}
+
+// SetFields sets the given fields of o, keyed by their names in the JSON
+// API, as UpdateOfferFields does. String fields take strings, and quantity a
+// non-negative whole number, as decoded from JSON. Unknown fields and values
+// of the wrong type are errors, in which case o may be partly changed, and a
+// version other than o.Version is ErrConcurrentModification. It doesn't
+// validate the result.
+func (o *Offer) SetFields(fields map[string]interface{}) error {
+	_, err := applyPatch(o, fields)
+	return err
+}
+
+// applyPatch is SetFields, and also returns the names of the fields set in
+// sorted order. A "version" field isn't set, but checked against o.Version.
+func applyPatch(o *Offer, fields map[string]interface{}) ([]string, error) {
+	names := make([]string, 0, len(fields))
+	for name, v := range fields {
+		if name != "version" {
+			names = append(names, name)
+			continue
+		}
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return nil, fmt.Errorf("offers: invalid version %v: must be a whole number", v)
+		}
+		if n != float64(o.Version) {
+			return nil, ErrConcurrentModification
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("offers: no fields to update for offer %s", o.ID)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, ok := patchFields[name]
+		if !ok {
+			return nil, fmt.Errorf("offers: unknown field %q", name)
+		}
+		v := fields[name]
+		if f.str == nil {
+			n, ok := v.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) || n > math.MaxInt64 {
+				return nil, fmt.Errorf("offers: invalid %s %v: must be a non-negative whole number", name, v)
+			}
+			o.Quantity = int64(n)
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("offers: invalid %s %v: must be a string", name, v)
+		}
+		*f.str(o) = s
+	}
+	return names, nil
+}
+
+// patchAssignments returns the SET clause writing the named fields of o,
+// and its arguments.
+func patchAssignments(o *Offer, names []string) (string, []interface{}) {
+	sets := make([]string, len(names))
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		f := patchFields[name]
+		sets[i] = f.column + " = " + f.placeholder
+		if f.str == nil {
+			args[i] = o.Quantity
+		} else {
+			args[i] = *f.str(o)
+		}
+	}
+	return strings.Join(sets, ", "), args
+}
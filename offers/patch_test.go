@@ -0,0 +1,48 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatchAssignments(t *testing.T) {
+	o := testOffer("a", "Chair", "10.00")
+	names, err := applyPatch(o, map[string]interface{}{
+		"sale_price": "",
+		"quantity":   float64(3),
+		"condition":  "used",
+	})
+	if err != nil {
+		t.Fatalf("applyPatch: %v", err)
+	}
+	if want := []string{"condition", "quantity", "sale_price"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("applyPatch set %q, want %q", names, want)
+	}
+	set, args := patchAssignments(o, names)
+	if want := "itemCondition = ?, quantity = ?, salePrice = NULLIF(?, '')"; set != want {
+		t.Errorf("SET clause = %q, want %q", set, want)
+	}
+	if want := []interface{}{"used", int64(3), ""}; !reflect.DeepEqual(args, want) {
+		t.Errorf("SET arguments = %v, want %v", args, want)
+	}
+
+	// Every whitelisted field writes only its own column.
+	for name, f := range patchFields {
+		var v interface{} = "x"
+		if f.str == nil {
+			v = float64(1)
+		}
+		names, err := applyPatch(testOffer("a", "Chair", "10.00"), map[string]interface{}{name: v})
+		if err != nil {
+			t.Errorf("applyPatch(%s): %v", name, err)
+			continue
+		}
+		if set, _ := patchAssignments(o, names); set != f.column+" = "+f.placeholder {
+			t.Errorf("SET clause for %s = %q, want only %s", name, set, f.column)
+		}
+	}
+}
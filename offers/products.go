@@ -2,11 +2,13 @@ package offers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"google.golang.org/api/content/v2"
 	"google.golang.org/api/googleapi"
@@ -14,116 +16,453 @@ import (
 
 const endpointEnvVar = "GOOGLE_SHOPPING_SAMPLES_ENDPOINT"
 
+// MaxProductPageSize is the largest page of products the Content API
+// returns.
+const MaxProductPageSize = 250
+
+// productListFields is the partial response requested when listing
+// products: the page token, and the product fields updateProducts reads.
+const productListFields googleapi.Field = "nextPageToken," +
+	"resources(id,title,imageLink,description,link,itemGroupId,gtin," +
+	"sellOnGoogleQuantity,brand,googleProductCategory,productTypes," +
+	"availability,condition,price,salePrice)"
+
+// SyncStats summarizes a run of RunUpdate.
+type SyncStats struct {
+	// Pages is the number of product list pages received.
+	Pages int
+	// Products is the number of products received.
+	Products int
+	// Changed is the number of offers that were added or changed, which is
+	// the number of rows written for them: unchanged offers aren't written.
+	Changed int
+	// Deleted is the number of offers deleted since they are no longer in
+	// Merchant Center.
+	Deleted int64
+	// Unpurchasable is the number of products without a valid link, which
+	// are excluded from the storefront list.
+	Unpurchasable int
+	// Unapproved is the number of products skipped because they aren't
+	// approved, as configured by ProductStatuses.
+	Unapproved int
+	// InvalidPrice is the number of products skipped because their price
+	// isn't a decimal number.
+	InvalidPrice int
+	// Unpriced is the number of products without a price, which are stored
+	// with an empty price and currency.
+	Unpriced int
+	// AlertsFired is the number of price alerts sent after the sync.
+	AlertsFired int
+
+	// AuthDuration is the time spent setting up the authenticated client.
+	AuthDuration time.Duration
+	// ListDuration is the time spent waiting for the Content API to list
+	// accounts and products.
+	ListDuration time.Duration
+	// WriteDuration is the time spent writing to the database.
+	WriteDuration time.Duration
+	// Duration is the time the whole update took.
+	Duration time.Duration
+}
+
+func (s SyncStats) String() string {
+	return fmt.Sprintf("%d products in %d pages, %d changed, %d deleted, %d without a link, %d unapproved skipped, %d with invalid prices skipped, %d without a price, %d price alerts sent; took %v (auth %v, list %v, write %v)",
+		s.Products, s.Pages, s.Changed, s.Deleted, s.Unpurchasable, s.Unapproved, s.InvalidPrice, s.Unpriced, s.AlertsFired, s.Duration, s.AuthDuration, s.ListDuration, s.WriteDuration)
+}
+
+// SubAccountFilter selects which sub-accounts of an MCA are synced.
+type SubAccountFilter struct {
+	// MaxAccounts is the maximum number of sub-accounts to sync. If zero,
+	// all sub-accounts are synced.
+	MaxAccounts int
+
+	// Allow, if not empty, lists the only sub-account IDs to sync.
+	Allow []uint64
+
+	// Deny lists sub-account IDs that are never synced.
+	Deny []uint64
+}
+
+// SubAccounts selects the MCA sub-accounts synced by RunUpdate.
+var SubAccounts SubAccountFilter
+
+// skip reports why the sub-account with the given ID should not be synced,
+// given how many accounts have been synced so far, or "" if it should be.
+func (f SubAccountFilter) skip(id uint64, synced int) string {
+	for _, d := range f.Deny {
+		if d == id {
+			return "denylisted"
+		}
+	}
+	if len(f.Allow) > 0 {
+		allowed := false
+		for _, a := range f.Allow {
+			if a == id {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "not allowlisted"
+		}
+	}
+	if f.MaxAccounts > 0 && synced >= f.MaxAccounts {
+		return fmt.Sprintf("already synced the maximum of %d accounts", f.MaxAccounts)
+	}
+	return ""
+}
+
+// StatusFilter selects which products are synced by their approval status.
+type StatusFilter struct {
+	// IncludeUnapproved syncs products regardless of their status. By
+	// default only products approved for at least one destination are
+	// synced, since the others can't be advertised.
+	IncludeUnapproved bool
+
+	// Destination, if set, requires products to be approved for that
+	// destination, such as "Shopping".
+	Destination string
+}
+
+// ProductStatuses selects the products synced by RunUpdate.
+var ProductStatuses StatusFilter
+
+// ListConfig configures how RunUpdate lists products.
+type ListConfig struct {
+	// PageSize is the number of products requested per page, up to
+	// MaxProductPageSize. If zero, the API's default is used.
+	PageSize int64
+}
+
+// ProductList configures the product listing of RunUpdate.
+var ProductList ListConfig
+
+// call returns the call listing the account's products, limited to the
+// fields updateProducts reads.
+func (c ListConfig) call(products *content.ProductsService, accountID uint64) *content.ProductsListCall {
+	call := products.List(accountID).Fields(productListFields)
+	if c.PageSize > 0 {
+		call = call.MaxResults(c.PageSize)
+	}
+	return call
+}
+
+// approved reports whether a product with the given status may be synced.
+func (f StatusFilter) approved(status *content.ProductStatus) bool {
+	for _, d := range status.DestinationStatuses {
+		if f.Destination != "" && !strings.EqualFold(d.Destination, f.Destination) {
+			continue
+		}
+		if d.ApprovalStatus == "approved" {
+			return true
+		}
+	}
+	return false
+}
+
+// approvedProducts returns the IDs of the account's products that pass the
+// filter, or nil if all products are synced.
+func (f StatusFilter) approvedProducts(ctx context.Context, service *content.APIService, accountID uint64) (map[string]bool, error) {
+	if f.IncludeUnapproved {
+		return nil, nil
+	}
+	approved := map[string]bool{}
+	statuses := content.NewProductstatusesService(service)
+	err := statuses.List(accountID).Pages(ctx, func(res *content.ProductstatusesListResponse) error {
+		for _, s := range res.Resources {
+			if f.approved(s) {
+				approved[s.ProductId] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing product statuses of account %d failed: %v", accountID, err)
+	}
+	return approved, nil
+}
+
 // The main business logic of updating offers information in the DB lies here.
-func updateOffersData(ctx context.Context, service *content.APIService, account *content.Account, isMCA bool) {
-	if err := DB.UpdateUpdated(); err != nil {
-		log.Fatalf("updating updating field failed: %v", err)
+// It writes through tx, a transaction, so shoppers see the offers as they
+// were until the whole sync commits. Every offer is marked stale first, and
+// every synced product marks its offer as fresh again, without writing it
+// unless it changed. Once all accounts are synced, the offers still stale
+// are no longer in Merchant Center and are deleted. If any account or page
+// fails, the error is returned to roll the sync back, since its offers can't
+// be told apart from removed ones.
+func updateOffersData(ctx context.Context, tx SyncWriter, service *content.APIService, account *content.Account, isMCA bool, stats *SyncStats, progress func(SyncStats)) error {
+	start := time.Now()
+	if err := tx.UpdateUpdated(ctx); err != nil {
+		return fmt.Errorf("could not mark offers stale: %v", err)
 	}
+	stats.WriteDuration += time.Since(start)
+
 	updateProductsList := func(account *content.Account) error {
+		// Without statuses, unapproved products can't be told apart, and
+		// syncing none of the account's products would delete them all.
+		statusStart := time.Now()
+		approved, err := ProductStatuses.approvedProducts(ctx, service, account.Id)
+		stats.ListDuration += time.Since(statusStart)
+		if err != nil {
+			return err
+		}
 		products := content.NewProductsService(service)
-		listCall := products.List(account.Id)
-		listCall.Pages(ctx, updateProducts)
+		listCall := ProductList.call(products, account.Id)
+		// Pages fetches each page before calling the callback, so the time
+		// between callbacks is spent waiting for the API.
+		fetchStart := time.Now()
+		err = listCall.Pages(ctx, func(res *content.ProductsListResponse) error {
+			fetched := time.Since(fetchStart)
+			stats.ListDuration += fetched
+			log.Printf("fetched %d products for account %d in %v", len(res.Resources), account.Id, fetched)
+			err := updateProducts(ctx, tx, int64(account.Id), res, approved, stats)
+			if progress != nil {
+				progress(*stats)
+			}
+			fetchStart = time.Now()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("syncing account %d failed: %v", account.Id, err)
+		}
 		return nil
 	}
+	synced := 0
 	updateAccountTables := func(res *content.AccountsListResponse) error {
 		for _, a := range res.Resources {
-			updateProductsList(a)
+			if reason := SubAccounts.skip(a.Id, synced); reason != "" {
+				// The offers synced from the account before are kept, so
+				// which accounts a cap leaves out doesn't delete them.
+				log.Printf("skipping account %d: %s", a.Id, reason)
+				if err := tx.KeepMerchantOffers(ctx, int64(a.Id)); err != nil {
+					return fmt.Errorf("could not keep the offers of account %d: %v", a.Id, err)
+				}
+				continue
+			}
+			synced++
+			if err := updateProductsList(a); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 	if !isMCA {
-		updateProductsList(account)
+		if err := updateProductsList(account); err != nil {
+			return err
+		}
 	} else {
 		accounts := content.NewAccountsService(service)
 		listCall := accounts.List(account.Id)
-		listCall.Pages(ctx, updateAccountTables)
+		fetchStart := time.Now()
+		err := listCall.Pages(ctx, func(res *content.AccountsListResponse) error {
+			stats.ListDuration += time.Since(fetchStart)
+			err := updateAccountTables(res)
+			fetchStart = time.Now()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("syncing sub-accounts of %d failed: %v", account.Id, err)
+		}
+	}
+
+	start = time.Now()
+	deleted, err := tx.DeleteOffers(ctx)
+	if err != nil {
+		return fmt.Errorf("could not delete stale offers: %v", err)
 	}
+	stats.Deleted += deleted
+	stats.WriteDuration += time.Since(start)
+	return nil
 }
 
-// Update data about all products in the offer DB. Add products if required.
-// At the end delete the unnecessary ones.
-func updateProducts(res *content.ProductsListResponse) error {
+// Update data about all products in the offer DB. Add products if required,
+// and mark every synced offer as fresh. The products are listed from the
+// account merchantID. If approved is not nil, only the products it contains
+// are synced.
+func updateProducts(ctx context.Context, tx SyncWriter, merchantID int64, res *content.ProductsListResponse, approved map[string]bool, stats *SyncStats) error {
+	start := time.Now()
+	defer func() { stats.WriteDuration += time.Since(start) }()
+
+	stats.Pages++
+	stats.Products += len(res.Resources)
+	batch := make([]*Offer, 0, len(res.Resources))
 	for _, product := range res.Resources {
-		id := product.Id
+		if approved != nil && !approved[product.Id] {
+			stats.Unapproved++
+			continue
+		}
 		o := &Offer{
-			ID:          product.Id,
-			Title:       product.Title,
-			Price:       product.Price.Value,
-			Currency:    product.Price.Currency,
-			ImageURL:    product.ImageLink,
-			Description: product.Description,
-			MerchantURL: product.Link,
-		}
-		if _, err := DB.GetOffer(id); err == nil {
-			DB.UpdateOffer(o)
-		}
-		if _, err := DB.AddOffer(o); err != nil {
-			return err
+			ID:           product.Id,
+			Title:        product.Title,
+			ImageURL:     product.ImageLink,
+			Description:  product.Description,
+			MerchantURL:  product.Link,
+			ItemGroupID:  product.ItemGroupId,
+			GTIN:         product.Gtin,
+			Quantity:     product.SellOnGoogleQuantity,
+			Brand:        product.Brand,
+			Category:     productCategory(product),
+			Availability: product.Availability,
+			Condition:    product.Condition,
+			MerchantID:   merchantID,
+		}
+		// Some products, such as service listings and incomplete items,
+		// have no price. They are kept, like products without a link, and
+		// shown without one.
+		if product.Price != nil {
+			o.Price, o.Currency = product.Price.Value, product.Price.Currency
+		} else {
+			log.Printf("product %s has no price", product.Id)
+			stats.Unpriced++
+		}
+		// A sale price is only kept in the currency of the price, since it
+		// is shown next to it.
+		if sale := product.SalePrice; sale != nil && o.Price != "" && sale.Currency == o.Currency {
+			o.SalePrice = sale.Value
 		}
+		// A bad price would fail the write and stop the sync, so skip
+		// the product instead; it is deleted at the end of the sync.
+		if err := o.validatePrice(); err != nil {
+			log.Printf("skipping product: %v", err)
+			stats.InvalidPrice++
+			continue
+		}
+		if !o.Purchasable() {
+			stats.Unpurchasable++
+		}
+		batch = append(batch, o)
 	}
-	return DB.DeleteOffers()
+	changed, err := tx.BulkUpsertOffers(ctx, batch)
+	if err != nil {
+		return err
+	}
+	stats.Changed += changed
+	log.Printf("%d of %d offers were new or changed", changed, len(res.Resources))
+	return nil
 }
 
-// For handling errors from the API:
-func dumpAPIErrorAndStop(e error, prefix string) {
-	gError, ok := e.(*googleapi.Error)
-	if ok {
-		fmt.Fprintf(os.Stderr, "\n\n%s:\nError %d: %s\n\n",
-			prefix, gError.Code, gError.Message)
-		log.Fatalln("Error from API, halting demos")
-	} else {
-		fmt.Fprintf(os.Stderr, "Non-API error (type %T) occurred.\n", e)
-		log.Fatal(e)
+// productCategory returns the category of a product: its Google product
+// category, or else the first of the merchant's product types.
+func productCategory(p *content.Product) string {
+	if p.GoogleProductCategory != "" {
+		return p.GoogleProductCategory
 	}
+	if len(p.ProductTypes) > 0 {
+		return p.ProductTypes[0]
+	}
+	return ""
+}
+
+// apiError describes an error from the API, prefixed with what failed.
+func apiError(e error, prefix string) error {
+	if gError, ok := e.(*googleapi.Error); ok {
+		return fmt.Errorf("%s: error %d from API: %s", prefix, gError.Code, gError.Message)
+	}
+	return fmt.Errorf("%s: non-API error (type %T): %v", prefix, e, e)
 }
 
 // RunUpdate runs the pipeline to update the sqlDB using the latest data from
-// the content API.
-func RunUpdate(id int64, logFile string) {
+// the content API, and returns statistics about the update. Content API
+// requests are logged as configured by logCfg. An error means the sync
+// couldn't start, or failed and was rolled back.
+// If progress is not nil, it is called with the statistics so far after
+// every page of products.
+func RunUpdate(id int64, logCfg LogConfig, progress func(SyncStats)) (SyncStats, error) {
+	var stats SyncStats
+	start := time.Now()
 	configPath := "merchant-center"
 	if id == int64(0) {
-		log.Fatal("valid merchant_id should be provided")
-	}
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		log.Fatalf("Configuration directory %s does not exist", configPath)
+		return stats, errors.New("valid merchant_id should be provided")
 	}
 
 	// Set up the API service to be passed to the demos.
 	ctx := context.Background()
-	client := authWithGoogle(ctx, configPath)
+	authStart := time.Now()
+	client, err := authWithGoogle(ctx, configPath, APIClient)
+	if err != nil {
+		return stats, err
+	}
+	if w, err := logCfg.open(); err != nil {
+		log.Printf("not logging API requests: %v", err)
+	} else if w != nil {
+		defer w.Close()
+		logClient(client, w)
+	}
+	// A momentary rate limit or server error shouldn't fail the sync.
+	retryClient(client)
 	contentService, err := content.New(client)
 	if err != nil {
-		log.Fatal(err)
+		return stats, err
 	}
+	stats.AuthDuration = time.Since(authStart)
 	contentService.UserAgent = "Content API for Shopping Samples"
 	baseURL := os.Getenv(endpointEnvVar)
 	if baseURL != "" {
 		// There may be other issues with the base URL that show up during calls,
 		// but let's do some straightforward syntactic checks here.
-		u, err := url.Parse(baseURL)
+		basePath, err := normalizeBasePath(baseURL)
 		if err != nil {
-			log.Fatal("Failure to parse " + endpointEnvVar + " value as URL: " + err.Error())
-		}
-		if !u.IsAbs() {
-			log.Fatal("Expected absolute URL for " + endpointEnvVar + " value: " + baseURL)
+			return stats, fmt.Errorf("invalid %s value: %v", endpointEnvVar, err)
 		}
-		// The API client expects the contents of BasePath will have a trailing /.
-		contentService.BasePath = strings.TrimSuffix(u.String(), "/") + "/"
+		contentService.BasePath = basePath
 		fmt.Println("Using non-standard API endpoint URL: " + contentService.BasePath)
 	}
-	retrieve(ctx, contentService, id)
+	if err := retrieve(ctx, contentService, id, &stats, progress); err != nil {
+		return stats, err
+	}
+	if groups, err := DetectDuplicates(ctx); err != nil {
+		log.Printf("could not detect duplicate offers: %v", err)
+	} else {
+		log.Printf("found %d groups of duplicate offers", len(groups))
+	}
+	if AlertNotifier != nil {
+		n, err := FirePriceAlerts(ctx, SyncDB, AlertNotifier)
+		if err != nil {
+			log.Printf("could not fire price alerts: %v", err)
+		}
+		stats.AlertsFired = n
+	}
+	stats.Duration = time.Since(start)
+	log.Printf("update finished: %v", stats)
+	return stats, nil
+}
+
+// normalizeBasePath converts an endpoint URL into the form the API client
+// expects for BasePath: an absolute URL without query or fragment, whose path
+// keeps any prefix (such as "/v2") and ends in exactly one slash.
+func normalizeBasePath(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL: %v", err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("expected absolute URL: %s", endpoint)
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	// Drop empty segments so "//" in the path and trailing slashes collapse.
+	segments := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	u.Path = "/"
+	if len(segments) > 0 {
+		u.Path += strings.Join(segments, "/") + "/"
+	}
+	u.RawPath = ""
+	return u.String(), nil
 }
 
 // Retrieve Merchant Center-located information for the configured merchant.
-func retrieve(ctx context.Context, service *content.APIService, id int64) {
+func retrieve(ctx context.Context, service *content.APIService, id int64, stats *SyncStats, progress func(SyncStats)) error {
 	accounts := content.NewAccountsService(service)
 	fmt.Println("Getting authenticated account information.")
 	authinfo, err := accounts.Authinfo().Do()
 	if err != nil {
-		dumpAPIErrorAndStop(err, "Getting information for authenticated account failed")
+		return apiError(err, "getting information for authenticated account failed")
 	}
 	if len(authinfo.AccountIdentifiers) == 0 {
-		log.Fatal("The current authenticated user has no access to any Merchant Center accounts.")
+		return errors.New("the current authenticated user has no access to any Merchant Center accounts")
 	}
 	// If we have no configured Merchant Center ID, then default to the first one provided
 	// from authinfo.
@@ -156,7 +495,9 @@ CheckAccounts:
 	}
 	account, err := accounts.Get(uint64(id), uint64(id)).Do()
 	if err != nil {
-		dumpAPIErrorAndStop(err, "Getting Merchant Center account information failed")
+		return apiError(err, "getting Merchant Center account information failed")
 	}
-	updateOffersData(ctx, service, account, isMCA)
+	return SyncDB.WithTx(ctx, func(tx SyncWriter) error {
+		return updateOffersData(ctx, tx, service, account, isMCA, stats, progress)
+	})
 }
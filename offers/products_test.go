@@ -0,0 +1,844 @@
+package offers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/content/v2"
+)
+
+// fakeContentAPI serves the Content API calls RunUpdate makes, and issues the
+// tokens authorizing them.
+type fakeContentAPI struct {
+	// merchantID is the authenticated account. If subAccounts is set, it is
+	// an MCA with those sub-accounts.
+	merchantID  uint64
+	subAccounts []uint64
+
+	// products holds the pages of products of each account, and statuses
+	// the destination statuses of products by ID. Products without statuses
+	// are approved for Shopping.
+	products map[uint64][][]*content.Product
+	statuses map[string][]*content.ProductStatusDestinationStatus
+
+	// delay is how long each list request takes.
+	delay time.Duration
+
+	// failWith, if set, is the status every API request fails with.
+	failWith int
+	// failPage, if set, is the page of products, from 1, whose request
+	// fails with 400 Bad Request.
+	failPage int
+
+	mu          sync.Mutex
+	requests    []string     // paths of the API requests, in order
+	listQueries []url.Values // queries of the product list requests, in order
+}
+
+func (f *fakeContentAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		tokenHandler(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/content/v2/")
+	f.mu.Lock()
+	f.requests = append(f.requests, path)
+	f.mu.Unlock()
+	if f.failWith != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.failWith)
+		fmt.Fprintf(w, `{"error": {"code": %d, "message": "request failed"}}`, f.failWith)
+		return
+	}
+
+	// page returns the page of n pages the request's pageToken selects,
+	// setting the token of the next.
+	page := func(n int, next *string) int {
+		i, _ := strconv.Atoi(r.FormValue("pageToken"))
+		if i+1 < n {
+			*next = strconv.Itoa(i + 1)
+		}
+		return i
+	}
+	parts := strings.Split(path, "/")
+	var res interface{}
+	switch {
+	case path == "accounts/authinfo":
+		id := &content.AccountIdentifier{MerchantId: f.merchantID}
+		if f.subAccounts != nil {
+			id = &content.AccountIdentifier{AggregatorId: f.merchantID}
+		}
+		res = &content.AccountsAuthInfoResponse{AccountIdentifiers: []*content.AccountIdentifier{id}}
+	case len(parts) == 3 && parts[1] == "accounts":
+		id, _ := strconv.ParseUint(parts[2], 10, 64)
+		res = &content.Account{Id: id}
+	case len(parts) == 2 && parts[1] == "accounts":
+		time.Sleep(f.delay)
+		list := &content.AccountsListResponse{}
+		for _, id := range f.subAccounts {
+			list.Resources = append(list.Resources, &content.Account{Id: id})
+		}
+		res = list
+	case len(parts) == 2 && parts[1] == "productstatuses":
+		time.Sleep(f.delay)
+		id, _ := strconv.ParseUint(parts[0], 10, 64)
+		list := &content.ProductstatusesListResponse{}
+		for _, products := range f.products[id] {
+			for _, p := range products {
+				statuses, ok := f.statuses[p.Id]
+				if !ok {
+					statuses = []*content.ProductStatusDestinationStatus{
+						{Destination: "Shopping", ApprovalStatus: "approved"},
+					}
+				}
+				list.Resources = append(list.Resources, &content.ProductStatus{
+					ProductId:           p.Id,
+					DestinationStatuses: statuses,
+				})
+			}
+		}
+		res = list
+	case len(parts) == 2 && parts[1] == "products":
+		time.Sleep(f.delay)
+		f.mu.Lock()
+		f.listQueries = append(f.listQueries, r.URL.Query())
+		f.mu.Unlock()
+		id, _ := strconv.ParseUint(parts[0], 10, 64)
+		pages := f.products[id]
+		list := &content.ProductsListResponse{}
+		if len(pages) > 0 {
+			i := page(len(pages), &list.NextPageToken)
+			if i+1 == f.failPage {
+				http.Error(w, `{"error": {"code": 400, "message": "bad page"}}`, http.StatusBadRequest)
+				return
+			}
+			list.Resources = pages[i]
+		}
+		res = list
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// productRequests returns the accounts whose products were listed, in order,
+// once per page.
+func (f *fakeContentAPI) productRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var accounts []string
+	for _, path := range f.requests {
+		if strings.HasSuffix(path, "/products") {
+			accounts = append(accounts, strings.TrimSuffix(path, "/products"))
+		}
+	}
+	return accounts
+}
+
+// useFakeContentAPI points RunUpdate at api, with db as the sync database,
+// until the test ends.
+func useFakeContentAPI(t *testing.T, api *fakeContentAPI, db OfferDatabase) {
+	t.Helper()
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	t.Setenv(endpointEnvVar, srv.URL+"/content/v2/")
+
+	savedClient, savedSyncDB := APIClient, SyncDB
+	t.Cleanup(func() { APIClient, SyncDB = savedClient, savedSyncDB })
+	APIClient = ClientConfig{
+		Auth:            AuthCredentials,
+		CredentialsJSON: testServiceAccount(t, srv.URL+"/token"),
+	}
+	SyncDB = db
+}
+
+// testProduct returns a valid product with the given ID, title and price.
+func testProduct(id, title, price string) *content.Product {
+	return &content.Product{
+		Id:        id,
+		Title:     title,
+		Link:      "https://example.com/products/" + id,
+		ImageLink: "https://example.com/images/" + id + ".png",
+		Price:     &content.Price{Value: price, Currency: "USD"},
+	}
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	for _, tt := range []struct {
+		endpoint, want string
+	}{
+		{"https://host", "https://host/"},
+		{"https://host/", "https://host/"},
+		{"https://host/v2", "https://host/v2/"},
+		{"https://host/v2/", "https://host/v2/"},
+		{"https://host/content/v2//", "https://host/content/v2/"},
+		{"https://host//content//v2", "https://host/content/v2/"},
+		{"https://host/v2/?alt=json", "https://host/v2/"},
+		{"https://host/v2?key=abc#top", "https://host/v2/"},
+		{"https://host?", "https://host/"},
+		{"http://localhost:8080/api", "http://localhost:8080/api/"},
+	} {
+		got, err := normalizeBasePath(tt.endpoint)
+		if err != nil {
+			t.Errorf("normalizeBasePath(%q): %v", tt.endpoint, err)
+		} else if got != tt.want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeBasePathInvalid(t *testing.T) {
+	for _, endpoint := range []string{
+		"",
+		"host/v2",
+		"/content/v2/",
+		"https://",
+		"https://host:port/",
+		"://host",
+	} {
+		if got, err := normalizeBasePath(endpoint); err == nil {
+			t.Errorf("normalizeBasePath(%q) = %q, want an error", endpoint, got)
+		}
+	}
+}
+
+func TestUpdateProductsItemGroup(t *testing.T) {
+	db := NewMemoryDB()
+	res := &content.ProductsListResponse{Resources: []*content.Product{
+		{Id: "online:en:US:shirt-s", Title: "Small shirt", ItemGroupId: "shirt", Link: "https://example.com/s", ImageLink: "https://example.com/s.png", Price: &content.Price{Value: "10.00", Currency: "USD"}},
+		{Id: "online:en:US:shirt-l", Title: "Large shirt", ItemGroupId: "shirt", Link: "https://example.com/l", ImageLink: "https://example.com/l.png", Price: &content.Price{Value: "12.00", Currency: "USD"}},
+		{Id: "online:en:US:hat", Title: "Hat", Link: "https://example.com/h", ImageLink: "https://example.com/h.png", Price: &content.Price{Value: "5.00", Currency: "USD"}},
+	}}
+	err := db.WithTx(context.Background(), func(tx SyncWriter) error {
+		return updateProducts(context.Background(), tx, 1, res, nil, &SyncStats{})
+	})
+	if err != nil {
+		t.Fatalf("updateProducts: %v", err)
+	}
+	list, err := db.GetVariants(context.Background(), "shirt")
+	if err != nil {
+		t.Fatalf("GetVariants: %v", err)
+	}
+	checkIDs(t, "GetVariants(shirt)", list, "online:en:US:shirt-l", "online:en:US:shirt-s")
+	if o := getOffer(t, db, "online:en:US:hat"); o.ItemGroupID != "" {
+		t.Errorf("ungrouped product has item group %q", o.ItemGroupID)
+	}
+}
+
+func TestUpdateProductsCategory(t *testing.T) {
+	both := testProduct("both", "Both", "1.00")
+	both.GoogleProductCategory = "Home & Garden > Lawn & Garden"
+	both.ProductTypes = []string{"Garden > Gnomes"}
+	types := testProduct("types", "Types", "1.00")
+	types.ProductTypes = []string{"Garden > Gnomes", "Gifts"}
+	res := &content.ProductsListResponse{Resources: []*content.Product{both, types, testProduct("none", "None", "1.00")}}
+	db := NewMemoryDB()
+	err := db.WithTx(context.Background(), func(tx SyncWriter) error {
+		return updateProducts(context.Background(), tx, 1, res, nil, &SyncStats{})
+	})
+	if err != nil {
+		t.Fatalf("updateProducts: %v", err)
+	}
+	for id, want := range map[string]string{
+		"both":  "Home & Garden > Lawn & Garden",
+		"types": "Garden > Gnomes",
+		"none":  "",
+	} {
+		if o := getOffer(t, db, id); o.Category != want {
+			t.Errorf("offer %s has category %q, want %q", id, o.Category, want)
+		}
+	}
+}
+
+func TestUpdateProductsFields(t *testing.T) {
+	full := testProduct("full", "Garden chair", "20.00")
+	full.Brand = "Acme"
+	full.Gtin = "00012345678905"
+	full.Availability = "out of stock"
+	full.Condition = "refurbished"
+	full.SalePrice = &content.Price{Value: "15.00", Currency: "USD"}
+	// A sale price in another currency can't be shown next to the price.
+	euros := testProduct("euros", "Garden table", "50.00")
+	euros.SalePrice = &content.Price{Value: "40.00", Currency: "EUR"}
+	badSale := testProduct("bad-sale", "Garden shed", "300.00")
+	badSale.SalePrice = &content.Price{Value: "cheap", Currency: "USD"}
+	res := &content.ProductsListResponse{Resources: []*content.Product{full, euros, badSale}}
+	db := NewMemoryDB()
+	var stats SyncStats
+	err := db.WithTx(context.Background(), func(tx SyncWriter) error {
+		return updateProducts(context.Background(), tx, 1, res, nil, &stats)
+	})
+	if err != nil {
+		t.Fatalf("updateProducts: %v", err)
+	}
+
+	o := getOffer(t, db, "full")
+	if o.Brand != "Acme" || o.GTIN != "00012345678905" || o.Availability != "out of stock" || o.Condition != "refurbished" || o.SalePrice != "15.00" {
+		t.Errorf("synced offer = %+v, want the brand, GTIN, availability, condition and sale price of the product", o)
+	}
+	if !o.OutOfStock() {
+		t.Error("offer listed as out of stock isn't out of stock")
+	}
+	if o := getOffer(t, db, "euros"); o.SalePrice != "" || o.Price != "50.00" {
+		t.Errorf("offer with a sale price in euros has price %q and sale price %q, want 50.00 and none", o.Price, o.SalePrice)
+	}
+	// A malformed sale price skips the product, like a malformed price.
+	if _, err := db.GetOffer(context.Background(), "bad-sale"); err != ErrOfferNotFound || stats.InvalidPrice != 1 {
+		t.Errorf("product with a bad sale price: GetOffer error %v, %d invalid prices; want ErrOfferNotFound and 1", err, stats.InvalidPrice)
+	}
+}
+
+func TestRunUpdatePhaseDurations(t *testing.T) {
+	db := NewMemoryDB()
+	api := &fakeContentAPI{
+		merchantID: 123,
+		products: map[uint64][][]*content.Product{123: {
+			{testProduct("a", "A", "1.00"), testProduct("b", "B", "2.00")},
+			{testProduct("c", "C", "3.00")},
+		}},
+		delay: 10 * time.Millisecond,
+	}
+	useFakeContentAPI(t, api, db)
+
+	var progress []SyncStats
+	stats, err := RunUpdate(123, LogConfig{}, func(s SyncStats) { progress = append(progress, s) })
+	if err != nil {
+		t.Fatalf("RunUpdate: %v", err)
+	}
+	if stats.Pages != 2 || stats.Products != 3 || stats.Changed != 3 {
+		t.Errorf("stats = %v, want 3 products changed in 2 pages", stats)
+	}
+	for _, d := range []struct {
+		phase string
+		d     time.Duration
+	}{
+		{"auth", stats.AuthDuration},
+		{"list", stats.ListDuration},
+		{"write", stats.WriteDuration},
+		{"total", stats.Duration},
+	} {
+		if d.d <= 0 {
+			t.Errorf("%s duration = %v, want more than 0", d.phase, d.d)
+		}
+	}
+	// Listing includes the statuses and both product pages, each delayed.
+	if min := 3 * api.delay; stats.ListDuration < min {
+		t.Errorf("list duration = %v, want at least %v", stats.ListDuration, min)
+	}
+	if sum := stats.AuthDuration + stats.ListDuration + stats.WriteDuration; sum > stats.Duration {
+		t.Errorf("phases took %v, more than the whole update's %v", sum, stats.Duration)
+	}
+	if !strings.Contains(stats.String(), "list "+stats.ListDuration.String()) {
+		t.Errorf("stats %q don't include the list duration", stats)
+	}
+	// Progress is reported after each page, with the durations so far.
+	if len(progress) != 2 {
+		t.Fatalf("progress reported %d times, want once per page", len(progress))
+	}
+	if p := progress[0]; p.Pages != 1 || p.ListDuration <= 0 || p.ListDuration > stats.ListDuration {
+		t.Errorf("progress after the first page = %v", p)
+	}
+}
+
+func TestSubAccountFilterSkip(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter SubAccountFilter
+		id     uint64
+		synced int
+		skip   bool
+	}{
+		{"no filter", SubAccountFilter{}, 1, 100, false},
+		{"under the cap", SubAccountFilter{MaxAccounts: 2}, 1, 1, false},
+		{"at the cap", SubAccountFilter{MaxAccounts: 2}, 1, 2, true},
+		{"allowlisted", SubAccountFilter{Allow: []uint64{1, 2}}, 2, 0, false},
+		{"not allowlisted", SubAccountFilter{Allow: []uint64{1, 2}}, 3, 0, true},
+		{"denylisted", SubAccountFilter{Deny: []uint64{3}}, 3, 0, true},
+		{"allowlisted and denylisted", SubAccountFilter{Allow: []uint64{3}, Deny: []uint64{3}}, 3, 0, true},
+	} {
+		if reason := tt.filter.skip(tt.id, tt.synced); (reason != "") != tt.skip {
+			t.Errorf("%s: skip(%d, %d) = %q, want skipped %t", tt.name, tt.id, tt.synced, reason, tt.skip)
+		}
+	}
+}
+
+func TestRunUpdateSubAccounts(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		filter SubAccountFilter
+		want   []string
+	}{
+		{"all", SubAccountFilter{}, []string{"11", "12", "13", "14"}},
+		{"cap", SubAccountFilter{MaxAccounts: 2}, []string{"11", "12"}},
+		{"allowlist", SubAccountFilter{Allow: []uint64{12, 14}}, []string{"12", "14"}},
+		{"denylist", SubAccountFilter{Deny: []uint64{11}}, []string{"12", "13", "14"}},
+		// The cap counts the accounts synced, not those skipped.
+		{"cap after denylist", SubAccountFilter{MaxAccounts: 2, Deny: []uint64{11, 13}}, []string{"12", "14"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := SubAccounts
+			defer func() { SubAccounts = saved }()
+			SubAccounts = tt.filter
+
+			api := &fakeContentAPI{
+				merchantID:  10,
+				subAccounts: []uint64{11, 12, 13, 14},
+				products:    map[uint64][][]*content.Product{},
+			}
+			for _, id := range api.subAccounts {
+				pid := strconv.FormatUint(id, 10)
+				api.products[id] = [][]*content.Product{{testProduct(pid, "Product "+pid, "1.00")}}
+			}
+			db := NewMemoryDB()
+			useFakeContentAPI(t, api, db)
+
+			stats, err := RunUpdate(10, LogConfig{}, nil)
+			if err != nil {
+				t.Fatalf("RunUpdate: %v", err)
+			}
+			if got := api.productRequests(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listed products of accounts %q, want %q", got, tt.want)
+			}
+			if stats.Products != len(tt.want) {
+				t.Errorf("synced %d products, want %d", stats.Products, len(tt.want))
+			}
+			list, _, err := db.ListOffers(context.Background(), ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIDs(t, "synced offers", list, tt.want...)
+		})
+	}
+}
+
+func TestRunUpdateRecordsMerchant(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		api := &fakeContentAPI{
+			merchantID:  10,
+			subAccounts: []uint64{11, 12},
+			products: map[uint64][][]*content.Product{
+				11: {{testProduct("a", "Chair", "10.00"), testProduct("b", "Table", "50.00")}},
+				12: {{testProduct("c", "Lamp", "5.00")}},
+			},
+		}
+		useFakeContentAPI(t, api, db)
+		if _, err := RunUpdate(10, LogConfig{}, nil); err != nil {
+			t.Fatalf("RunUpdate: %v", err)
+		}
+		ctx := context.Background()
+		for _, tt := range []struct {
+			merchantID int64
+			want       []string
+		}{{11, []string{"a", "b"}}, {12, []string{"c"}}, {10, nil}} {
+			list, err := db.ListOffersByMerchant(ctx, tt.merchantID, 10, 0)
+			if err != nil {
+				t.Fatalf("ListOffersByMerchant(%d): %v", tt.merchantID, err)
+			}
+			checkIDs(t, fmt.Sprintf("offers of account %d", tt.merchantID), list, tt.want...)
+		}
+		if o := getOffer(t, db, "c"); o.MerchantID != 12 {
+			t.Errorf("offer c has merchant %d, want 12", o.MerchantID)
+		}
+	})
+}
+
+func TestRunUpdateKeepsSkippedAccounts(t *testing.T) {
+	saved := SubAccounts
+	defer func() { SubAccounts = saved }()
+
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		api := &fakeContentAPI{
+			merchantID:  10,
+			subAccounts: []uint64{11, 12, 13},
+			products: map[uint64][][]*content.Product{
+				11: {{testProduct("a", "Chair", "10.00"), testProduct("b", "Table", "50.00")}},
+				12: {{testProduct("c", "Lamp", "5.00")}},
+				13: {{testProduct("d", "Rug", "30.00")}},
+			},
+		}
+		useFakeContentAPI(t, api, db)
+		SubAccounts = SubAccountFilter{}
+		if _, err := RunUpdate(10, LogConfig{}, nil); err != nil {
+			t.Fatalf("first RunUpdate: %v", err)
+		}
+		// An offer added outside a sync is still deleted by the next.
+		addOffers(t, db, testOffer("manual", "Vase", "8.00"))
+
+		// Only the first account fits the cap, and the third is denied. The
+		// offers of the others are kept, but b, gone from the first, isn't.
+		api.products[11] = [][]*content.Product{{testProduct("a", "Chair", "10.00")}}
+		api.products[12] = [][]*content.Product{{testProduct("e", "Stool", "15.00")}}
+		SubAccounts = SubAccountFilter{MaxAccounts: 1, Deny: []uint64{13}}
+		stats, err := RunUpdate(10, LogConfig{}, nil)
+		if err != nil {
+			t.Fatalf("capped RunUpdate: %v", err)
+		}
+		if stats.Deleted != 2 {
+			t.Errorf("capped sync deleted %d offers, want b and the manual one", stats.Deleted)
+		}
+		list, _, err := db.ListOffers(context.Background(), ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIDs(t, "offers after the capped sync", list, "a", "c", "d")
+		if o := getOffer(t, db, "c"); o.Title != "Lamp" || o.MerchantID != 12 {
+			t.Errorf("offer of the skipped account is %q from %d, want it unchanged", o.Title, o.MerchantID)
+		}
+	})
+}
+
+func TestUpdateProductsCountsUnpurchasable(t *testing.T) {
+	noLink := testProduct("no-link", "No link", "1.00")
+	noLink.Link = ""
+	badLink := testProduct("bad-link", "Bad link", "1.00")
+	badLink.Link = "example.com/bad-link"
+	res := &content.ProductsListResponse{Resources: []*content.Product{
+		testProduct("a", "A", "1.00"), noLink, badLink,
+	}}
+	db := NewMemoryDB()
+	var stats SyncStats
+	err := db.WithTx(context.Background(), func(tx SyncWriter) error {
+		return updateProducts(context.Background(), tx, 1, res, nil, &stats)
+	})
+	if err != nil {
+		t.Fatalf("updateProducts: %v", err)
+	}
+	if stats.Unpurchasable != 2 || stats.Changed != 3 {
+		t.Errorf("stats = %v, want 3 changed, 2 of them without a link", stats)
+	}
+	// Offers without a link are kept, so admins can see them.
+	all, _, err := db.ListOffers(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("%d offers stored, want 3", len(all))
+	}
+}
+
+func TestRunUpdateWritesToSyncDB(t *testing.T) {
+	serving := NewMemoryDB()
+	addOffers(t, serving, testOffer("old", "Old", "1.00"))
+	savedDB := DB
+	defer func() { DB = savedDB }()
+	DB = serving
+
+	syncDB := NewMemoryDB()
+	api := &fakeContentAPI{
+		merchantID: 123,
+		products:   map[uint64][][]*content.Product{123: {{testProduct("a", "A", "1.00")}}},
+	}
+	useFakeContentAPI(t, api, syncDB)
+	if _, err := RunUpdate(123, LogConfig{}, nil); err != nil {
+		t.Fatalf("RunUpdate: %v", err)
+	}
+
+	list, _, err := syncDB.ListOffers(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "sync database offers", list, "a")
+	// The serving database is left alone; replication or a shared
+	// instance brings the changes to it.
+	list, _, err = serving.ListOffers(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "serving database offers", list, "old")
+}
+
+func TestRunUpdateProductStatuses(t *testing.T) {
+	approved := func(destination string) *content.ProductStatusDestinationStatus {
+		return &content.ProductStatusDestinationStatus{Destination: destination, ApprovalStatus: "approved"}
+	}
+	disapproved := func(destination string) *content.ProductStatusDestinationStatus {
+		return &content.ProductStatusDestinationStatus{Destination: destination, ApprovalStatus: "disapproved"}
+	}
+	statuses := map[string][]*content.ProductStatusDestinationStatus{
+		"shopping":    {approved("Shopping")},
+		"actions":     {disapproved("Shopping"), approved("ShoppingActions")},
+		"disapproved": {disapproved("Shopping"), disapproved("ShoppingActions")},
+		"pending":     {{Destination: "Shopping", ApprovalStatus: "pending"}},
+		"none":        {},
+	}
+	for _, tt := range []struct {
+		name   string
+		filter StatusFilter
+		want   []string
+	}{
+		{"default", StatusFilter{}, []string{"actions", "shopping"}},
+		{"destination", StatusFilter{Destination: "shopping"}, []string{"shopping"}},
+		{"include unapproved", StatusFilter{IncludeUnapproved: true}, []string{"actions", "disapproved", "none", "pending", "shopping"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := ProductStatuses
+			defer func() { ProductStatuses = saved }()
+			ProductStatuses = tt.filter
+
+			api := &fakeContentAPI{merchantID: 10, statuses: statuses}
+			var page []*content.Product
+			for _, id := range []string{"actions", "disapproved", "none", "pending", "shopping"} {
+				page = append(page, testProduct(id, "Product "+id, "1.00"))
+			}
+			api.products = map[uint64][][]*content.Product{10: {page}}
+			db := NewMemoryDB()
+			useFakeContentAPI(t, api, db)
+
+			stats, err := RunUpdate(10, LogConfig{}, nil)
+			if err != nil {
+				t.Fatalf("RunUpdate: %v", err)
+			}
+			if want := len(page) - len(tt.want); stats.Unapproved != want {
+				t.Errorf("Unapproved = %d, want %d", stats.Unapproved, want)
+			}
+			list, _, err := db.ListOffers(context.Background(), ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIDs(t, "synced offers", list, tt.want...)
+		})
+	}
+}
+
+func TestUpdateProductsTwice(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		res := &content.ProductsListResponse{Resources: []*content.Product{
+			testProduct("a", "Chair", "10.00"),
+			testProduct("b", "Table", "20.00"),
+			testProduct("c", "Lamp", "5.00"),
+		}}
+		rows := func() int {
+			t.Helper()
+			n := 0
+			if err := db.ForEachOffer(ctx, func(*Offer) error { n++; return nil }); err != nil {
+				t.Fatalf("ForEachOffer: %v", err)
+			}
+			return n
+		}
+		for i, wantChanged := range []int{3, 0} {
+			var stats SyncStats
+			err := db.WithTx(ctx, func(tx SyncWriter) error {
+				return updateProducts(ctx, tx, 1, res, nil, &stats)
+			})
+			if err != nil {
+				t.Fatalf("updateProducts run %d: %v", i+1, err)
+			}
+			// Existing offers are updated rather than inserted again.
+			if n := rows(); n != len(res.Resources) {
+				t.Errorf("%d rows after run %d, want %d", n, i+1, len(res.Resources))
+			}
+			if stats.Changed != wantChanged {
+				t.Errorf("run %d changed %d offers, want %d", i+1, stats.Changed, wantChanged)
+			}
+		}
+	})
+}
+
+func TestRunUpdateWithoutPrice(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		unpriced := testProduct("service", "Lawn mowing", "")
+		unpriced.Price = nil
+		unpriced.SalePrice = &content.Price{Value: "5.00", Currency: "USD"}
+		api := &fakeContentAPI{merchantID: 10, products: map[uint64][][]*content.Product{
+			10: {{testProduct("a", "Chair", "10.00"), unpriced}},
+		}}
+		useFakeContentAPI(t, api, db)
+
+		stats, err := RunUpdate(10, LogConfig{}, nil)
+		if err != nil {
+			t.Fatalf("RunUpdate with a product without a price: %v", err)
+		}
+		if stats.Unpriced != 1 || stats.InvalidPrice != 0 || stats.Changed != 2 {
+			t.Errorf("stats = %v, want 2 changed, 1 of them without a price", stats)
+		}
+		o := getOffer(t, db, "service")
+		if o.Title != "Lawn mowing" || o.Price != "" || o.Currency != "" || o.SalePrice != "" {
+			t.Errorf("offer without a price = %+v, want it stored without a price or sale price", o)
+		}
+		if o := getOffer(t, db, "a"); o.Price != "10.00" {
+			t.Errorf("priced offer has price %q, want 10.00", o.Price)
+		}
+	})
+}
+
+func TestRunUpdateDeletesVanishedOffers(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		api := &fakeContentAPI{merchantID: 10}
+		useFakeContentAPI(t, api, db)
+		update := func(wantDeleted int64, pages ...[]*content.Product) {
+			t.Helper()
+			api.products = map[uint64][][]*content.Product{10: pages}
+			stats, err := RunUpdate(10, LogConfig{}, nil)
+			if err != nil {
+				t.Fatalf("RunUpdate: %v", err)
+			}
+			if stats.Deleted != wantDeleted {
+				t.Errorf("sync deleted %d offers, want %d", stats.Deleted, wantDeleted)
+			}
+		}
+		listed := func(name string, opts ListOptions, want ...string) {
+			t.Helper()
+			opts.Sort = SortByTitle
+			list, _, err := db.ListOffers(ctx, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIDs(t, name, list, want...)
+		}
+
+		update(0,
+			[]*content.Product{testProduct("a", "Chair", "10.00"), testProduct("b", "Lamp", "5.00")},
+			[]*content.Product{testProduct("c", "Table", "20.00")})
+		listed("offers after the first sync", ListOptions{}, "a", "b", "c")
+
+		// The lamp leaves the feed and a new offer joins it, on another
+		// page.
+		update(1,
+			[]*content.Product{testProduct("a", "Chair", "10.00")},
+			[]*content.Product{testProduct("c", "Table", "20.00"), testProduct("d", "Desk", "30.00")})
+		listed("offers after the lamp vanished", ListOptions{}, "a", "d", "c")
+		if _, err := db.GetOffer(ctx, "b"); err != ErrOfferNotFound {
+			t.Errorf("GetOffer of the vanished offer = %v, want ErrOfferNotFound", err)
+		}
+		listed("offers including deleted ones", ListOptions{IncludeDeleted: true}, "a", "d", "b", "c")
+
+		// Nothing else is stale on the next sync of the same feed.
+		update(0,
+			[]*content.Product{testProduct("a", "Chair", "10.00")},
+			[]*content.Product{testProduct("c", "Table", "20.00"), testProduct("d", "Desk", "30.00")})
+
+		// An offer back in the feed is restored.
+		update(0, []*content.Product{
+			testProduct("a", "Chair", "10.00"), testProduct("b", "Lamp", "5.00"),
+			testProduct("c", "Table", "20.00"), testProduct("d", "Desk", "30.00"),
+		})
+		listed("offers after the lamp returned", ListOptions{}, "a", "d", "b", "c")
+	})
+}
+
+func TestRunUpdateReturnsErrors(t *testing.T) {
+	if _, err := RunUpdate(0, LogConfig{}, nil); err == nil {
+		t.Error("RunUpdate without a merchant ID succeeded")
+	}
+
+	// An API error fails the sync, rather than the process, and leaves the
+	// offers alone.
+	db := NewMemoryDB()
+	addOffers(t, db, testOffer("a", "Chair", "10.00"))
+	api := &fakeContentAPI{merchantID: 10, failWith: http.StatusForbidden}
+	useFakeContentAPI(t, api, db)
+	_, err := RunUpdate(10, LogConfig{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("RunUpdate with a failing API = %v, want the 403 error", err)
+	}
+	list, _, err := db.ListOffers(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "offers after the failed sync", list, "a")
+}
+
+func TestRunUpdateFailureLeavesOffersUnchanged(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		api := &fakeContentAPI{merchantID: 10}
+		useFakeContentAPI(t, api, db)
+		api.products = map[uint64][][]*content.Product{10: {
+			{testProduct("a", "Chair", "10.00"), testProduct("b", "Lamp", "5.00")},
+			{testProduct("c", "Table", "20.00")},
+		}}
+		if _, err := RunUpdate(10, LogConfig{}, nil); err != nil {
+			t.Fatalf("RunUpdate: %v", err)
+		}
+		snapshot := func() []Offer {
+			t.Helper()
+			list, _, err := db.ListOffers(ctx, ListOptions{IncludeDeleted: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var offers []Offer
+			for _, o := range list {
+				offers = append(offers, *o)
+			}
+			return offers
+		}
+		before := snapshot()
+
+		// The first page changes an offer and adds one, and the lamp has
+		// left the feed, but the second page fails.
+		api.products = map[uint64][][]*content.Product{10: {
+			{testProduct("a", "Chair", "8.00"), testProduct("d", "Desk", "30.00")},
+			{testProduct("c", "Table", "20.00")},
+		}}
+		api.failPage = 2
+		if _, err := RunUpdate(10, LogConfig{}, nil); err == nil {
+			t.Fatal("RunUpdate with a failing page succeeded")
+		}
+		if after := snapshot(); !reflect.DeepEqual(after, before) {
+			t.Errorf("offers after the failed sync = %+v, want them unchanged: %+v", after, before)
+		}
+	})
+}
+
+func TestRunUpdateListCall(t *testing.T) {
+	// The mask selects the page token and the fields updateProducts maps.
+	const wantFields = "nextPageToken,resources(id,title,imageLink,description,link,itemGroupId,gtin," +
+		"sellOnGoogleQuantity,brand,googleProductCategory,productTypes,availability,condition,price,salePrice)"
+	saved := ProductList
+	defer func() { ProductList = saved }()
+
+	for _, tt := range []struct {
+		pageSize   int64
+		maxResults string
+	}{
+		{0, ""},
+		{2, "2"},
+		{MaxProductPageSize, "250"},
+	} {
+		ProductList = ListConfig{PageSize: tt.pageSize}
+		api := &fakeContentAPI{
+			merchantID: 10,
+			products: map[uint64][][]*content.Product{10: {
+				{testProduct("a", "A", "1.00"), testProduct("b", "B", "2.00")},
+				{testProduct("c", "C", "3.00")},
+			}},
+		}
+		useFakeContentAPI(t, api, NewMemoryDB())
+		stats, err := RunUpdate(10, LogConfig{}, nil)
+		if err != nil {
+			t.Fatalf("RunUpdate: %v", err)
+		}
+		if stats.Pages != 2 || len(api.listQueries) != 2 {
+			t.Fatalf("page size %d: %d pages from %d list requests, want 2", tt.pageSize, stats.Pages, len(api.listQueries))
+		}
+		for i, q := range api.listQueries {
+			if got := q.Get("fields"); got != wantFields {
+				t.Errorf("page size %d, request %d: fields %q, want %q", tt.pageSize, i+1, got, wantFields)
+			}
+			if got := q.Get("maxResults"); got != tt.maxResults {
+				t.Errorf("page size %d, request %d: maxResults %q, want %q", tt.pageSize, i+1, got, tt.maxResults)
+			}
+		}
+		if token := api.listQueries[1].Get("pageToken"); token != "1" {
+			t.Errorf("page size %d: second request has page token %q, want 1", tt.pageSize, token)
+		}
+	}
+}
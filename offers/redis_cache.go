@@ -0,0 +1,206 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// redisGenKey holds the cache generation. Cached entries are keyed by
+	// generation, so incrementing it invalidates them all at once; the old
+	// entries expire with their TTL.
+	redisGenKey = "offers:cache:gen"
+	// redisInvalidateChannel announces each new generation to the other
+	// instances.
+	redisInvalidateChannel = "offers:cache:invalidate"
+)
+
+// redisCachedDB caches reads from an OfferDatabase in Redis, shared by all
+// instances using the same Redis server.
+type redisCachedDB struct {
+	invalidatingDB
+
+	client        *redis.Client
+	ttl           time.Duration
+	maxResultSize int
+
+	// gen is the current cache generation, read atomically. It is kept up
+	// to date through redisInvalidateChannel rather than read from Redis for
+	// every lookup.
+	gen  int64
+	sub  *redis.PubSub
+	done chan struct{}
+}
+
+// Ensure redisCachedDB conforms to the OfferDatabase and CacheInvalidator
+// interfaces.
+var (
+	_ OfferDatabase    = &redisCachedDB{}
+	_ CacheInvalidator = &redisCachedDB{}
+)
+
+// NewRedisCachedDB returns an OfferDatabase that caches offers and search
+// results from inner in Redis, like NewCachedDB does in process. A write
+// through any instance clears the cache for all of them; writes made directly
+// to inner are only seen once cached entries expire, or the cache is flushed
+// through CacheInvalidator. opts.MaxEntries, MaxOffers and PollInterval are
+// ignored: Redis evicts entries itself, and invalidations are announced over
+// pub/sub. If Redis fails, reads fall back to inner. Closing the database
+// doesn't close client.
+func NewRedisCachedDB(inner OfferDatabase, client *redis.Client, opts CacheOptions) (OfferDatabase, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCacheTTL
+	}
+	if opts.MaxResultSize <= 0 {
+		opts.MaxResultSize = defaultCacheResultSize
+	}
+	gen, err := client.Get(redisGenKey).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis: could not get cache generation: %v", err)
+	}
+	db := &redisCachedDB{
+		client:        client,
+		ttl:           opts.TTL,
+		maxResultSize: opts.MaxResultSize,
+		gen:           gen,
+		sub:           client.Subscribe(redisInvalidateChannel),
+		done:          make(chan struct{}),
+	}
+	db.invalidatingDB = invalidatingDB{OfferDatabase: inner, cache: db}
+	go db.listen()
+	return db, nil
+}
+
+// listen follows the generations announced by other instances until the
+// subscription is closed.
+func (db *redisCachedDB) listen() {
+	defer close(db.done)
+	for msg := range db.sub.Channel() {
+		gen, err := strconv.ParseInt(msg.Payload, 10, 64)
+		if err != nil {
+			log.Printf("redis: invalid cache generation %q", msg.Payload)
+			continue
+		}
+		db.advance(gen)
+	}
+}
+
+// advance moves to generation gen, unless a later one is already current.
+func (db *redisCachedDB) advance(gen int64) {
+	for {
+		cur := atomic.LoadInt64(&db.gen)
+		if gen <= cur || atomic.CompareAndSwapInt64(&db.gen, cur, gen) {
+			return
+		}
+	}
+}
+
+// Close stops following invalidations and closes the underlying database.
+func (db *redisCachedDB) Close() error {
+	db.sub.Close()
+	<-db.done
+	return db.OfferDatabase.Close()
+}
+
+// key returns the key of an entry of the given kind in the current
+// generation.
+func (db *redisCachedDB) key(kind, k string) string {
+	return fmt.Sprintf("offers:cache:%d:%s:%s", atomic.LoadInt64(&db.gen), kind, k)
+}
+
+// get decodes the entry with the given key into v, and reports whether it
+// was found.
+func (db *redisCachedDB) get(key string, v interface{}) bool {
+	b, err := db.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return false
+	}
+	if err != nil {
+		log.Printf("redis: could not get %s: %v", key, err)
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Printf("redis: could not decode %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// set stores v as the entry with the given key.
+func (db *redisCachedDB) set(key string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("redis: could not encode %s: %v", key, err)
+		return
+	}
+	if err := db.client.Set(key, b, db.ttl).Err(); err != nil {
+		log.Printf("redis: could not set %s: %v", key, err)
+	}
+}
+
+// GetOffer returns the cached offer with the given ID if present. Errors,
+// including missing offers, aren't cached.
+func (db *redisCachedDB) GetOffer(ctx context.Context, id string) (*Offer, error) {
+	// The key is taken before reading the database, so an offer read before
+	// an invalidation is stored in the old generation, where it isn't seen.
+	key := db.key("offer", id)
+	var cached Offer
+	if db.get(key, &cached) {
+		return &cached, nil
+	}
+	o, err := db.OfferDatabase.GetOffer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	db.set(key, o)
+	return o, nil
+}
+
+// SearchOffers returns cached results for q in the given order if present.
+func (db *redisCachedDB) SearchOffers(ctx context.Context, q string, order SortOrder, limit int) ([]*Offer, error) {
+	key := db.key("search", searchKey(q, order, limit))
+	var cached []*Offer
+	if db.get(key, &cached) {
+		return cached, nil
+	}
+	offers, err := db.OfferDatabase.SearchOffers(ctx, q, order, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(offers) <= db.maxResultSize {
+		db.set(key, offers)
+	}
+	return offers, nil
+}
+
+// InvalidateAll starts a new cache generation and announces it to the
+// other instances. If Redis fails, cached entries are only dropped once
+// they expire.
+func (db *redisCachedDB) InvalidateAll() {
+	gen, err := db.client.Incr(redisGenKey).Result()
+	if err != nil {
+		log.Printf("redis: could not invalidate cache: %v", err)
+		return
+	}
+	db.advance(gen)
+	if err := db.client.Publish(redisInvalidateChannel, strconv.FormatInt(gen, 10)).Err(); err != nil {
+		log.Printf("redis: could not announce cache invalidation: %v", err)
+	}
+}
+
+// InvalidateCache drops the cached offer and the results containing it.
+// Cached search results can't be searched in Redis, so it drops all entries.
+func (db *redisCachedDB) InvalidateCache(offerID string) {
+	db.InvalidateAll()
+}
@@ -0,0 +1,320 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"offers"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeRedis is a Redis server speaking enough of the protocol for the
+// cache: GET, SET with EX or PX, INCR, PUBLISH, SUBSCRIBE and PING.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	ttls    map[string]time.Duration // as last set
+	subs    map[*fakeRedisConn]bool
+	conns   map[net.Conn]bool
+}
+
+type fakeRedisConn struct {
+	mu sync.Mutex // guards w
+	w  *bufio.Writer
+}
+
+// reply writes the RESP encoding of v: nil, a string, an int64, an
+// []interface{} of those, or a status such as "+OK".
+func (c *fakeRedisConn) reply(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeRESP(c.w, v)
+	c.w.Flush()
+}
+
+func writeRESP(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeRESP(w, e)
+		}
+	case string:
+		if strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-") {
+			w.WriteString(v + "\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	}
+}
+
+// newFakeRedis starts a server, stopped when the test ends.
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		ln:      ln,
+		values:  map[string]string{},
+		expires: map[string]time.Time{},
+		ttls:    map[string]time.Duration{},
+		subs:    map[*fakeRedisConn]bool{},
+		conns:   map[net.Conn]bool{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(s.stop)
+	return s
+}
+
+// stop closes the listener and all connections.
+func (s *fakeRedis) stop() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// client returns a client of the server, closed when the test ends.
+func (s *fakeRedis) client(t *testing.T) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: s.ln.Addr().String()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// ttl returns the expiration the key was last set with.
+func (s *fakeRedis) ttl(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttls[key]
+}
+
+func (s *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	c := &fakeRedisConn{w: bufio.NewWriter(nc)}
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, c)
+		s.mu.Unlock()
+	}()
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		c.reply(s.exec(c, args))
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	args[0] = strings.ToLower(args[0])
+	return args, nil
+}
+
+// exec runs a command for c and returns its reply.
+func (s *fakeRedis) exec(c *fakeRedisConn, args []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case args[0] == "get" && len(args) == 2:
+		if e, ok := s.expires[args[1]]; ok && !time.Now().Before(e) {
+			delete(s.values, args[1])
+		}
+		if v, ok := s.values[args[1]]; ok {
+			return v
+		}
+		return nil
+	case args[0] == "set" && len(args) >= 3:
+		s.values[args[1]] = args[2]
+		delete(s.expires, args[1])
+		s.ttls[args[1]] = 0
+		if len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			ttl := time.Duration(n) * time.Millisecond
+			if strings.ToLower(args[3]) == "ex" {
+				ttl = time.Duration(n) * time.Second
+			}
+			s.expires[args[1]] = time.Now().Add(ttl)
+			s.ttls[args[1]] = ttl
+		}
+		return "+OK"
+	case args[0] == "incr" && len(args) == 2:
+		n, _ := strconv.ParseInt(s.values[args[1]], 10, 64)
+		n++
+		s.values[args[1]] = strconv.FormatInt(n, 10)
+		return n
+	case args[0] == "publish" && len(args) == 3:
+		for sub := range s.subs {
+			go sub.reply([]interface{}{"message", args[1], args[2]})
+		}
+		return int64(len(s.subs))
+	case args[0] == "subscribe" && len(args) == 2:
+		s.subs[c] = true
+		return []interface{}{"subscribe", args[1], int64(1)}
+	case args[0] == "ping" && s.subs[c]:
+		return []interface{}{"pong", ""}
+	case args[0] == "ping":
+		return "+PONG"
+	}
+	return "-ERR unsupported command " + args[0]
+}
+
+// newRedisCachedDB returns a Redis cache of the mock database, closed when
+// the test ends.
+func newRedisCachedDB(t *testing.T, inner offers.OfferDatabase, client *redis.Client, opts offers.CacheOptions) offers.OfferDatabase {
+	t.Helper()
+	db, err := offers.NewRedisCachedDB(inner, client, opts)
+	if err != nil {
+		t.Fatalf("NewRedisCachedDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRedisCachedGetOffer(t *testing.T) {
+	server := newFakeRedis(t)
+	mock, _ := catalogDB(nil, offers.CacheOptions{})
+	db := newRedisCachedDB(t, mock, server.client(t), offers.CacheOptions{TTL: 10 * time.Second})
+
+	getOffer(t, db, "1")
+	if o := getOffer(t, db, "1"); o.ID != "1" {
+		t.Errorf("cached offer has ID %q, want 1", o.ID)
+	}
+	checkGets(t, mock, "reading an offer twice", "1")
+	if ttl := server.ttl("offers:cache:0:offer:1"); ttl != 10*time.Second {
+		t.Errorf("offer cached for %v, want the TTL of 10s", ttl)
+	}
+
+	getOffer(t, db, "2")
+	if err := db.UpdateOffer(context.Background(), &offers.Offer{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	getOffer(t, db, "1")
+	getOffer(t, db, "2")
+	checkGets(t, mock, "reading offers after an update", "1", "2", "1", "2")
+}
+
+func TestRedisCachedSearchExpires(t *testing.T) {
+	server := newFakeRedis(t)
+	mock, _ := catalogDB(map[string][]string{"chair": {"1", "2"}}, offers.CacheOptions{})
+	db := newRedisCachedDB(t, mock, server.client(t), offers.CacheOptions{TTL: 20 * time.Millisecond})
+
+	if list := search(t, db, "chair", 0); len(list) != 2 {
+		t.Fatalf("search returned %d offers, want 2", len(list))
+	}
+	if list := search(t, db, "Chair", 0); len(list) != 2 || list[1].ID != "2" {
+		t.Errorf("cached search returned %v, want offers 1 and 2", list)
+	}
+	checkSearches(t, mock, "searching twice", 1)
+
+	time.Sleep(40 * time.Millisecond)
+	search(t, db, "chair", 0)
+	checkSearches(t, mock, "search after the TTL", 2)
+}
+
+func TestRedisCacheSharedByInstances(t *testing.T) {
+	server := newFakeRedis(t)
+	mock, _ := catalogDB(map[string][]string{"chair": {"1"}}, offers.CacheOptions{})
+	first := newRedisCachedDB(t, mock, server.client(t), offers.CacheOptions{})
+	second := newRedisCachedDB(t, mock, server.client(t), offers.CacheOptions{})
+
+	getOffer(t, first, "1")
+	getOffer(t, second, "1")
+	search(t, first, "chair", 0)
+	search(t, second, "chair", 0)
+	checkGets(t, mock, "reading an offer from both instances", "1")
+	checkSearches(t, mock, "searching from both instances", 1)
+
+	// A sync through the first instance is announced to the second, which
+	// stops serving the entries cached before it.
+	if err := first.WithTx(context.Background(), func(tx offers.SyncWriter) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the second instance to be invalidated", func() bool {
+		getOffer(t, second, "1")
+		return len(mock.CallsTo("GetOffer")) == 2
+	})
+	search(t, second, "chair", 0)
+	checkSearches(t, mock, "searching after the sync", 2)
+
+	// The first instance shares the entries the second cached since.
+	getOffer(t, first, "1")
+	search(t, first, "chair", 0)
+	checkGets(t, mock, "reading after the sync", "1", "1")
+	checkSearches(t, mock, "searching after the sync", 2)
+
+	// Instances started later pick up the current generation.
+	third := newRedisCachedDB(t, mock, server.client(t), offers.CacheOptions{})
+	getOffer(t, third, "1")
+	checkGets(t, mock, "reading from a new instance", "1", "1")
+}
+
+func TestRedisCacheFallsBack(t *testing.T) {
+	server := newFakeRedis(t)
+	mock, _ := catalogDB(nil, offers.CacheOptions{})
+	db := newRedisCachedDB(t, mock, server.client(t), offers.CacheOptions{})
+	getOffer(t, db, "1")
+
+	// Without Redis, offers are read from the database.
+	server.stop()
+	getOffer(t, db, "1")
+	getOffer(t, db, "1")
+	checkGets(t, mock, "reading without Redis", "1", "1", "1")
+}
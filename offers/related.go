@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxRelatedKeywords bounds the number of title words RelatedOffers
+	// matches other offers on, which bounds the size of its query.
+	maxRelatedKeywords = 5
+	// minKeywordLength is the length of the shortest keyword; shorter words,
+	// like "a" or "of", would relate almost every offer.
+	minKeywordLength = 3
+)
+
+// relatedKeywords returns the distinct words of the offer's title that
+// related offers are matched on, lowercased, in title order.
+func relatedKeywords(o *Offer) []string {
+	words := strings.FieldsFunc(strings.ToLower(o.Title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var keywords []string
+	seen := map[string]bool{}
+	for _, w := range words {
+		if len([]rune(w)) < minKeywordLength || seen[w] {
+			continue
+		}
+		seen[w] = true
+		keywords = append(keywords, w)
+		if len(keywords) == maxRelatedKeywords {
+			break
+		}
+	}
+	return keywords
+}
+
+// relatedScore returns the number of keywords the title or description of o
+// contains, like the ORDER BY clause of relatedQuery.
+func relatedScore(o *Offer, keywords []string) int {
+	n := 0
+	for _, k := range keywords {
+		if matchesSearch(o, k) {
+			n++
+		}
+	}
+	return n
+}
+
+// relatedQuery returns the SQL selecting up to limit offers, other than the
+// one with the given ID, containing any of keywords, ordered by how many
+// they contain, and the arguments for it.
+func relatedQuery(id string, keywords []string, limit int) (string, []interface{}) {
+	matches := make([]string, len(keywords))
+	var patterns []interface{}
+	for i, k := range keywords {
+		matches[i] = "(title LIKE ? OR description LIKE ?)"
+		pattern := "%" + escapeLike(k) + "%"
+		patterns = append(patterns, pattern, pattern)
+	}
+	query := "SELECT * FROM offers WHERE " + notDeleted + " AND offerId <> ? AND (" +
+		strings.Join(matches, " OR ") + ") ORDER BY " + strings.Join(matches, " + ") +
+		" DESC, title, id LIMIT ?"
+	args := append([]interface{}{id}, patterns...)
+	args = append(args, patterns...)
+	return query, append(args, limit)
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxAPIRetries is how many times a Content API request failing with a
+	// transient error is retried.
+	maxAPIRetries = 5
+	// maxAPIRetryDelay bounds the delay before a retry, including delays
+	// asked for by the server.
+	maxAPIRetryDelay = 30 * time.Second
+)
+
+// apiRetryDelay is the delay before the first retry. It doubles with every
+// retry. Tests shorten it.
+var apiRetryDelay = time.Second
+
+// retryableStatus reports whether a response status is a transient error
+// worth retrying: rate limiting, or a server error that may be momentary.
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests ||
+		code == http.StatusInternalServerError ||
+		code == http.StatusServiceUnavailable
+}
+
+// retryRoundTripper retries requests that fail with a retryable status, with
+// exponential backoff and jitter. Only requests without a body, such as the
+// GETs listing accounts and products, are retried, since they can be resent
+// as they are.
+type retryRoundTripper struct {
+	Delegate http.RoundTripper
+}
+
+// RoundTrip sends the request, retrying it up to maxAPIRetries times. The
+// last response is returned as it is, so the caller sees the final error.
+func (rrt retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := rrt.Delegate.RoundTrip(req)
+		if err != nil || !retryableStatus(resp.StatusCode) || req.Body != nil || attempt == maxAPIRetries {
+			return resp, err
+		}
+		delay := retryDelay(attempt, resp.Header.Get("Retry-After"))
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		log.Printf("%s %s: %s, retrying in %v", req.Method, req.URL.Path, resp.Status, delay)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retry number attempt, from 0.
+// The delay is picked randomly between half and all of the backoff, so
+// concurrent clients don't retry in lockstep, or is the server's Retry-After
+// in seconds if that is longer.
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	backoff := apiRetryDelay << uint(attempt)
+	if backoff > maxAPIRetryDelay {
+		backoff = maxAPIRetryDelay
+	}
+	delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if s, err := strconv.Atoi(retryAfter); err == nil && time.Duration(s)*time.Second > delay {
+		delay = time.Duration(s) * time.Second
+	}
+	if delay > maxAPIRetryDelay {
+		delay = maxAPIRetryDelay
+	}
+	return delay
+}
+
+// retryClient makes the client retry transient errors. Wrap the client after
+// logClient, so every attempt is logged.
+func retryClient(client *http.Client) {
+	delegate := client.Transport
+	if delegate == nil {
+		delegate = http.DefaultTransport
+	}
+	client.Transport = retryRoundTripper{Delegate: delegate}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubTransport answers requests with the given statuses in turn, repeating
+// the last, and counts them.
+type stubTransport struct {
+	statuses []int
+	requests int
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	code := s.statuses[len(s.statuses)-1]
+	if s.requests < len(s.statuses) {
+		code = s.statuses[s.requests]
+	}
+	s.requests++
+	return &http.Response{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(http.StatusText(code))),
+		Request:    req,
+	}, nil
+}
+
+func TestRetryRoundTripper(t *testing.T) {
+	saved := apiRetryDelay
+	defer func() { apiRetryDelay = saved }()
+	apiRetryDelay = time.Millisecond
+
+	for _, tt := range []struct {
+		name         string
+		method       string
+		statuses     []int
+		wantStatus   int
+		wantRequests int
+	}{
+		{"transient errors", "GET", []int{503, 503, 200}, 200, 3},
+		{"rate limited", "GET", []int{429, 500, 200}, 200, 3},
+		{"permanent error", "GET", []int{404}, 404, 1},
+		{"gives up", "GET", []int{503}, 503, maxAPIRetries + 1},
+		{"with a body", "POST", []int{503, 200}, 503, 1},
+	} {
+		stub := &stubTransport{statuses: tt.statuses}
+		client := &http.Client{Transport: stub}
+		retryClient(client)
+		var body io.Reader
+		if tt.method == "POST" {
+			body = strings.NewReader("{}")
+		}
+		req, err := http.NewRequest(tt.method, "https://example.com/content/v2/1/products", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus || stub.requests != tt.wantRequests {
+			t.Errorf("%s: status %d after %d requests, want %d after %d", tt.name, resp.StatusCode, stub.requests, tt.wantStatus, tt.wantRequests)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		backoff := apiRetryDelay << uint(attempt)
+		if backoff > maxAPIRetryDelay {
+			backoff = maxAPIRetryDelay
+		}
+		for i := 0; i < 20; i++ {
+			if d := retryDelay(attempt, ""); d < backoff/2 || d > backoff {
+				t.Fatalf("retryDelay(%d) = %v, want within [%v, %v]", attempt, d, backoff/2, backoff)
+			}
+		}
+	}
+	// The server's Retry-After is honored if longer, up to the maximum.
+	if d := retryDelay(0, "7"); d != 7*time.Second {
+		t.Errorf("retryDelay with Retry-After 7 = %v, want 7s", d)
+	}
+	if d := retryDelay(0, "3600"); d != maxAPIRetryDelay {
+		t.Errorf("retryDelay with Retry-After 3600 = %v, want %v", d, maxAPIRetryDelay)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	// defaultMetaTitle is used for offers without a title.
+	defaultMetaTitle = "Offers from Best CSS"
+	// maxMetaTitle and maxMetaDescription are the lengths, in characters,
+	// beyond which search engines usually truncate titles and descriptions.
+	maxMetaTitle       = 60
+	maxMetaDescription = 160
+)
+
+// htmlTag matches HTML tags, which some merchants include in descriptions.
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// MetaTitle returns the title of the offer's page for search engines: the
+// stored override if there is one, else the title shortened to fit, followed
+// by the price.
+func (o *Offer) MetaTitle() string {
+	if o.CustomMetaTitle != "" {
+		return o.CustomMetaTitle
+	}
+	title := cleanText(o.Title)
+	if title == "" {
+		return defaultMetaTitle
+	}
+	price := strings.TrimSpace(o.Price + " " + o.Currency)
+	if price == "" {
+		return shorten(title, maxMetaTitle)
+	}
+	suffix := " - " + price
+	return shorten(title, maxMetaTitle-len([]rune(suffix))) + suffix
+}
+
+// MetaDescription returns the description of the offer's page for search
+// engines: the stored override if there is one, else the description with
+// markup removed and shortened to fit.
+func (o *Offer) MetaDescription() string {
+	if o.CustomMetaDescription != "" {
+		return o.CustomMetaDescription
+	}
+	if d := cleanText(o.Description); d != "" {
+		return shorten(d, maxMetaDescription)
+	}
+	if title := cleanText(o.Title); title != "" {
+		return shorten("Compare prices for "+title+".", maxMetaDescription)
+	}
+	return ""
+}
+
+// cleanText removes HTML tags from s and collapses whitespace.
+func cleanText(s string) string {
+	return strings.Join(strings.Fields(htmlTag.ReplaceAllString(s, " ")), " ")
+}
+
+// shorten truncates s to at most n characters at a word boundary, ending it
+// with an ellipsis if anything was removed.
+func shorten(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+	cut := string(r[:n-1])
+	// The last word is only cut short if it continues past the cut.
+	if r[n-1] != ' ' {
+		if i := strings.LastIndex(cut, " "); i > 0 {
+			cut = cut[:i]
+		}
+	}
+	return strings.TrimSpace(cut) + "…"
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMetaTitle(t *testing.T) {
+	long := strings.Repeat("Comfortable ", 10) + "chair"
+	for _, tt := range []struct {
+		name string
+		o    Offer
+		want string
+	}{
+		{"title and price", Offer{Title: "Garden chair", Price: "10.00", Currency: "USD"}, "Garden chair - 10.00 USD"},
+		{"markup and spaces", Offer{Title: " <b>Garden</b>\n chair ", Price: "10.00", Currency: "USD"}, "Garden chair - 10.00 USD"},
+		{"no price", Offer{Title: "Garden chair"}, "Garden chair"},
+		{"no title", Offer{Price: "10.00", Currency: "USD"}, defaultMetaTitle},
+		{"long title", Offer{Title: long, Price: "10.00", Currency: "USD"}, "Comfortable Comfortable Comfortable Comfortable… - 10.00 USD"},
+		{"override", Offer{Title: "Garden chair", Price: "10.00", CustomMetaTitle: "The best chair"}, "The best chair"},
+	} {
+		got := tt.o.MetaTitle()
+		if got != tt.want {
+			t.Errorf("%s: MetaTitle = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.o.CustomMetaTitle == "" && utf8.RuneCountInString(got) > maxMetaTitle {
+			t.Errorf("%s: MetaTitle %q is longer than %d characters", tt.name, got, maxMetaTitle)
+		}
+	}
+}
+
+func TestMetaDescription(t *testing.T) {
+	long := strings.Repeat("A sturdy chair for the garden. ", 10)
+	for _, tt := range []struct {
+		name string
+		o    Offer
+		want string
+	}{
+		{"description", Offer{Title: "Chair", Description: "A sturdy chair."}, "A sturdy chair."},
+		{"markup", Offer{Description: "<p>A <em>sturdy</em>\n\nchair.</p>"}, "A sturdy chair."},
+		{"no description", Offer{Title: "Garden chair"}, "Compare prices for Garden chair."},
+		{"only markup", Offer{Title: "Garden chair", Description: "<br/>"}, "Compare prices for Garden chair."},
+		{"nothing", Offer{}, ""},
+		{"override", Offer{Description: "A sturdy chair.", CustomMetaDescription: "Buy it now."}, "Buy it now."},
+	} {
+		if got := tt.o.MetaDescription(); got != tt.want {
+			t.Errorf("%s: MetaDescription = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	o := Offer{Description: long}
+	got := o.MetaDescription()
+	if n := utf8.RuneCountInString(got); n > maxMetaDescription || !strings.HasSuffix(got, "…") {
+		t.Errorf("MetaDescription of a long description = %q (%d characters), want it shortened to %d", got, n, maxMetaDescription)
+	}
+	if !strings.HasPrefix(long, strings.TrimSuffix(got, "…")) {
+		t.Errorf("MetaDescription %q isn't cut at a word boundary", got)
+	}
+}
+
+func TestMetaOverridesStored(t *testing.T) {
+	forEachDB(t, func(t *testing.T, db OfferDatabase) {
+		ctx := context.Background()
+		o := testOffer("a", "Garden chair", "10.00")
+		o.Description = "A sturdy chair."
+		addOffers(t, db, o)
+
+		if err := db.SetMetaOverrides(ctx, "a", "The best chair", "Buy it now."); err != nil {
+			t.Fatalf("SetMetaOverrides: %v", err)
+		}
+		got := getOffer(t, db, "a")
+		if got.MetaTitle() != "The best chair" || got.MetaDescription() != "Buy it now." {
+			t.Errorf("meta = %q, %q, want the overrides", got.MetaTitle(), got.MetaDescription())
+		}
+
+		// Syncs don't touch the overrides.
+		changed := testOffer("a", "Garden chair", "12.00")
+		changed.Description = "A sturdy chair."
+		syncOffers(t, db, changed)
+		if got := getOffer(t, db, "a"); got.CustomMetaTitle != "The best chair" {
+			t.Errorf("meta title override = %q after a sync, want it kept", got.CustomMetaTitle)
+		}
+
+		// Empty values remove the overrides.
+		if err := db.SetMetaOverrides(ctx, "a", "", ""); err != nil {
+			t.Fatalf("SetMetaOverrides: %v", err)
+		}
+		got = getOffer(t, db, "a")
+		if got.MetaTitle() != "Garden chair - 12.00 USD" || got.MetaDescription() != "A sturdy chair." {
+			t.Errorf("meta = %q, %q after removing the overrides, want the generated ones", got.MetaTitle(), got.MetaDescription())
+		}
+	})
+}
+
+func TestShorten(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Garden chair", 12, "Garden chair"},
+		{"Garden chair", 11, "Garden…"},
+		{"Garden chair", 8, "Garden…"},
+		{"Garden chair", 7, "Garden…"},
+		{"Garden chair", 6, "Garde…"},
+		{"Gartenstühle", 8, "Gartens…"},
+		{"Garden chair", 0, ""},
+	} {
+		if got := shorten(tt.s, tt.n); got != tt.want {
+			t.Errorf("shorten(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
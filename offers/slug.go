@@ -0,0 +1,78 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxSlugLength is the length, in characters, at which slugs are cut
+	// before a suffix is added.
+	maxSlugLength = 80
+	// defaultSlug is the slug of offers whose titles have no letters or
+	// digits.
+	defaultSlug = "offer"
+)
+
+// slugify returns the slug for an offer's title: its letters and digits,
+// lowercased, with the runs of other characters between them replaced by
+// hyphens. Letters outside ASCII are kept, and apostrophes and combining
+// marks dropped, so "Men's Café" becomes "mens-café".
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range title {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.Is(unicode.Mn, r), r == '\'', r == '’':
+		default:
+			hyphen = true
+		}
+	}
+	slug := []rune(b.String())
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+	}
+	if s := strings.TrimSuffix(string(slug), "-"); s != "" {
+		return s
+	}
+	return defaultSlug
+}
+
+// slugCandidate returns the nth slug to try for an offer whose base slug is
+// base: base itself, then base-2, base-3 and so on.
+func slugCandidate(base string, n int) string {
+	if n <= 1 {
+		return base
+	}
+	return base + "-" + strconv.Itoa(n)
+}
+
+// uniqueSlug returns the first candidate slug for base that isn't taken.
+func uniqueSlug(base string, taken func(string) bool) string {
+	for n := 1; ; n++ {
+		if s := slugCandidate(base, n); !taken(s) {
+			return s
+		}
+	}
+}
+
+// URL returns the path of the offer's page: /p/ and its slug, or /offers/
+// and its ID until it has been given a slug.
+func (o *Offer) URL() string {
+	if o.Slug == "" {
+		return "/offers/" + url.PathEscape(o.ID)
+	}
+	return "/p/" + url.PathEscape(o.Slug)
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, tt := range []struct {
+		title, want string
+	}{
+		{"Garden Chair", "garden-chair"},
+		{"  Garden   chair, teak (2-pack)! ", "garden-chair-teak-2-pack"},
+		{"Men's Café", "mens-café"},
+		// A combining accent is dropped.
+		{"Cafe\u0301 table", "cafe-table"},
+		{"Kids’ bike", "kids-bike"},
+		{"Größe XL", "größe-xl"},
+		{"Стул садовый", "стул-садовый"},
+		{"椅子 2024", "椅子-2024"},
+		{"!!!", defaultSlug},
+		{"", defaultSlug},
+		{strings.Repeat("a", 100), strings.Repeat("a", maxSlugLength)},
+		// A cut landing on a hyphen doesn't leave it at the end.
+		{strings.Repeat("b", maxSlugLength-1) + " c", strings.Repeat("b", maxSlugLength-1)},
+		{strings.Repeat("é", 100), strings.Repeat("é", maxSlugLength)},
+	} {
+		if got := slugify(tt.title); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	taken := map[string]bool{"garden-chair": true, "garden-chair-2": true, "garden-chair-4": true}
+	isTaken := func(s string) bool { return taken[s] }
+	for _, tt := range []struct {
+		base, want string
+	}{
+		{"garden-chair", "garden-chair-3"},
+		{"garden-table", "garden-table"},
+		{"garden-chair-2", "garden-chair-2-2"},
+	} {
+		if got := uniqueSlug(tt.base, isTaken); got != tt.want {
+			t.Errorf("uniqueSlug(%q) = %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestOfferURL(t *testing.T) {
+	o := &Offer{ID: "online:en:US:123/4"}
+	if got, want := o.URL(), "/offers/online:en:US:123%2F4"; got != want {
+		t.Errorf("URL without a slug = %q, want %q", got, want)
+	}
+	o.Slug = "garden-chair"
+	if got, want := o.URL(), "/p/garden-chair"; got != want {
+		t.Errorf("URL with a slug = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TLSMode is how connections to MySQL are encrypted.
+type TLSMode string
+
+// The supported TLS modes.
+const (
+	// TLSDisable connects without TLS. It is the default.
+	TLSDisable TLSMode = "disable"
+	// TLSRequire encrypts connections without verifying the server's
+	// certificate.
+	TLSRequire TLSMode = "require"
+	// TLSVerifyCA encrypts connections and verifies that the server's
+	// certificate is signed by a trusted CA, but not its host name. Cloud SQL
+	// server certificates don't name the host.
+	TLSVerifyCA TLSMode = "verify-ca"
+	// TLSVerifyFull also verifies that the certificate names the host.
+	TLSVerifyFull TLSMode = "verify-full"
+)
+
+// tlsConfigs numbers the TLS configurations registered with the driver, so
+// each gets a unique name.
+var tlsConfigs int64
+
+// registerTLS registers the TLS configuration of c with the driver and
+// returns its name for the DSN's tls parameter, or "" if TLS is disabled.
+func (c MySQLConfig) registerTLS() (string, error) {
+	cfg, err := c.tlsConfig()
+	if err != nil || cfg == nil {
+		return "", err
+	}
+	name := fmt.Sprintf("offers-%d", atomic.AddInt64(&tlsConfigs, 1))
+	if err := mysql.RegisterTLSConfig(name, cfg); err != nil {
+		return "", fmt.Errorf("mysql: could not register TLS config: %v", err)
+	}
+	return name, nil
+}
+
+// tlsConfig builds the TLS configuration for c.TLSMode, or returns nil if
+// TLS is disabled.
+func (c MySQLConfig) tlsConfig() (*tls.Config, error) {
+	switch c.TLSMode {
+	case "", TLSDisable:
+		return nil, nil
+	case TLSRequire, TLSVerifyCA, TLSVerifyFull:
+	default:
+		return nil, fmt.Errorf("mysql: unknown TLS mode %q; supported modes are %s, %s, %s and %s",
+			c.TLSMode, TLSDisable, TLSRequire, TLSVerifyCA, TLSVerifyFull)
+	}
+
+	cfg := &tls.Config{ServerName: c.Host}
+	if c.CACertPath != "" {
+		pem, err := ioutil.ReadFile(c.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read CA certificate: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mysql: no certificates in %s", c.CACertPath)
+		}
+	}
+	if c.ClientCertPath != "" || c.ClientKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertPath, c.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch c.TLSMode {
+	case TLSRequire:
+		cfg.InsecureSkipVerify = true
+	case TLSVerifyCA:
+		// Skip the default verification, which checks the host name, and
+		// verify the chain alone.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyChain(cfg.RootCAs)
+	}
+	return cfg, nil
+}
+
+// verifyChain returns a function verifying that the peer's certificate is
+// signed by roots, or by the system roots if roots is nil.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("mysql: server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("mysql: could not parse server certificate: %v", err)
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return fmt.Errorf("mysql: could not verify server certificate: %v", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package offers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new self-signed CA certificate and its key as PEM files
+// in dir, returning their paths and the certificate's DER bytes.
+func writeCert(t *testing.T, dir, name string) (certPath, keyPath string, der []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, der
+}
+
+func TestDataStoreNameTLS(t *testing.T) {
+	for _, mode := range []TLSMode{"", TLSDisable} {
+		c := MySQLConfig{Host: "localhost", Port: 3306, TLSMode: mode}
+		name, err := c.registerTLS()
+		if err != nil || name != "" {
+			t.Errorf("registerTLS with mode %q = %q, %v; want no TLS", mode, name, err)
+		}
+		c.tlsName = name
+		if dsn := c.dataStoreName("library"); strings.Contains(dsn, "tls=") {
+			t.Errorf("DSN with mode %q = %q, want no tls parameter", mode, dsn)
+		}
+	}
+
+	for _, mode := range []TLSMode{TLSRequire, TLSVerifyFull} {
+		c := MySQLConfig{Host: "db.example.com", Port: 3306, TLSMode: mode}
+		name, err := c.registerTLS()
+		if err != nil || name == "" {
+			t.Fatalf("registerTLS with mode %q = %q, %v; want a config name", mode, name, err)
+		}
+		c.tlsName = name
+		if dsn := c.dataStoreName("library"); !strings.Contains(dsn, "tls="+name) {
+			t.Errorf("DSN with mode %q = %q, want tls=%s", mode, dsn, name)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caPath, _, caDER := writeCert(t, dir, "ca")
+	certPath, keyPath, _ := writeCert(t, dir, "client")
+	_, _, otherDER := writeCert(t, dir, "other")
+
+	c := MySQLConfig{
+		Host:           "db.example.com",
+		TLSMode:        TLSVerifyCA,
+		CACertPath:     caPath,
+		ClientCertPath: certPath,
+		ClientKeyPath:  keyPath,
+	}
+	cfg, err := c.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	if cfg.RootCAs == nil || len(cfg.Certificates) != 1 {
+		t.Fatalf("tlsConfig has CAs %v and %d client certificates, want the CA and one", cfg.RootCAs, len(cfg.Certificates))
+	}
+	// verify-ca checks the chain but not the host name.
+	if !cfg.InsecureSkipVerify || cfg.VerifyPeerCertificate == nil {
+		t.Fatal("verify-ca config doesn't verify the chain itself")
+	}
+	if err := cfg.VerifyPeerCertificate([][]byte{caDER}, nil); err != nil {
+		t.Errorf("verifying a certificate signed by the CA: %v", err)
+	}
+	if err := cfg.VerifyPeerCertificate([][]byte{otherDER}, nil); err == nil {
+		t.Error("verifying a certificate from another CA succeeded")
+	}
+
+	c.TLSMode = TLSVerifyFull
+	if cfg, err = c.tlsConfig(); err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	if cfg.InsecureSkipVerify || cfg.ServerName != "db.example.com" {
+		t.Errorf("verify-full config skips verification: %v, server name %q", cfg.InsecureSkipVerify, cfg.ServerName)
+	}
+
+	for _, bad := range []MySQLConfig{
+		{TLSMode: "prefer"},
+		{TLSMode: TLSVerifyCA, CACertPath: filepath.Join(dir, "missing.pem")},
+		{TLSMode: TLSVerifyCA, CACertPath: keyPath},
+		{TLSMode: TLSRequire, ClientCertPath: certPath},
+	} {
+		if _, err := bad.tlsConfig(); err == nil {
+			t.Errorf("tlsConfig(%+v) succeeded, want an error", bad)
+		}
+	}
+}